@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"wayback-discover-diff/internal/maintenance"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// runBackup writes all simhash data and metadata, with the features,
+// versions, eras, exclusions, baselines and diff permalinks kept for them,
+// to a backup directory
+func runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("out", "backup", "directory to write the backup to")
+	fs.Parse(args)
+
+	store, closeFn, err := openStore()
+	if err != nil {
+		log.Printf("Failed to initialize storage: %v", err)
+		return 1
+	}
+	defer closeFn()
+
+	manifest, err := maintenance.Backup(context.Background(), store, *dir)
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(manifest)
+	return 0
+}
+
+// runRestore loads a backup directory into the configured storage
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("in", "backup", "backup directory to restore from")
+	fs.Parse(args)
+
+	store, closeFn, err := openStore()
+	if err != nil {
+		log.Printf("Failed to initialize storage: %v", err)
+		return 1
+	}
+	defer closeFn()
+
+	counts, err := maintenance.Restore(context.Background(), store, *dir)
+	if err != nil {
+		log.Printf("Restore failed after %v records: %v", counts, err)
+		return 1
+	}
+
+	log.Printf("Restored %d simhash and %d metadata records (%v by kind)",
+		counts[maintenance.KindSimhash], counts[maintenance.KindMeta], counts)
+	return 0
+}
+
+// openStore connects to the primary Redis for offline commands
+func openStore() (*storage.Store, func(), error) {
+	redisClient, _ := newRedisClients()
+	store, err := storage.New(redisClient)
+	if err != nil {
+		redisClient.Close()
+		return nil, nil, err
+	}
+	return store, func() { redisClient.Close() }, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"wayback-discover-diff/internal/selfcheck"
+)
+
+// runCheck prints the self-check report and returns the process exit code
+func runCheck() int {
+	redisClient, replicas := newRedisClients()
+	defer redisClient.Close()
+
+	report := selfcheck.Run(context.Background(), redisClient, replicas)
+	report.Print(os.Stdout)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+
+	"wayback-discover-diff/internal/devserver"
+)
+
+// runDevserver serves a fake archive for local development; the devserver
+// archive preset points at its default address
+func runDevserver(args []string) int {
+	flags := flag.NewFlagSet("devserver", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:4100", "address to listen on")
+	dir := flags.String("dir", "", "fixtures directory, <host>/<timestamp>.html; defaults to the built-in set")
+	flags.Parse(args)
+
+	fixtures := devserver.Fixtures()
+	if *dir != "" {
+		if _, err := os.Stat(*dir); err != nil {
+			log.Printf("Invalid fixtures directory: %v", err)
+			return 1
+		}
+		fixtures = os.DirFS(*dir)
+	}
+	sites, _ := fs.ReadDir(fixtures, ".")
+
+	log.Printf("Serving %d fixture sites on http://%s (CDX at /cdx, replay at /web)", len(sites), *addr)
+	if err := http.ListenAndServe(*addr, devserver.New(fixtures)); err != nil {
+		log.Printf("Devserver failed: %v", err)
+		return 1
+	}
+	return 0
+}
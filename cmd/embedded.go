@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"wayback-discover-diff/config"
+)
+
+// startEmbeddedRedis serves config.redis from memory for local development.
+// Nothing is persisted, and read replicas are not used.
+func startEmbeddedRedis() (func(), error) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	config.AppConfig.Redis.URL = srv.Addr()
+	config.AppConfig.Redis.ReadURLs = nil
+	log.Printf("Using embedded Redis at %s; data is lost on exit", srv.Addr())
+	return srv.Close, nil
+}
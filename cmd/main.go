@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,23 +17,98 @@ import (
 
 	"wayback-discover-diff/config"
 	"wayback-discover-diff/internal/handler"
+	"wayback-discover-diff/internal/maintenance"
+	"wayback-discover-diff/internal/selfcheck"
+	"wayback-discover-diff/internal/watchdog"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/extractor"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/resources"
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/storage"
 	wk "wayback-discover-diff/pkg/worker"
 )
 
 func main() {
 	configFile := flag.String("config", "config.yml", "path to config file")
+	profile := flag.String("profile", os.Getenv("WDD_PROFILE"), "config profile to apply, e.g. dev")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [serve|check|repair|backup|restore|export-queue|import-queue|devserver]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Load configuration
-	if err := config.LoadConfig(*configFile); err != nil {
+	if err := config.LoadConfig(*configFile, *profile); err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if err := logging.Configure(config.AppConfig.Log.Level, config.AppConfig.Log.Modules); err != nil {
+		log.Fatalf("Invalid log configuration: %v", err)
+	}
+	resources.Tune()
+	if config.AppConfig.Redis.Embedded {
+		stop, err := startEmbeddedRedis()
+		if err != nil {
+			log.Fatalf("Failed to start embedded Redis: %v", err)
+		}
+		defer stop()
+	}
 
-	// Initialize Redis client
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve()
+	case "check":
+		os.Exit(runCheck())
+	case "repair":
+		os.Exit(runRepair(flag.Args()[1:]))
+	case "backup":
+		os.Exit(runBackup(flag.Args()[1:]))
+	case "restore":
+		os.Exit(runRestore(flag.Args()[1:]))
+	case "export-queue":
+		os.Exit(runExportQueue(flag.Args()[1:]))
+	case "import-queue":
+		os.Exit(runImportQueue(flag.Args()[1:]))
+	case "devserver":
+		os.Exit(runDevserver(flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// newRedisClients connects to the primary Redis and its read replicas
+func newRedisClients() (*redis.Client, []*redis.Client) {
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: config.AppConfig.Redis.URL,
 	})
 
+	var replicas []*redis.Client
+	for _, addr := range config.AppConfig.Redis.ReadURLs {
+		replicas = append(replicas, redis.NewClient(&redis.Options{Addr: addr}))
+	}
+	return redisClient, replicas
+}
+
+func serve() {
+	// Initialize Redis clients
+	redisClient, replicas := newRedisClients()
+
+	// Verify dependencies before accepting traffic
+	if !config.AppConfig.SkipStartupCheck {
+		report := selfcheck.Run(context.Background(), redisClient, replicas)
+		report.Print(log.Writer())
+		if !report.OK {
+			log.Fatalf("Startup self-check failed")
+		}
+	}
+
+	store, err := storage.New(redisClient, replicas...)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
 	// Initialize Asynq client and server
 	taskClient := asynq.NewClient(asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL})
 	defer taskClient.Close()
@@ -39,33 +116,147 @@ func main() {
 	srv := asynq.NewServer(
 		asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL},
 		asynq.Config{
-			Concurrency: config.AppConfig.Threads,
+			Concurrency:    config.AppConfig.Threads,
+			Queues:         wk.Queues(),
+			StrictPriority: config.AppConfig.Queues.StrictPriority,
+			// Jobs interrupted by a shutdown are retried from their
+			// checkpoint without using up a retry
+			IsFailure:       wk.IsFailure,
+			ShutdownTimeout: time.Duration(config.AppConfig.Worker.ShutdownTimeout) * time.Second,
 		},
 	)
 
+	// Resolve the archive source
+	source, err := archive.FromConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure archive source: %v", err)
+	}
+
+	// Compile custom feature extractors
+	extractors, err := extractor.Load(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load extractors: %v", err)
+	}
+	defer extractors.Close(context.Background())
+
 	// Initialize worker
-	worker := wk.NewWorker(redisClient)
+	worker, err := wk.NewWorker(store, taskClient, source, extractors)
+	if err != nil {
+		log.Fatalf("Failed to initialize worker: %v", err)
+	}
 
 	// Register task handler
 	mux := asynq.NewServeMux()
+	mux.Use(worker.TrackHistory)
 	mux.HandleFunc(wk.TypeCalculateSimHash, worker.HandleCalculateSimHash)
+	mux.HandleFunc(wk.TypeFetchCapture, worker.HandleFetchCapture)
+	mux.HandleFunc(wk.TypeHashCapture, worker.HandleHashCapture)
+	mux.HandleFunc(wk.TypeDiscoverYears, worker.HandleDiscoverYears)
+	mux.HandleFunc(wk.TypeImportSeeds, worker.HandleImportSeeds)
+	mux.HandleFunc(wk.TypeBuildProfile, worker.HandleBuildProfile)
+	mux.HandleFunc(wk.TypeRetryCaptures, worker.HandleRetryCaptures)
+	mux.HandleFunc(retention.TypeJanitor, retention.NewJanitor(redisClient).HandleJanitor)
+	mux.HandleFunc(maintenance.TypeVerify, maintenance.NewVerifier(store).HandleVerify)
+	mux.HandleFunc(maintenance.TypePurge, maintenance.NewPurger(store).HandlePurge)
 
-	// Start task processor in background
+	// Register periodic tasks
+	scheduler := asynq.NewScheduler(asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL}, nil)
+	if err := wk.RegisterSeedSchedules(scheduler); err != nil {
+		log.Fatalf("Failed to register seed schedules: %v", err)
+	}
+	if err := retention.RegisterSchedule(scheduler); err != nil {
+		log.Fatalf("Failed to register retention janitor: %v", err)
+	}
+	if err := wk.RegisterRetrySchedule(scheduler); err != nil {
+		log.Fatalf("Failed to register capture retries: %v", err)
+	}
+	if err := maintenance.RegisterVerifySchedule(scheduler); err != nil {
+		log.Fatalf("Failed to register storage verifier: %v", err)
+	}
 	go func() {
-		if err := srv.Run(mux); err != nil {
-			log.Fatalf("Failed to run task processor: %v", err)
+		if err := scheduler.Run(); err != nil {
+			log.Fatalf("Failed to run scheduler: %v", err)
 		}
 	}()
 
-	// Initialize HTTP handlers
-	handler := handler.NewHandler(redisClient, taskClient)
+	// Start task processor in background. It is stopped below rather than
+	// on its own signal handling, so running jobs are drained first.
+	if err := srv.Start(mux); err != nil {
+		log.Fatalf("Failed to run task processor: %v", err)
+	}
+
+	// Watch queue lag and failure rates
+	watchCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL})
+	defer inspector.Close()
+	go watchdog.New(inspector).Run(watchCtx)
 
 	// Setup Gin router
-	r := gin.Default()
-	// Register routes
-	r.GET("/calculate-simhash", handler.CalculateSimHash)
-	r.GET("/simhash", handler.GetSimHash)
-	r.GET("/job", handler.GetJobStatus)
+	r := gin.New()
+	r.Use(gin.Logger(), handler.RequestID, handler.Compress, handler.Recovery, handler.MarkStale, handler.Timeout)
+
+	// Initialize HTTP handlers
+	handler := handler.NewHandler(store, taskClient, worker)
+	r.Use(handler.SLO)
+
+	// Register routes under http.base_path
+	root := r.Group(config.BasePath())
+	root.GET("/metrics", gin.WrapH(metrics.Handler()))
+	api := root.Group("/", handler.Authenticate)
+	api.GET("/calculate-simhash", handler.CalculateSimHash)
+	api.GET("/simhash", handler.GetSimHash)
+	api.POST("/simhash/batch", handler.BatchGetSimHash)
+	api.GET("/simhash/before", handler.GetCaptureBefore)
+	api.GET("/exists", handler.Exists)
+	api.POST("/captures/retry", handler.RetryCapture)
+	api.GET("/simhash/versions", handler.ListVersions)
+	api.GET("/urls", handler.ListURLs)
+	api.GET("/timeline", handler.Timeline)
+	api.GET("/changes", handler.Changes)
+	api.GET("/nearest", handler.Nearest)
+	api.GET("/diff", handler.Diff)
+	api.GET("/diff/baseline", handler.DiffBaseline)
+	api.POST("/diff/matrix", handler.DiffMatrix)
+	api.POST("/diffs", handler.CreateDiffLink)
+	api.GET("/diffs/:id", handler.GetDiffLink)
+	api.GET("/baseline", handler.GetBaseline)
+	api.PUT("/baseline", handler.SetBaseline)
+	api.DELETE("/baseline", handler.DeleteBaseline)
+	api.GET("/analyze/trend", handler.Trend)
+	api.GET("/analyze/anomalies", handler.Anomalies)
+	api.GET("/analyze/eras", handler.Eras)
+	api.GET("/export/story", handler.Story)
+	api.GET("/job", handler.GetJobStatus)
+	api.GET("/job/report", handler.GetJobReport)
+	api.POST("/jobs/status", handler.JobStatuses)
+	api.GET("/sign", handler.SignURL)
+	api.GET("/capabilities", handler.Capabilities)
+
+	root.DELETE("/simhash", handler.RequireAdmin, handler.DeleteSimHash)
+	root.GET("/jobs", handler.RequireAdmin, handler.ListJobs)
+
+	admin := root.Group("/admin", handler.RequireAdmin)
+	admin.GET("/templates", handler.ListTemplates)
+	admin.GET("/templates/:name", handler.GetTemplate)
+	admin.PUT("/templates/:name", handler.PutTemplate)
+	admin.DELETE("/templates/:name", handler.DeleteTemplate)
+	admin.GET("/template-profiles/:host", handler.GetProfile)
+	admin.POST("/template-profiles/:host", handler.BuildProfile)
+	admin.DELETE("/template-profiles/:host", handler.DeleteProfile)
+	admin.GET("/usage", handler.GetUsage)
+	admin.POST("/repair", handler.Repair)
+	admin.POST("/purge", handler.StartPurge)
+	admin.GET("/purge/:id", handler.GetPurge)
+	admin.GET("/loglevel", handler.GetLogLevel)
+	admin.PUT("/loglevel", handler.SetLogLevel)
+	admin.POST("/task/:id/priority", handler.SetTaskPriority)
+	admin.POST("/task/:id/retry", handler.RetryTask)
+	admin.GET("/exclusions", handler.GetExclusions)
+	admin.PUT("/exclusions", handler.PutExclusion)
+	admin.DELETE("/exclusions", handler.DeleteExclusion)
+
+	handler.SetRoutes(r.Routes())
 
 	httpSrv := &http.Server{
 		Addr:    ":4000",
@@ -81,7 +272,7 @@ func main() {
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, os.Kill)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	sig := <-sigChan
 	log.Println("Received signal:", sig)
 
@@ -90,6 +281,9 @@ func main() {
 	defer cancel()
 
 	log.Println("Shutting down server...")
+	stopWatchdog()
+	scheduler.Shutdown()
+	worker.Drain()
 	srv.Shutdown()
 	if err := httpSrv.Shutdown(ctx); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/maintenance"
+)
+
+// runExportQueue writes the waiting tasks of every queue to a file
+func runExportQueue(args []string) int {
+	fs := flag.NewFlagSet("export-queue", flag.ExitOnError)
+	out := fs.String("out", "queue.ndjson", "file to write the tasks to")
+	fs.Parse(args)
+
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL})
+	defer inspector.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Printf("Export failed: %v", err)
+		return 1
+	}
+	defer f.Close()
+
+	counts, err := maintenance.ExportQueues(inspector, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		log.Printf("Export failed after %v tasks: %v", counts, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(counts)
+	return 0
+}
+
+// runImportQueue enqueues the tasks of an export into the configured Redis
+func runImportQueue(args []string) int {
+	fs := flag.NewFlagSet("import-queue", flag.ExitOnError)
+	in := fs.String("in", "queue.ndjson", "file to read the tasks from")
+	fs.Parse(args)
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL})
+	defer client.Close()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Printf("Import failed: %v", err)
+		return 1
+	}
+	defer f.Close()
+
+	counts, err := maintenance.ImportQueues(context.Background(), client, f)
+	if err != nil {
+		log.Printf("Import failed after %v tasks: %v", counts, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(counts)
+	return 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/maintenance"
+)
+
+// runRepair scans storage for inconsistencies and prints a JSON report
+func runRepair(args []string) int {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "re-key or delete the problems found")
+	fs.Parse(args)
+
+	store, closeFn, err := openStore()
+	if err != nil {
+		log.Printf("Failed to initialize storage: %v", err)
+		return 1
+	}
+	defer closeFn()
+
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: config.AppConfig.Redis.URL})
+	defer inspector.Close()
+
+	report, err := maintenance.Repair(context.Background(), store, inspector, *fix)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if err != nil {
+		log.Printf("Repair scan failed: %v", err)
+		return 1
+	}
+	return 0
+}
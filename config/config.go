@@ -1,8 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,29 +12,499 @@ import (
 type Config struct {
 	Redis struct {
 		URL string `yaml:"url"`
+		// Embedded runs an in-process, non-persistent Redis for local
+		// development in place of URL
+		Embedded bool `yaml:"embedded"`
+		// ReadURLs are replicas serving query reads; writes use URL
+		ReadURLs []string `yaml:"read_urls"`
 	} `yaml:"redis"`
+	Storage struct {
+		Encryption struct {
+			Enabled   bool   `yaml:"enabled"`
+			ActiveKey string `yaml:"active_key"`
+			// Provider is where keys come from: env (default), vault, or a
+			// provider registered with storage.RegisterKeyProvider
+			Provider string `yaml:"provider"`
+			// KeyEnv maps key IDs to environment variables holding
+			// base64-encoded 256-bit keys
+			KeyEnv map[string]string `yaml:"key_env"`
+			// Vault unwraps data keys with a HashiCorp Vault transit key
+			Vault struct {
+				Address    string `yaml:"address"`
+				TokenEnv   string `yaml:"token_env"`
+				TransitKey string `yaml:"transit_key"`
+				// WrappedKeys maps key IDs to data key ciphertexts
+				// (vault:v1:...) returned by the transit datakey endpoint
+				WrappedKeys map[string]string `yaml:"wrapped_keys"`
+			} `yaml:"vault"`
+		} `yaml:"encryption"`
+		Retry struct {
+			// Attempts is the number of tries of a storage operation
+			// failing with a connection error, at most 1 disables retries
+			Attempts  int `yaml:"attempts"`
+			BackoffMs int `yaml:"backoff_ms"`
+		} `yaml:"retry"`
+		StaleCache struct {
+			// Size is the number of recently read values kept in process
+			// to answer reads while Redis is unreachable; 0 disables it
+			Size int `yaml:"size"`
+			// MaxAge is how old, in seconds, a cached value may be
+			MaxAge int `yaml:"max_age"`
+		} `yaml:"stale_cache"`
+		// RetryAfter is the Retry-After, in seconds, of the 503 answered
+		// when storage is unavailable
+		RetryAfter int `yaml:"retry_after"`
+	} `yaml:"storage"`
 	Simhash struct {
 		Size        int   `yaml:"size"`
 		ExpireAfter int64 `yaml:"expire_after"`
+		// MinSize and MaxSize bound the size= clients may request;
+		// they default to Size, allowing only the default
+		MinSize int `yaml:"min_size"`
+		MaxSize int `yaml:"max_size"`
+		// StoreFeatures keeps the feature map of every capture for the
+		// jaccard and containment metrics
+		StoreFeatures bool `yaml:"store_features"`
+		// FeatureDeltas stores the features of most captures as the
+		// change from the capture before
+		FeatureDeltas struct {
+			Enabled bool `yaml:"enabled"`
+			// FullEvery is the number of captures per full feature map,
+			// default 20
+			FullEvery int `yaml:"full_every"`
+		} `yaml:"feature_deltas"`
+		// The extraction settings of stored hashes
+		ExtractProfile `yaml:",inline"`
+		// Profiles are further extraction settings by name, which jobs
+		// choose with profile=
+		Profiles map[string]ExtractProfile `yaml:"profiles"`
+		// Ignore lists by host CSS selectors of page regions removed
+		// before extraction, for the host and its subdomains; the longest
+		// matching host wins
+		Ignore map[string][]string `yaml:"ignore"`
+		// Shadow also hashes a share of captures with a candidate profile,
+		// exporting how far the candidate hashes are from the stored ones
+		// so that extractor changes can be validated before switching
+		Shadow struct {
+			// Fraction is the share of captures hashed twice; 0 disables it
+			Fraction  float64        `yaml:"fraction"`
+			Candidate ExtractProfile `yaml:"candidate"`
+		} `yaml:"shadow"`
 	} `yaml:"simhash"`
+	Diff struct {
+		// Thresholds are the minimum normalized similarity of each label
+		// of /diff?normalize=1; anything below Changed is very different
+		Thresholds struct {
+			Identical     float64 `yaml:"identical"`
+			NearDuplicate float64 `yaml:"near_duplicate"`
+			Changed       float64 `yaml:"changed"`
+		} `yaml:"thresholds"`
+		// BitWeights weighs each simhash bit, lowest first, for
+		// metric=weighted; missing weights are 1
+		BitWeights []float64 `yaml:"bit_weights"`
+	} `yaml:"diff"`
+	Retention struct {
+		// Schedule of the janitor task enforcing the policies, default @hourly
+		Schedule string `yaml:"schedule"`
+		// Policies maps record classes to how long they are kept, e.g.
+		// "36h", "400d" or seconds; "0" keeps records forever
+		Policies map[string]string `yaml:"policies"`
+	} `yaml:"retention"`
+	Analysis struct {
+		Eras struct {
+			// Distance is the default era distance in bits of
+			// /analyze/eras; eras for it are kept up to date by jobs
+			Distance int `yaml:"distance"`
+		} `yaml:"eras"`
+		Changes struct {
+			// Threshold is the default distance in bits of /changes; a
+			// capture further than it from the one before is listed
+			Threshold int `yaml:"threshold"`
+		} `yaml:"changes"`
+	} `yaml:"analysis"`
+	TemplateProfiles struct {
+		// Enabled subtracts the template features of a page's host, when a
+		// profile was built for it, before hashing the page
+		Enabled bool `yaml:"enabled"`
+		// SampleSize is the number of stored pages fetched to build a profile
+		SampleSize int `yaml:"sample_size"`
+		// MinPages is the fewest sampled pages a profile is built from
+		MinPages int `yaml:"min_pages"`
+		// Threshold is the share of sampled pages a feature must appear on
+		// to count as template
+		Threshold float64 `yaml:"threshold"`
+	} `yaml:"template_profiles"`
 	Snapshots struct {
 		NumberPerYear int `yaml:"number_per_year"`
+		// VerifyDigest checks downloaded bodies against the SHA-1 digest
+		// of their CDX row, failing the capture on a mismatch
+		VerifyDigest bool `yaml:"verify_digest"`
+		// ContentTypes are the media types hashed as HTML, as path.Match
+		// patterns; default text/html and application/xhtml+xml
+		ContentTypes []string `yaml:"content_types"`
 	} `yaml:"snapshots"`
+	// Archive is the default source; Archives are further named sources
+	// selected with archive=
+	Archive  ArchiveConfig            `yaml:"archive"`
+	Archives map[string]ArchiveConfig `yaml:"archives"`
+
+	DNS struct {
+		// CacheTTL is how long worker lookups are cached, in seconds;
+		// 0 disables caching
+		CacheTTL int `yaml:"cache_ttl"`
+		// Overrides pins hosts to fixed IP addresses
+		Overrides map[string][]string `yaml:"overrides"`
+	} `yaml:"dns"`
+	Transport struct {
+		// Hosts tunes the worker's connections per archive host
+		Hosts map[string]struct {
+			// Protocol is h2, http1 or empty to negotiate
+			Protocol string `yaml:"protocol"`
+			// MaxStreams caps in-flight requests and sizes the idle pool
+			MaxStreams int `yaml:"max_streams"`
+			// TLSSessionCache is the number of TLS sessions kept for resumption
+			TLSSessionCache int `yaml:"tls_session_cache"`
+		} `yaml:"hosts"`
+		// CDX bounds CDX and availability queries, Snapshot the download
+		// of capture bodies
+		CDX      RequestBudget `yaml:"cdx"`
+		Snapshot RequestBudget `yaml:"snapshot"`
+	} `yaml:"transport"`
+	Auth struct {
+		// APIKeys maps client keys to tenants for usage accounting;
+		// when empty the API is open and usage is recorded as anonymous
+		APIKeys []struct {
+			Key    string `yaml:"key"`
+			Tenant string `yaml:"tenant"`
+		} `yaml:"api_keys"`
+	} `yaml:"auth"`
+	Signing struct {
+		// Secret keys the HMAC of signed result URLs; signing is disabled when empty
+		Secret string `yaml:"secret"`
+		// DefaultExpiry and MaxExpiry are in seconds
+		DefaultExpiry int  `yaml:"default_expiry"`
+		MaxExpiry     int  `yaml:"max_expiry"`
+		SingleUse     bool `yaml:"single_use"`
+	} `yaml:"signing"`
+	Admin struct {
+		// Token authenticates /admin routes; they are disabled when empty
+		Token string `yaml:"token"`
+	} `yaml:"admin"`
+	SMTP struct {
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		From     string `yaml:"from"`
+		// AllowedDomains are the recipient domains notify_email accepts
+		// from anonymous callers; callers with an API key may use any
+		AllowedDomains []string `yaml:"allowed_domains"`
+		// Timeout bounds the delivery of one message in seconds, 30 by
+		// default
+		Timeout int `yaml:"timeout"`
+	} `yaml:"smtp"`
+	HTTP struct {
+		// BasePath is the path prefix the API is served under, e.g.
+		// /services/simhash behind a shared ingress; see BasePath
+		BasePath string `yaml:"base_path"`
+		// Timeout bounds each request in seconds; 0 disables it
+		Timeout int `yaml:"timeout"`
+		// RouteTimeouts overrides Timeout per route path, e.g. /admin/repair
+		RouteTimeouts map[string]int `yaml:"route_timeouts"`
+		SLO           struct {
+			// Budgets maps route paths to their latency budget in
+			// milliseconds, "default" covering the others; 0 leaves a
+			// route unmeasured
+			Budgets map[string]int `yaml:"budgets"`
+			// MaxInFlight sheds requests with 503 while this many are
+			// being served; 0 disables it
+			MaxInFlight int `yaml:"max_in_flight"`
+			// MaxBacklog sheds job submissions with 503 while this many
+			// tasks are pending; 0 disables it
+			MaxBacklog int `yaml:"max_backlog"`
+		} `yaml:"slo"`
+		Compression struct {
+			Enabled bool `yaml:"enabled"`
+			// MinSize is the smallest body in bytes worth compressing
+			MinSize      int      `yaml:"min_size"`
+			ContentTypes []string `yaml:"content_types"`
+		} `yaml:"compression"`
+	} `yaml:"http"`
+	Webhooks struct {
+		// Signing selects the HMAC keys of outbound webhook requests by
+		// destination; the entry with the longest URL prefix matching the
+		// destination applies, and "" matches every destination
+		Signing []struct {
+			Prefix string `yaml:"prefix"`
+			// KeyEnv maps key IDs to environment variables holding the
+			// secrets; each key adds its own signature to the header
+			KeyEnv map[string]string `yaml:"key_env"`
+		} `yaml:"signing"`
+	} `yaml:"webhooks"`
+	Alerts struct {
+		// WebhookURL receives a JSON alert whenever an HTTP handler panics
+		WebhookURL string `yaml:"webhook_url"`
+		// Watchdog checks the task queues every Interval seconds and
+		// alerts when a threshold is exceeded; 0 disables a check
+		Watchdog struct {
+			Interval int `yaml:"interval"`
+			// MaxLag is the age in seconds of the oldest pending task
+			MaxLag int `yaml:"max_lag"`
+			// MaxFailureRate is the share of tasks failing between checks,
+			// judged once at least MinSamples tasks finished
+			MaxFailureRate float64 `yaml:"max_failure_rate"`
+			MinSamples     int     `yaml:"min_samples"`
+		} `yaml:"watchdog"`
+	} `yaml:"alerts"`
+	// PublicURL is the externally reachable base URL used in links,
+	// without http.base_path
+	PublicURL string `yaml:"public_url"`
+	Worker    struct {
+		// Hooks lists compiled-in pipeline hooks to enable, in order
+		Hooks []string `yaml:"hooks"`
+		// SlowCaptureMs is the processing time above which a capture is
+		// logged with its phase timings; 0 disables the log
+		SlowCaptureMs int `yaml:"slow_capture_ms"`
+		// ShutdownTimeout is how long running jobs get to finish their
+		// current capture and save a checkpoint on shutdown, in seconds;
+		// 0 keeps asynq's default of 8
+		ShutdownTimeout int `yaml:"shutdown_timeout"`
+		// Stages splits each year job into per-capture fetch and hash
+		// tasks on their own queues
+		Stages struct {
+			Enabled    bool   `yaml:"enabled"`
+			FetchQueue string `yaml:"fetch_queue"`
+			HashQueue  string `yaml:"hash_queue"`
+			// MaxRetry is the number of retries of a failing stage
+			MaxRetry int `yaml:"max_retry"`
+			// CacheTTL bounds how long a fetched body waits for hashing, in seconds
+			CacheTTL int `yaml:"cache_ttl"`
+		} `yaml:"stages"`
+		// Prefetch pipelines unstaged year jobs: the CDX listing is read
+		// a month at a time while the captures listed so far download
+		// ahead of hashing
+		Prefetch struct {
+			Enabled bool `yaml:"enabled"`
+			// Depth is the number of captures downloaded ahead
+			Depth int `yaml:"depth"`
+		} `yaml:"prefetch"`
+		// Sitemap bounds the pages all-years jobs with sitemap=1 add from
+		// the archived sitemap.xml of their host
+		Sitemap struct {
+			MaxURLs int `yaml:"max_urls"`
+		} `yaml:"sitemap"`
+	} `yaml:"worker"`
+	Extractors []struct {
+		ContentType string `yaml:"content_type"`
+		WASM        string `yaml:"wasm"`
+		MemoryPages uint32 `yaml:"memory_pages"`
+		TimeoutMs   int    `yaml:"timeout_ms"`
+	} `yaml:"extractors"`
+	Seeds []struct {
+		Name string `yaml:"name"`
+		// Source is a local path, an s3://bucket/key object or an HTTP URL
+		Source   string `yaml:"source"`
+		Schedule string `yaml:"schedule"`
+		Template string `yaml:"template"`
+	} `yaml:"seeds"`
+	Log struct {
+		// Level is one of debug, info, warn, error
+		Level string `yaml:"level"`
+		// Modules overrides the level per module (downloader, extractor, storage, worker)
+		Modules map[string]string `yaml:"modules"`
+	} `yaml:"log"`
+	Queues struct {
+		// Weights maps task queues to their share of worker time; new
+		// jobs go to "default" and operators may move them elsewhere
+		Weights map[string]int `yaml:"weights"`
+		// Priorities are the queues clients may pick with priority= of
+		// /calculate-simhash, e.g. interactive for single pages and bulk
+		// for backfills
+		Priorities []string `yaml:"priorities"`
+		// StrictPriority drains higher-weight queues before lower ones
+		StrictPriority bool `yaml:"strict_priority"`
+		// CollapseWindow is how many seconds identical job submissions
+		// keep sharing one job; 0 disables collapsing
+		CollapseWindow int `yaml:"collapse_window"`
+		// Retention is how many seconds completed jobs stay listed by
+		// GET /jobs; 0 drops them on completion
+		Retention int `yaml:"retention"`
+		// JobTimeout bounds each attempt of a calculation or discovery
+		// job in seconds, per year for multi-year jobs; JobDeadline bounds
+		// all attempts from submission. 0 disables each.
+		JobTimeout  int `yaml:"job_timeout"`
+		JobDeadline int `yaml:"job_deadline"`
+	} `yaml:"queues"`
+	Resources struct {
+		// MemoryLimitMB is the soft memory limit of the Go runtime
+		// unless GOMEMLIMIT is set; 0 takes MemoryRatio of the container
+		// limit, if any
+		MemoryLimitMB int `yaml:"memory_limit_mb"`
+		// MemoryRatio is the share of the container memory limit used
+		MemoryRatio float64 `yaml:"memory_ratio"`
+		// ThreadsPerCPU sizes threads when it is 0
+		ThreadsPerCPU int `yaml:"threads_per_cpu"`
+		// TaskMemoryMB is the memory budgeted per concurrent capture;
+		// threads derived from the CPUs are capped to fit the memory limit
+		TaskMemoryMB int `yaml:"task_memory_mb"`
+	} `yaml:"resources"`
+	// SkipStartupCheck disables the dependency self-check run before serving
+	SkipStartupCheck bool `yaml:"skip_startup_check"`
+
+	// Threads is the number of captures processed concurrently; 0 sizes
+	// it from the CPUs and memory available, see Resources
 	Threads      int    `yaml:"threads"`
 	CdxAuthToken string `yaml:"cdx_auth_token"`
 	MaxDownloads int    `yaml:"max_downloads"`
 	MaxErrors    int    `yaml:"max_errors"`
+	ErrorPolicy  struct {
+		// Window is the number of most recent captures MaxRatio applies
+		// to; 0 disables the ratio check
+		Window int `yaml:"window"`
+		// MaxRatio aborts a job once the weighted share of failed
+		// captures in the window exceeds it
+		MaxRatio float64 `yaml:"max_ratio"`
+		// MinSamples is the number of captures to see before MaxRatio
+		// applies
+		MinSamples int `yaml:"min_samples"`
+		// Weights scale errors by class (timeout, network, http_4xx,
+		// http_5xx, content, other); missing classes weigh 1
+		Weights map[string]float64 `yaml:"weights"`
+	} `yaml:"error_policy"`
+	CaptureRetry struct {
+		// Enabled keeps captures failing with one of Classes as error
+		// records and retries them periodically
+		Enabled bool `yaml:"enabled"`
+		// Schedule of the retry task, default @hourly
+		Schedule string `yaml:"schedule"`
+		// Cooldown is the wait before the first retry, e.g. "7d"
+		Cooldown string `yaml:"cooldown"`
+		// Backoff multiplies the wait after each failed retry
+		Backoff float64 `yaml:"backoff"`
+		// MaxAttempts is the number of retries before a capture is given up
+		MaxAttempts int `yaml:"max_attempts"`
+		// Batch caps the captures retried per run
+		Batch int `yaml:"batch"`
+		// Classes are the error classes worth retrying
+		Classes []string `yaml:"classes"`
+		// InlinePerMinute caps the POST /captures/retry requests of each
+		// tenant per minute; 0 is unlimited
+		InlinePerMinute int `yaml:"inline_per_minute"`
+	} `yaml:"capture_retry"`
+	Verify struct {
+		// Enabled runs the background verifier of stored hashes
+		Enabled bool `yaml:"enabled"`
+		// Schedule of the verifier, default @every 10m
+		Schedule string `yaml:"schedule"`
+		// Sample is the number of keys checked per run
+		Sample int `yaml:"sample"`
+		// Queue runs the verifier, with weight 1 unless queues.weights
+		// sets one; default "verify"
+		Queue string `yaml:"queue"`
+	} `yaml:"verify"`
+	// Purge paces POST /admin/purge deletions
+	Purge struct {
+		// BatchSize is the number of keys scanned per batch, default 500
+		BatchSize int `yaml:"batch_size"`
+		// PauseMs is the pause between batches in milliseconds
+		PauseMs int `yaml:"pause_ms"`
+	} `yaml:"purge"`
+	Canonical struct {
+		// Record stores the rel=canonical link of HTML captures in their
+		// metadata
+		Record bool `yaml:"record"`
+		// Alias also stores each hash under the canonical URL when it
+		// differs from the capture's; needs Record
+		Alias bool `yaml:"alias"`
+	} `yaml:"canonical"`
+	URLNormalization struct {
+		// The default rules, applied to hosts without an override
+		URLRules `yaml:",inline"`
+		// Hosts replace the default rules for a host and its subdomains;
+		// the longest matching host wins
+		Hosts map[string]URLRules `yaml:"hosts"`
+	} `yaml:"url_normalization"`
+}
+
+// URLRules rewrite the URLs clients submit before they are hashed or
+// looked up, so that variants of a page share one set of captures
+type URLRules struct {
+	// StripFragment drops the #fragment
+	StripFragment bool `yaml:"strip_fragment"`
+	// DropParams are query parameters to remove, as path.Match patterns
+	// such as utm_*
+	DropParams []string `yaml:"drop_params"`
+	// SortParams orders the query parameters by name
+	SortParams bool `yaml:"sort_params"`
+}
+
+// RequestBudget bounds the phases of an outgoing request in
+// milliseconds; 0 keeps the default of the phase
+type RequestBudget struct {
+	// ConnectMs covers the DNS lookup and TCP connect, default 30000
+	ConnectMs int `yaml:"connect_ms"`
+	// TLSMs covers the TLS handshake, default 10000
+	TLSMs int `yaml:"tls_ms"`
+	// HeaderMs is the wait for response headers once the request is
+	// sent, unbounded by default
+	HeaderMs int `yaml:"header_ms"`
+	// TotalMs bounds the whole request including reading the body,
+	// default 20000
+	TotalMs int `yaml:"total_ms"`
+}
+
+// ExtractProfile is how features are extracted from HTML pages
+type ExtractProfile struct {
+	// Features weighs optional page content; 0 leaves it out
+	Features struct {
+		AltText int `yaml:"alt_text"`
+		Meta    int `yaml:"meta"`
+		JSONLD  int `yaml:"json_ld"`
+	} `yaml:"features"`
+	// Limits cap the nodes, nesting depth and words extracted from a
+	// page; captures cut short are flagged as truncated. 0 is unlimited.
+	Limits struct {
+		MaxNodes  int `yaml:"max_nodes"`
+		MaxDepth  int `yaml:"max_depth"`
+		MaxTokens int `yaml:"max_tokens"`
+	} `yaml:"limits"`
+	// Tokens map numerals and dates to placeholder features, so that
+	// counters and timestamps do not count as change
+	Tokens struct {
+		Numbers bool `yaml:"numbers"`
+		Dates   bool `yaml:"dates"`
+	} `yaml:"tokens"`
+}
+
+// ArchiveConfig selects a source preset and overrides its endpoints
+type ArchiveConfig struct {
+	Preset    string `yaml:"preset"`
+	CdxURL    string `yaml:"cdx_url"`
+	ReplayURL string `yaml:"replay_url"`
+	Modifier  string `yaml:"modifier"`
+	Format    string `yaml:"format"`
+	// AvailabilityURL is the Wayback Availability API endpoint used by
+	// /exists; without one the CDX server is asked instead
+	AvailabilityURL string `yaml:"availability_url"`
 }
 
 var AppConfig Config
 
-func LoadConfig(filename string) error {
+// LoadConfig reads filename into AppConfig. A non-empty profile names a
+// section under profiles: whose settings are merged over the rest of the
+// file; a profile may build on another one with extends: <name>.
+func LoadConfig(filename, profile string) error {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		log.Printf("Error reading config file: %v", err)
 		return err
 	}
 
+	if data, err = applyProfile(data, profile); err != nil {
+		log.Printf("Error applying config profile: %v", err)
+		return err
+	}
+
 	err = yaml.Unmarshal(data, &AppConfig)
 	if err != nil {
 		log.Printf("Error parsing config file: %v", err)
@@ -41,3 +513,62 @@ func LoadConfig(filename string) error {
 
 	return nil
 }
+
+// BasePath is http.base_path without its trailing slash, "" when the API
+// is served at the root
+func BasePath() string {
+	return strings.TrimRight(AppConfig.HTTP.BasePath, "/")
+}
+
+// PublicLink is the external URL of the API path p
+func PublicLink(p string) string {
+	return strings.TrimRight(AppConfig.PublicURL, "/") + BasePath() + p
+}
+
+// applyProfile merges the named profile over the document in data and
+// drops the profiles section
+func applyProfile(data []byte, profile string) ([]byte, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	profiles, _ := doc["profiles"].(map[interface{}]interface{})
+	delete(doc, "profiles")
+	if profile == "" {
+		return yaml.Marshal(doc)
+	}
+
+	// Resolve the extends chain, base profiles first
+	var chain []map[interface{}]interface{}
+	seen := map[string]bool{}
+	for name := profile; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("profile %s extends itself", name)
+		}
+		seen[name] = true
+		section, ok := profiles[name].(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unknown profile: %s", name)
+		}
+		chain = append([]map[interface{}]interface{}{section}, chain...)
+		name, _ = section["extends"].(string)
+	}
+
+	for _, section := range chain {
+		delete(section, "extends")
+		merge(doc, section)
+	}
+	return yaml.Marshal(doc)
+}
+
+// merge copies overlay into base, recursing into sections present in both
+func merge(base, overlay map[interface{}]interface{}) {
+	for key, value := range overlay {
+		sub, isMap := value.(map[interface{}]interface{})
+		if existing, ok := base[key].(map[interface{}]interface{}); ok && isMap {
+			merge(existing, sub)
+			continue
+		}
+		base[key] = value
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"wayback-discover-diff/internal/maintenance"
+	"wayback-discover-diff/pkg/usage"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// TemplateList answers GET /admin/templates
+type TemplateList struct {
+	Templates map[string]worker.JobOptions `json:"templates"`
+}
+
+// Template answers GET and PUT /admin/templates/:name
+type Template struct {
+	Name    string            `json:"name"`
+	Options worker.JobOptions `json:"options"`
+}
+
+// TemplateDeleted answers DELETE /admin/templates/:name
+type TemplateDeleted struct {
+	Status string `json:"status"`
+	Name   string `json:"name"`
+}
+
+// TenantUsage is the usage of one tenant over a report range
+type TenantUsage struct {
+	Days  []usage.Day    `json:"days"`
+	Total usage.Counters `json:"total"`
+}
+
+// UsageReport answers GET /admin/usage
+type UsageReport struct {
+	From    string                 `json:"from"`
+	To      string                 `json:"to"`
+	Tenants map[string]TenantUsage `json:"tenants"`
+}
+
+// LogLevels answers GET /admin/loglevel and is the body of PUT. An empty
+// module level removes the override so the module follows Level again.
+type LogLevels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+// TaskPriority is the body of POST /admin/task/:id/priority. Queue moves
+// the task to another queue; Front makes it the next task of its queue.
+type TaskPriority struct {
+	Queue string `json:"queue"`
+	Front bool   `json:"front"`
+}
+
+// TaskQueued answers POST /admin/task/:id/priority and
+// POST /admin/task/:id/retry
+type TaskQueued struct {
+	JobID string `json:"job_id"`
+	Queue string `json:"queue"`
+	State string `json:"state"`
+}
+
+// TaskRetry is the optional body of POST /admin/task/:id/retry.
+// ResetRetries gives the task its full number of attempts again.
+type TaskRetry struct {
+	ResetRetries bool `json:"reset_retries"`
+}
+
+// RepairFailed answers a POST /admin/repair scan that stopped early, with
+// the findings gathered so far
+type RepairFailed struct {
+	Error
+	Report maintenance.RepairReport `json:"report"`
+}
+
+// JobList answers GET /jobs
+type JobList struct {
+	Jobs  []worker.JobInfo `json:"jobs"`
+	Count int              `json:"count"`
+}
@@ -0,0 +1,27 @@
+// Package api defines the JSON bodies returned by the HTTP API. The field
+// names are part of the public contract shared with client SDKs and the
+// OpenAPI description; change them only together with a version bump.
+package api
+
+// StatusError is the status of every failed request
+const StatusError = "error"
+
+// Error is the body of every failed request
+type Error struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewError builds the error body carrying message
+func NewError(message string) Error {
+	return Error{Status: StatusError, Message: message}
+}
+
+// Job and capture statuses
+const (
+	StatusStarted  = "started"
+	StatusPending  = "PENDING"
+	StatusComplete = "COMPLETE"
+	StatusDeleted  = "deleted"
+)
@@ -0,0 +1,58 @@
+package api
+
+// Capabilities answers GET /capabilities, describing what this deployment
+// supports so clients need not hard-code it
+type Capabilities struct {
+	Simhash SimhashCapabilities `json:"simhash"`
+	Source  SourceCapabilities  `json:"source"`
+	// Archives are the further sources selectable with archive=
+	Archives []SourceCapabilities `json:"archives"`
+	// Formats are the media types offered for capture lists and batch results
+	Formats     []string `json:"formats"`
+	Compression []string `json:"compression"`
+	// ContentTypes are the capture media types that can be hashed
+	ContentTypes []string `json:"content_types"`
+	// Priorities are the priority= values of /calculate-simhash
+	Priorities []string `json:"priorities"`
+	// Profiles are the profile= values of /calculate-simhash
+	Profiles []string `json:"profiles"`
+	// Endpoints lists the public API routes, e.g. "GET /diff", under
+	// BasePath
+	Endpoints []string         `json:"endpoints"`
+	BasePath  string           `json:"base_path"`
+	Limits    CapabilityLimits `json:"limits"`
+	Auth      AuthCapabilities `json:"auth"`
+}
+
+// SimhashCapabilities describes the hash sizes clients may request
+type SimhashCapabilities struct {
+	Algorithm   string `json:"algorithm"`
+	DefaultSize int    `json:"default_size"`
+	MinSize     int    `json:"min_size"`
+	MaxSize     int    `json:"max_size"`
+	// Metrics are the /diff?metric= values; feature metrics additionally
+	// need FeaturesStored
+	Metrics        []string `json:"metrics"`
+	FeaturesStored bool     `json:"features_stored"`
+}
+
+// SourceCapabilities names the archive captures are read from
+type SourceCapabilities struct {
+	Name      string `json:"name"`
+	CDXFormat string `json:"cdx_format"`
+}
+
+// CapabilityLimits are the request limits of the deployment
+type CapabilityLimits struct {
+	BatchSize        int `json:"batch_size"`
+	SnapshotsPerYear int `json:"snapshots_per_year"`
+	// JobWait and RequestTimeout are in seconds; zero means no timeout
+	JobWait        int `json:"job_wait"`
+	RequestTimeout int `json:"request_timeout"`
+}
+
+// AuthCapabilities tells clients which credentials they need
+type AuthCapabilities struct {
+	APIKeyRequired bool `json:"api_key_required"`
+	SignedURLs     bool `json:"signed_urls"`
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//go:generate protoc --go_out=apipb --go_opt=paths=source_relative api.proto
+
+// ProtoMessage is implemented by the bodies offered as Protobuf, encoded
+// as the messages of api.proto
+type ProtoMessage interface {
+	MarshalProto() []byte
+}
+
+// CaptureRows is a bare capture list, the CaptureList message
+type CaptureRows [][]string
+
+// MarshalProto encodes rows as a CaptureList
+func (rows CaptureRows) MarshalProto() []byte {
+	return appendRows(nil, 1, rows)
+}
+
+// MarshalProto encodes y as a YearCaptures message
+func (y YearCaptures) MarshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, y.URLKey)
+	b = appendRows(b, 2, y.Captures)
+	b = appendInt(b, 3, y.Total)
+	b = appendInt(b, 4, y.Page)
+	b = appendInt(b, 5, y.PageSize)
+	b = appendString(b, 6, y.Status)
+	b = appendString(b, 7, y.JobID)
+	b = appendString(b, 8, y.AsOf)
+	timestamps := make([]string, 0, len(y.Excluded))
+	for timestamp := range y.Excluded {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Strings(timestamps)
+	for _, timestamp := range timestamps {
+		var entry []byte
+		entry = appendString(entry, 1, timestamp)
+		entry = appendString(entry, 2, y.Excluded[timestamp])
+		b = appendMessage(b, 9, entry)
+	}
+	for _, field := range y.Fields {
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendString(b, field)
+	}
+	return b
+}
+
+// MarshalProto encodes r as a BatchResult message
+func (r BatchResult) MarshalProto() []byte {
+	var b []byte
+	for _, c := range r.Captures {
+		var item []byte
+		item = appendString(item, 1, c.URL)
+		item = appendString(item, 2, c.URLKey)
+		item = appendString(item, 3, c.Timestamp)
+		item = appendString(item, 4, c.SimHash)
+		item = appendString(item, 5, c.Status)
+		item = appendString(item, 6, c.Message)
+		b = appendMessage(b, 1, item)
+	}
+	b = appendInt(b, 2, r.Total)
+	b = appendInt(b, 3, r.Found)
+	return b
+}
+
+// appendRows appends rows as repeated CaptureRow field num
+func appendRows(b []byte, num protowire.Number, rows [][]string) []byte {
+	for _, row := range rows {
+		var msg []byte
+		for _, column := range row {
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, column)
+		}
+		b = appendMessage(b, num, msg)
+	}
+	return b
+}
+
+// appendString appends a string field, omitted when empty as in proto3
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendInt appends an int64 field, omitted when zero as in proto3
+func appendInt(b []byte, num protowire.Number, n int) []byte {
+	if n == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(n)))
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
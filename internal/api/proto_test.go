@@ -0,0 +1,65 @@
+package api
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"wayback-discover-diff/internal/api/apipb"
+)
+
+func TestMarshalProtoRoundTrip(t *testing.T) {
+	rows := [][]string{{"20190101000000", "ANPEUQxkLYw="}, {"20190301000000", ""}}
+	pbRows := []*apipb.CaptureRow{
+		{Fields: []string{"20190101000000", "ANPEUQxkLYw="}},
+		{Fields: []string{"20190301000000", ""}},
+	}
+
+	tests := []struct {
+		name string
+		msg  ProtoMessage
+		want proto.Message
+	}{
+		{"capture list", CaptureRows(rows), &apipb.CaptureList{Captures: pbRows}},
+		{"empty capture list", CaptureRows(nil), &apipb.CaptureList{}},
+		{"year captures", YearCaptures{
+			URLKey: "com,example)/", Captures: rows, Total: 2, Page: 1, PageSize: 50,
+			Status: "COMPLETE", JobID: "job-1", AsOf: "20200101000000",
+			Excluded: map[string]string{"20190301000000": "maintenance page", "20190101000000": "spam"},
+			Fields:   []string{"timestamp", "simhash"},
+		}, &apipb.YearCaptures{
+			UrlKey: "com,example)/", Captures: pbRows, Total: 2, Page: 1, PageSize: 50,
+			Status: "COMPLETE", JobId: "job-1", AsOf: "20200101000000",
+			Excluded: map[string]string{"20190301000000": "maintenance page", "20190101000000": "spam"},
+			Fields:   []string{"timestamp", "simhash"},
+		}},
+		{"year captures with zero values", YearCaptures{Status: "PENDING"}, &apipb.YearCaptures{Status: "PENDING"}},
+		{"batch result", BatchResult{
+			Captures: []BatchCapture{
+				{URL: "example.com", URLKey: "com,example)/", Timestamp: "20190101000000", SimHash: "ANPEUQxkLYw="},
+				{URL: "example.com/missing", Timestamp: "20190101000000", Status: StatusError, Message: "CAPTURE_NOT_FOUND"},
+			},
+			Total: 2, Found: 1,
+		}, &apipb.BatchResult{
+			Captures: []*apipb.BatchCapture{
+				{Url: "example.com", UrlKey: "com,example)/", Timestamp: "20190101000000", Simhash: "ANPEUQxkLYw="},
+				{Url: "example.com/missing", Timestamp: "20190101000000", Status: StatusError, Message: "CAPTURE_NOT_FOUND"},
+			},
+			Total: 2, Found: 1,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.want.ProtoReflect().New().Interface()
+			if err := proto.Unmarshal(tt.msg.MarshalProto(), got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+			if unknown := got.ProtoReflect().GetUnknown(); len(unknown) > 0 {
+				t.Errorf("%d bytes of unknown fields", len(unknown))
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package api
+
+import (
+	"wayback-discover-diff/pkg/analysis"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// JobCreated answers /calculate-simhash. QueuePosition and ETASeconds
+// estimate when a waiting job starts; they are omitted once it runs.
+type JobCreated struct {
+	Status        string  `json:"status"`
+	JobID         string  `json:"job_id"`
+	QueuePosition int     `json:"queue_position,omitempty"`
+	ETASeconds    float64 `json:"eta_seconds,omitempty"`
+}
+
+// JobStatus answers /job; History is only set with history=1. Status is
+// pending, scheduled, active, retrying, completed or failed. Error is the
+// last error of a job that failed an attempt, Retried the number of
+// retries so far out of MaxRetry, and NextAttemptAt when a retrying or
+// scheduled job runs next. Result sums up a finished calculation job.
+type JobStatus struct {
+	Status        string                `json:"status"`
+	JobID         string                `json:"job_id"`
+	Error         string                `json:"error,omitempty"`
+	Retried       int                   `json:"retried,omitempty"`
+	MaxRetry      int                   `json:"max_retry,omitempty"`
+	NextAttemptAt string                `json:"next_attempt_at,omitempty"`
+	Result        *worker.JobSummary    `json:"result,omitempty"`
+	History       []worker.HistoryEvent `json:"history,omitempty"`
+}
+
+// JobStatusQuery is the body of POST /jobs/status
+type JobStatusQuery struct {
+	JobIDs []string `json:"job_ids"`
+}
+
+// JobStatuses answers POST /jobs/status in request order. Jobs that are
+// unknown or expired carry the not_found status.
+type JobStatuses struct {
+	Jobs  []JobStatus `json:"jobs"`
+	Count int         `json:"count"`
+}
+
+// StatusNotFound is the JobStatuses status of an unknown job
+const StatusNotFound = "not_found"
+
+// SimHash answers a single-timestamp /simhash lookup
+type SimHash struct {
+	SimHash string `json:"simhash"`
+	// Canonical is the rel=canonical URL recorded for the capture
+	Canonical string `json:"canonical,omitempty"`
+	// AliasOf is the URL the hash was stored from, for hashes aliased to
+	// their canonical URL
+	AliasOf string `json:"alias_of,omitempty"`
+	// ExpiresAt is when the hash will be dropped, in RFC 3339; absent
+	// when it does not expire
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// Capture answers /simhash/before
+type Capture struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+	SimHash   string `json:"simhash"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// YearCaptures lists the [timestamp, simhash] pairs of one year. It is the
+// body of /simhash?year=...&compress=1 and an entry of Timeline. With
+// keyed_by=surt URLKey is set and rows are [urlkey, timestamp, simhash].
+// With as_of= JobID and AsOf name the version the captures come from.
+// Excluded maps the timestamps of captures excluded from analyses to the
+// reason given. Paged responses carry one page of Total captures.
+type YearCaptures struct {
+	URLKey   string            `json:"url_key,omitempty"`
+	Captures [][]string        `json:"captures"`
+	Total    int               `json:"total"`
+	Page     int               `json:"page,omitempty"`
+	PageSize int               `json:"page_size,omitempty"`
+	Status   string            `json:"status"`
+	JobID    string            `json:"job_id,omitempty"`
+	AsOf     string            `json:"as_of,omitempty"`
+	Excluded map[string]string `json:"excluded,omitempty"`
+	// Fields names the columns of the capture rows chosen with fields=
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Exclusion is a capture excluded from analyses by an operator
+type Exclusion struct {
+	URL       string `json:"url,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Reason    string `json:"reason"`
+	At        string `json:"at"`
+}
+
+// Exclusions answers GET /admin/exclusions
+type Exclusions struct {
+	URL        string      `json:"url"`
+	Exclusions []Exclusion `json:"exclusions"`
+}
+
+// Version is a recorded state of the hashes of one year, see /simhash?as_of=
+type Version struct {
+	JobID string `json:"job_id"`
+	At    string `json:"at"`
+}
+
+// Versions answers /simhash/versions, oldest first
+type Versions struct {
+	URL      string    `json:"url"`
+	Year     string    `json:"year"`
+	Versions []Version `json:"versions"`
+}
+
+// URLs answers /urls with one page of the URLs that have hashes for Year,
+// in byte order. Total counts them across all pages.
+type URLs struct {
+	Year     string   `json:"year"`
+	URLs     []string `json:"urls"`
+	Page     int      `json:"page"`
+	PageSize int      `json:"page_size"`
+	Total    int      `json:"total"`
+}
+
+// Timeline answers /simhash?all=1 with captures grouped by year
+type Timeline struct {
+	URLKey string                  `json:"url_key,omitempty"`
+	Years  map[string]YearCaptures `json:"years"`
+	Total  int                     `json:"total"`
+	Status string                  `json:"status"`
+	// Fields names the columns of the capture rows chosen with fields=
+	Fields []string `json:"fields,omitempty"`
+}
+
+// BatchCapture is one entry of BatchResult. Missing or malformed captures
+// carry an error status and message instead of a simhash.
+type BatchCapture struct {
+	URL string `json:"url"`
+	// URLKey is the SURT key of URL, set with keyed_by=surt
+	URLKey    string `json:"url_key,omitempty"`
+	Timestamp string `json:"timestamp"`
+	SimHash   string `json:"simhash,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// BatchResult answers POST /simhash/batch in request order
+type BatchResult struct {
+	Captures []BatchCapture `json:"captures"`
+	Total    int            `json:"total"`
+	Found    int            `json:"found"`
+}
+
+// Purged answers DELETE /simhash
+type Purged struct {
+	Status  string `json:"status"`
+	URL     string `json:"url"`
+	Removed int    `json:"removed"`
+}
+
+// SignedURL answers /sign
+type SignedURL struct {
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expires_at"`
+	SingleUse bool   `json:"single_use"`
+}
+
+// Diff answers /diff with the distance between two captures of a URL.
+// Similarity and Label are only set with normalize=1 or a metric other
+// than hamming, which Similarity is then measured with.
+type Diff struct {
+	URL        string   `json:"url"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Distance   int      `json:"distance"`
+	Size       int      `json:"size"`
+	Metric     string   `json:"metric,omitempty"`
+	Similarity *float64 `json:"similarity,omitempty"`
+	Label      string   `json:"label,omitempty"`
+	// Words lists the words that changed, with /diff?words=1
+	Words *WordChanges `json:"words,omitempty"`
+}
+
+// WordChanges maps the words whose weight grew from one capture to the
+// next to the weight gained, and those whose weight shrank to the weight
+// lost
+type WordChanges struct {
+	Added   map[string]int `json:"added"`
+	Removed map[string]int `json:"removed"`
+}
+
+// DiffLink is a named diff recorded by POST /diffs and served at
+// GET /diffs/:id, with the result computed when it was recorded
+type DiffLink struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Creator string `json:"creator"`
+	Archive string `json:"archive,omitempty"`
+	Created string `json:"created"`
+	Link    string `json:"link"`
+	Diff    Diff   `json:"diff"`
+}
+
+// DiffMatrix answers POST /diff/matrix. Distances[i][j] is the distance
+// between Timestamps[i] and Timestamps[j]; Similarities is only set with
+// normalize.
+type DiffMatrix struct {
+	URL          string      `json:"url"`
+	Size         int         `json:"size"`
+	Timestamps   []string    `json:"timestamps"`
+	Distances    [][]int     `json:"distances"`
+	Similarities [][]float64 `json:"similarities,omitempty"`
+}
+
+// Baseline answers the /baseline routes with the capture pinned for a URL
+type Baseline struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Similarity labels of Diff
+const (
+	LabelIdentical     = "identical"
+	LabelNearDuplicate = "near-duplicate"
+	LabelChanged       = "changed"
+	LabelVeryDifferent = "very different"
+)
+
+// Trend answers /analyze/trend with monthly change rates between the
+// From and To years
+type Trend struct {
+	URL    string           `json:"url"`
+	From   int              `json:"from"`
+	To     int              `json:"to"`
+	Size   int              `json:"size"`
+	Months []analysis.Month `json:"months"`
+	// Excluded is the number of excluded captures left out
+	Excluded int `json:"excluded,omitempty"`
+}
+
+// CaptureTimeline answers /timeline with the captures of a year in
+// timestamp order
+type CaptureTimeline struct {
+	URL      string          `json:"url"`
+	Year     string          `json:"year"`
+	Size     int             `json:"size"`
+	Captures []TimelinePoint `json:"captures"`
+	// Excluded is the number of excluded captures of the year left out
+	Excluded int `json:"excluded,omitempty"`
+}
+
+// TimelinePoint is a capture with its distance to the previous capture,
+// which may fall in an earlier year; it is null for the first capture
+type TimelinePoint struct {
+	Timestamp string `json:"timestamp"`
+	SimHash   string `json:"simhash"`
+	Distance  *int   `json:"distance"`
+}
+
+// Changes answers /changes with the captures of a year that changed
+// significantly from the capture before
+type Changes struct {
+	URL       string `json:"url"`
+	Year      string `json:"year"`
+	Size      int    `json:"size"`
+	Threshold int    `json:"threshold"`
+	// Captures is the number of captures of the year compared
+	Captures int             `json:"captures"`
+	Changes  []TimelinePoint `json:"changes"`
+}
+
+// Story answers /export/story with how a page changed over a year, for
+// readers who document its history: Summary narrates the year, Eras group
+// its captures and Changes are the captures that changed most from the
+// capture before
+type Story struct {
+	URL       string         `json:"url"`
+	Year      string         `json:"year"`
+	Size      int            `json:"size"`
+	Distance  int            `json:"distance"`
+	Threshold int            `json:"threshold"`
+	Captures  int            `json:"captures"`
+	Summary   string         `json:"summary"`
+	Eras      []analysis.Era `json:"eras"`
+	Changes   []StoryChange  `json:"changes"`
+}
+
+// StoryChange is one change of a Story with links to both captures in the
+// archive. EraStart marks changes starting an era. Words lists the words
+// gaining or losing the most weight, when features are stored.
+type StoryChange struct {
+	From       string       `json:"from"`
+	To         string       `json:"to"`
+	Distance   int          `json:"distance"`
+	Similarity float64      `json:"similarity"`
+	Label      string       `json:"label"`
+	EraStart   bool         `json:"era_start,omitempty"`
+	FromLink   string       `json:"from_link"`
+	ToLink     string       `json:"to_link"`
+	Words      *WordChanges `json:"words,omitempty"`
+	Summary    string       `json:"summary"`
+}
+
+// Exists answers /exists. Status is "processed" when the hash of the
+// capture is stored, "archived" when the archive has the capture but it
+// is not processed yet and "not_archived" when the archive does not have it.
+type Exists struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"`
+	// Closest is the timestamp of the archive's capture nearest to the one
+	// asked for, when the archive reports one
+	Closest string `json:"closest,omitempty"`
+}
+
+// CaptureRetry answers POST /captures/retry. Status is hashed, or stored
+// when the hash was stored before the retry.
+type CaptureRetry struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"`
+	SimHash   string `json:"simhash"`
+}
+
+// Nearest answers /nearest with the capture most similar to the reference
+type Nearest struct {
+	URL       string           `json:"url"`
+	Reference NearestReference `json:"reference"`
+	Timestamp string           `json:"timestamp"`
+	SimHash   string           `json:"simhash"`
+	Distance  int              `json:"distance"`
+	Size      int              `json:"size"`
+}
+
+// NearestReference is the capture or hash /nearest compared with
+type NearestReference struct {
+	Timestamp string `json:"timestamp,omitempty"`
+	SimHash   string `json:"simhash"`
+}
+
+// Eras answers /analyze/eras
+type Eras struct {
+	URL      string         `json:"url"`
+	Distance int            `json:"distance"`
+	Size     int            `json:"size"`
+	Captures int            `json:"captures"`
+	Eras     []analysis.Era `json:"eras"`
+	// ComputedAt is when the eras were grouped from the stored captures
+	ComputedAt string `json:"computed_at"`
+	// Excluded is the number of excluded captures left out
+	Excluded int `json:"excluded,omitempty"`
+}
+
+// Anomalies answers /analyze/anomalies
+type Anomalies struct {
+	URL         string             `json:"url"`
+	Window      int                `json:"window"`
+	Sensitivity float64            `json:"sensitivity"`
+	Captures    int                `json:"captures"`
+	Anomalies   []analysis.Anomaly `json:"anomalies"`
+	// Excluded is the number of excluded captures left out
+	Excluded int `json:"excluded,omitempty"`
+}
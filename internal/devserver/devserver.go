@@ -0,0 +1,188 @@
+// Package devserver is a stand-in for a Wayback Machine style archive. It
+// answers CDX queries and replays captures from a directory of fixtures so
+// the whole pipeline can run offline.
+//
+// Fixtures are laid out as <host>/<timestamp>.html. Hosts without a
+// directory of their own are served the captures of _default.
+package devserver
+
+import (
+	"crypto/sha1"
+	"embed"
+	"encoding/base32"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultSite holds the captures of hosts without fixtures of their own
+const defaultSite = "_default"
+
+//go:embed all:testdata
+var testdata embed.FS
+
+// Fixtures returns the fixtures built into the binary
+func Fixtures() fs.FS {
+	sub, _ := fs.Sub(testdata, "testdata")
+	return sub
+}
+
+// Server serves the CDX API under /cdx and replays under /web
+type Server struct {
+	fixtures fs.FS
+}
+
+// New returns a server for the fixtures in fsys
+func New(fsys fs.FS) *Server {
+	return &Server{fixtures: fsys}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/cdx":
+		s.serveCDX(w, r)
+	case strings.HasPrefix(r.URL.Path, "/web/"):
+		s.serveReplay(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// cdxFields are the columns of a CDX row, in the order of the real API
+var cdxFields = []string{"urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length"}
+
+// serveCDX answers a query in the rows dialect. It understands the from,
+// to, fl, collapse=timestamp:N and limit parameters.
+func (s *Server) serveCDX(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target := q.Get("url")
+	site, timestamps := s.captures(target)
+
+	from, to := q.Get("from"), q.Get("to")
+	collapse := 0
+	if c := strings.TrimPrefix(q.Get("collapse"), "timestamp:"); c != q.Get("collapse") {
+		collapse, _ = strconv.Atoi(c)
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	fields := cdxFields
+	if fl := q.Get("fl"); fl != "" {
+		fields = strings.Split(fl, ",")
+	}
+
+	rows := [][]string{fields}
+	seen := map[string]bool{}
+	for _, ts := range timestamps {
+		if from != "" && ts < pad(from, '0') || to != "" && ts > pad(to, '9') {
+			continue
+		}
+		if collapse > 0 && collapse <= len(ts) {
+			if seen[ts[:collapse]] {
+				continue
+			}
+			seen[ts[:collapse]] = true
+		}
+		if limit > 0 && len(rows) > limit {
+			break
+		}
+
+		values := map[string]string{
+			"urlkey":     strings.ToLower(hostOf(target)),
+			"timestamp":  ts,
+			"original":   target,
+			"mimetype":   "text/html",
+			"statuscode": "200",
+			"digest":     s.digest(site, ts),
+			"length":     "0",
+		}
+		row := make([]string, len(fields))
+		for i, f := range fields {
+			row[i] = values[f]
+		}
+		rows = append(rows, row)
+	}
+
+	// The real API answers an empty array when nothing matches
+	if len(rows) == 1 {
+		rows = [][]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+// serveReplay returns the capture named by /web/<timestamp><flags>/<url>
+func (s *Server) serveReplay(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/web/")
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	ts := strings.TrimRightFunc(rest[:i], func(c rune) bool { return c < '0' || c > '9' })
+	target := rest[i+1:]
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	site, _ := s.captures(target)
+	body, err := fs.ReadFile(s.fixtures, site+"/"+ts+".html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
+
+// captures returns the fixture directory serving target and its capture
+// timestamps in order
+func (s *Server) captures(target string) (string, []string) {
+	site := strings.TrimPrefix(strings.ToLower(hostOf(target)), "www.")
+	entries, err := fs.ReadDir(s.fixtures, site)
+	if site == "" || err != nil {
+		site = defaultSite
+		entries, _ = fs.ReadDir(s.fixtures, site)
+	}
+
+	var timestamps []string
+	for _, e := range entries {
+		if ts := strings.TrimSuffix(e.Name(), ".html"); ts != e.Name() && !e.IsDir() {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	sort.Strings(timestamps)
+	return site, timestamps
+}
+
+// digest is the base32 SHA-1 of a fixture, as the real CDX API reports it
+func (s *Server) digest(site, ts string) string {
+	body, err := fs.ReadFile(s.fixtures, site+"/"+ts+".html")
+	if err != nil {
+		return "-"
+	}
+	sum := sha1.Sum(body)
+	return base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func hostOf(target string) string {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// pad extends a partial timestamp such as a year to 14 digits
+func pad(ts string, digit byte) string {
+	for len(ts) < 14 {
+		ts += string(digit)
+	}
+	return ts
+}
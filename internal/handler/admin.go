@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+)
+
+// RequireAdmin rejects requests that do not carry the configured admin
+// token, either as a bearer token or in the X-Admin-Token header. Admin
+// routes are disabled entirely when no token is configured.
+func (h *Handler) RequireAdmin(c *gin.Context) {
+	expected := config.AppConfig.Admin.Token
+	if expected == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, api.NewError("Admin API is disabled"))
+		return
+	}
+
+	token := c.GetHeader("X-Admin-Token")
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewError("Invalid admin token"))
+		return
+	}
+	c.Next()
+}
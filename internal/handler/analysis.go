@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/analysis"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// Trend reports per-month capture counts and average distance between
+// consecutive captures of a URL over years=2015-2020 (or a single year)
+func (h *Handler) Trend(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	from, to, err := parseYears(c.Query("years"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid years, expected YYYY or YYYY-YYYY"))
+		return
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	stored, excluded, err := listAnalyzed(c.Request.Context(), store, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	// The capture preceding the range seeds the first month's comparison
+	captures, found := inYears(stored, from, to, 1)
+	if found == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	months := []analysis.Month{}
+	for _, month := range analysis.Trend(captures) {
+		if year, _ := strconv.Atoi(month.Month[:4]); year >= from && year <= to {
+			months = append(months, month)
+		}
+	}
+	if c.Query("years") == "" {
+		from, _ = strconv.Atoi(months[0].Month[:4])
+		to, _ = strconv.Atoi(months[len(months)-1].Month[:4])
+	}
+	c.JSON(http.StatusOK, api.Trend{
+		URL:      url,
+		From:     from,
+		To:       to,
+		Size:     worker.BitSize(size),
+		Months:   months,
+		Excluded: excluded,
+	})
+}
+
+// parseYears reads an inclusive YYYY-YYYY range or a single YYYY. An empty
+// range covers every year.
+func parseYears(s string) (int, int, error) {
+	if s == "" {
+		return 0, 9999, nil
+	}
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	from, err := strconv.Atoi(first)
+	if err != nil || len(first) != 4 {
+		return 0, 0, fmt.Errorf("invalid year: %s", first)
+	}
+	to, err := strconv.Atoi(last)
+	if err != nil || len(last) != 4 {
+		return 0, 0, fmt.Errorf("invalid year: %s", last)
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("years out of order: %s", s)
+	}
+	return from, to, nil
+}
+
+// inYears returns the captures, in timestamp order, taken between the from
+// and to years inclusive, plus up to margin captures on either side so
+// comparisons at the range edges read across year boundaries. found is
+// the number of captures within the range itself.
+func inYears(captures []storage.Capture, from, to, margin int) (kept []storage.Capture, found int) {
+	first, last := -1, -1
+	for i, capture := range captures {
+		if !inRange(capture.Timestamp, from, to) {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		found++
+	}
+	if found == 0 {
+		return nil, 0
+	}
+
+	start, end := first-margin, last+margin+1
+	if start < 0 {
+		start = 0
+	}
+	if end > len(captures) {
+		end = len(captures)
+	}
+	return captures[start:end], found
+}
+
+// inRange reports whether timestamp falls between the from and to years
+func inRange(timestamp string, from, to int) bool {
+	year, err := strconv.Atoi(ts.Year(timestamp))
+	return err == nil && year >= from && year <= to
+}
+
+// Anomalies flags captures of a URL whose distance to the previous capture
+// is a statistical outlier. sensitivity is the z-score threshold (default
+// 3, lower flags more) and window the number of surrounding pairs each
+// capture is scored against (default 10).
+func (h *Handler) Anomalies(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	from, to, err := parseYears(c.Query("years"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid years, expected YYYY or YYYY-YYYY"))
+		return
+	}
+
+	sensitivity := 3.0
+	if s := c.Query("sensitivity"); s != "" {
+		if sensitivity, err = strconv.ParseFloat(s, 64); err != nil || sensitivity <= 0 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid sensitivity"))
+			return
+		}
+	}
+	window := 10
+	if s := c.Query("window"); s != "" {
+		if window, err = strconv.Atoi(s); err != nil || window < 2 || window > 1000 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid window, expected 2 to 1000"))
+			return
+		}
+	}
+	store, _, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	stored, excluded, err := listAnalyzed(c.Request.Context(), store, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	// Score edge captures against neighbours from adjacent years too
+	captures, found := inYears(stored, from, to, window/2+1)
+	if found == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	anomalies := []analysis.Anomaly{}
+	for _, anomaly := range analysis.Anomalies(captures, window, sensitivity) {
+		if inRange(anomaly.Timestamp, from, to) {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	c.JSON(http.StatusOK, api.Anomalies{
+		URL:         url,
+		Window:      window,
+		Sensitivity: sensitivity,
+		Captures:    found,
+		Anomalies:   anomalies,
+		Excluded:    excluded,
+	})
+}
+
+// Eras groups the captures of a URL into eras of about the same content: a
+// capture more than distance bits (default config.analysis.eras.distance)
+// from the first capture of the current era starts a new one. Eras are
+// served from storage unless refresh=1; years= keeps the eras overlapping
+// the range and after= those starting after a timestamp, which is how a
+// client jumps to the next meaningful version.
+func (h *Handler) Eras(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	from, to, err := parseYears(c.Query("years"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid years, expected YYYY or YYYY-YYYY"))
+		return
+	}
+	var after string
+	if s := c.Query("after"); s != "" {
+		if after, _, err = ts.Normalize(s); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+			return
+		}
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+	distance := worker.EraDistance()
+	if s := c.Query("distance"); s != "" {
+		if distance, err = strconv.Atoi(s); err != nil || distance < 0 || distance > worker.BitSize(size) {
+			c.JSON(http.StatusBadRequest, api.NewError(fmt.Sprintf("Invalid distance, expected 0 to %d", worker.BitSize(size))))
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	var set worker.EraSet
+	computedAt, err := store.Eras(ctx, url, distance, &set)
+	if err == storage.ErrNotFound || c.Query("refresh") == "1" {
+		set, err = worker.RefreshEras(ctx, store, url, distance)
+		computedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if len(set.Eras) == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	eras := []analysis.Era{}
+	for _, era := range set.Eras {
+		end := era.Until
+		if end == "" {
+			end = era.End
+		}
+		if inRange(era.Start, 0, to) && inRange(end, from, 9999) && era.Start > after {
+			eras = append(eras, era)
+		}
+	}
+	c.JSON(http.StatusOK, api.Eras{
+		URL:        url,
+		Distance:   distance,
+		Size:       worker.BitSize(size),
+		Captures:   set.Captures,
+		Eras:       eras,
+		ComputedAt: computedAt.Format(time.RFC3339),
+		Excluded:   set.Excluded,
+	})
+}
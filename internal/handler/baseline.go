@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// GetBaseline returns the baseline capture pinned for a URL
+func (h *Handler) GetBaseline(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+	store := h.store.WithArchive(name)
+
+	timestamp, err := store.Baseline(c.Request.Context(), url)
+	if err == storage.ErrNotFound {
+		c.JSON(http.StatusNotFound, api.NewError("BASELINE_NOT_SET"))
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, api.Baseline{URL: url, Timestamp: timestamp})
+}
+
+// SetBaseline pins a stored capture as the baseline of its URL, replacing
+// any earlier baseline
+func (h *Handler) SetBaseline(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+	store := h.store.WithArchive(name)
+	timestamp, _, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	exists, err := store.HasSimHash(ctx, url, timestamp)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND"))
+		return
+	}
+
+	if err := store.SetBaseline(ctx, url, timestamp); err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, api.Baseline{URL: url, Timestamp: timestamp})
+}
+
+// DeleteBaseline unpins the baseline of a URL
+func (h *Handler) DeleteBaseline(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+	store := h.store.WithArchive(name)
+
+	removed, err := store.DeleteBaseline(c.Request.Context(), url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, api.NewError("BASELINE_NOT_SET"))
+		return
+	}
+	c.JSON(http.StatusOK, api.Purged{Status: api.StatusDeleted, URL: url, Removed: 1})
+}
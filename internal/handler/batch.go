@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/surt"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/urlnorm"
+)
+
+// maxBatchSize bounds the captures looked up by one /simhash/batch call
+const maxBatchSize = 500
+
+// batchCapture is one requested capture of POST /simhash/batch
+type batchCapture struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+}
+
+// BatchGetSimHash returns the simhashes of a list of {url, timestamp}
+// pairs in request order, of the bit size given by size=. Captures that
+// are missing or malformed are reported per item instead of failing the
+// whole batch.
+func (h *Handler) BatchGetSimHash(c *gin.Context) {
+	store, _, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+	bySURT, ok := queryKeyedBy(c)
+	if !ok {
+		return
+	}
+
+	var req []batchCapture
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Expected a JSON array of {url, timestamp} objects"))
+		return
+	}
+	if len(req) == 0 || len(req) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, api.NewError("Batch must contain between 1 and 500 captures"))
+		return
+	}
+
+	results := make([]api.BatchCapture, len(req))
+	var refs []storage.CaptureRef
+	var positions []int
+	for i, item := range req {
+		item.URL = urlnorm.Normalize(item.URL)
+		results[i] = api.BatchCapture{URL: item.URL, Timestamp: item.Timestamp}
+		if bySURT && item.URL != "" {
+			results[i].URLKey = surt.Key(item.URL)
+		}
+		if item.URL == "" {
+			results[i].Status, results[i].Message = api.StatusError, "URL is required"
+			continue
+		}
+		normalized, _, err := ts.Normalize(item.Timestamp)
+		if err != nil {
+			results[i].Status, results[i].Message = api.StatusError, "Invalid timestamp format"
+			continue
+		}
+		results[i].Timestamp = normalized
+		refs = append(refs, storage.CaptureRef{URL: item.URL, Timestamp: normalized})
+		positions = append(positions, i)
+	}
+
+	hashes, err := store.GetSimHashes(c.Request.Context(), refs)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	found := 0
+	for j, i := range positions {
+		if hashes[j] == "" {
+			results[i].Status, results[i].Message = api.StatusError, "CAPTURE_NOT_FOUND"
+			continue
+		}
+		results[i].SimHash = hashes[j]
+		found++
+	}
+
+	respond(c, http.StatusOK, api.BatchResult{
+		Captures: results,
+		Total:    len(results),
+		Found:    found,
+	})
+}
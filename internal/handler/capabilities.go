@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/similarity"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// Capabilities describes the features and limits of this deployment
+func (h *Handler) Capabilities(c *gin.Context) {
+	cfg := config.AppConfig
+	min, max := worker.SizeRange()
+
+	caps := api.Capabilities{
+		Simhash: api.SimhashCapabilities{
+			Algorithm:      "simhash",
+			DefaultSize:    cfg.Simhash.Size,
+			MinSize:        min,
+			MaxSize:        max,
+			Metrics:        similarity.Names(),
+			FeaturesStored: cfg.Simhash.StoreFeatures,
+		},
+		Formats:      []string{"application/json", mimeMsgPack, mimeProtobuf},
+		Compression:  []string{},
+		ContentTypes: append([]string{}, worker.HTMLContentTypes()...),
+		Priorities:   append([]string{}, config.AppConfig.Queues.Priorities...),
+		Profiles:     worker.ProfileNames(),
+		Endpoints:    []string{},
+		BasePath:     config.BasePath(),
+		Limits: api.CapabilityLimits{
+			BatchSize:        maxBatchSize,
+			SnapshotsPerYear: cfg.Snapshots.NumberPerYear,
+			JobWait:          int(maxJobWait.Seconds()),
+			RequestTimeout:   cfg.HTTP.Timeout,
+		},
+		Auth: api.AuthCapabilities{
+			APIKeyRequired: len(cfg.Auth.APIKeys) > 0,
+			SignedURLs:     cfg.Signing.Secret != "",
+		},
+	}
+	if src, err := archive.FromConfig(); err == nil {
+		caps.Source = api.SourceCapabilities{Name: src.Name, CDXFormat: string(src.Format)}
+	}
+	caps.Archives = []api.SourceCapabilities{}
+	for _, name := range archive.Names() {
+		if src, err := archive.Named(name); err == nil {
+			caps.Archives = append(caps.Archives, api.SourceCapabilities{Name: src.Name, CDXFormat: string(src.Format)})
+		}
+	}
+	if cfg.HTTP.Compression.Enabled {
+		caps.Compression = append(caps.Compression, "gzip")
+	}
+	for _, ext := range cfg.Extractors {
+		caps.ContentTypes = append(caps.ContentTypes, ext.ContentType)
+	}
+
+	// Operator routes are not part of the client API
+	for _, route := range h.routes {
+		path := apiPath(route.Path)
+		if strings.HasPrefix(path, "/admin") || path == "/metrics" {
+			continue
+		}
+		caps.Endpoints = append(caps.Endpoints, route.Method+" "+path)
+	}
+	sort.Strings(caps.Endpoints)
+
+	c.JSON(http.StatusOK, caps)
+}
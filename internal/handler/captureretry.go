@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// Answers of /captures/retry
+const (
+	retryHashed = "hashed"
+	retryStored = "stored"
+)
+
+// RetryCapture serves POST /captures/retry?url=...&timestamp=..., which
+// downloads and hashes one capture while the client waits instead of
+// queueing a job for its year. size=, archive= and profile= select the
+// hashes like for /calculate-simhash. Each tenant may retry
+// config.capture_retry.inline_per_minute captures a minute.
+func (h *Handler) RetryCapture(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	timestamp, _, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+	var opts worker.JobOptions
+	if s := c.Query("size"); s != "" {
+		if opts.Size, err = strconv.Atoi(s); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid size"))
+			return
+		}
+	}
+	if opts.Size, err = worker.HashSize(opts.Size); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError(err.Error()))
+		return
+	}
+	opts.Archive = c.Query("archive")
+	if _, ok := config.AppConfig.Archives[opts.Archive]; opts.Archive != "" && !ok {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown archive"))
+		return
+	}
+	profile, ok := queryProfile(c)
+	if !ok {
+		return
+	}
+	opts.Profile = profile
+	tenant := c.GetString(tenantKey)
+	if !h.allowInlineRetry(c, tenant) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	payload := worker.SimHashPayload{URL: url, Tenant: tenant, Options: opts}
+	hashed, err := h.worker.RetryCaptureNow(ctx, payload, timestamp)
+	switch {
+	case errors.Is(err, worker.ErrNotArchived):
+		c.JSON(http.StatusNotFound, api.NewError("Capture not archived"))
+		return
+	case errors.Is(err, worker.ErrSkipCapture):
+		c.JSON(http.StatusUnprocessableEntity, api.NewError("Capture skipped by hook"))
+		return
+	case errors.Is(err, storage.ErrUnavailable):
+		internalError(c, err)
+		return
+	case err != nil:
+		logging.Warnf(logging.Worker, "retry of %s %s: %v", url, timestamp, err)
+		c.JSON(http.StatusBadGateway, api.NewError("Capture failed"))
+		return
+	}
+
+	encoded, err := h.store.WithArchive(opts.Archive).WithProfile(opts.Profile).WithSize(opts.Size).GetSimHash(ctx, url, timestamp)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	resp := api.CaptureRetry{URL: url, Timestamp: timestamp, Status: retryStored, SimHash: encoded}
+	if hashed {
+		resp.Status = retryHashed
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// allowInlineRetry counts a retry against the tenant's budget of the
+// current minute, answering 429 once it is spent
+func (h *Handler) allowInlineRetry(c *gin.Context, tenant string) bool {
+	limit := config.AppConfig.CaptureRetry.InlinePerMinute
+	if limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	key := fmt.Sprintf("ratelimit:captures-retry:%s:%d", tenant, now.Unix()/60)
+	ctx := c.Request.Context()
+	n, err := h.redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+	if n == 1 {
+		h.redisClient.Expire(ctx, key, 2*time.Minute)
+	}
+	if n > int64(limit) {
+		c.Header("Retry-After", strconv.FormatInt(60-now.Unix()%60, 10))
+		c.JSON(http.StatusTooManyRequests, api.NewError("Retry limit reached, retry later"))
+		return false
+	}
+	return true
+}
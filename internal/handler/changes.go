@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// defaultChangeThreshold is the /changes threshold when
+// config.analysis.changes.threshold is unset
+const defaultChangeThreshold = 8
+
+// Changes serves /changes?url=...&year=..., the captures of a year more
+// than threshold bits (default config.analysis.changes.threshold) from
+// the capture before them, so that clients can jump to meaningful
+// revisions. The first capture of a year is compared with the last one of
+// an earlier year; excluded captures are passed over.
+func (h *Handler) Changes(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	year := c.Query("year")
+	n, err := strconv.Atoi(year)
+	if err != nil || len(year) != 4 {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+		return
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+	threshold := config.AppConfig.Analysis.Changes.Threshold
+	if threshold <= 0 {
+		threshold = defaultChangeThreshold
+	}
+	if s := c.Query("threshold"); s != "" {
+		if threshold, err = strconv.Atoi(s); err != nil || threshold < 0 || threshold > worker.BitSize(size) {
+			c.JSON(http.StatusBadRequest, api.NewError(fmt.Sprintf("Invalid threshold, expected 0 to %d", worker.BitSize(size))))
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	captures, found := inYears(storage.WithoutExcluded(stored, exclusions), n, n, 1)
+	if found == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	changes := []api.TimelinePoint{}
+	for _, point := range timelinePoints(captures, n) {
+		if point.Distance != nil && *point.Distance > threshold {
+			changes = append(changes, point)
+		}
+	}
+	respond(c, http.StatusOK, api.Changes{
+		URL:       url,
+		Year:      year,
+		Size:      worker.BitSize(size),
+		Threshold: threshold,
+		Captures:  found,
+		Changes:   changes,
+	})
+}
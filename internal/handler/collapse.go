@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+)
+
+// collapser lets identical job submissions share one enqueue: callers of
+// do with the same key while a call is running, or within
+// config.queues.collapse_window after it succeeded, get its result instead
+// of running their own
+type collapser struct {
+	mu    sync.Mutex
+	calls map[string]*collapsedCall
+}
+
+// errCallPanicked is what waiters get when the call they share panicked
+var errCallPanicked = errors.New("collapsed call panicked")
+
+type collapsedCall struct {
+	done chan struct{}
+	resp api.JobCreated
+	err  error
+}
+
+// do runs fn for key unless a call for key is running or recently
+// succeeded. shared reports whether resp came from another caller's call.
+func (s *collapser) do(key string, fn func() (api.JobCreated, error)) (resp api.JobCreated, shared bool, err error) {
+	window := time.Duration(config.AppConfig.Queues.CollapseWindow) * time.Second
+	if window <= 0 {
+		resp, err = fn()
+		return resp, false, err
+	}
+
+	s.mu.Lock()
+	if call, ok := s.calls[key]; ok {
+		s.mu.Unlock()
+		<-call.done
+		return call.resp, true, call.err
+	}
+	if s.calls == nil {
+		s.calls = map[string]*collapsedCall{}
+	}
+	call := &collapsedCall{done: make(chan struct{}), err: errCallPanicked}
+	s.calls[key] = call
+	s.mu.Unlock()
+
+	forget := func() {
+		s.mu.Lock()
+		if s.calls[key] == call {
+			delete(s.calls, key)
+		}
+		s.mu.Unlock()
+	}
+	// Waiters are released even when fn panics; failures are not
+	// remembered so the next caller tries again
+	defer func() {
+		close(call.done)
+		if call.err != nil {
+			forget()
+		} else {
+			time.AfterFunc(window, forget)
+		}
+	}()
+
+	call.resp, call.err = fn()
+	return call.resp, false, call.err
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+)
+
+func withCollapseWindow(t *testing.T, seconds int) {
+	t.Helper()
+	saved := config.AppConfig.Queues.CollapseWindow
+	config.AppConfig.Queues.CollapseWindow = seconds
+	t.Cleanup(func() { config.AppConfig.Queues.CollapseWindow = saved })
+}
+
+func TestCollapserSharesConcurrentCalls(t *testing.T) {
+	withCollapseWindow(t, 60)
+	var s collapser
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (api.JobCreated, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return api.JobCreated{Status: api.StatusStarted, JobID: "job-1"}, nil
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	ids := make([]string, n)
+	owners := int32(0)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, shared, err := s.do("key", fn)
+			if err != nil {
+				t.Errorf("do: %v", err)
+			}
+			if !shared {
+				atomic.AddInt32(&owners, 1)
+			}
+			ids[i] = resp.JobID
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	if owners != 1 {
+		t.Errorf("%d callers ran their own call, want 1", owners)
+	}
+	for i, id := range ids {
+		if id != "job-1" {
+			t.Errorf("caller %d got job_id %q, want job-1", i, id)
+		}
+	}
+}
+
+func TestCollapserReleasesWaitersOnPanic(t *testing.T) {
+	withCollapseWindow(t, 60)
+	var s collapser
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		s.do("key", func() (api.JobCreated, error) {
+			close(started)
+			<-release
+			panic("enqueue failed")
+		})
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, _, err := s.do("key", func() (api.JobCreated, error) {
+			return api.JobCreated{JobID: "job-2"}, nil
+		})
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Error("waiter of a panicked call got no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still blocked after the call panicked")
+	}
+
+	resp, shared, err := s.do("key", func() (api.JobCreated, error) {
+		return api.JobCreated{JobID: "job-3"}, nil
+	})
+	if err != nil || shared || resp.JobID != "job-3" {
+		t.Errorf("after a panic got %+v, shared %v, err %v; want a fresh call", resp, shared, err)
+	}
+}
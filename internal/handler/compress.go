@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+)
+
+// defaultCompressTypes are compressed when config.http.compression lists none
+var defaultCompressTypes = []string{"application/json", "application/x-ndjson", "text/plain"}
+
+// Compress gzips responses for clients sending Accept-Encoding: gzip. Bodies
+// are buffered up to config.http.compression.min_size bytes; smaller ones and
+// content types not listed in content_types are sent as is.
+func Compress(c *gin.Context) {
+	cfg := config.AppConfig.HTTP.Compression
+	if !cfg.Enabled || c.Request.Method == http.MethodHead ||
+		!strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+		c.Next()
+		return
+	}
+
+	types := cfg.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	w := &gzipWriter{ResponseWriter: c.Writer, minSize: cfg.MinSize, types: types}
+	c.Writer = w
+	defer w.finish()
+	c.Next()
+}
+
+// gzipWriter holds back the start of a response until it knows whether the
+// body is large enough to compress
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	types   []string
+	buf     bytes.Buffer
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		return w.write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what is buffered so far, compressed if it qualifies
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide(w.buf.Len() >= w.minSize)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide picks the encoding and writes out the buffered start of the body
+func (w *gzipWriter) decide(largeEnough bool) error {
+	w.decided = true
+	header := w.Header()
+	if largeEnough && header.Get("Content-Encoding") == "" && w.compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", "gzip")
+		header.Add("Vary", "Accept-Encoding")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *gzipWriter) write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range w.types {
+		if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish flushes a body that stayed below the minimum size and closes the
+// gzip stream
+func (w *gzipWriter) finish() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/similarity"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// Diff compares two stored captures of a URL, from and to, also accepted
+// as timestamp_a and timestamp_b. Without from, to is compared with the
+// capture preceding it, even when that falls in an earlier year, passing
+// over excluded captures.
+// With normalize=1 the Hamming distance is also reported as a [0,1]
+// similarity and a label; metric= selects another similarity measure and
+// words=1 lists the words that changed, from stored features.
+func (h *Handler) Diff(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+
+	to, _, err := ts.Normalize(queryEither(c, "to", "timestamp_b"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid to timestamp"))
+		return
+	}
+
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	var from string
+	if raw := queryEither(c, "from", "timestamp_a"); raw != "" {
+		if from, _, err = ts.Normalize(raw); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid from timestamp"))
+			return
+		}
+	} else {
+		// Compare with the closest preceding capture not excluded
+		ctx := c.Request.Context()
+		exclusions, err := store.Exclusions(ctx, url)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		for from = to; ; {
+			previous, err := store.LatestBefore(ctx, url, from)
+			if err == storage.ErrNotFound {
+				c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND"))
+				return
+			}
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			from = previous.Timestamp
+			if _, excluded := exclusions[from]; !excluded {
+				break
+			}
+		}
+	}
+
+	h.compare(c, store, url, from, to, size)
+}
+
+// compare answers a diff between the from and to captures of url, scored
+// with the metric= similarity metric
+func (h *Handler) compare(c *gin.Context, store *storage.Store, url, from, to string, size int) {
+	if diff, ok := h.diffCaptures(c, store, url, from, to, size); ok {
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+// diffCaptures compares the from and to captures of url as compare does,
+// answering the request itself when they cannot be compared
+func (h *Handler) diffCaptures(c *gin.Context, store *storage.Store, url, from, to string, size int) (api.Diff, bool) {
+	name := c.DefaultQuery("metric", similarity.Default)
+	metric, ok := similarity.Lookup(name)
+	if !ok {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown metric; expected one of "+strings.Join(similarity.Names(), ", ")))
+		return api.Diff{}, false
+	}
+
+	ctx := c.Request.Context()
+	captures := make([]similarity.Capture, 2)
+	for i, timestamp := range []string{from, to} {
+		encoded, err := store.GetSimHash(ctx, url, timestamp)
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND"))
+			return api.Diff{}, false
+		}
+		if err != nil {
+			internalError(c, err)
+			return api.Diff{}, false
+		}
+		if captures[i].Hash, err = simhash.DecodeSimHash(encoded); err != nil {
+			internalError(c, err)
+			return api.Diff{}, false
+		}
+		if metric.NeedsFeatures() {
+			captures[i].Features, err = store.GetFeatures(ctx, url, timestamp)
+			if err == storage.ErrNotFound {
+				c.JSON(http.StatusNotFound, api.NewError("FEATURES_NOT_STORED"))
+				return api.Diff{}, false
+			}
+			if err != nil {
+				internalError(c, err)
+				return api.Diff{}, false
+			}
+		}
+	}
+
+	bits := worker.BitSize(size)
+	diff := api.Diff{
+		URL:      url,
+		From:     from,
+		To:       to,
+		Distance: simhash.Distance(captures[0].Hash, captures[1].Hash),
+		Size:     bits,
+	}
+	if c.Query("normalize") == "1" || name != similarity.Default {
+		score, err := metric.Similarity(captures[0], captures[1], bits)
+		if err != nil {
+			internalError(c, err)
+			return api.Diff{}, false
+		}
+		diff.Metric = name
+		diff.Similarity = &score
+		diff.Label = similarityLabel(score)
+	}
+
+	if c.Query("words") == "1" {
+		changes, err := store.FeatureChanges(ctx, url, from, to)
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, api.NewError("FEATURES_NOT_STORED"))
+			return api.Diff{}, false
+		}
+		if err != nil {
+			internalError(c, err)
+			return api.Diff{}, false
+		}
+		diff.Words = &api.WordChanges{Added: map[string]int{}, Removed: map[string]int{}}
+		for word, d := range changes {
+			if d > 0 {
+				diff.Words.Added[word] = d
+			} else {
+				diff.Words.Removed[word] = -d
+			}
+		}
+	}
+	return diff, true
+}
+
+// queryEither returns query parameter name, or alias when name is unset
+func queryEither(c *gin.Context, name, alias string) string {
+	if v := c.Query(name); v != "" {
+		return v
+	}
+	return c.Query(alias)
+}
+
+// DiffBaseline compares a capture of a URL with the baseline pinned for it
+func (h *Handler) DiffBaseline(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	to, _, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	baseline, err := store.Baseline(c.Request.Context(), url)
+	if err == storage.ErrNotFound {
+		c.JSON(http.StatusNotFound, api.NewError("BASELINE_NOT_SET"))
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	h.compare(c, store, url, baseline, to, size)
+}
+
+// GetCaptureBefore returns the latest capture of a URL taken before
+// timestamp, regardless of year
+func (h *Handler) GetCaptureBefore(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	timestamp, _, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+	store, _, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	capture, err := store.LatestBefore(c.Request.Context(), url, timestamp)
+	if err == storage.ErrNotFound {
+		c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND"))
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	expires, err := expiresAt(c.Request.Context(), store, url, capture.Timestamp)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, api.Capture{URL: url, Timestamp: capture.Timestamp, SimHash: capture.SimHash, ExpiresAt: expires})
+}
+
+// expiresAt formats when a capture expires, "" when it does not
+func expiresAt(ctx context.Context, store *storage.Store, url, timestamp string) (string, error) {
+	at, err := store.ExpiresAt(ctx, url, timestamp)
+	if err != nil || at.IsZero() {
+		return "", err
+	}
+	return at.Format(time.RFC3339), nil
+}
+
+// similarityLabel buckets a normalized similarity by the configured
+// config.diff.thresholds
+func similarityLabel(similarity float64) string {
+	t := config.AppConfig.Diff.Thresholds
+	identical, near, changed := t.Identical, t.NearDuplicate, t.Changed
+	if identical == 0 {
+		identical = 1
+	}
+	if near == 0 {
+		near = 0.9
+	}
+	if changed == 0 {
+		changed = 0.6
+	}
+
+	switch {
+	case similarity >= identical:
+		return api.LabelIdentical
+	case similarity >= near:
+		return api.LabelNearDuplicate
+	case similarity >= changed:
+		return api.LabelChanged
+	default:
+		return api.LabelVeryDifferent
+	}
+}
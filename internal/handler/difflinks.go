@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/urlnorm"
+)
+
+// maxDiffNameLength bounds the name and creator of a diff permalink
+const maxDiffNameLength = 200
+
+// CreateDiffLink records a diff under a permalink for citing it. The JSON
+// body names the comparison, e.g. {"url": "example.com", "from":
+// "20190101000000", "to": "20200101000000", "name": "Redesign", "creator":
+// "J. Doe"}; archive=, size=, metric= and normalize=1 apply as for /diff.
+// The creator defaults to the caller's tenant.
+func (h *Handler) CreateDiffLink(c *gin.Context) {
+	var req struct {
+		URL     string `json:"url"`
+		From    string `json:"from"`
+		To      string `json:"to"`
+		Name    string `json:"name"`
+		Creator string `json:"creator"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid request body"))
+		return
+	}
+	req.URL = urlnorm.Normalize(req.URL)
+	if req.URL == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	req.Name, req.Creator = strings.TrimSpace(req.Name), strings.TrimSpace(req.Creator)
+	if req.Name == "" || len(req.Name) > maxDiffNameLength || len(req.Creator) > maxDiffNameLength {
+		c.JSON(http.StatusBadRequest, api.NewError("A name of at most 200 bytes is required"))
+		return
+	}
+	if req.Creator == "" {
+		req.Creator = c.GetString(tenantKey)
+	}
+	from, _, err := ts.Normalize(req.From)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid from timestamp"))
+		return
+	}
+	to, _, err := ts.Normalize(req.To)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid to timestamp"))
+		return
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	diff, ok := h.diffCaptures(c, store, req.URL, from, to, size)
+	if !ok {
+		return
+	}
+	id := uuid.New().String()
+	link := api.DiffLink{
+		ID:      id,
+		Name:    req.Name,
+		Creator: req.Creator,
+		Archive: c.Query("archive"),
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Link:    config.PublicLink("/diffs/" + id),
+		Diff:    diff,
+	}
+	if err := h.store.SaveDiffLink(c.Request.Context(), id, link); err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, link)
+}
+
+// GetDiffLink returns the diff recorded under a permalink
+func (h *Handler) GetDiffLink(c *gin.Context) {
+	var link api.DiffLink
+	err := h.store.DiffLink(c.Request.Context(), c.Param("id"), &link)
+	if err == storage.ErrNotFound {
+		c.JSON(http.StatusNotFound, api.NewError("DIFF_NOT_FOUND"))
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, link)
+}
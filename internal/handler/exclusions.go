@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// maxReasonLength bounds the reason recorded with an exclusion
+const maxReasonLength = 1000
+
+// GetExclusions lists the captures of a URL excluded from analyses
+func (h *Handler) GetExclusions(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+
+	exclusions, err := h.store.WithArchive(name).Exclusions(c.Request.Context(), url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	resp := api.Exclusions{URL: url, Exclusions: make([]api.Exclusion, 0, len(exclusions))}
+	for timestamp, e := range exclusions {
+		resp.Exclusions = append(resp.Exclusions, exclusionBody(timestamp, e))
+	}
+	sort.Slice(resp.Exclusions, func(i, j int) bool {
+		return resp.Exclusions[i].Timestamp < resp.Exclusions[j].Timestamp
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
+// PutExclusion excludes a capture of a URL from analyses, dropping the
+// eras grouped with it. The JSON body
+// carries the reason, e.g. {"reason": "defacement under investigation"}.
+// Captures not calculated yet may be excluded ahead of time.
+func (h *Handler) PutExclusion(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+	timestamp, _, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid request body"))
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Reason) > maxReasonLength {
+		c.JSON(http.StatusBadRequest, api.NewError("A reason of at most 1000 bytes is required"))
+		return
+	}
+
+	store := h.store.WithArchive(name)
+	e, err := store.ExcludeCapture(c.Request.Context(), url, timestamp, req.Reason)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if err := store.DeleteEras(c.Request.Context(), url); err != nil {
+		internalError(c, err)
+		return
+	}
+	body := exclusionBody(timestamp, e)
+	body.URL = url
+	c.JSON(http.StatusOK, body)
+}
+
+// DeleteExclusion returns an excluded capture to analyses
+func (h *Handler) DeleteExclusion(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+	timestamp, _, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+
+	store := h.store.WithArchive(name)
+	removed, err := store.IncludeCapture(c.Request.Context(), url, timestamp)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if err := store.DeleteEras(c.Request.Context(), url); err != nil {
+		internalError(c, err)
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, api.NewError("EXCLUSION_NOT_FOUND"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func exclusionBody(timestamp string, e storage.Exclusion) api.Exclusion {
+	return api.Exclusion{Timestamp: timestamp, Reason: e.Reason, At: e.At.Format(time.RFC3339)}
+}
+
+// listAnalyzed returns the stored captures of url analyses work on: all
+// but the excluded ones. excluded is the number left out.
+func listAnalyzed(ctx context.Context, store *storage.Store, url string) (captures []storage.Capture, excluded int, err error) {
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	captures = storage.WithoutExcluded(stored, exclusions)
+	return captures, len(stored) - len(captures), nil
+}
+
+// excludedReasons maps the timestamps of the excluded captures among
+// captures to their reasons, for flagging them in listings
+func excludedReasons(captures []storage.Capture, exclusions map[string]storage.Exclusion) map[string]string {
+	var reasons map[string]string
+	for _, c := range captures {
+		if e, ok := exclusions[c.Timestamp]; ok {
+			if reasons == nil {
+				reasons = map[string]string{}
+			}
+			reasons[c.Timestamp] = e.Reason
+		}
+	}
+	return reasons
+}
+
+// ofYear returns the captures of captures taken in year
+func ofYear(captures []storage.Capture, year string) []storage.Capture {
+	var in []storage.Capture
+	for _, c := range captures {
+		if ts.Year(c.Timestamp) == year {
+			in = append(in, c)
+		}
+	}
+	return in
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/dnscache"
+	"wayback-discover-diff/pkg/logging"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/transport"
+)
+
+// Answers of /exists
+const (
+	existsProcessed   = "processed"
+	existsArchived    = "archived"
+	existsNotArchived = "not_archived"
+)
+
+// newArchiveClient is the HTTP client of archive lookups, configured
+// like the worker's CDX client
+func newArchiveClient() *http.Client {
+	var dial transport.DialFunc
+	if resolver, err := dnscache.FromConfig(); err == nil {
+		dial = resolver.DialContext
+	}
+	client, err := transport.NewClient(dial, config.AppConfig.Transport.CDX)
+	if err != nil {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	return client
+}
+
+// Exists serves /exists?url=...&timestamp=..., telling a capture whose
+// hash is stored from one the archive has but that is not processed yet,
+// and from one the archive never took. Storage is checked first; the
+// archive is asked through its Availability API, or its CDX server when it
+// has none. A shortened timestamp matches any capture it prefixes.
+func (h *Handler) Exists(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	timestamp, precision, err := ts.Normalize(c.Query("timestamp"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+		return
+	}
+	store, _, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	resp := api.Exists{URL: url, Timestamp: timestamp}
+	found, err := store.HasSimHash(c.Request.Context(), url, timestamp)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if found {
+		resp.Status, resp.Closest = existsProcessed, timestamp
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	src, err := archive.Named(c.Query("archive"))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	closest, err := h.archivedCapture(c.Request.Context(), src, url, timestamp[:precision])
+	if err != nil {
+		logging.Warnf(logging.Downloader, "availability of %s %s: %v", url, timestamp, err)
+		c.JSON(http.StatusBadGateway, api.NewError("Archive unavailable"))
+		return
+	}
+	resp.Status = existsNotArchived
+	if len(closest) >= precision && closest[:precision] == timestamp[:precision] {
+		resp.Status = existsArchived
+	}
+	resp.Closest = closest
+	c.JSON(http.StatusOK, resp)
+}
+
+// archivedCapture returns the timestamp of the capture of url the archive
+// holds closest to prefix, "" when it has none. Without an Availability API
+// only captures within prefix are found.
+func (h *Handler) archivedCapture(ctx context.Context, src archive.Source, url, prefix string) (string, error) {
+	query := src.AvailabilityQuery(url, prefix)
+	if query == "" {
+		query = src.CDXQuery(url, prefix, prefix)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, query, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := h.archiveClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if src.AvailabilityURL != "" {
+		return archive.ParseAvailability(resp.Body)
+	}
+	captures, err := src.ParseCaptures(resp.Body)
+	if err == archive.ErrNoSnapshots || (err == nil && len(captures) == 0) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return captures[0].Timestamp, nil
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// Columns of capture listing rows selectable with fields=
+const (
+	fieldURLKey    = "url_key"
+	fieldTimestamp = "timestamp"
+	fieldSimHash   = "simhash"
+	// fieldDistance is the distance to the capture listed before
+	fieldDistance = "distance"
+)
+
+// rowFields are the columns of capture listing rows, in order
+type rowFields []string
+
+// queryFields reads fields=, a comma-separated list of url_key, timestamp,
+// simhash and distance, answering 400 for other names. Without it rows
+// are [timestamp, simhash], led by url_key with keyed_by=surt, and
+// selected is false.
+func queryFields(c *gin.Context, bySURT bool) (fields rowFields, selected, ok bool) {
+	raw := c.Query("fields")
+	if raw == "" {
+		if bySURT {
+			return rowFields{fieldURLKey, fieldTimestamp, fieldSimHash}, false, true
+		}
+		return rowFields{fieldTimestamp, fieldSimHash}, false, true
+	}
+
+	seen := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case fieldURLKey, fieldTimestamp, fieldSimHash, fieldDistance:
+		default:
+			c.JSON(http.StatusBadRequest, api.NewError("Unknown field "+strconv.Quote(name)+
+				"; expected url_key, timestamp, simhash or distance"))
+			return nil, false, false
+		}
+		if !seen[name] {
+			seen[name] = true
+			fields = append(fields, name)
+		}
+	}
+	return fields, true, true
+}
+
+func (f rowFields) has(name string) bool {
+	for _, field := range f {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// row lays out capture as the selected columns. The distance is to prev,
+// the capture listed before it, and empty for the first capture or one
+// whose hash cannot be decoded.
+func (f rowFields) row(urlKey string, capture storage.Capture, prev *storage.Capture) []string {
+	row := make([]string, len(f))
+	for i, field := range f {
+		switch field {
+		case fieldURLKey:
+			row[i] = urlKey
+		case fieldTimestamp:
+			row[i] = capture.Timestamp
+		case fieldSimHash:
+			row[i] = capture.SimHash
+		case fieldDistance:
+			if prev == nil {
+				continue
+			}
+			a, err1 := simhash.DecodeSimHash(prev.SimHash)
+			b, err2 := simhash.DecodeSimHash(capture.SimHash)
+			if err1 == nil && err2 == nil {
+				row[i] = strconv.Itoa(simhash.Distance(a, b))
+			}
+		}
+	}
+	return row
+}
+
+// rows lays out the captures kept by keep, in order. Distances are to
+// the preceding capture of captures, kept or not.
+func (f rowFields) rows(urlKey string, captures []storage.Capture, keep func(storage.Capture) bool) [][]string {
+	rows := make([][]string, 0, len(captures))
+	for i, capture := range captures {
+		if keep != nil && !keep(capture) {
+			continue
+		}
+		var prev *storage.Capture
+		if i > 0 {
+			prev = &captures[i-1]
+		}
+		rows = append(rows, f.row(urlKey, capture, prev))
+	}
+	return rows
+}
@@ -2,244 +2,767 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
-
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/notify"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/surt"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/urlnorm"
+	"wayback-discover-diff/pkg/usage"
 	"wayback-discover-diff/pkg/worker"
 )
 
+// maxJobWait caps how long /job?wait= holds a request
+const maxJobWait = 60 * time.Second
+
 type Handler struct {
+	store       *storage.Store
 	redisClient *redis.Client
 	taskClient  *asynq.Client
+	inspector   *asynq.Inspector
+	// worker hashes the captures of /captures/retry inline
+	worker *worker.Worker
+	// archiveClient makes the archive lookups of /exists
+	archiveClient *http.Client
+	routes        gin.RoutesInfo
+	jobs          collapser
+	shed          shedder
 }
 
-func NewHandler(redisClient *redis.Client, taskClient *asynq.Client) *Handler {
+func NewHandler(store *storage.Store, taskClient *asynq.Client, w *worker.Worker) *Handler {
 	return &Handler{
-		redisClient: redisClient,
+		store:       store,
+		redisClient: store.Client(),
 		taskClient:  taskClient,
+		worker:      w,
+		inspector: asynq.NewInspector(asynq.RedisClientOpt{
+			Addr: store.Client().Options().Addr,
+		}),
+		archiveClient: newArchiveClient(),
 	}
 }
 
-// CalculateSimHash handles requests to start simhash calculation
+// apiPath is the request or route path p without the base path, as route
+// paths are given in the configuration
+func apiPath(p string) string {
+	return strings.TrimPrefix(p, config.BasePath())
+}
+
+// SetRoutes records the registered routes for /capabilities
+func (h *Handler) SetRoutes(routes gin.RoutesInfo) {
+	h.routes = routes
+}
+
+// CalculateSimHash handles requests to start simhash calculation. A range
+// of years, year=2018-2021 or year_from=2018&year_to=2021, is processed as
+// one job. With all=1 every year is, and sitemap=1 also starts such a job
+// for each page of the archived sitemap.xml of the URL's host.
 func (h *Handler) CalculateSimHash(c *gin.Context) {
-	url := c.Query("url")
+	url := queryURL(c)
 	yearStr := c.Query("year")
+	if from := c.Query("year_from"); yearStr == "" && from != "" {
+		yearStr = from + "-" + queryEither(c, "year_to", "year_from")
+	}
 
 	if url == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": "URL is required",
-		})
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
 		return
 	}
 
-	year, err := strconv.Atoi(yearStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": "Invalid year format",
-		})
+	all := c.Query("all") == "1"
+	year, yearTo, err := parseYears(yearStr)
+	if (err != nil || yearStr == "") && !all {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
 		return
 	}
 
-	// Check if there's already a task running for this URL and year
-	taskKey := fmt.Sprintf("task:%s:%d", url, year)
-	exists, err := h.redisClient.Exists(context.Background(), taskKey).Result()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"status":  "error",
-			"message": "Internal server error",
-		})
+	// Resolve the job template, if any
+	var opts worker.JobOptions
+	if name := c.Query("template"); name != "" {
+		var found bool
+		opts, found, err = worker.LoadTemplate(c.Request.Context(), h.redisClient, name)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if !found {
+			c.JSON(http.StatusBadRequest, api.NewError("Unknown template"))
+			return
+		}
+	}
+
+	if email := c.Query("notify_email"); email != "" {
+		if !strings.Contains(email, "@") || strings.ContainsAny(email, "\r\n") {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid notify_email"))
+			return
+		}
+		// Anonymous callers could otherwise relay mail to anyone
+		if tenant := c.GetString(tenantKey); (tenant == "" || tenant == usage.Anonymous) && !notify.RecipientAllowed(email) {
+			c.JSON(http.StatusForbidden, api.NewError("notify_email needs an API key or an allowed domain"))
+			return
+		}
+		opts.NotifyEmail = email
+	}
+
+	if s := c.Query("size"); s != "" {
+		if opts.Size, err = strconv.Atoi(s); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid size"))
+			return
+		}
+	}
+	if opts.Size, err = worker.HashSize(opts.Size); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError(err.Error()))
+		return
+	}
+	if name := c.Query("archive"); name != "" {
+		opts.Archive = name
+	}
+	if _, ok := config.AppConfig.Archives[opts.Archive]; opts.Archive != "" && !ok {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown archive"))
 		return
 	}
 
-	if exists == 1 {
-		// Get existing task ID
-		taskID, err := h.redisClient.Get(context.Background(), taskKey).Result()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status":  "error",
-				"message": "Internal server error",
-			})
+	if profile := c.Query("profile"); profile != "" {
+		opts.Profile = profile
+	}
+	if opts.Profile != "" && !worker.IsProfile(opts.Profile) {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown profile"))
+		return
+	}
+
+	// Only all-years jobs read sitemaps, also when a template asks for it
+	if c.Query("sitemap") == "1" {
+		if !all {
+			c.JSON(http.StatusBadRequest, api.NewError("sitemap=1 needs all=1"))
 			return
 		}
+		opts.Sitemap = true
+	}
+	opts.Sitemap = opts.Sitemap && all
 
-		c.JSON(http.StatusOK, gin.H{
-			"status": "PENDING",
-			"job_id": taskID,
-		})
+	if priority := c.Query("priority"); priority != "" {
+		opts.Priority = priority
+	}
+	if opts.Priority != "" && !worker.IsPriority(opts.Priority) {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown priority"))
 		return
 	}
 
-	// Create new task
-	taskID := uuid.New().String()
-	task := asynq.NewTask(worker.TypeCalculateSimHash, []byte(fmt.Sprintf(
-		`{"url":"%s","year":%d}`, url, year)))
+	payload := worker.SimHashPayload{URL: url, Year: year, Tenant: c.GetString(tenantKey), Options: opts}
+	if yearTo > year {
+		payload.YearTo = yearTo
+	}
+	kind, enqueue := worker.TypeCalculateSimHash, worker.EnqueueCalculation
+	if all {
+		// Years are discovered by the worker and fanned out as separate jobs
+		payload.Year, payload.YearTo = 0, 0
+		kind, enqueue = worker.TypeDiscoverYears, worker.EnqueueDiscovery
+	}
 
-	_, err = h.taskClient.Enqueue(task, asynq.TaskID(taskID))
+	// Identical submissions share the first one's job and queue estimate
+	key, err := json.Marshal(payload)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"status":  "error",
-			"message": "Failed to create task",
-		})
+		internalError(c, err)
+		return
+	}
+	// Other requests may be waiting on this enqueue, so only the
+	// deadline of the request carries over, not its cancellation
+	ctx := context.WithoutCancel(c.Request.Context())
+	if deadline, ok := c.Request.Context().Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	resp, shared, err := h.jobs.do(kind+" "+string(key), func() (api.JobCreated, error) {
+		return h.createJob(ctx, payload, enqueue)
+	})
+	if errors.Is(err, worker.ErrRecentDuplicate) {
+		c.JSON(http.StatusConflict, api.NewError("Identical job submitted recently"))
 		return
 	}
-
-	// Store task information
-	err = h.redisClient.Set(context.Background(), taskKey, taskID, 24*time.Hour).Err()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"status":  "error",
-			"message": "Failed to store task information",
-		})
+		c.JSON(http.StatusInternalServerError, api.NewError("Failed to create task"))
 		return
 	}
+	if shared {
+		resp.Status = api.StatusPending
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status": "started",
-		"job_id": taskID,
-	})
+// createJob enqueues payload unless the same job is already running and
+// estimates its position in the queue
+func (h *Handler) createJob(ctx context.Context, payload worker.SimHashPayload,
+	enqueue func(context.Context, *redis.Client, *asynq.Client, worker.SimHashPayload) (string, bool, error)) (api.JobCreated, error) {
+	taskID, existing, err := enqueue(ctx, h.redisClient, h.taskClient, payload)
+	if err != nil {
+		return api.JobCreated{}, err
+	}
+
+	status := api.StatusStarted
+	if existing {
+		status = api.StatusPending
+	}
+	resp := api.JobCreated{Status: status, JobID: taskID}
+	if est, ok, err := worker.EstimateQueue(ctx, h.redisClient, h.inspector, taskID); err != nil {
+		log.Printf("Job %s: queue estimate failed: %v", taskID, err)
+	} else if ok {
+		resp.QueuePosition = est.Position
+		resp.ETASeconds = math.Round(est.ETA.Seconds())
+	}
+	return resp, nil
 }
 
-// GetSimHash handles requests to get simhash values
+// GetSimHash handles requests to get simhash values of one timestamp, a
+// year or the from/to window, which may also narrow a year. Captures of a
+// year or window are paged with page= and page_size= (or limit=).
 func (h *Handler) GetSimHash(c *gin.Context) {
-	url := c.Query("url")
+	url := queryURL(c)
 	timestamp := c.Query("timestamp")
 	year := c.Query("year")
 	compress := c.Query("compress")
 
 	if url == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": "URL is required",
-		})
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+	bySURT, ok := queryKeyedBy(c)
+	if !ok {
+		return
+	}
+	fields, selected, ok := queryFields(c, bySURT)
+	if !ok {
+		return
+	}
+	var urlKey string
+	if bySURT || fields.has(fieldURLKey) {
+		urlKey = surt.Key(url)
+	}
+	var layout []string
+	if selected {
+		layout = fields
+	}
+
+	asOf := c.Query("as_of")
+	if asOf != "" && (timestamp != "" || year == "") {
+		c.JSON(http.StatusBadRequest, api.NewError("as_of requires year"))
+		return
+	}
+	window, ok := queryWindow(c)
+	if !ok {
+		return
+	}
+	if window.set() && (timestamp != "" || asOf != "" || c.Query("all") == "1") {
+		c.JSON(http.StatusBadRequest, api.NewError("from and to cannot be combined with timestamp, as_of or all"))
 		return
 	}
 
 	// Handle single timestamp request
 	if timestamp != "" {
-		key := fmt.Sprintf("simhash:%s:%s", url, timestamp)
-		simhash, err := h.redisClient.Get(context.Background(), key).Result()
-		if err == redis.Nil {
-			c.JSON(http.StatusNotFound, gin.H{
-				"status":  "error",
-				"message": "CAPTURE_NOT_FOUND",
-			})
+		normalized, _, err := ts.Normalize(timestamp)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+			return
+		}
+
+		simhash, err := store.GetSimHash(c.Request.Context(), url, normalized)
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND"))
 			return
 		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status":  "error",
-				"message": "Internal server error",
-			})
+			internalError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"simhash": simhash,
-		})
+		resp := api.SimHash{SimHash: simhash}
+		if config.AppConfig.Canonical.Record {
+			meta, err := store.GetCaptureMeta(c.Request.Context(), url, normalized)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			resp.Canonical, resp.AliasOf = meta[storage.MetaCanonical], meta[storage.MetaAliasOf]
+		}
+		if resp.ExpiresAt, err = expiresAt(c.Request.Context(), store, url, normalized); err != nil {
+			internalError(c, err)
+			return
+		}
+		respond(c, http.StatusOK, resp)
+		return
+	}
+
+	// Handle whole-history request
+	if c.Query("all") == "1" {
+		h.getAllYears(c, store, url, urlKey, size, fields, layout)
 		return
 	}
 
 	// Handle year request
-	if year != "" {
-		pattern := fmt.Sprintf("simhash:%s:*", url)
-		keys, err := h.redisClient.Keys(context.Background(), pattern).Result()
+	if year != "" && asOf != "" {
+		getYearAsOf(c, store, url, urlKey, year, asOf, fields, layout)
+		return
+	}
+	if year != "" || window.set() {
+		// Paged requests always get the YearCaptures envelope
+		var page, pageSize int
+		paged := c.Query("page") != "" || queryEither(c, "page_size", "limit") != ""
+		if paged {
+			if page, pageSize, ok = queryPage(c, defaultCapturesPageSize, maxCapturesPageSize); !ok {
+				return
+			}
+		}
+
+		stored, err := store.ListSimHashes(c.Request.Context(), url)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status":  "error",
-				"message": "Internal server error",
-			})
+			internalError(c, err)
 			return
 		}
 
-		if len(keys) == 0 {
-			c.JSON(http.StatusNotFound, gin.H{
-				"status":  "error",
-				"message": "NOT_CAPTURED",
-			})
+		if len(stored) == 0 {
+			c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
 			return
 		}
 
-		// Get all simhash values
-		captures := make([][]string, 0, len(keys))
-		for _, key := range keys {
-			simhash, err := h.redisClient.Get(context.Background(), key).Result()
-			if err != nil {
-				continue
-			}
-			timestamp := key[len(fmt.Sprintf("simhash:%s:", url)):]
-			captures = append(captures, []string{timestamp, simhash})
+		keep := func(capture storage.Capture) bool {
+			return (year == "" || ts.Year(capture.Timestamp) == year) && window.contains(capture.Timestamp)
+		}
+		captures := fields.rows(urlKey, stored, keep)
+
+		if len(captures) == 0 {
+			c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+			return
 		}
 
 		// Check if task is still running
-		taskKey := fmt.Sprintf("task:%s:%s", url, year)
-		taskExists, _ := h.redisClient.Exists(context.Background(), taskKey).Result()
-		status := "COMPLETE"
-		if taskExists == 1 {
-			status = "PENDING"
-		}
-
-		if compress == "1" {
-			c.JSON(http.StatusOK, gin.H{
-				"captures": captures,
-				"total":    len(captures),
-				"status":   status,
+		status := api.StatusComplete
+		if year != "" {
+			yearNum, _ := strconv.Atoi(year)
+			taskExists, _ := h.redisClient.Exists(c.Request.Context(), worker.SizedTaskKey(url, yearNum, size)).Result()
+			if taskExists == 1 {
+				status = api.StatusPending
+			}
+		}
+
+		total := len(captures)
+		if paged {
+			captures = pageOf(captures, page, pageSize)
+		}
+
+		if compress == "1" || paged {
+			exclusions, err := store.Exclusions(c.Request.Context(), url)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			respond(c, http.StatusOK, api.YearCaptures{
+				URLKey:   urlKey,
+				Captures: captures,
+				Total:    total,
+				Page:     page,
+				PageSize: pageSize,
+				Status:   status,
+				Excluded: excludedReasons(selectCaptures(stored, keep), exclusions),
+				Fields:   layout,
 			})
 		} else {
-			c.JSON(http.StatusOK, captures)
+			respond(c, http.StatusOK, captures)
+		}
+		return
+	}
+
+	c.JSON(http.StatusBadRequest, api.NewError("Either timestamp, year or from and to are required"))
+}
+
+// Page sizes of paged /simhash year responses
+const (
+	defaultCapturesPageSize = 1000
+	maxCapturesPageSize     = 10000
+)
+
+// pageOf returns page of rows, pageSize at a time; pages past the end
+// are empty
+func pageOf(rows [][]string, page, pageSize int) [][]string {
+	start := (page - 1) * pageSize
+	if start >= len(rows) {
+		return [][]string{}
+	}
+	end := start + pageSize
+	if end > len(rows) {
+		end = len(rows)
+	}
+	return rows[start:end]
+}
+
+// window is an inclusive timestamp range of /simhash?from=...&to=...; a
+// shortened to covers every timestamp it is a prefix of, so to=2019
+// reaches the end of 2019
+type window struct {
+	from, to string
+}
+
+// queryWindow reads the from= and to= parameters, answering 400 for
+// malformed ones
+func queryWindow(c *gin.Context) (window, bool) {
+	var w window
+	if s := c.Query("from"); s != "" {
+		from, _, err := ts.Normalize(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid from timestamp"))
+			return w, false
+		}
+		w.from = from
+	}
+	if s := c.Query("to"); s != "" {
+		to, precision, err := ts.Normalize(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid to timestamp"))
+			return w, false
+		}
+		w.to = to[:precision]
+	}
+	if w.from != "" && w.to != "" && w.from[:len(w.to)] > w.to {
+		c.JSON(http.StatusBadRequest, api.NewError("from must not be after to"))
+		return w, false
+	}
+	return w, true
+}
+
+func (w window) set() bool {
+	return w.from != "" || w.to != ""
+}
+
+func (w window) contains(timestamp string) bool {
+	if timestamp < w.from {
+		return false
+	}
+	return w.to == "" || timestamp[:len(w.to)] <= w.to
+}
+
+// selectCaptures returns the captures keep accepts
+func selectCaptures(captures []storage.Capture, keep func(storage.Capture) bool) []storage.Capture {
+	var selected []storage.Capture
+	for _, c := range captures {
+		if keep(c) {
+			selected = append(selected, c)
 		}
+	}
+	return selected
+}
+
+// getAllYears returns the complete multi-year timeline of url grouped by
+// year, with the calculation status of each year
+func (h *Handler) getAllYears(c *gin.Context, store *storage.Store, url, urlKey string, size int, fields rowFields, layout []string) {
+	ctx := c.Request.Context()
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		internalError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusBadRequest, gin.H{
-		"status":  "error",
-		"message": "Either timestamp or year is required",
+	discovering, _ := h.redisClient.Exists(ctx, worker.DiscoveryTaskKey(url, size)).Result()
+	if len(stored) == 0 && discovering == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	captures := make(map[string][][]string)
+	var order []string
+	for i, capture := range stored {
+		year := ts.Year(capture.Timestamp)
+		if _, ok := captures[year]; !ok {
+			order = append(order, year)
+		}
+		var prev *storage.Capture
+		if i > 0 {
+			prev = &stored[i-1]
+		}
+		captures[year] = append(captures[year], fields.row(urlKey, capture, prev))
+	}
+
+	status := api.StatusComplete
+	if discovering == 1 {
+		status = api.StatusPending
+	}
+
+	years := make(map[string]api.YearCaptures, len(order))
+	for _, year := range order {
+		yearStatus := api.StatusComplete
+		if n, _ := strconv.Atoi(year); n > 0 {
+			if running, _ := h.redisClient.Exists(ctx, worker.SizedTaskKey(url, n, size)).Result(); running == 1 {
+				yearStatus = api.StatusPending
+				status = api.StatusPending
+			}
+		}
+		years[year] = api.YearCaptures{
+			Captures: captures[year],
+			Total:    len(captures[year]),
+			Status:   yearStatus,
+			Excluded: excludedReasons(ofYear(stored, year), exclusions),
+		}
+	}
+
+	respond(c, http.StatusOK, api.Timeline{
+		URLKey: urlKey,
+		Years:  years,
+		Total:  len(stored),
+		Status: status,
+		Fields: layout,
 	})
 }
 
-// GetJobStatus handles requests to get job status
+// GetJobStatus handles requests to get job status. With wait=30s the
+// request is held until the job finishes or the wait expires; history=1
+// adds the job's state transitions.
 func (h *Handler) GetJobStatus(c *gin.Context) {
 	jobID := c.Query("job_id")
 	if jobID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": "Job ID is required",
-		})
+		c.JSON(http.StatusBadRequest, api.NewError("Job ID is required"))
 		return
 	}
 
-	// Get task information from Redis
-	inspector := asynq.NewInspector(asynq.RedisClientOpt{
-		Addr: h.redisClient.Options().Addr,
-	})
+	wait, err := parseWait(c.Query("wait"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid wait duration"))
+		return
+	}
+	ctx := c.Request.Context()
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline)-time.Second < wait {
+		// Answer before the route timeout cuts the request off
+		wait = time.Until(deadline) - time.Second
+	}
 
-	taskInfo, err := inspector.GetTaskInfo("default", jobID)
+	// Subscribe before reading the state so a completion in between is not missed
+	var done <-chan *redis.Message
+	if wait > 0 {
+		sub := h.redisClient.Subscribe(ctx, worker.JobDoneChannel(jobID))
+		defer sub.Close()
+		if _, err := sub.Receive(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+		done = sub.Channel()
+	}
+
+	// Captures of a staged job are still processed after its task is done
+	staging, err := worker.StagesRunning(ctx, h.redisClient, jobID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"status":  "error",
-			"message": "Job not found",
-		})
+		internalError(c, err)
 		return
 	}
 
-	status := "pending"
-	switch taskInfo.State {
+	var history []worker.HistoryEvent
+	if c.Query("history") == "1" {
+		if history, err = worker.JobHistory(ctx, h.redisClient, jobID); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+
+	// Get task information from Redis
+	taskInfo, err := worker.FindTask(h.inspector, jobID)
+	if err != nil && !staging {
+		// The result and history outlive the task, so finished jobs still answer
+		result, found, err := worker.JobResult(ctx, h.redisClient, jobID)
+		switch {
+		case err != nil:
+			internalError(c, err)
+		case found:
+			c.JSON(http.StatusOK, api.JobStatus{Status: result.Status, JobID: jobID, Result: &result, History: history})
+		case len(history) > 0:
+			c.JSON(http.StatusOK, api.JobStatus{Status: history[len(history)-1].State, JobID: jobID, History: history})
+		default:
+			c.JSON(http.StatusNotFound, api.NewError("Job not found"))
+		}
+		return
+	}
+
+	resp := api.JobStatus{Status: worker.HistoryActive, JobID: jobID}
+	finished := false
+	if !staging {
+		resp.Status = taskStatus(taskInfo.State)
+		finished = taskInfo.State == asynq.TaskStateCompleted || taskInfo.State == asynq.TaskStateArchived
+		resp.Error, resp.Retried, resp.MaxRetry = taskInfo.LastErr, taskInfo.Retried, taskInfo.MaxRetry
+		if taskInfo.State == asynq.TaskStateRetry || taskInfo.State == asynq.TaskStateScheduled {
+			resp.NextAttemptAt = taskInfo.NextProcessAt.UTC().Format(time.RFC3339)
+		}
+	}
+
+	if wait > 0 && !finished {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case msg := <-done:
+			resp.Status = msg.Payload
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if wait > 0 && len(history) > 0 {
+		// Transitions may have been recorded while waiting
+		if history, err = worker.JobHistory(ctx, h.redisClient, jobID); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+	if resp.Status == worker.HistoryCompleted || resp.Status == worker.HistoryFailed {
+		result, found, err := worker.JobResult(ctx, h.redisClient, jobID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if found {
+			resp.Result = &result
+		}
+	}
+	resp.History = history
+	c.JSON(http.StatusOK, resp)
+}
+
+// taskStatus is the /job status of a task state, named like the states
+// of the job history
+func taskStatus(state asynq.TaskState) string {
+	switch state {
+	case asynq.TaskStateActive:
+		return worker.HistoryActive
+	case asynq.TaskStateRetry:
+		return worker.HistoryRetrying
+	case asynq.TaskStateArchived:
+		return worker.HistoryFailed
 	case asynq.TaskStateCompleted:
-		status = "completed"
-	case asynq.TaskStatePending:
-		status = "pending"
+		return worker.HistoryCompleted
+	case asynq.TaskStateScheduled:
+		return "scheduled"
+	default:
+		return "pending"
 	}
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status": status,
-		"job_id": jobID,
-	})
+// querySize resolves the size= parameter of a read request, answering
+// 400 when it is outside the configured bounds
+func querySize(c *gin.Context) (int, bool) {
+	s := c.Query("size")
+	if s == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid size"))
+		return 0, false
+	}
+	size, err := worker.HashSize(n)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError(err.Error()))
+		return 0, false
+	}
+	return size, true
+}
+
+// queryArchive resolves the archive= parameter, answering 400 for names
+// missing from config.archives
+func queryArchive(c *gin.Context) (string, bool) {
+	name := c.Query("archive")
+	if _, ok := config.AppConfig.Archives[name]; name != "" && !ok {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown archive"))
+		return "", false
+	}
+	return name, true
+}
+
+// queryProfile resolves the profile= parameter, answering 400 for names
+// missing from config.simhash.profiles
+func queryProfile(c *gin.Context) (string, bool) {
+	name := c.Query("profile")
+	if name != "" && !worker.IsProfile(name) {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown profile"))
+		return "", false
+	}
+	return name, true
+}
+
+// queryStore is the store view selected by the archive=, profile= and
+// size= parameters of a read request
+func (h *Handler) queryStore(c *gin.Context) (*storage.Store, int, bool) {
+	name, ok := queryArchive(c)
+	if !ok {
+		return nil, 0, false
+	}
+	profile, ok := queryProfile(c)
+	if !ok {
+		return nil, 0, false
+	}
+	size, ok := querySize(c)
+	if !ok {
+		return nil, 0, false
+	}
+	return h.store.WithArchive(name).WithProfile(profile).WithSize(size), size, true
+}
+
+// queryKeyedBy reports whether keyed_by=surt asks for SURT URL keys,
+// answering 400 for unknown key forms
+func queryKeyedBy(c *gin.Context) (bool, bool) {
+	switch c.Query("keyed_by") {
+	case "", "url":
+		return false, true
+	case "surt":
+		return true, true
+	}
+	c.JSON(http.StatusBadRequest, api.NewError("keyed_by must be url or surt"))
+	return false, false
+}
+
+// queryURL returns the url= parameter rewritten by the
+// url_normalization rules
+func queryURL(c *gin.Context) string {
+	return urlnorm.Normalize(c.Query("url"))
+}
+
+// parseWait reads a long-poll duration such as "30s" or "30", capped at
+// maxJobWait
+func parseWait(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative wait: %s", s)
+	}
+	if d > maxJobWait {
+		d = maxJobWait
+	}
+	return d, nil
 }
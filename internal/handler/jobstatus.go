@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// maxJobStatuses bounds the jobs looked up by one /jobs/status call
+const maxJobStatuses = 500
+
+// JobStatuses serves POST /jobs/status, the statuses /job would give for
+// a list of job IDs, in request order, so that dashboards poll once per
+// refresh. history=1 adds each job's state transitions; waiting is not
+// supported.
+func (h *Handler) JobStatuses(c *gin.Context) {
+	var req api.JobStatusQuery
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Expected a JSON object with a job_ids array"))
+		return
+	}
+	if len(req.JobIDs) == 0 || len(req.JobIDs) > maxJobStatuses {
+		c.JSON(http.StatusBadRequest, api.NewError("job_ids must contain between 1 and 500 IDs"))
+		return
+	}
+	for _, id := range req.JobIDs {
+		if id == "" {
+			c.JSON(http.StatusBadRequest, api.NewError("Job ID is required"))
+			return
+		}
+	}
+
+	full := c.Query("history") == "1"
+	lookups, err := worker.LookupJobs(c.Request.Context(), h.redisClient, h.inspector, req.JobIDs, full)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	jobs := make([]api.JobStatus, len(lookups))
+	for i, job := range lookups {
+		jobs[i] = lookupStatus(req.JobIDs[i], job)
+		if !full {
+			jobs[i].History = nil
+		}
+	}
+	c.JSON(http.StatusOK, api.JobStatuses{Jobs: jobs, Count: len(jobs)})
+}
+
+// lookupStatus is the status of job id as GetJobStatus tells it
+func lookupStatus(id string, job worker.JobLookup) api.JobStatus {
+	resp := api.JobStatus{JobID: id, History: job.History}
+	switch {
+	case job.Staging:
+		// Captures of a staged job are still processed after its task is done
+		resp.Status = worker.HistoryActive
+		return resp
+	case job.Task != nil:
+	case job.Result != nil:
+		resp.Status, resp.Result = job.Result.Status, job.Result
+		return resp
+	case len(job.History) > 0:
+		resp.Status = job.History[len(job.History)-1].State
+		return resp
+	default:
+		resp.Status = api.StatusNotFound
+		return resp
+	}
+
+	task := job.Task
+	resp.Status = taskStatus(task.State)
+	resp.Error, resp.Retried, resp.MaxRetry = task.LastErr, task.Retried, task.MaxRetry
+	if task.State == asynq.TaskStateRetry || task.State == asynq.TaskStateScheduled {
+		resp.NextAttemptAt = task.NextProcessAt.UTC().Format(time.RFC3339)
+	}
+	if resp.Status == worker.HistoryCompleted || resp.Status == worker.HistoryFailed {
+		resp.Result = job.Result
+	}
+	return resp
+}
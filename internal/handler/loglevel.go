@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// GetLogLevel reports the default log level and per-module overrides
+func (h *Handler) GetLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, currentLogLevels())
+}
+
+// SetLogLevel changes log verbosity without a restart. The change applies
+// to this process only.
+func (h *Handler) SetLogLevel(c *gin.Context) {
+	var req api.LogLevels
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid log level body"))
+		return
+	}
+
+	// Validate everything before applying anything
+	levels := make(map[string]logging.Level, len(req.Modules))
+	for module, name := range req.Modules {
+		if !logging.IsModule(module) {
+			c.JSON(http.StatusBadRequest, api.NewError("Unknown log module "+module))
+			return
+		}
+		if name == "" {
+			continue
+		}
+		l, err := logging.ParseLevel(name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid level for module "+module))
+			return
+		}
+		levels[module] = l
+	}
+	var level logging.Level
+	if req.Level != "" {
+		var err error
+		if level, err = logging.ParseLevel(req.Level); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid log level"))
+			return
+		}
+	}
+
+	if req.Level != "" {
+		logging.SetLevel(level)
+	}
+	for module, name := range req.Modules {
+		if name == "" {
+			logging.ClearModuleLevel(module)
+		} else {
+			logging.SetModuleLevel(module, levels[module])
+		}
+	}
+
+	c.JSON(http.StatusOK, currentLogLevels())
+}
+
+func currentLogLevels() api.LogLevels {
+	level, overrides := logging.Levels()
+	modules := make(map[string]string, len(overrides))
+	for module, l := range overrides {
+		modules[module] = l.String()
+	}
+	return api.LogLevels{Level: level.String(), Modules: modules}
+}
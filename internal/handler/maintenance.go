@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/internal/maintenance"
+)
+
+// Repair scans storage for malformed and orphaned records. Nothing is
+// changed unless fix=1 is given.
+func (h *Handler) Repair(c *gin.Context) {
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{
+		Addr: h.redisClient.Options().Addr,
+	})
+	defer inspector.Close()
+
+	report, err := maintenance.Repair(c.Request.Context(), h.store, inspector, c.Query("fix") == "1")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.RepairFailed{
+			Error:  api.NewError("Repair scan failed"),
+			Report: report,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
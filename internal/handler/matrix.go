@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/urlnorm"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// maxMatrixSize bounds the timestamps of one /diff/matrix call; the
+// response grows with its square
+const maxMatrixSize = 200
+
+// matrixRequest is the body of POST /diff/matrix
+type matrixRequest struct {
+	URL        string   `json:"url"`
+	Timestamps []string `json:"timestamps"`
+	Normalize  bool     `json:"normalize"`
+}
+
+// DiffMatrix returns the pairwise distances between captures of a URL,
+// of the bit size given by size=
+func (h *Handler) DiffMatrix(c *gin.Context) {
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	var req matrixRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Expected a JSON object with url and timestamps"))
+		return
+	}
+	req.URL = urlnorm.Normalize(req.URL)
+	if req.URL == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	if len(req.Timestamps) < 2 || len(req.Timestamps) > maxMatrixSize {
+		c.JSON(http.StatusBadRequest, api.NewError(fmt.Sprintf("Matrix must contain between 2 and %d timestamps", maxMatrixSize)))
+		return
+	}
+
+	timestamps := make([]string, len(req.Timestamps))
+	refs := make([]storage.CaptureRef, len(req.Timestamps))
+	for i, raw := range req.Timestamps {
+		normalized, _, err := ts.Normalize(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format: "+raw))
+			return
+		}
+		timestamps[i] = normalized
+		refs[i] = storage.CaptureRef{URL: req.URL, Timestamp: normalized}
+	}
+
+	encoded, err := store.GetSimHashes(c.Request.Context(), refs)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	hashes := make([]uint64, len(encoded))
+	for i, e := range encoded {
+		if e == "" {
+			c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND: "+timestamps[i]))
+			return
+		}
+		if hashes[i], err = simhash.DecodeSimHash(e); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+
+	bits := worker.BitSize(size)
+	matrix := api.DiffMatrix{
+		URL:        req.URL,
+		Size:       bits,
+		Timestamps: timestamps,
+		Distances:  simhash.DistanceMatrix(hashes),
+	}
+	if req.Normalize {
+		matrix.Similarities = make([][]float64, len(hashes))
+		for i, row := range matrix.Distances {
+			matrix.Similarities[i] = make([]float64, len(row))
+			for j, d := range row {
+				matrix.Similarities[i][j] = simhash.Similarity(d, bits)
+			}
+		}
+	}
+	respond(c, http.StatusOK, matrix)
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// Nearest serves /nearest?url=...&timestamp=..., the stored capture of a
+// URL whose simhash is closest by Hamming distance to a reference: the
+// capture at timestamp, or simhash= given as /simhash returns it. year=
+// restricts the candidates to one year. The reference capture and
+// excluded captures are passed over; of equally close captures the one
+// nearest in time to the reference capture wins, else the earliest.
+func (h *Handler) Nearest(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	rawTimestamp, rawHash := c.Query("timestamp"), c.Query("simhash")
+	if (rawTimestamp == "") == (rawHash == "") {
+		c.JSON(http.StatusBadRequest, api.NewError("Either timestamp or simhash is required"))
+		return
+	}
+	var timestamp string
+	if rawTimestamp != "" {
+		var err error
+		if timestamp, _, err = ts.Normalize(rawTimestamp); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid timestamp format"))
+			return
+		}
+	}
+	// A + of base64 arrives as a space when the client did not escape it
+	rawHash = strings.ReplaceAll(rawHash, " ", "+")
+	var reference uint64
+	if rawHash != "" {
+		var err error
+		if reference, err = simhash.DecodeSimHash(rawHash); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid simhash"))
+			return
+		}
+	}
+	year := 0
+	if s := c.Query("year"); s != "" {
+		var err error
+		if year, err = strconv.Atoi(s); err != nil || len(s) != 4 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+			return
+		}
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if timestamp != "" {
+		encoded, err := store.GetSimHash(ctx, url, timestamp)
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, api.NewError("CAPTURE_NOT_FOUND"))
+			return
+		}
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		rawHash = encoded
+		if reference, err = simhash.DecodeSimHash(encoded); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	captures := storage.WithoutExcluded(stored, exclusions)
+	if year != 0 {
+		captures, _ = inYears(captures, year, year, 0)
+	}
+
+	var best *storage.Capture
+	bestDistance := 0
+	var bestGap time.Duration
+	for i := range captures {
+		capture := &captures[i]
+		if capture.Timestamp == timestamp {
+			continue
+		}
+		hash, err := simhash.DecodeSimHash(capture.SimHash)
+		if err != nil {
+			continue
+		}
+		distance := simhash.Distance(reference, hash)
+		gap := timeGap(timestamp, capture.Timestamp)
+		if best == nil || distance < bestDistance || (distance == bestDistance && gap < bestGap) {
+			best, bestDistance, bestGap = capture, distance, gap
+		}
+	}
+	if best == nil {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Nearest{
+		URL:       url,
+		Reference: api.NearestReference{Timestamp: timestamp, SimHash: rawHash},
+		Timestamp: best.Timestamp,
+		SimHash:   best.SimHash,
+		Distance:  bestDistance,
+		Size:      worker.BitSize(size),
+	})
+}
+
+// timeGap is the time between the captures at timestamps a and b, 0 when
+// a is unset so that ties keep the earliest capture
+func timeGap(a, b string) time.Duration {
+	if a == "" {
+		return 0
+	}
+	ta, err := ts.Parse(a)
+	if err != nil {
+		return 0
+	}
+	tb, err := ts.Parse(b)
+	if err != nil {
+		return 0
+	}
+	if d := ta.Sub(tb); d > 0 {
+		return d
+	}
+	return tb.Sub(ta)
+}
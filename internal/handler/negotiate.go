@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+
+	"wayback-discover-diff/internal/api"
+)
+
+// Media types offered besides JSON for capture lists and batch results
+const (
+	mimeMsgPack  = "application/msgpack"
+	mimeProtobuf = "application/x-protobuf"
+)
+
+// respond writes obj in the format the client asks for in Accept:
+// MessagePack, Protobuf for the bodies encoded as the messages of
+// api.proto (capture lists and batch results) or JSON by default. A client
+// asking Protobuf of another body gets its next choice.
+func respond(c *gin.Context, code int, obj interface{}) {
+	if rows, ok := obj.([][]string); ok {
+		obj = api.CaptureRows(rows)
+	}
+	msg, isProto := obj.(api.ProtoMessage)
+	switch negotiate(c.GetHeader("Accept"), isProto) {
+	case mimeMsgPack:
+		c.Render(code, render.MsgPack{Data: obj})
+	case mimeProtobuf:
+		c.Data(code, mimeProtobuf, msg.MarshalProto())
+	default:
+		c.JSON(code, obj)
+	}
+}
+
+// negotiate picks the supported media type accept prefers, by q-value
+// and then by order, Protobuf only when proto is set. Types with q=0 are
+// refused; JSON is the default.
+func negotiate(accept string, proto bool) string {
+	type choice struct {
+		mediaType string
+		q         float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		if q == 0 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case mimeMsgPack, "application/x-msgpack":
+			choices = append(choices, choice{mimeMsgPack, q})
+		case mimeProtobuf, "application/protobuf":
+			if proto {
+				choices = append(choices, choice{mimeProtobuf, q})
+			}
+		case "application/json", "application/*", "*/*":
+			choices = append(choices, choice{"", q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return ""
+	}
+	return choices[0].mediaType
+}
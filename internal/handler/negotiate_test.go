@@ -0,0 +1,31 @@
+package handler
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		proto  bool
+		want   string
+	}{
+		{"", true, ""},
+		{"application/json", true, ""},
+		{"application/x-protobuf", true, mimeProtobuf},
+		{"application/x-protobuf", false, ""},
+		{"application/protobuf, application/json", true, mimeProtobuf},
+		{"application/x-protobuf;q=0, application/json", true, ""},
+		{"application/x-protobuf; q=0.5, application/msgpack", true, mimeMsgPack},
+		{"application/json;q=0.9, application/x-msgpack;q=1", true, mimeMsgPack},
+		{"application/x-msgpack;q=0.8, */*;q=0.9", true, ""},
+		{"application/x-protobuf;q=0.5, application/msgpack;q=0.5", true, mimeProtobuf},
+		{"application/msgpack;q=0", true, ""},
+		{"APPLICATION/MSGPACK;Q=0.3", true, mimeMsgPack},
+		{"application/msgpack;q=bogus, application/json;q=0.5", true, mimeMsgPack},
+		{"text/html, application/x-protobuf;q=0.1", true, mimeProtobuf},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept, tt.proto); got != tt.want {
+			t.Errorf("negotiate(%q, %v) = %q, want %q", tt.accept, tt.proto, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// BuildProfile starts building the template profile of a host from a
+// sample of its stored pages; sample= overrides template_profiles.sample_size
+func (h *Handler) BuildProfile(c *gin.Context) {
+	host := worker.ProfileHost(c.Param("host"))
+	if host == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid host"))
+		return
+	}
+	p := worker.ProfilePayload{Host: host}
+	if s := c.Query("sample"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid sample"))
+			return
+		}
+		p.Sample = n
+	}
+
+	taskID, err := worker.EnqueueProfileBuild(c.Request.Context(), h.taskClient, p)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewError("Failed to create task"))
+		return
+	}
+	c.JSON(http.StatusOK, api.JobCreated{Status: api.StatusStarted, JobID: taskID})
+}
+
+// GetProfile returns the template profile of a host
+func (h *Handler) GetProfile(c *gin.Context) {
+	profile, found, err := worker.LoadProfile(c.Request.Context(), h.redisClient, worker.ProfileHost(c.Param("host")))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, api.NewError("Profile not found"))
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// DeleteProfile removes the template profile of a host, so its pages are
+// hashed in full again
+func (h *Handler) DeleteProfile(c *gin.Context) {
+	host := worker.ProfileHost(c.Param("host"))
+
+	removed, err := h.redisClient.HDel(c.Request.Context(), worker.ProfilesKey, host).Result()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("Profile not found"))
+		return
+	}
+	c.JSON(http.StatusOK, api.TemplateDeleted{Status: api.StatusDeleted, Name: host})
+}
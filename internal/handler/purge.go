@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/internal/maintenance"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// DeleteSimHash purges the stored hashes, capture metadata, task markers
+// and job records (queued tasks, history, reports, checkpoints and staged
+// capture bodies) of a URL, optionally limited to one year. CDX responses
+// are never cached, so none are left behind. It serves takedown requests
+// and must be mounted behind RequireAdmin. The URL is taken as given,
+// without url_normalization, so that variants stored before a rule was
+// added can be purged too.
+func (h *Handler) DeleteSimHash(c *gin.Context) {
+	url := c.Query("url")
+	year := c.Query("year")
+
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+
+	if year != "" {
+		if _, err := strconv.Atoi(year); err != nil || len(year) != 4 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+			return
+		}
+	}
+
+	name, ok := queryArchive(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	removed, err := h.store.WithArchive(name).PurgeURL(ctx, url, year)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewError("Failed to purge stored data"))
+		return
+	}
+
+	// Clear task markers of every profile so the URL can be recalculated
+	// right away; the year prefix also matches markers of non-default
+	// sizes (2019-32)
+	for _, profile := range append([]string{""}, worker.ProfileNames()...) {
+		scoped := storage.ArchiveURL(storage.ProfileArchive(name, profile), url)
+		for _, prefix := range worker.TaskKeyPrefixes(scoped) {
+			if _, err := h.store.PurgePrefix(ctx, prefix, year); err != nil {
+				c.JSON(http.StatusInternalServerError, api.NewError("Failed to purge task markers"))
+				return
+			}
+		}
+	}
+	forgotten, err := worker.ForgetJobs(ctx, h.redisClient, h.inspector, name, url, year)
+	removed += forgotten
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewError("Failed to purge job records"))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Purged{
+		Status:  api.StatusDeleted,
+		URL:     url,
+		Removed: removed,
+	})
+}
+
+// StartPurge starts deleting the stored data of a host (host=) or the
+// usage records of a tenant (tenant=) in the background; GetPurge reports
+// its progress. Must be mounted behind RequireAdmin.
+func (h *Handler) StartPurge(c *gin.Context) {
+	p := maintenance.PurgePayload{Host: c.Query("host"), Tenant: c.Query("tenant")}
+	if (p.Host == "") == (p.Tenant == "") {
+		c.JSON(http.StatusBadRequest, api.NewError("Either host or tenant is required"))
+		return
+	}
+	if p.Host != "" {
+		if p.Host = worker.ProfileHost(p.Host); p.Host == "" {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid host"))
+			return
+		}
+	}
+
+	taskID, err := maintenance.NewPurger(h.store).EnqueuePurge(c.Request.Context(), h.taskClient, p)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewError("Failed to create task"))
+		return
+	}
+	c.JSON(http.StatusOK, api.JobCreated{Status: api.StatusStarted, JobID: taskID})
+}
+
+// GetPurge returns the progress of a purge started by StartPurge
+func (h *Handler) GetPurge(c *gin.Context) {
+	progress, found, err := maintenance.LoadPurge(c.Request.Context(), h.redisClient, c.Param("id"))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, api.NewError("Purge not found"))
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
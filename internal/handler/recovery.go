@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/notify"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+// panicAlert is posted to the alert webhook when a handler panics
+type panicAlert struct {
+	Event     string `json:"event"`
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Error     string `json:"error"`
+	Time      string `json:"time"`
+}
+
+// RequestID tags every request with an ID, reusing the one supplied by the
+// client or a proxy in X-Request-ID
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = uuid.New().String()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// Recovery turns handler panics into a JSON 500 carrying the request ID,
+// logs the stack and raises an alert if a webhook is configured
+func Recovery(c *gin.Context) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+		if rec == http.ErrAbortHandler {
+			// The client went away; there is nobody to answer
+			panic(rec)
+		}
+
+		id := c.GetString(requestIDKey)
+		log.Printf("Panic in %s %s (request %s): %v\n%s", c.Request.Method, c.Request.URL.Path, id, rec, debug.Stack())
+		metrics.HTTPPanics.Inc()
+
+		if url := config.AppConfig.Alerts.WebhookURL; url != "" {
+			alert := panicAlert{
+				Event:     "panic",
+				RequestID: id,
+				Method:    c.Request.Method,
+				Path:      c.Request.URL.Path,
+				Error:     fmt.Sprint(rec),
+				Time:      time.Now().UTC().Format(time.RFC3339),
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if err := notify.PostJSON(ctx, url, alert); err != nil {
+					log.Printf("Failed to post panic alert: %v", err)
+				}
+			}()
+		}
+
+		if c.Writer.Written() {
+			c.Abort()
+			return
+		}
+		body := api.NewError("Internal server error")
+		body.RequestID = id
+		c.AbortWithStatusJSON(http.StatusInternalServerError, body)
+	}()
+	c.Next()
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// reportPage renders a job report for format=html
+var reportPage = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Job {{.JobID}}</title></head>
+<body>
+<h1>Job {{.JobID}}: {{.Status}}</h1>
+<table>
+<tr><th>URL</th><td>{{.URL}}</td></tr>
+<tr><th>Year</th><td>{{.Year}}{{if gt .YearTo .Year}}-{{.YearTo}}{{end}}</td></tr>
+<tr><th>Finished</th><td>{{.Finished.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Duration</th><td>{{printf "%.1f" .Duration}}s</td></tr>
+<tr><th>Processed</th><td>{{.Processed}} captures</td></tr>
+<tr><th>Skipped</th><td>{{.Skipped}} captures</td></tr>
+<tr><th>Stored</th><td>{{.Captures}} captures{{if .Excluded}}, {{.Excluded}} excluded{{end}}</td></tr>
+{{if .Error}}<tr><th>Error</th><td>{{.Error}}</td></tr>{{end}}
+</table>
+{{if .Errors}}<h2>Errors</h2>
+<table>{{range $class, $n := .Errors}}<tr><th>{{$class}}</th><td>{{$n}}</td></tr>{{end}}</table>{{end}}
+<h2>Change points</h2>
+{{if .ChangePoints}}<table>
+<tr><th>From</th><th>To</th><th>Distance</th></tr>
+{{range .ChangePoints}}<tr><td>{{.From}}</td><td>{{.To}}</td><td>{{.Distance}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+<h2>Largest distances</h2>
+{{if .Largest}}<table>
+<tr><th>From</th><th>To</th><th>Distance</th></tr>
+{{range .Largest}}<tr><td>{{.From}}</td><td>{{.To}}</td><td>{{.Distance}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+</body>
+</html>
+`))
+
+// GetJobReport serves /job/report?job_id=..., the report stored when the
+// job finished, as JSON or, with format=html or an Accept header
+// preferring it, as an HTML page
+func (h *Handler) GetJobReport(c *gin.Context) {
+	jobID := c.Query("job_id")
+	if jobID == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("Job ID is required"))
+		return
+	}
+	format := c.Query("format")
+	if format != "" && format != "json" && format != "html" {
+		c.JSON(http.StatusBadRequest, api.NewError("format must be json or html"))
+		return
+	}
+
+	report, err := worker.Report(c.Request.Context(), h.redisClient, jobID)
+	if err == worker.ErrReportNotFound {
+		c.JSON(http.StatusNotFound, api.NewError("REPORT_NOT_FOUND"))
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if format == "html" || (format == "" && strings.HasPrefix(c.GetHeader("Accept"), "text/html")) {
+		var page strings.Builder
+		if err := reportPage.Execute(&page, report); err != nil {
+			internalError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page.String()))
+		return
+	}
+	respond(c, http.StatusOK, report)
+}
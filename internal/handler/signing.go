@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+)
+
+// Query parameters added to signed URLs
+const (
+	sigParam     = "signature"
+	expiresParam = "expires"
+	nonceParam   = "nonce"
+	signerParam  = "signed_by"
+)
+
+// signableRoutes are the read and export routes links can be signed for;
+// routes that write or start jobs are charged to the signer and never are
+var signableRoutes = []string{
+	"/simhash", "/simhash/before", "/simhash/versions", "/exists", "/urls",
+	"/timeline", "/changes", "/nearest", "/diff", "/diff/baseline", "/baseline",
+	"/analyze/trend", "/analyze/anomalies", "/analyze/eras", "/export/story",
+	"/job", "/job/report", "/capabilities",
+}
+
+// signable reports whether a link to API path p can be signed
+func signable(p string) bool {
+	for _, route := range signableRoutes {
+		if p == route {
+			return true
+		}
+	}
+	id := strings.TrimPrefix(p, "/diffs/")
+	return id != p && id != "" && !strings.Contains(id, "/")
+}
+
+// signPayload is the canonical string covered by a link signature: the
+// method, the path and the sorted query string without the signature
+// itself
+func signPayload(method, path string, query url.Values) string {
+	q := url.Values{}
+	for k, v := range query {
+		if k != sigParam {
+			q[k] = v
+		}
+	}
+	return method + " " + path + "?" + q.Encode()
+}
+
+func computeSignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.AppConfig.Signing.Secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL issues a time-limited signed GET link to one of signableRoutes
+// so results can be shared with collaborators who hold no API key.
+// Downloads through the link are charged to the issuing tenant.
+func (h *Handler) SignURL(c *gin.Context) {
+	cfg := config.AppConfig.Signing
+	if cfg.Secret == "" {
+		c.JSON(http.StatusNotImplemented, api.NewError("URL signing is not configured"))
+		return
+	}
+
+	target, err := url.Parse(c.Query("path"))
+	if err == nil {
+		target.Path = apiPath(target.Path)
+	}
+	if err != nil || target.Path == "" || target.IsAbs() || !strings.HasPrefix(target.Path, "/") {
+		c.JSON(http.StatusBadRequest, api.NewError("path must be a relative API path"))
+		return
+	}
+	if !signable(target.Path) {
+		c.JSON(http.StatusBadRequest, api.NewError("path is not a read or export route"))
+		return
+	}
+
+	expiry := time.Duration(cfg.DefaultExpiry) * time.Second
+	if s := c.Query("expires_in"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid expires_in"))
+			return
+		}
+		expiry = time.Duration(secs) * time.Second
+	}
+	if max := time.Duration(cfg.MaxExpiry) * time.Second; max > 0 && expiry > max {
+		expiry = max
+	}
+	if expiry <= 0 {
+		expiry = time.Hour
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewError("Internal server error"))
+		return
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	query := target.Query()
+	for _, k := range []string{sigParam, expiresParam, nonceParam, signerParam} {
+		query.Del(k)
+	}
+	query.Set(expiresParam, strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set(nonceParam, hex.EncodeToString(nonce))
+	query.Set(signerParam, c.GetString(tenantKey))
+	query.Set(sigParam, computeSignature(signPayload(http.MethodGet, target.Path, query)))
+
+	c.JSON(http.StatusOK, api.SignedURL{
+		URL:       config.PublicLink(target.Path + "?" + query.Encode()),
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+		SingleUse: cfg.SingleUse,
+	})
+}
+
+// verifySignedURL checks a signed link and returns the issuing tenant, or
+// the status code and message to reject the request with. Single-use
+// links are burned on first verification.
+func (h *Handler) verifySignedURL(c *gin.Context) (string, int, string) {
+	cfg := config.AppConfig.Signing
+	if cfg.Secret == "" {
+		return "", http.StatusUnauthorized, "URL signing is not configured"
+	}
+
+	if c.Request.Method != http.MethodGet {
+		return "", http.StatusMethodNotAllowed, "Signed URLs only allow GET"
+	}
+	path := apiPath(c.Request.URL.Path)
+	if !signable(path) {
+		return "", http.StatusForbidden, "Signed URLs are not accepted on this route"
+	}
+
+	query := c.Request.URL.Query()
+	expected := computeSignature(signPayload(c.Request.Method, path, query))
+	if !hmac.Equal([]byte(expected), []byte(query.Get(sigParam))) {
+		return "", http.StatusUnauthorized, "Invalid signature"
+	}
+
+	expiresAt, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	remaining := time.Until(time.Unix(expiresAt, 0))
+	if err != nil || remaining <= 0 {
+		return "", http.StatusGone, "Signed URL has expired"
+	}
+
+	if cfg.SingleUse {
+		key := "signed:used:" + query.Get(nonceParam)
+		fresh, err := h.redisClient.SetNX(c.Request.Context(), key, 1, remaining).Result()
+		if err != nil {
+			return "", http.StatusInternalServerError, "Internal server error"
+		}
+		if !fresh {
+			return "", http.StatusGone, "Signed URL has already been used"
+		}
+	}
+	return query.Get(signerParam), 0, ""
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/worker"
+)
+
+var (
+	sloRequests = metrics.NewCounterVec("wdd_http_slo_requests_total",
+		"Requests measured against the latency budget of their route.", "route")
+	sloMet = metrics.NewCounterVec("wdd_http_slo_met_total",
+		"Requests answered without a server error within the latency budget of their route.", "route")
+	shedRequests = metrics.NewCounterVec("wdd_http_shed_total",
+		"Requests rejected with 503 before being served, by shed reason.", "reason")
+)
+
+// Shed reasons
+const (
+	shedInFlight = "in_flight"
+	shedBacklog  = "backlog"
+)
+
+// backlogRoutes submit jobs and are shed while the task queues are backed up
+var backlogRoutes = map[string]bool{
+	"/calculate-simhash": true,
+}
+
+// backlogRefresh is how long a backlog reading is reused
+const backlogRefresh = time.Second
+
+// shedder tracks the load requests are shed on
+type shedder struct {
+	inFlight int64
+
+	mu      sync.Mutex
+	backlog int
+	read    time.Time
+}
+
+// SLO measures each request against the latency budget of its route, see
+// config.http.slo, and sheds requests before they are served while too
+// many are in flight or, for job submissions, too many tasks are pending
+func (h *Handler) SLO(c *gin.Context) {
+	route := apiPath(c.FullPath())
+	if route == "" {
+		c.Next()
+		return
+	}
+	cfg := config.AppConfig.HTTP.SLO
+
+	if route != "/metrics" && !strings.HasPrefix(route, "/admin/") {
+		n := atomic.AddInt64(&h.shed.inFlight, 1)
+		defer atomic.AddInt64(&h.shed.inFlight, -1)
+		if cfg.MaxInFlight > 0 && n > int64(cfg.MaxInFlight) {
+			shedRequest(c, shedInFlight)
+			return
+		}
+		if cfg.MaxBacklog > 0 && backlogRoutes[route] && h.shed.pending(c.Request.Context(), h.redisClient) >= cfg.MaxBacklog {
+			shedRequest(c, shedBacklog)
+			return
+		}
+	}
+
+	budget := routeBudget(route)
+	if budget <= 0 {
+		c.Next()
+		return
+	}
+	started := time.Now()
+	c.Next()
+	sloRequests.Inc(route)
+	if time.Since(started) <= budget && c.Writer.Status() < http.StatusInternalServerError {
+		sloMet.Inc(route)
+	}
+}
+
+// pending returns the task backlog, read from Redis at most once per
+// backlogRefresh. A failed read keeps the previous value.
+func (s *shedder) pending(ctx context.Context, rdb *redis.Client) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.read) < backlogRefresh {
+		return s.backlog
+	}
+	s.read = time.Now()
+	backlog, err := worker.Backlog(ctx, rdb)
+	if err != nil {
+		log.Printf("Failed to read task backlog: %v", err)
+		return s.backlog
+	}
+	s.backlog = backlog
+	return backlog
+}
+
+// routeBudget returns the latency budget of route, falling back to the
+// default budget
+func routeBudget(route string) time.Duration {
+	budgets := config.AppConfig.HTTP.SLO.Budgets
+	ms, ok := budgets[route]
+	if !ok {
+		ms = budgets["default"]
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func shedRequest(c *gin.Context, reason string) {
+	shedRequests.Inc(reason)
+	c.Header("Retry-After", strconv.Itoa(retryAfter()))
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, api.NewError("Server overloaded, retry later"))
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/pkg/storage"
+)
+
+// staleWarning flags responses built from values cached in process while
+// Redis was unreachable
+const staleWarning = `110 - "Response is Stale"`
+
+// MarkStale lets storage record reads answered from its stale cache and
+// adds a Warning header to responses built from them
+func MarkStale(c *gin.Context) {
+	c.Request = c.Request.WithContext(storage.TrackStale(c.Request.Context()))
+	c.Writer = &staleWriter{ResponseWriter: c.Writer, c: c}
+	c.Next()
+}
+
+// staleWriter sets the Warning header just before the response starts
+type staleWriter struct {
+	gin.ResponseWriter
+	c       *gin.Context
+	checked bool
+}
+
+func (w *staleWriter) check() {
+	if w.checked {
+		return
+	}
+	w.checked = true
+	if storage.Stale(w.c.Request.Context()) {
+		w.Header().Set("Warning", staleWarning)
+	}
+}
+
+func (w *staleWriter) WriteHeader(code int) {
+	w.check()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *staleWriter) WriteHeaderNow() {
+	w.check()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *staleWriter) Write(b []byte) (int, error) {
+	w.check()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *staleWriter) WriteString(s string) (int, error) {
+	w.check()
+	return w.ResponseWriter.WriteString(s)
+}
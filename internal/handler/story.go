@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/analysis"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// storyWords is the default number of words listed per change and side
+const storyWords = 10
+
+// Story serves /export/story?url=...&year=..., one document telling how a
+// page changed over a year: its eras at distance= bits (default
+// config.analysis.eras.distance), the captures more than threshold= bits
+// from the capture before, as for /changes, with the words= words that
+// changed most when features are stored, archive links and a short text
+// for each. Excluded captures are passed over.
+func (h *Handler) Story(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	year := c.Query("year")
+	n, err := strconv.Atoi(year)
+	if err != nil || len(year) != 4 {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+		return
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+	bits := worker.BitSize(size)
+	distance := worker.EraDistance()
+	if s := c.Query("distance"); s != "" {
+		if distance, err = strconv.Atoi(s); err != nil || distance < 0 || distance > bits {
+			c.JSON(http.StatusBadRequest, api.NewError(fmt.Sprintf("Invalid distance, expected 0 to %d", bits)))
+			return
+		}
+	}
+	threshold := config.AppConfig.Analysis.Changes.Threshold
+	if threshold <= 0 {
+		threshold = defaultChangeThreshold
+	}
+	if s := c.Query("threshold"); s != "" {
+		if threshold, err = strconv.Atoi(s); err != nil || threshold < 0 || threshold > bits {
+			c.JSON(http.StatusBadRequest, api.NewError(fmt.Sprintf("Invalid threshold, expected 0 to %d", bits)))
+			return
+		}
+	}
+	words := storyWords
+	if s := c.Query("words"); s != "" {
+		if words, err = strconv.Atoi(s); err != nil || words < 0 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid words"))
+			return
+		}
+	}
+	src, err := archive.Named(c.Query("archive"))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	captures, found := inYears(storage.WithoutExcluded(stored, exclusions), n, n, 1)
+	if found == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	ofYear, _ := inYears(captures, n, n, 0)
+	eras := analysis.Eras(ofYear, distance)
+	if eras == nil {
+		eras = []analysis.Era{}
+	}
+	eraStarts := make(map[string]bool, len(eras))
+	for i, era := range eras {
+		if i > 0 {
+			eraStarts[era.Start] = true
+		}
+	}
+
+	story := api.Story{URL: url, Year: year, Size: bits, Distance: distance, Threshold: threshold,
+		Captures: found, Eras: eras, Changes: []api.StoryChange{}}
+	var from string
+	var fromHash uint64
+	decoded := false
+	for _, capture := range captures {
+		hash, err := simhash.DecodeSimHash(capture.SimHash)
+		prev, prevHash, comparable := from, fromHash, decoded
+		from, fromHash, decoded = capture.Timestamp, hash, err == nil
+		if err != nil || !comparable || !inRange(capture.Timestamp, n, n) {
+			continue
+		}
+		d := simhash.Distance(prevHash, hash)
+		if d <= threshold {
+			continue
+		}
+		similarity := simhash.Similarity(d, bits)
+		change := api.StoryChange{
+			From:       prev,
+			To:         capture.Timestamp,
+			Distance:   d,
+			Similarity: similarity,
+			Label:      similarityLabel(similarity),
+			EraStart:   eraStarts[capture.Timestamp],
+			FromLink:   src.ViewURL(prev, url),
+			ToLink:     src.ViewURL(capture.Timestamp, url),
+		}
+		if words > 0 {
+			diff, err := store.FeatureChanges(ctx, url, prev, capture.Timestamp)
+			if err != nil && err != storage.ErrNotFound {
+				internalError(c, err)
+				return
+			}
+			if err == nil {
+				change.Words = topWords(diff, words)
+			}
+		}
+		change.Summary = changeSummary(change, bits)
+		story.Changes = append(story.Changes, change)
+	}
+	story.Summary = storySummary(story)
+	c.JSON(http.StatusOK, story)
+}
+
+// topWords keeps the n words of diff gaining the most weight and the n
+// losing the most
+func topWords(diff map[string]int, n int) *api.WordChanges {
+	var added, removed []string
+	for word, d := range diff {
+		if d > 0 {
+			added = append(added, word)
+		} else if d < 0 {
+			removed = append(removed, word)
+		}
+	}
+	words := &api.WordChanges{Added: map[string]int{}, Removed: map[string]int{}}
+	for _, w := range heaviest(added, diff, n, 1) {
+		words.Added[w] = diff[w]
+	}
+	for _, w := range heaviest(removed, diff, n, -1) {
+		words.Removed[w] = -diff[w]
+	}
+	return words
+}
+
+// heaviest orders words by sign*diff, largest first, and keeps n
+func heaviest(words []string, diff map[string]int, n, sign int) []string {
+	sort.Slice(words, func(i, j int) bool {
+		if a, b := sign*diff[words[i]], sign*diff[words[j]]; a != b {
+			return a > b
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > n {
+		words = words[:n]
+	}
+	return words
+}
+
+// changeSummary is the sentence telling a change of a story
+func changeSummary(change api.StoryChange, bits int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Between %s and %s the page changed by %d of %d bits (%s)",
+		storyDate(change.From), storyDate(change.To), change.Distance, bits, strings.ReplaceAll(change.Label, "_", " "))
+	if change.EraStart {
+		b.WriteString(", starting a new era")
+	}
+	b.WriteString(".")
+	if change.Words != nil {
+		if added := sortedWords(change.Words.Added); len(added) > 0 {
+			fmt.Fprintf(&b, " Added: %s.", strings.Join(added, ", "))
+		}
+		if removed := sortedWords(change.Words.Removed); len(removed) > 0 {
+			fmt.Fprintf(&b, " Removed: %s.", strings.Join(removed, ", "))
+		}
+	}
+	return b.String()
+}
+
+// storySummary is the text opening a story
+func storySummary(story api.Story) string {
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	summary := fmt.Sprintf("%s was captured %s in %s, falling into %s.",
+		story.URL, plural(story.Captures, "time"), story.Year, plural(len(story.Eras), "era"))
+	if len(story.Changes) == 0 {
+		return summary + fmt.Sprintf(" No capture changed by more than %d bits.", story.Threshold)
+	}
+	largest := story.Changes[0]
+	for _, change := range story.Changes[1:] {
+		if change.Distance > largest.Distance {
+			largest = change
+		}
+	}
+	return summary + fmt.Sprintf(" %s changed by more than %d bits, the largest on %s (%d bits).",
+		plural(len(story.Changes), "capture"), story.Threshold, storyDate(largest.To), largest.Distance)
+}
+
+// sortedWords lists the words of weights, heaviest first
+func sortedWords(weights map[string]int) []string {
+	words := make([]string, 0, len(weights))
+	for w := range weights {
+		words = append(words, w)
+	}
+	return heaviest(words, weights, len(words), 1)
+}
+
+// storyDate formats a timestamp as a date for story texts
+func storyDate(timestamp string) string {
+	t, err := ts.Parse(timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.Format("January 2, 2006")
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// SetTaskPriority moves a waiting job to another queue or to the front of
+// its queue, so urgent requests need not wait behind bulk crawls
+func (h *Handler) SetTaskPriority(c *gin.Context) {
+	var req api.TaskPriority
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid priority body"))
+		return
+	}
+	if req.Queue != "" {
+		if _, ok := worker.Queues()[req.Queue]; !ok {
+			c.JSON(http.StatusBadRequest, api.NewError("Unknown queue"))
+			return
+		}
+	}
+
+	id := c.Param("id")
+	info, err := worker.Reprioritize(c.Request.Context(), h.redisClient, h.inspector, h.taskClient, id, req.Queue, req.Front)
+	switch {
+	case errors.Is(err, worker.ErrTaskNotFound):
+		c.JSON(http.StatusNotFound, api.NewError("Job not found"))
+		return
+	case errors.Is(err, worker.ErrTaskNotWaiting):
+		c.JSON(http.StatusConflict, api.NewError("Job is no longer waiting"))
+		return
+	case err != nil:
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TaskQueued{JobID: id, Queue: info.Queue, State: info.State.String()})
+}
+
+// RetryTask runs a failed job again under its job ID, without waiting for
+// its running-task marker to lapse. The body may ask to reset its retry
+// count.
+func (h *Handler) RetryTask(c *gin.Context) {
+	var req api.TaskRetry
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid retry body"))
+			return
+		}
+	}
+
+	id := c.Param("id")
+	info, err := worker.RetryFailed(c.Request.Context(), h.redisClient, h.inspector, h.taskClient, id, req.ResetRetries)
+	switch {
+	case errors.Is(err, worker.ErrTaskNotFound):
+		c.JSON(http.StatusNotFound, api.NewError("Job not found"))
+		return
+	case errors.Is(err, worker.ErrTaskNotFailed):
+		c.JSON(http.StatusConflict, api.NewError("Job has not failed"))
+		return
+	case errors.Is(err, worker.ErrJobRunning):
+		c.JSON(http.StatusConflict, api.NewError("Another job is running for this URL"))
+		return
+	case err != nil:
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TaskQueued{JobID: id, Queue: info.Queue, State: info.State.String()})
+}
+
+// maxJobList caps limit= of /jobs
+const maxJobList = 1000
+
+// ListJobs serves GET /jobs, the calculation jobs waiting, running,
+// retrying and recently completed across the queues. state= takes a
+// comma-separated list of states and queue= one queue; limit= defaults
+// to 100.
+func (h *Handler) ListJobs(c *gin.Context) {
+	var states []string
+	if s := c.Query("state"); s != "" {
+		for _, state := range strings.Split(s, ",") {
+			if !validJobState(state) {
+				c.JSON(http.StatusBadRequest, api.NewError("Unknown state"))
+				return
+			}
+			states = append(states, state)
+		}
+	}
+	queue := c.Query("queue")
+	if _, ok := worker.Queues()[queue]; queue != "" && !ok {
+		c.JSON(http.StatusBadRequest, api.NewError("Unknown queue"))
+		return
+	}
+	limit := 100
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid limit"))
+			return
+		}
+		limit = n
+	}
+	if limit > maxJobList {
+		limit = maxJobList
+	}
+
+	jobs, err := worker.ListJobs(c.Request.Context(), h.redisClient, h.inspector, states, queue, limit)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, api.JobList{Jobs: jobs, Count: len(jobs)})
+}
+
+func validJobState(state string) bool {
+	for _, s := range worker.JobStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
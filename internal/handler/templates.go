@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// ListTemplates returns all job templates
+func (h *Handler) ListTemplates(c *gin.Context) {
+	all, err := h.redisClient.HGetAll(c.Request.Context(), worker.TemplatesKey).Result()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	templates := make(map[string]worker.JobOptions, len(all))
+	for name, raw := range all {
+		var opts worker.JobOptions
+		if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+			continue
+		}
+		templates[name] = opts
+	}
+
+	c.JSON(http.StatusOK, api.TemplateList{Templates: templates})
+}
+
+// GetTemplate returns a single job template
+func (h *Handler) GetTemplate(c *gin.Context) {
+	name := c.Param("name")
+	opts, found, err := worker.LoadTemplate(c.Request.Context(), h.redisClient, name)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, api.NewError("Template not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Template{Name: name, Options: opts})
+}
+
+// PutTemplate creates or replaces a job template from the JSON body
+func (h *Handler) PutTemplate(c *gin.Context) {
+	name := c.Param("name")
+
+	var opts worker.JobOptions
+	if err := c.ShouldBindJSON(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid template body"))
+		return
+	}
+
+	raw, _ := json.Marshal(opts)
+	if err := h.redisClient.HSet(c.Request.Context(), worker.TemplatesKey, name, raw).Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewError("Failed to store template"))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Template{Name: name, Options: opts})
+}
+
+// DeleteTemplate removes a job template
+func (h *Handler) DeleteTemplate(c *gin.Context) {
+	name := c.Param("name")
+
+	removed, err := h.redisClient.HDel(c.Request.Context(), worker.TemplatesKey, name).Result()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("Template not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TemplateDeleted{Status: api.StatusDeleted, Name: name})
+}
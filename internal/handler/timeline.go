@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// Timeline serves /timeline?url=...&year=..., the captures of a year in
+// timestamp order with the distance of each to the one before, for change
+// graphs. Excluded captures are passed over.
+func (h *Handler) Timeline(c *gin.Context) {
+	url := queryURL(c)
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	year := c.Query("year")
+	n, err := strconv.Atoi(year)
+	if err != nil || len(year) != 4 {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+		return
+	}
+	store, size, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	// The capture preceding the year gives the first one its distance
+	captures, found := inYears(storage.WithoutExcluded(stored, exclusions), n, n, 1)
+	if found == 0 {
+		c.JSON(http.StatusNotFound, api.NewError("NOT_CAPTURED"))
+		return
+	}
+
+	respond(c, http.StatusOK, api.CaptureTimeline{
+		URL:      url,
+		Year:     year,
+		Size:     worker.BitSize(size),
+		Captures: timelinePoints(captures, n),
+		Excluded: len(excludedReasons(ofYear(stored, year), exclusions)),
+	})
+}
+
+// timelinePoints returns the captures of year with their distance to the
+// capture before, which may precede the year
+func timelinePoints(captures []storage.Capture, year int) []api.TimelinePoint {
+	points := []api.TimelinePoint{}
+	var prev uint64
+	decoded := false
+	for _, capture := range captures {
+		hash, err := simhash.DecodeSimHash(capture.SimHash)
+		if inRange(capture.Timestamp, year, year) {
+			point := api.TimelinePoint{Timestamp: capture.Timestamp, SimHash: capture.SimHash}
+			if err == nil && decoded {
+				d := simhash.Distance(prev, hash)
+				point.Distance = &d
+			}
+			points = append(points, point)
+		}
+		prev, decoded = hash, err == nil
+	}
+	return points
+}
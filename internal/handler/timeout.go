@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// Timeout bounds the request context by the route's configured timeout.
+// Handlers pass c.Request.Context() down to Redis, so work stops once the
+// deadline passes or the client disconnects.
+func Timeout(c *gin.Context) {
+	d := routeTimeout(apiPath(c.FullPath()))
+	if d <= 0 {
+		c.Next()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// routeTimeout returns the timeout of route, falling back to the default
+func routeTimeout(route string) time.Duration {
+	cfg := config.AppConfig.HTTP
+	seconds, ok := cfg.RouteTimeouts[route]
+	if !ok {
+		seconds = cfg.Timeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// internalError answers a failed storage call, reporting an exceeded
+// request deadline as a timeout and unreachable storage as temporarily
+// unavailable rather than a server error
+func internalError(c *gin.Context, err error) {
+	if errors.Is(err, storage.ErrUnavailable) {
+		c.Header("Retry-After", strconv.Itoa(retryAfter()))
+		c.JSON(http.StatusServiceUnavailable, api.NewError("Storage temporarily unavailable"))
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, api.NewError("Request timed out"))
+		return
+	}
+	c.JSON(http.StatusInternalServerError, api.NewError("Internal server error"))
+}
+
+// retryAfter is the Retry-After in seconds sent with 503 responses
+func retryAfter() int {
+	if s := config.AppConfig.Storage.RetryAfter; s > 0 {
+		return s
+	}
+	return 5
+}
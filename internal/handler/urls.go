@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+)
+
+// Page sizes of /urls
+const (
+	defaultURLsPageSize = 100
+	maxURLsPageSize     = 1000
+)
+
+// ListURLs serves /urls?year=...&page=..., the URLs this deployment has
+// computed hashes for in a year, page_size at a time in byte order.
+// Pages are numbered from 1.
+func (h *Handler) ListURLs(c *gin.Context) {
+	year := c.Query("year")
+	if _, err := strconv.Atoi(year); err != nil || len(year) != 4 {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+		return
+	}
+	page, pageSize, ok := queryPage(c, defaultURLsPageSize, maxURLsPageSize)
+	if !ok {
+		return
+	}
+	store, _, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	urls, total, err := store.URLs(c.Request.Context(), year, (page-1)*pageSize, pageSize)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if urls == nil {
+		urls = []string{}
+	}
+	respond(c, http.StatusOK, api.URLs{Year: year, URLs: urls, Page: page, PageSize: pageSize, Total: total})
+}
+
+// queryPage reads the page= and page_size= parameters, page_size also
+// accepted as limit, answering 400 for invalid ones. Pages are numbered
+// from 1.
+func queryPage(c *gin.Context, defaultSize, maxSize int) (page, pageSize int, ok bool) {
+	page, pageSize = 1, defaultSize
+	var err error
+	if s := c.Query("page"); s != "" {
+		if page, err = strconv.Atoi(s); err != nil || page < 1 {
+			c.JSON(http.StatusBadRequest, api.NewError("page must be a positive integer"))
+			return 0, 0, false
+		}
+	}
+	if s := queryEither(c, "page_size", "limit"); s != "" {
+		if pageSize, err = strconv.Atoi(s); err != nil || pageSize < 1 || pageSize > maxSize {
+			c.JSON(http.StatusBadRequest, api.NewError("page_size must be between 1 and "+strconv.Itoa(maxSize)))
+			return 0, 0, false
+		}
+	}
+	return page, pageSize, true
+}
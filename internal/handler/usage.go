@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/usage"
+)
+
+// tenantKey is the gin context key holding the caller's tenant name
+const tenantKey = "tenant"
+
+// Authenticate resolves the caller's API key, or the issuer of a signed
+// URL, to a tenant, counts the request against it and reports today's
+// usage in response headers. When no API keys are configured every
+// caller is the anonymous tenant.
+func (h *Handler) Authenticate(c *gin.Context) {
+	tenant := usage.Anonymous
+	if c.Query(sigParam) != "" {
+		signer, code, message := h.verifySignedURL(c)
+		if code != 0 {
+			c.AbortWithStatusJSON(code, api.NewError(message))
+			return
+		}
+		if signer != "" {
+			tenant = signer
+		}
+	} else if keys := config.AppConfig.Auth.APIKeys; len(keys) > 0 {
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			key = c.Query("api_key")
+		}
+
+		tenant = ""
+		for _, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+				tenant = k.Tenant
+				break
+			}
+		}
+		if tenant == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewError("Invalid API key"))
+			return
+		}
+	}
+	c.Set(tenantKey, tenant)
+
+	ctx := c.Request.Context()
+	if today, err := usage.RecordToday(ctx, h.redisClient, tenant, usage.Counters{usage.Requests: 1}); err == nil {
+		c.Header("X-Usage-Requests", strconv.FormatInt(today[usage.Requests], 10))
+		c.Header("X-Usage-Snapshots", strconv.FormatInt(today[usage.Snapshots], 10))
+		c.Header("X-Usage-Bytes", strconv.FormatInt(today[usage.Bytes], 10))
+	}
+	c.Next()
+}
+
+// GetUsage reports per-tenant usage over a date range (YYYYMMDD, inclusive).
+// The range defaults to the last 30 days; without tenant= (formerly key=)
+// all tenants are listed.
+func (h *Handler) GetUsage(c *gin.Context) {
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -29)
+
+	var err error
+	if s := c.Query("from"); s != "" {
+		if from, err = usage.ParseDay(s); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid from date, expected YYYYMMDD"))
+			return
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if to, err = usage.ParseDay(s); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewError("Invalid to date, expected YYYYMMDD"))
+			return
+		}
+	}
+	if to.Before(from) || to.Sub(from) > 366*24*time.Hour {
+		c.JSON(http.StatusBadRequest, api.NewError("Date range must be ordered and at most one year"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenants := []string{queryEither(c, "tenant", "key")}
+	if tenants[0] == "" {
+		if tenants, err = usage.Tenants(ctx, h.redisClient); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+
+	report := make(map[string]api.TenantUsage, len(tenants))
+	for _, tenant := range tenants {
+		days, err := usage.Range(ctx, h.redisClient, tenant, from, to)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		report[tenant] = api.TenantUsage{Days: days, Total: usage.Sum(days)}
+	}
+
+	c.JSON(http.StatusOK, api.UsageReport{
+		From:    from.Format("20060102"),
+		To:      to.Format("20060102"),
+		Tenants: report,
+	})
+}
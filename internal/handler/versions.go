@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wayback-discover-diff/internal/api"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// getYearAsOf answers /simhash?year=...&as_of= with the hashes of the year
+// as a past job left them. as_of is the ID of that job, or a date picking
+// the latest version recorded at or before it.
+func getYearAsOf(c *gin.Context, store *storage.Store, url, urlKey, year, asOf string, fields rowFields, layout []string) {
+	ctx := c.Request.Context()
+	var version storage.Version
+	var stored []storage.Capture
+	var err error
+	if at, perr := ts.Parse(asOf); perr == nil {
+		version, stored, err = store.YearVersionAsOf(ctx, url, year, at)
+	} else {
+		version, stored, err = store.YearVersionByJob(ctx, url, year, asOf)
+	}
+	if err == storage.ErrNotFound {
+		c.JSON(http.StatusNotFound, api.NewError("VERSION_NOT_FOUND"))
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	captures := fields.rows(urlKey, stored, nil)
+	if c.Query("compress") != "1" {
+		respond(c, http.StatusOK, captures)
+		return
+	}
+	respond(c, http.StatusOK, api.YearCaptures{
+		URLKey:   urlKey,
+		Captures: captures,
+		Total:    len(captures),
+		Status:   api.StatusComplete,
+		JobID:    version.JobID,
+		AsOf:     version.At.Format(time.RFC3339),
+		Fields:   layout,
+	})
+}
+
+// ListVersions lists the recorded versions of the hashes of one year of a
+// URL, usable as /simhash?as_of=
+func (h *Handler) ListVersions(c *gin.Context) {
+	url := queryURL(c)
+	year := c.Query("year")
+	if url == "" {
+		c.JSON(http.StatusBadRequest, api.NewError("URL is required"))
+		return
+	}
+	if _, err := strconv.Atoi(year); err != nil || len(year) != 4 {
+		c.JSON(http.StatusBadRequest, api.NewError("Invalid year format"))
+		return
+	}
+	store, _, ok := h.queryStore(c)
+	if !ok {
+		return
+	}
+
+	versions, err := store.YearVersions(c.Request.Context(), url, year)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	resp := api.Versions{URL: url, Year: year, Versions: make([]api.Version, 0, len(versions))}
+	for _, v := range versions {
+		resp.Versions = append(resp.Versions, api.Version{JobID: v.JobID, At: v.At.Format(time.RFC3339)})
+	}
+	respond(c, http.StatusOK, resp)
+}
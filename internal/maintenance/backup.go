@@ -0,0 +1,381 @@
+package maintenance
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+const (
+	backupFormat  = "wayback-discover-diff-backup"
+	backupVersion = 1
+	manifestFile  = "manifest.json"
+	dataFile      = "data.ndjson"
+)
+
+// Manifest describes a backup directory
+type Manifest struct {
+	Format    string         `json:"format"`
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Counts    map[string]int `json:"counts"`
+	// SHA256 is the checksum of the data file
+	SHA256 string `json:"sha256"`
+}
+
+// Record is one line of the NDJSON data file. Values are written in
+// plaintext so backups can be restored into any storage backend.
+type Record struct {
+	Kind      string            `json:"kind"`
+	URL       string            `json:"url,omitempty"`
+	Timestamp string            `json:"timestamp,omitempty"`
+	Value     string            `json:"value,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	// Key is the Redis key of the kinds not keyed by URL and timestamp
+	Key string `json:"key,omitempty"`
+	// Scores are the members of a sorted set key
+	Scores map[string]float64 `json:"scores,omitempty"`
+	// Size is the bit size of a non-default-size simhash or its metadata
+	Size int `json:"size,omitempty"`
+	// TTL is the remaining lifetime in seconds, zero for none
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// Record kinds
+const (
+	KindSimhash = "simhash"
+	KindMeta    = "meta"
+	// KindFeatures is a stored feature map or delta, KindVersion the
+	// captures of a year version and KindDiffLink a diff permalink, each
+	// one sealed string key
+	KindFeatures = "features"
+	KindVersion  = "version"
+	KindDiffLink = "diff_link"
+	// KindExclusions and KindEras are hashes of sealed fields
+	KindExclusions = "exclusions"
+	KindEras       = "eras"
+	// KindVersionIndex is the sorted set of the versions of a year
+	KindVersionIndex = "version_index"
+	// KindBaseline is the pinned baseline of URL
+	KindBaseline = "baseline"
+)
+
+// stringKinds are the kinds backed up as one sealed value per key, by key
+// prefix
+var stringKinds = []struct{ prefix, kind string }{
+	{"features:", KindFeatures},
+	{"version:", KindVersion},
+	{storage.DiffLinkKey(""), KindDiffLink},
+}
+
+// hashKinds are the kinds backed up as one record of sealed fields per key
+var hashKinds = []struct{ prefix, kind string }{
+	{storage.ExclusionsKey(""), KindExclusions},
+	{storage.ErasKey(""), KindEras},
+}
+
+// Backup streams every simhash and metadata record, along with the
+// features, versions, eras, exclusions, baselines and diff permalinks
+// kept for them, into dir
+func Backup(ctx context.Context, store *storage.Store, dir string) (Manifest, error) {
+	manifest := Manifest{
+		Format:    backupFormat,
+		Version:   backupVersion,
+		CreatedAt: time.Now().UTC(),
+		Counts:    map[string]int{},
+	}
+
+	// Values are written decrypted, so only the owner may read them
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return manifest, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, dataFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(f, hash))
+	enc := json.NewEncoder(buf)
+
+	// The bare prefix also covers the namespaces of other sizes (simhash32:)
+	err = store.ScanPrefix(ctx, "simhash", func(keys []string) error {
+		for _, key := range keys {
+			size, url, timestamp, ok := storage.ParseSizedSimhashKey(key)
+			if !ok {
+				continue
+			}
+			value, err := store.ReadKey(ctx, key)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			rec := Record{Kind: KindSimhash, URL: url, Timestamp: timestamp, Value: value, Size: size,
+				TTL: ttlOf(ctx, store, key)}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			manifest.Counts[KindSimhash]++
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	err = store.ScanPrefix(ctx, "meta", func(keys []string) error {
+		for _, key := range keys {
+			size, url, timestamp, ok := storage.ParseSizedMetaKey(key)
+			if !ok {
+				continue
+			}
+			fields, err := store.WithSize(size).GetCaptureMeta(ctx, url, timestamp)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			rec := Record{Kind: KindMeta, URL: url, Timestamp: timestamp, Fields: fields, Size: size,
+				TTL: ttlOf(ctx, store, key)}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			manifest.Counts[KindMeta]++
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	emit := func(rec Record) error {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		manifest.Counts[rec.Kind]++
+		return nil
+	}
+	for _, k := range stringKinds {
+		err = store.ScanPrefix(ctx, k.prefix, func(keys []string) error {
+			for _, key := range keys {
+				value, err := store.ReadKey(ctx, key)
+				if err == storage.ErrNotFound {
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %v", key, err)
+				}
+				if err := emit(Record{Kind: k.kind, Key: key, Value: value, TTL: ttlOf(ctx, store, key)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return manifest, err
+		}
+	}
+	for _, k := range hashKinds {
+		err = store.ScanPrefix(ctx, k.prefix, func(keys []string) error {
+			for _, key := range keys {
+				fields, err := store.ReadHash(ctx, key)
+				if err != nil {
+					return fmt.Errorf("%s: %v", key, err)
+				}
+				if len(fields) == 0 {
+					continue
+				}
+				if err := emit(Record{Kind: k.kind, Key: key, Fields: fields, TTL: ttlOf(ctx, store, key)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	client := store.Client()
+	err = store.ScanPrefix(ctx, "versions:", func(keys []string) error {
+		for _, key := range keys {
+			members, err := client.ZRangeWithScores(ctx, key, 0, -1).Result()
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if len(members) == 0 {
+				continue
+			}
+			scores := make(map[string]float64, len(members))
+			for _, m := range members {
+				if job, ok := m.Member.(string); ok {
+					scores[job] = m.Score
+				}
+			}
+			if err := emit(Record{Kind: KindVersionIndex, Key: key, Scores: scores, TTL: ttlOf(ctx, store, key)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	baselines, err := client.HGetAll(ctx, storage.BaselinesKey).Result()
+	if err != nil {
+		return manifest, err
+	}
+	for url, timestamp := range baselines {
+		if err := emit(Record{Kind: KindBaseline, URL: url, Timestamp: timestamp}); err != nil {
+			return manifest, err
+		}
+	}
+
+	if err := buf.Flush(); err != nil {
+		return manifest, err
+	}
+	if err := f.Sync(); err != nil {
+		return manifest, err
+	}
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, os.WriteFile(filepath.Join(dir, manifestFile), data, 0o600)
+}
+
+// Restore loads a backup directory written by Backup into store and lists
+// the URLs of the restored hashes for /urls. The data file is verified
+// against the manifest checksum before anything is written.
+func Restore(ctx context.Context, store *storage.Store, dir string) (map[string]int, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Format != backupFormat || manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup format %s v%d", manifest.Format, manifest.Version)
+	}
+
+	path := filepath.Join(dir, dataFile)
+	if sum, err := fileSHA256(path); err != nil {
+		return nil, err
+	} else if sum != manifest.SHA256 {
+		return nil, fmt.Errorf("data file checksum mismatch")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	counts := map[string]int{}
+	indexed := map[string]bool{}
+	client := store.Client()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return counts, err
+		}
+
+		ttl := time.Duration(rec.TTL) * time.Second
+		switch rec.Kind {
+		case KindSimhash:
+			if err = store.WithSize(rec.Size).SetSimHash(ctx, rec.URL, rec.Timestamp, rec.Value, ttl); err == nil {
+				err = indexRestored(ctx, store, rec, indexed)
+			}
+		case KindMeta:
+			err = store.WithSize(rec.Size).SetCaptureMeta(ctx, rec.URL, rec.Timestamp, rec.Fields, ttl)
+		case KindFeatures, KindVersion, KindDiffLink:
+			err = store.WriteKey(ctx, rec.Key, rec.Value, ttl)
+		case KindExclusions, KindEras:
+			for field, value := range rec.Fields {
+				if err = store.WriteHashField(ctx, rec.Key, field, value, ttl); err != nil {
+					break
+				}
+			}
+		case KindVersionIndex:
+			pipe := client.TxPipeline()
+			for job, score := range rec.Scores {
+				pipe.ZAdd(ctx, rec.Key, &redis.Z{Score: score, Member: job})
+			}
+			if ttl > 0 {
+				pipe.Expire(ctx, rec.Key, ttl)
+			}
+			_, err = pipe.Exec(ctx)
+		case KindBaseline:
+			err = store.SetBaseline(ctx, rec.URL, rec.Timestamp)
+		default:
+			continue
+		}
+		if err != nil {
+			return counts, err
+		}
+		counts[rec.Kind]++
+	}
+	return counts, nil
+}
+
+// indexRestored lists the URL of a restored simhash under its year, once
+// per size, archive, URL and year
+func indexRestored(ctx context.Context, store *storage.Store, rec Record, indexed map[string]bool) error {
+	year := ts.Year(rec.Timestamp)
+	seen := fmt.Sprintf("%d|%s|%s", rec.Size, rec.URL, year)
+	if year == "" || indexed[seen] {
+		return nil
+	}
+	indexed[seen] = true
+	name, url := storage.SplitArchiveURL(rec.URL)
+	return store.WithArchive(name).WithSize(rec.Size).IndexURL(ctx, url, year, retention.TTL(storage.RetentionCaptures))
+}
+
+func ttlOf(ctx context.Context, store *storage.Store, key string) int64 {
+	ttl, err := store.Client().TTL(ctx, key).Result()
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return int64(ttl / time.Second)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
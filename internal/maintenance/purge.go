@@ -0,0 +1,352 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/usage"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// TypePurge is the admin task deleting the stored data of a host or tenant
+const TypePurge = "maintenance:purge"
+
+// purgeTTL is how long the progress of a purge is kept
+const purgeTTL = 7 * 24 * time.Hour
+
+// Purge task states
+const (
+	PurgeQueued    = "queued"
+	PurgeRunning   = "running"
+	PurgeCompleted = "completed"
+	PurgeFailed    = "failed"
+)
+
+// PurgePayload names the host or the tenant whose data a purge deletes
+type PurgePayload struct {
+	Host   string `json:"host,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// PurgeProgress is the state of a purge, saved after every batch
+type PurgeProgress struct {
+	ID     string `json:"id"`
+	Host   string `json:"host,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	Status string `json:"status"`
+	// Scanned is the number of keys examined and Removed the number of
+	// keys, index entries and records deleted so far
+	Scanned int    `json:"scanned"`
+	Removed int    `json:"removed"`
+	Error   string `json:"error,omitempty"`
+	// StartedAt is when the purge was submitted
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func purgeKey(id string) string {
+	return "purge:" + id
+}
+
+// EnqueuePurge submits a purge and returns its task ID
+func (p *Purger) EnqueuePurge(ctx context.Context, taskClient *asynq.Client, payload PurgePayload) (string, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	info, err := taskClient.EnqueueContext(ctx, asynq.NewTask(TypePurge, raw), asynq.MaxRetry(3))
+	if err != nil {
+		return "", fmt.Errorf("failed to create task: %v", err)
+	}
+	p.save(ctx, &PurgeProgress{ID: info.ID, Host: payload.Host, Tenant: payload.Tenant,
+		Status: PurgeQueued, StartedAt: time.Now().UTC()})
+	return info.ID, nil
+}
+
+// LoadPurge returns the progress of the purge with task ID id
+func LoadPurge(ctx context.Context, redisClient *redis.Client, id string) (PurgeProgress, bool, error) {
+	var progress PurgeProgress
+	raw, err := redisClient.Get(ctx, purgeKey(id)).Bytes()
+	if err == redis.Nil {
+		return progress, false, nil
+	}
+	if err != nil {
+		return progress, false, err
+	}
+	return progress, true, json.Unmarshal(raw, &progress)
+}
+
+// Purger deletes the data of a host or tenant in batches of
+// config.purge.batch_size keys, pausing config.purge.pause_ms between
+// them so that Redis keeps serving
+type Purger struct {
+	store *storage.Store
+}
+
+// NewPurger creates a purger of store
+func NewPurger(store *storage.Store) *Purger {
+	return &Purger{store: store}
+}
+
+// HandlePurge runs a purge. A host purge covers every archive and hash
+// size and treats www.host as host, like template profiles; a tenant
+// purge deletes its usage records, the only data kept per tenant. Jobs
+// still running for the host are not stopped. A retried purge scans again
+// from the start.
+func (p *Purger) HandlePurge(ctx context.Context, t *asynq.Task) error {
+	var payload PurgePayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	id, _ := asynq.GetTaskID(ctx)
+	progress := &PurgeProgress{ID: id, Host: payload.Host, Tenant: payload.Tenant,
+		Status: PurgeRunning, StartedAt: time.Now().UTC()}
+	if queued, found, err := LoadPurge(ctx, p.store.Client(), id); err == nil && found {
+		progress.StartedAt = queued.StartedAt
+	}
+	p.save(ctx, progress)
+
+	var err error
+	if payload.Host != "" {
+		err = p.purgeHost(ctx, worker.ProfileHost(payload.Host), progress)
+	} else {
+		err = p.purgeTenant(ctx, payload.Tenant, progress)
+	}
+	if err != nil {
+		progress.Status, progress.Error = PurgeFailed, err.Error()
+	} else {
+		progress.Status = PurgeCompleted
+	}
+	p.save(ctx, progress)
+	logging.Infof(logging.Storage, "purge %s: %s, %d of %d keys scanned removed", id, progress.Status, progress.Removed, progress.Scanned)
+	return err
+}
+
+// purgeHost removes the per-URL keys of host's pages while scanning the
+// whole keyspace, drops its pages from the year indexes met on the way,
+// then unpins their baselines and forgets their failed captures
+func (p *Purger) purgeHost(ctx context.Context, host string, progress *PurgeProgress) error {
+	if host == "" {
+		return fmt.Errorf("invalid host: %w", asynq.SkipRetry)
+	}
+	client := p.store.Client()
+	ofHost := func(url string) bool {
+		_, url = storage.SplitArchiveURL(url)
+		return worker.ProfileHost(url) == host
+	}
+
+	err := p.batches(ctx, progress, func(cursor uint64, count int64) ([]string, uint64, error) {
+		return client.Scan(ctx, cursor, "*", count).Result()
+	}, func(keys []string) error {
+		progress.Scanned += len(keys)
+		var doomed []string
+		for _, key := range keys {
+			if isURLsKey(key) {
+				if err := p.unindexHost(ctx, key, ofHost, progress); err != nil {
+					return err
+				}
+				continue
+			}
+			if url, ok := keyURL(key); ok && ofHost(url) {
+				doomed = append(doomed, key)
+			}
+		}
+		if len(doomed) == 0 {
+			return nil
+		}
+		if err := client.Unlink(ctx, doomed...).Err(); err != nil {
+			return err
+		}
+		progress.Removed += len(doomed)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.batches(ctx, progress, func(cursor uint64, count int64) ([]string, uint64, error) {
+		return client.HScan(ctx, storage.BaselinesKey, cursor, "*", count).Result()
+	}, func(fields []string) error {
+		var unpinned []string
+		for i := 0; i+1 < len(fields); i += 2 {
+			if ofHost(fields[i]) {
+				unpinned = append(unpinned, fields[i])
+			}
+		}
+		if len(unpinned) == 0 {
+			return nil
+		}
+		if err := client.HDel(ctx, storage.BaselinesKey, unpinned...).Err(); err != nil {
+			return err
+		}
+		progress.Removed += len(unpinned)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dropped, err := worker.DropCaptureErrors(ctx, client, ofHost)
+	progress.Removed += dropped
+	return err
+}
+
+// unindexHost drops the pages of host from the year index key
+func (p *Purger) unindexHost(ctx context.Context, key string, ofHost func(string) bool, progress *PurgeProgress) error {
+	client := p.store.Client()
+	var cursor uint64
+	for {
+		members, next, err := client.ZScan(ctx, key, cursor, "*", purgeBatch()).Result()
+		if err != nil {
+			return err
+		}
+		var doomed []interface{}
+		for i := 0; i+1 < len(members); i += 2 {
+			if ofHost(members[i]) {
+				doomed = append(doomed, members[i])
+			}
+		}
+		if len(doomed) > 0 {
+			if err := client.ZRem(ctx, key, doomed...).Err(); err != nil {
+				return err
+			}
+			progress.Removed += len(doomed)
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// purgeTenant removes the daily usage records of tenant
+func (p *Purger) purgeTenant(ctx context.Context, tenant string, progress *PurgeProgress) error {
+	if tenant == "" {
+		return fmt.Errorf("invalid tenant: %w", asynq.SkipRetry)
+	}
+	client := p.store.Client()
+	pattern := storage.EscapePattern(usage.KeyPrefix(tenant)) + "*"
+	err := p.batches(ctx, progress, func(cursor uint64, count int64) ([]string, uint64, error) {
+		return client.Scan(ctx, cursor, pattern, count).Result()
+	}, func(keys []string) error {
+		progress.Scanned += len(keys)
+		if err := client.Unlink(ctx, keys...).Err(); err != nil {
+			return err
+		}
+		progress.Removed += len(keys)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return usage.Forget(ctx, client, tenant)
+}
+
+// batches runs a SCAN-style iteration to its end, handing each non-empty
+// batch to fn, saving progress and pausing config.purge.pause_ms between
+// batches
+func (p *Purger) batches(ctx context.Context, progress *PurgeProgress,
+	next func(cursor uint64, count int64) ([]string, uint64, error), fn func([]string) error) error {
+	pause := time.Duration(config.AppConfig.Purge.PauseMs) * time.Millisecond
+	var cursor uint64
+	for {
+		batch, following, err := next(cursor, purgeBatch())
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+		p.save(ctx, progress)
+		if following == 0 {
+			return nil
+		}
+		cursor = following
+		if pause > 0 {
+			select {
+			case <-time.After(pause):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func (p *Purger) save(ctx context.Context, progress *PurgeProgress) {
+	progress.UpdatedAt = time.Now().UTC()
+	raw, err := json.Marshal(progress)
+	if err != nil {
+		return
+	}
+	if err := p.store.Client().Set(ctx, purgeKey(progress.ID), raw, purgeTTL).Err(); err != nil {
+		logging.Warnf(logging.Storage, "purge %s: saving progress: %v", progress.ID, err)
+	}
+}
+
+// purgeBatch is config.purge.batch_size, default 500
+func purgeBatch() int64 {
+	if n := config.AppConfig.Purge.BatchSize; n > 0 {
+		return int64(n)
+	}
+	return 500
+}
+
+// Families of per-URL keys: the URL is followed by a final :segment in
+// those of segmentedPrefixes and ends the key in those of wholePrefixes
+var (
+	segmentedPrefixes = []string{"features:", "versions:", "version:", "task:", "recent:task:"}
+	wholePrefixes     = []string{"eras:", "exclusions:"}
+)
+
+// keyURL returns the archive-scoped URL a per-URL key belongs to
+func keyURL(key string) (string, bool) {
+	if _, url, _, ok := storage.ParseSizedSimhashKey(key); ok {
+		return url, true
+	}
+	if _, url, _, ok := storage.ParseSizedMetaKey(key); ok {
+		return url, true
+	}
+	for _, prefix := range segmentedPrefixes {
+		if rest := strings.TrimPrefix(key, prefix); rest != key {
+			if i := strings.LastIndex(rest, ":"); i > 0 {
+				return rest[:i], true
+			}
+			return "", false
+		}
+	}
+	for _, prefix := range wholePrefixes {
+		if rest := strings.TrimPrefix(key, prefix); rest != key && rest != "" {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// isURLsKey reports whether key is a year index of storage.URLsKey
+func isURLsKey(key string) bool {
+	rest := strings.TrimPrefix(key, "urls")
+	if rest == key {
+		return false
+	}
+	i := strings.Index(rest, ":")
+	if i < 0 {
+		return false
+	}
+	for _, r := range rest[:i] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package maintenance
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// queuePageSize is the number of tasks listed per inspector call
+const queuePageSize = 500
+
+// TaskRecord is one line of a queue export: a waiting task with the
+// options needed to enqueue it again
+type TaskRecord struct {
+	Queue   string `json:"queue"`
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Payload []byte `json:"payload"`
+	// State is pending, scheduled or retry
+	State     string    `json:"state"`
+	ProcessAt time.Time `json:"process_at"`
+	MaxRetry  int       `json:"max_retry"`
+	Retried   int       `json:"retried,omitempty"`
+	// Timeout and Retention are in seconds
+	Timeout   int64     `json:"timeout,omitempty"`
+	Deadline  time.Time `json:"deadline"`
+	Retention int64     `json:"retention,omitempty"`
+}
+
+// ExportQueues writes every pending, scheduled and retrying task of every
+// queue to w as NDJSON, returning the number of tasks per state
+func ExportQueues(inspector *asynq.Inspector, w io.Writer) (map[string]int, error) {
+	counts := map[string]int{}
+	queues, err := inspector.Queues()
+	if err != nil {
+		return counts, err
+	}
+
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	for _, queue := range queues {
+		listers := []func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error){
+			inspector.ListPendingTasks,
+			inspector.ListScheduledTasks,
+			inspector.ListRetryTasks,
+		}
+		for _, list := range listers {
+			for page := 1; ; page++ {
+				tasks, err := list(queue, asynq.Page(page), asynq.PageSize(queuePageSize))
+				if err != nil {
+					return counts, fmt.Errorf("queue %s: %v", queue, err)
+				}
+				for _, t := range tasks {
+					if err := enc.Encode(taskRecord(t)); err != nil {
+						return counts, err
+					}
+					counts[t.State.String()]++
+				}
+				if len(tasks) < queuePageSize {
+					break
+				}
+			}
+		}
+	}
+	return counts, buf.Flush()
+}
+
+func taskRecord(t *asynq.TaskInfo) TaskRecord {
+	rec := TaskRecord{
+		Queue:     t.Queue,
+		ID:        t.ID,
+		Type:      t.Type,
+		Payload:   t.Payload,
+		State:     t.State.String(),
+		MaxRetry:  t.MaxRetry,
+		Retried:   t.Retried,
+		Timeout:   int64(t.Timeout / time.Second),
+		Deadline:  t.Deadline,
+		Retention: int64(t.Retention / time.Second),
+	}
+	if t.State != asynq.TaskStatePending {
+		rec.ProcessAt = t.NextProcessAt
+	}
+	return rec
+}
+
+// ImportQueues enqueues the tasks of an export written by ExportQueues.
+// Tasks whose ID is already queued are skipped, so an import can be
+// repeated safely. Counts are returned per state, plus "existing".
+func ImportQueues(ctx context.Context, client *asynq.Client, r io.Reader) (map[string]int, error) {
+	counts := map[string]int{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec TaskRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return counts, err
+		}
+
+		opts := []asynq.Option{asynq.Queue(rec.Queue), asynq.TaskID(rec.ID), asynq.MaxRetry(rec.MaxRetry)}
+		if rec.Timeout > 0 {
+			opts = append(opts, asynq.Timeout(time.Duration(rec.Timeout)*time.Second))
+		}
+		if !rec.Deadline.IsZero() {
+			opts = append(opts, asynq.Deadline(rec.Deadline))
+		}
+		if rec.Retention > 0 {
+			opts = append(opts, asynq.Retention(time.Duration(rec.Retention)*time.Second))
+		}
+		if rec.ProcessAt.After(time.Now()) {
+			opts = append(opts, asynq.ProcessAt(rec.ProcessAt))
+		}
+
+		_, err = client.EnqueueContext(ctx, asynq.NewTask(rec.Type, rec.Payload), opts...)
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			counts["existing"]++
+			continue
+		}
+		if err != nil {
+			return counts, fmt.Errorf("task %s: %v", rec.ID, err)
+		}
+		counts[rec.State]++
+	}
+	return counts, nil
+}
@@ -0,0 +1,335 @@
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// maxSamples bounds the example keys listed per problem in a report
+const maxSamples = 20
+
+// Problem counts the keys affected by one kind of inconsistency
+type Problem struct {
+	Count   int      `json:"count"`
+	Fixed   int      `json:"fixed"`
+	Samples []string `json:"samples,omitempty"`
+}
+
+func (p *Problem) add(key string) {
+	p.Count++
+	if len(p.Samples) < maxSamples {
+		p.Samples = append(p.Samples, key)
+	}
+}
+
+// RepairReport summarizes a storage scan
+type RepairReport struct {
+	Fix     bool `json:"fix"`
+	Scanned int  `json:"scanned"`
+	// MalformedKeys are simhash keys whose timestamp is not canonical
+	MalformedKeys Problem `json:"malformed_keys"`
+	// UndecodableValues cannot be decrypted or base64-decoded
+	UndecodableValues Problem `json:"undecodable_values"`
+	// MixedVersion hashes were written with another encoding width or bit
+	// size than their namespace, e.g. before simhash.size changed
+	MixedVersion Problem `json:"mixed_version"`
+	// OrphanedMetadata belongs to captures without a simhash of any size
+	OrphanedMetadata Problem `json:"orphaned_metadata"`
+	// OrphanedTasks are task markers pointing at jobs the queue has forgotten
+	OrphanedTasks Problem `json:"orphaned_tasks"`
+	// UnlistedYears are years of URLs with hashes missing from /urls,
+	// e.g. computed before the listing existed
+	UnlistedYears Problem `json:"unlisted_years"`
+	// EmptyYears are years listed in /urls for URLs without any hash of
+	// that size and year left
+	EmptyYears Problem `json:"empty_years"`
+}
+
+// Repair scans the store for inconsistencies left by crashes and earlier
+// key layouts. With fix set, malformed timestamps are re-keyed to their
+// canonical form, unusable records are deleted and the year listings
+// gain unlisted years and lose empty ones.
+func Repair(ctx context.Context, store *storage.Store, inspector *asynq.Inspector, fix bool) (RepairReport, error) {
+	report := RepairReport{Fix: fix}
+
+	// Years with hashes by size, archive-scoped URL and year
+	hashed := make(map[string]bool)
+	err := store.ScanPrefix(ctx, "simhash", func(keys []string) error {
+		for _, key := range keys {
+			if !simhashNamespace(key) {
+				continue
+			}
+			report.Scanned++
+			ok, err := checkSimhash(ctx, store, key, &report)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := checkListed(ctx, store, key, hashed, &report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// The bare prefix also covers the metadata of other sizes (meta32:)
+	err = store.ScanPrefix(ctx, "meta", func(keys []string) error {
+		for _, key := range keys {
+			size, url, timestamp, ok := storage.ParseSizedMetaKey(key)
+			if !ok {
+				continue
+			}
+			report.Scanned++
+			exists, err := store.Client().Exists(ctx, storage.SizedSimhashKey(size, url, timestamp)).Result()
+			if err != nil || exists == 1 {
+				continue
+			}
+			report.OrphanedMetadata.add(key)
+			if fix && store.Delete(ctx, key) == nil {
+				report.OrphanedMetadata.Fixed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if err := checkEmptyYears(ctx, store, hashed, &report); err != nil {
+		return report, err
+	}
+
+	queues, err := inspector.Queues()
+	if err != nil {
+		return report, err
+	}
+	err = store.ScanPrefix(ctx, "task:", func(keys []string) error {
+		for _, key := range keys {
+			report.Scanned++
+			jobID, err := store.Client().Get(ctx, key).Result()
+			if err != nil || taskKnown(inspector, queues, jobID) {
+				continue
+			}
+			report.OrphanedTasks.add(key)
+			if fix && store.Delete(ctx, key) == nil {
+				report.OrphanedTasks.Fixed++
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// simhashNamespace reports whether key lies in the default or a sized
+// simhash namespace, simhash: or simhash<size>:
+func simhashNamespace(key string) bool {
+	i := strings.Index(key, ":")
+	if i < 0 || !strings.HasPrefix(key, "simhash") {
+		return false
+	}
+	for _, c := range key[len("simhash"):i] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSimhash checks one simhash key, returning whether it holds a
+// usable hash, under its key or, when fixed, a canonical one
+func checkSimhash(ctx context.Context, store *storage.Store, key string, report *RepairReport) (bool, error) {
+	size, url, timestamp, ok := storage.ParseSizedSimhashKey(key)
+	if !ok {
+		report.MalformedKeys.add(key)
+		if report.Fix && store.Delete(ctx, key) == nil {
+			report.MalformedKeys.Fixed++
+		}
+		return false, nil
+	}
+	sized := store.WithSize(size)
+
+	value, err := store.ReadKey(ctx, key)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		report.UndecodableValues.add(key)
+		if report.Fix && store.Delete(ctx, key) == nil {
+			report.UndecodableValues.Fixed++
+		}
+		return false, nil
+	}
+
+	switch hashProblem(size, value) {
+	case corruptValue:
+		report.UndecodableValues.add(key)
+		if report.Fix && store.Delete(ctx, key) == nil {
+			report.UndecodableValues.Fixed++
+		}
+		return false, nil
+	case corruptSize:
+		report.MixedVersion.add(key)
+		if report.Fix && store.Delete(ctx, key) == nil {
+			report.MixedVersion.Fixed++
+		}
+		return false, nil
+	}
+
+	normalized, _, err := ts.Normalize(timestamp)
+	if err == nil && normalized == timestamp {
+		return true, nil
+	}
+	report.MalformedKeys.add(key)
+	if !report.Fix {
+		return err == nil, nil
+	}
+
+	// Re-key timestamps written before normalization, keeping the TTL
+	if err == nil {
+		ttl, terr := store.Client().TTL(ctx, key).Result()
+		if terr != nil {
+			return false, terr
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		if exists, _ := sized.HasSimHash(ctx, url, normalized); !exists {
+			if err := sized.SetSimHash(ctx, url, normalized, value, ttl); err != nil {
+				return false, err
+			}
+		}
+		if err := rekeyMeta(ctx, store, size, url, timestamp, normalized); err != nil {
+			return false, err
+		}
+	}
+	if store.Delete(ctx, key) == nil {
+		report.MalformedKeys.Fixed++
+	}
+	return err == nil, nil
+}
+
+// rekeyMeta moves the metadata of a capture re-keyed from timestamp from
+// to to along with its simhash of the given size, keeping the TTL, unless
+// the capture at to has metadata of its own. Metadata that cannot be
+// decrypted is left for the orphan pass.
+func rekeyMeta(ctx context.Context, store *storage.Store, size int, url, from, to string) error {
+	client := store.Client()
+	store = store.WithSize(size)
+	key := storage.SizedMetaKey(size, url, from)
+	if exists, err := client.Exists(ctx, storage.SizedMetaKey(size, url, to)).Result(); err != nil || exists == 1 {
+		return err
+	}
+	fields, err := store.GetCaptureMeta(ctx, url, from)
+	if errors.Is(err, storage.ErrUndecryptable) || (err == nil && len(fields) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := client.TTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	if err := store.SetCaptureMeta(ctx, url, to, fields, ttl); err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// checkListed looks up the year of a simhash key in the year listing of
+// its size once per URL and year, recorded in hashed
+func checkListed(ctx context.Context, store *storage.Store, key string, hashed map[string]bool, report *RepairReport) error {
+	size, scoped, timestamp, ok := storage.ParseSizedSimhashKey(key)
+	year := ts.Year(timestamp)
+	if !ok || year == "" {
+		return nil
+	}
+	id := yearID(size, scoped, year)
+	if hashed[id] {
+		return nil
+	}
+	hashed[id] = true
+
+	name, url := storage.SplitArchiveURL(scoped)
+	listing := storage.URLsKey(size, name, year)
+	_, err := store.Client().ZScore(ctx, listing, url).Result()
+	if err != redis.Nil {
+		return err
+	}
+	report.UnlistedYears.add(listing + " " + url)
+	if report.Fix && store.WithArchive(name).WithSize(size).IndexURL(ctx, url, year, retention.TTL(storage.RetentionCaptures)) == nil {
+		report.UnlistedYears.Fixed++
+	}
+	return nil
+}
+
+// checkEmptyYears reports the URLs of the year listings without a hash
+// of that size and year in hashed, e.g. left behind by a crash between
+// expiring or deleting hashes and updating the listing
+func checkEmptyYears(ctx context.Context, store *storage.Store, hashed map[string]bool, report *RepairReport) error {
+	client := store.Client()
+	return store.ScanPrefix(ctx, "urls", func(keys []string) error {
+		for _, key := range keys {
+			size, name, year, ok := storage.ParseURLsKey(key)
+			if !ok {
+				continue
+			}
+			var empty []interface{}
+			iter := client.ZScan(ctx, key, 0, "", 1000).Iterator()
+			for i := 0; iter.Next(ctx); i++ {
+				// Members alternate with their scores
+				if i%2 == 1 {
+					continue
+				}
+				url := iter.Val()
+				report.Scanned++
+				if hashed[yearID(size, storage.ArchiveURL(name, url), year)] {
+					continue
+				}
+				report.EmptyYears.add(key + " " + url)
+				empty = append(empty, url)
+			}
+			if err := iter.Err(); err != nil {
+				return err
+			}
+			if report.Fix && len(empty) > 0 {
+				if n, err := client.ZRem(ctx, key, empty...).Result(); err == nil {
+					report.EmptyYears.Fixed += int(n)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// yearID identifies the hashes of one size, archive-scoped URL and year
+func yearID(size int, scoped, year string) string {
+	return strconv.Itoa(size) + "|" + scoped + "|" + year
+}
+
+// taskKnown reports whether any queue still holds jobID
+func taskKnown(inspector *asynq.Inspector, queues []string, jobID string) bool {
+	for _, queue := range queues {
+		if _, err := inspector.GetTaskInfo(queue, jobID); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// TypeVerify is the periodic task verifying a sample of stored hashes
+const TypeVerify = "storage:verify"
+
+// verifyCursorKey holds the SCAN cursor the next verifier run resumes from
+const verifyCursorKey = "verify:cursor"
+
+// Problems found by the verifier
+const (
+	// corruptKey is a simhash key whose timestamp is not canonical
+	corruptKey = "malformed_key"
+	// corruptValue cannot be decrypted or base64-decoded
+	corruptValue = "undecodable"
+	// corruptSize is a hash of another encoding width or with bits set
+	// beyond its bit size
+	corruptSize = "size_mismatch"
+	// corruptMeta is capture metadata that cannot be decrypted or holds
+	// out-of-range values
+	corruptMeta = "bad_metadata"
+)
+
+var (
+	verifiedKeys = metrics.NewCounter("wdd_verify_checked_total",
+		"Stored hashes checked by the background verifier.")
+	corruptKeys = metrics.NewCounterVec("wdd_verify_corrupt_total",
+		"Corrupt stored hashes found by the background verifier, by problem.", "problem")
+)
+
+// RegisterVerifySchedule schedules the verifier when config.verify is
+// enabled
+func RegisterVerifySchedule(scheduler *asynq.Scheduler) error {
+	cfg := config.AppConfig.Verify
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Sample <= 0 {
+		return fmt.Errorf("verify.sample must be positive")
+	}
+	schedule := cfg.Schedule
+	if schedule == "" {
+		schedule = "@every 10m"
+	}
+	_, err := scheduler.Register(schedule, asynq.NewTask(TypeVerify, nil),
+		asynq.Queue(worker.VerifyQueue()), asynq.Unique(time.Hour))
+	return err
+}
+
+// Verifier re-reads stored hashes and their metadata, reporting corrupt
+// ones in metrics and the log without touching them; Repair removes them
+type Verifier struct {
+	store *storage.Store
+}
+
+// NewVerifier creates a verifier of store
+func NewVerifier(store *storage.Store) *Verifier {
+	return &Verifier{store: store}
+}
+
+// HandleVerify checks about config.verify.sample simhash keys of any
+// size, continuing the key scan where the previous run stopped so that
+// successive runs cover the whole dataset
+func (v *Verifier) HandleVerify(ctx context.Context, t *asynq.Task) error {
+	sample := config.AppConfig.Verify.Sample
+	if sample <= 0 {
+		return nil
+	}
+	client := v.store.Client()
+	cursor, err := client.Get(ctx, verifyCursorKey).Uint64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	batch := int64(sample)
+	if batch > 1000 {
+		batch = 1000
+	}
+	checked, corrupt := 0, 0
+	for checked < sample {
+		keys, next, err := client.Scan(ctx, cursor, "simhash*", batch).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if problem, err := v.verify(ctx, key); err != nil {
+				return err
+			} else if problem != "" {
+				corrupt++
+				corruptKeys.Inc(problem)
+				logging.Warnf(logging.Storage, "verify: %s: %s", key, problem)
+			}
+			checked++
+			verifiedKeys.Inc()
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	if err := client.Set(ctx, verifyCursorKey, cursor, 0).Err(); err != nil {
+		return err
+	}
+	logging.Debugf(logging.Storage, "verify: checked %d keys, %d corrupt", checked, corrupt)
+	return nil
+}
+
+// hashProblem returns corruptValue for a value the read path cannot
+// decode, corruptSize for one encoded with another width or with bits
+// set beyond the bit size of its namespace, or ""
+func hashProblem(size int, value string) string {
+	hash, err := simhash.DecodeSimHash(value)
+	if err != nil {
+		return corruptValue
+	}
+	if simhash.EncodeSimHash(hash) != value {
+		return corruptSize
+	}
+	if bits := worker.BitSize(size); bits < 64 && hash>>uint(bits) != 0 {
+		return corruptSize
+	}
+	return ""
+}
+
+// verify returns the problem of one simhash key, if any. Keys vanishing
+// meanwhile are fine; errors are reserved for Redis failures.
+func (v *Verifier) verify(ctx context.Context, key string) (string, error) {
+	size, scoped, timestamp, ok := storage.ParseSizedSimhashKey(key)
+	if !ok {
+		return "", nil
+	}
+	if normalized, _, err := ts.Normalize(timestamp); err != nil || normalized != timestamp {
+		return corruptKey, nil
+	}
+
+	value, err := v.store.ReadKey(ctx, key)
+	if err == storage.ErrNotFound {
+		return "", nil
+	}
+	if errors.Is(err, storage.ErrUndecryptable) {
+		return corruptValue, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if problem := hashProblem(size, value); problem != "" {
+		return problem, nil
+	}
+
+	name, url := storage.SplitArchiveURL(scoped)
+	meta, err := v.store.WithArchive(name).WithSize(size).GetCaptureMeta(ctx, url, timestamp)
+	if errors.Is(err, storage.ErrUndecryptable) {
+		return corruptMeta, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if p, ok := meta[storage.MetaPrecision]; ok {
+		if n, err := strconv.Atoi(p); err != nil || n < 4 || n > 14 {
+			return corruptMeta, nil
+		}
+	}
+	if t, ok := meta[storage.MetaTruncated]; ok && t != "1" {
+		return corruptMeta, nil
+	}
+	return "", nil
+}
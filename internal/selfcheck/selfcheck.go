@@ -0,0 +1,326 @@
+package selfcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/notify"
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/storage"
+	"wayback-discover-diff/pkg/urlnorm"
+	"wayback-discover-diff/pkg/worker"
+)
+
+// minRedisMajor is the oldest Redis release asynq supports
+const minRedisMajor = 4
+
+// Result is the outcome of a single check
+type Result struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Critical failures prevent the service from starting
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail"`
+	Duration string `json:"duration"`
+}
+
+// Report collects the results of all checks
+type Report struct {
+	OK     bool     `json:"ok"`
+	Checks []Result `json:"checks"`
+}
+
+// Run verifies configuration, Redis, the task queue and archive reachability
+func Run(ctx context.Context, redisClient *redis.Client, replicas []*redis.Client) Report {
+	report := Report{OK: true}
+	add := func(name string, critical bool, check func(context.Context) (string, error)) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		detail, err := check(ctx)
+		res := Result{
+			Name:     name,
+			OK:       err == nil,
+			Critical: critical,
+			Detail:   detail,
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			res.Detail = err.Error()
+			if critical {
+				report.OK = false
+			}
+		}
+		report.Checks = append(report.Checks, res)
+	}
+
+	add("config", true, checkConfig)
+	add("redis", true, func(ctx context.Context) (string, error) {
+		return checkRedis(ctx, redisClient)
+	})
+	for i, replica := range replicas {
+		add(fmt.Sprintf("redis-replica-%d", i), true, func(ctx context.Context) (string, error) {
+			return checkRedis(ctx, replica)
+		})
+	}
+	add("asynq", true, func(ctx context.Context) (string, error) {
+		return checkQueue(redisClient)
+	})
+
+	if source, err := archive.FromConfig(); err == nil {
+		add("archive-cdx", false, func(ctx context.Context) (string, error) {
+			return checkReachable(ctx, source.CDXQuery("example.com", "", "")+"&limit=1")
+		})
+		add("archive-replay", false, func(ctx context.Context) (string, error) {
+			return checkReachable(ctx, source.ReplayURL)
+		})
+	}
+	for _, name := range archive.Names() {
+		source, err := archive.Named(name)
+		if err != nil {
+			continue
+		}
+		add("archive-cdx-"+name, false, func(ctx context.Context) (string, error) {
+			return checkReachable(ctx, source.CDXQuery("example.com", "", "")+"&limit=1")
+		})
+		add("archive-replay-"+name, false, func(ctx context.Context) (string, error) {
+			return checkReachable(ctx, source.ReplayURL)
+		})
+	}
+
+	return report
+}
+
+func checkConfig(ctx context.Context) (string, error) {
+	cfg := config.AppConfig
+	var problems []string
+
+	if cfg.Redis.URL == "" {
+		problems = append(problems, "redis.url is empty")
+	}
+	if cfg.Threads <= 0 {
+		problems = append(problems, "threads must be positive")
+	}
+	if r := cfg.Resources; r.MemoryLimitMB < 0 || r.MemoryRatio < 0 || r.MemoryRatio > 1 || r.ThreadsPerCPU < 0 || r.TaskMemoryMB < 0 {
+		problems = append(problems, "resources must not be negative and memory_ratio at most 1")
+	}
+	if cfg.Simhash.Size <= 0 || cfg.Simhash.Size > 64 {
+		problems = append(problems, "simhash.size must be between 1 and 64")
+	}
+	if f := cfg.Simhash.Features; f.AltText < 0 || f.Meta < 0 || f.JSONLD < 0 {
+		problems = append(problems, "simhash.features weights must not be negative")
+	}
+	if w := cfg.Alerts.Watchdog; w.Interval < 0 || w.MaxLag < 0 || w.MinSamples < 0 || w.MaxFailureRate < 0 || w.MaxFailureRate > 1 {
+		problems = append(problems, "alerts.watchdog thresholds must not be negative and max_failure_rate at most 1")
+	}
+	if p := cfg.HTTP.BasePath; p != "" && (!strings.HasPrefix(p, "/") || strings.ContainsAny(p, ":*?#")) {
+		problems = append(problems, "http.base_path must be a plain path starting with /")
+	}
+	for route, ms := range cfg.HTTP.SLO.Budgets {
+		if ms < 0 {
+			problems = append(problems, fmt.Sprintf("http.slo.budgets: budget of %s must not be negative", route))
+		}
+	}
+	if s := cfg.HTTP.SLO; s.MaxInFlight < 0 || s.MaxBacklog < 0 {
+		problems = append(problems, "http.slo shed thresholds must not be negative")
+	}
+	if l := cfg.Simhash.Limits; l.MaxNodes < 0 || l.MaxDepth < 0 || l.MaxTokens < 0 {
+		problems = append(problems, "simhash.limits must not be negative")
+	}
+	if s := cfg.Simhash.Shadow; s.Fraction < 0 || s.Fraction > 1 {
+		problems = append(problems, "simhash.shadow.fraction must be between 0 and 1")
+	}
+	if c := cfg.Simhash.Shadow.Candidate; c.Features.AltText < 0 || c.Features.Meta < 0 || c.Features.JSONLD < 0 ||
+		c.Limits.MaxNodes < 0 || c.Limits.MaxDepth < 0 || c.Limits.MaxTokens < 0 {
+		problems = append(problems, "simhash.shadow.candidate weights and limits must not be negative")
+	}
+	if retention.TTL(storage.RetentionCaptures) <= 0 {
+		problems = append(problems, "capture retention (simhash.expire_after) must be positive")
+	}
+	if err := retention.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if cfg.MaxErrors <= 0 {
+		problems = append(problems, "max_errors must be positive")
+	}
+	if r := cfg.ErrorPolicy.MaxRatio; r < 0 || r > 1 {
+		problems = append(problems, "error_policy.max_ratio must be between 0 and 1")
+	}
+	for class, weight := range cfg.ErrorPolicy.Weights {
+		if !worker.IsErrorClass(class) {
+			problems = append(problems, fmt.Sprintf("error_policy.weights: unknown error class %q", class))
+		} else if weight < 0 {
+			problems = append(problems, fmt.Sprintf("error_policy.weights.%s must not be negative", class))
+		}
+	}
+	if err := notify.ValidateSigning(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := urlnorm.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := worker.ValidateIgnore(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if v := cfg.Verify; v.Enabled && v.Sample <= 0 {
+		problems = append(problems, "verify.sample must be positive")
+	}
+	if cfg.Purge.BatchSize < 0 || cfg.Purge.PauseMs < 0 {
+		problems = append(problems, "purge.batch_size and purge.pause_ms must not be negative")
+	}
+	for _, pattern := range cfg.Snapshots.ContentTypes {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+			problems = append(problems, fmt.Sprintf("snapshots.content_types: invalid media type pattern %q", pattern))
+		}
+	}
+	for _, name := range cfg.Queues.Priorities {
+		if _, ok := worker.Queues()[name]; !ok {
+			problems = append(problems, fmt.Sprintf("queues.priorities: %s has no weight in queues.weights", name))
+		}
+	}
+	if cfg.Queues.CollapseWindow < 0 || cfg.Queues.Retention < 0 {
+		problems = append(problems, "queues.collapse_window and queues.retention must not be negative")
+	}
+	if cfg.Queues.JobTimeout < 0 || cfg.Queues.JobDeadline < 0 {
+		problems = append(problems, "queues.job_timeout and queues.job_deadline must not be negative")
+	}
+	if cfg.Canonical.Alias && !cfg.Canonical.Record {
+		problems = append(problems, "canonical.alias requires canonical.record")
+	}
+	if r := cfg.CaptureRetry; r.Enabled {
+		if err := worker.ValidateCaptureRetry(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, b := range []config.RequestBudget{cfg.Transport.CDX, cfg.Transport.Snapshot} {
+		if b.ConnectMs < 0 || b.TLSMs < 0 || b.HeaderMs < 0 || b.TotalMs < 0 {
+			problems = append(problems, "transport.cdx and transport.snapshot budgets must not be negative")
+			break
+		}
+	}
+	if cfg.CaptureRetry.InlinePerMinute < 0 {
+		problems = append(problems, "capture_retry.inline_per_minute must not be negative")
+	}
+	if _, err := archive.FromConfig(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, name := range worker.ProfileNames() {
+		if !validArchiveName(name) {
+			problems = append(problems, fmt.Sprintf("simhash profile name %q may only contain letters, digits, - and _", name))
+		}
+	}
+	for _, name := range archive.Names() {
+		if !validArchiveName(name) {
+			problems = append(problems, fmt.Sprintf("archive name %q may only contain letters, digits, - and _", name))
+		} else if _, err := archive.Named(name); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return "configuration is valid", nil
+}
+
+// validArchiveName reports whether an archive or profile name is safe to
+// embed in storage keys
+func validArchiveName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func checkRedis(ctx context.Context, client *redis.Client) (string, error) {
+	if err := client.Ping(ctx).Err(); err != nil {
+		return "", fmt.Errorf("%s: %v", client.Options().Addr, err)
+	}
+	if config.AppConfig.Redis.Embedded {
+		// The embedded server does not report a version
+		return fmt.Sprintf("embedded redis at %s", client.Options().Addr), nil
+	}
+
+	info, err := client.Info(ctx, "server").Result()
+	if err != nil {
+		return "", err
+	}
+
+	version := "unknown"
+	for _, line := range strings.Split(info, "\n") {
+		if v := strings.TrimPrefix(strings.TrimSpace(line), "redis_version:"); v != strings.TrimSpace(line) {
+			version = v
+		}
+	}
+	major, _ := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if major < minRedisMajor {
+		return "", fmt.Errorf("redis %s at %s is older than %d.0", version, client.Options().Addr, minRedisMajor)
+	}
+	return fmt.Sprintf("redis %s at %s", version, client.Options().Addr), nil
+}
+
+func checkQueue(client *redis.Client) (string, error) {
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: client.Options().Addr})
+	defer inspector.Close()
+
+	queues, err := inspector.Queues()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d queues visible", len(queues)), nil
+}
+
+func checkReachable(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "wayback-discover-diff")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return fmt.Sprintf("%s returned status %d", url, resp.StatusCode), nil
+}
+
+// Print writes a human-readable report
+func (r Report) Print(w io.Writer) {
+	for _, res := range r.Checks {
+		state := "ok"
+		if !res.OK {
+			state = "FAIL"
+			if !res.Critical {
+				state = "WARN"
+			}
+		}
+		fmt.Fprintf(w, "%-4s %-18s %-8s %s\n", state, res.Name, res.Duration, res.Detail)
+	}
+	if r.OK {
+		fmt.Fprintln(w, "self-check passed")
+	} else {
+		fmt.Fprintln(w, "self-check failed")
+	}
+}
@@ -0,0 +1,166 @@
+// Package watchdog periodically checks the task queues against the
+// thresholds of config.alerts.watchdog. It exports the measured lag and
+// failure rate at /metrics and posts an alert to the alert webhook when a
+// threshold is breached, and again once it recovers.
+package watchdog
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/notify"
+	"wayback-discover-diff/pkg/worker"
+)
+
+var (
+	lagSeconds = metrics.NewGauge("wdd_queue_lag_seconds",
+		"Age of the oldest pending task across all queues.")
+	failureRate = metrics.NewGauge("wdd_queue_failure_rate",
+		"Share of tasks that failed since the previous watchdog check.")
+	alertsRaised = metrics.NewCounter("wdd_watchdog_alerts_total",
+		"Queue thresholds breached, counted once per breach.")
+)
+
+// Alert names posted to the webhook
+const (
+	AlertQueueLag    = "queue_lag"
+	AlertFailureRate = "queue_failure_rate"
+)
+
+// Alert is posted to the alert webhook when a queue threshold is breached
+// or, with Resolved set, once it no longer is
+type Alert struct {
+	Event     string  `json:"event"`
+	Queue     string  `json:"queue"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Resolved  bool    `json:"resolved"`
+	Time      string  `json:"time"`
+}
+
+// Watchdog checks the queues served by this instance
+type Watchdog struct {
+	inspector *asynq.Inspector
+
+	// totals are the processed and failed counts of each queue at the
+	// previous check
+	totals map[string][2]int
+	// breached holds the alerts currently raised, by event and queue
+	breached map[string]bool
+}
+
+// New returns a watchdog reading queue statistics through inspector
+func New(inspector *asynq.Inspector) *Watchdog {
+	return &Watchdog{
+		inspector: inspector,
+		totals:    map[string][2]int{},
+		breached:  map[string]bool{},
+	}
+}
+
+// Run checks the queues every config.alerts.watchdog.interval seconds until
+// ctx is done; it returns at once when the interval is 0
+func (w *Watchdog) Run(ctx context.Context) {
+	interval := time.Duration(config.AppConfig.Alerts.Watchdog.Interval) * time.Second
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watchdog) check(ctx context.Context) {
+	cfg := config.AppConfig.Alerts.Watchdog
+
+	var queues []string
+	for name := range worker.Queues() {
+		queues = append(queues, name)
+	}
+	sort.Strings(queues)
+
+	var maxLag time.Duration
+	var processed, failed int
+	for _, queue := range queues {
+		info, err := w.inspector.GetQueueInfo(queue)
+		if err != nil {
+			// Queues appear in Redis with their first task
+			continue
+		}
+		if info.Latency > maxLag {
+			maxLag = info.Latency
+		}
+		if cfg.MaxLag > 0 {
+			w.evaluate(ctx, AlertQueueLag, queue, info.Latency.Seconds(), float64(cfg.MaxLag))
+		}
+
+		// Failure rates cover the tasks finished since the previous check
+		prev, seen := w.totals[queue]
+		w.totals[queue] = [2]int{info.ProcessedTotal, info.FailedTotal}
+		if !seen || info.ProcessedTotal < prev[0] {
+			continue
+		}
+		p, f := info.ProcessedTotal-prev[0], info.FailedTotal-prev[1]
+		processed += p
+		failed += f
+		if cfg.MaxFailureRate > 0 && p > 0 && p >= cfg.MinSamples {
+			w.evaluate(ctx, AlertFailureRate, queue, float64(f)/float64(p), cfg.MaxFailureRate)
+		}
+	}
+
+	lagSeconds.Set(maxLag.Seconds())
+	if processed > 0 {
+		failureRate.Set(float64(failed) / float64(processed))
+	} else {
+		failureRate.Set(0)
+	}
+}
+
+// evaluate raises an alert when value first exceeds threshold and resolves
+// it once value is back within it
+func (w *Watchdog) evaluate(ctx context.Context, event, queue string, value, threshold float64) {
+	key := event + " " + queue
+	exceeded := value > threshold
+	if exceeded == w.breached[key] {
+		return
+	}
+	w.breached[key] = exceeded
+
+	if exceeded {
+		alertsRaised.Inc()
+		log.Printf("Watchdog: %s of queue %s is %.2f, above %.2f", event, queue, value, threshold)
+	} else {
+		log.Printf("Watchdog: %s of queue %s is back to %.2f", event, queue, value)
+	}
+
+	url := config.AppConfig.Alerts.WebhookURL
+	if url == "" {
+		return
+	}
+	alert := Alert{
+		Event:     event,
+		Queue:     queue,
+		Value:     value,
+		Threshold: threshold,
+		Resolved:  !exceeded,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	}
+	postCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := notify.PostJSON(postCtx, url, alert); err != nil {
+		log.Printf("Failed to post watchdog alert: %v", err)
+	}
+}
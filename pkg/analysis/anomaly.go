@@ -0,0 +1,98 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// minNeighbours is the smallest window a capture is scored against
+const minNeighbours = 3
+
+// Anomaly is a capture whose distance to its predecessor stands out from
+// the distances around it
+type Anomaly struct {
+	Timestamp string `json:"timestamp"`
+	// Previous is the capture it was compared with
+	Previous string  `json:"previous"`
+	Distance int     `json:"distance"`
+	Median   float64 `json:"median"`
+	ZScore   float64 `json:"z_score"`
+}
+
+// Anomalies flags captures, in timestamp order, whose distance to the
+// previous capture has a robust z-score of at least threshold against the
+// distances of up to window surrounding pairs. Defacements and template
+// breakages show up as one large jump followed by a jump back.
+func Anomalies(captures []storage.Capture, window int, threshold float64) []Anomaly {
+	type pair struct {
+		from, to string
+		distance int
+	}
+
+	var pairs []pair
+	var prev uint64
+	var prevTimestamp string
+	for _, capture := range captures {
+		hash, err := simhash.DecodeSimHash(capture.SimHash)
+		if err != nil {
+			continue
+		}
+		if prevTimestamp != "" {
+			pairs = append(pairs, pair{prevTimestamp, capture.Timestamp, simhash.Distance(prev, hash)})
+		}
+		prev, prevTimestamp = hash, capture.Timestamp
+	}
+
+	half := window / 2
+	if half < 1 {
+		half = 1
+	}
+
+	var anomalies []Anomaly
+	for i, p := range pairs {
+		var neighbours []float64
+		for j := i - half; j <= i+half; j++ {
+			if j >= 0 && j < len(pairs) && j != i {
+				neighbours = append(neighbours, float64(pairs[j].distance))
+			}
+		}
+		if len(neighbours) < minNeighbours {
+			continue
+		}
+
+		// Median and MAD rather than mean and standard deviation, so the
+		// jump back after a defacement does not mask the jump into it
+		median := medianOf(neighbours)
+		deviations := make([]float64, len(neighbours))
+		for k, d := range neighbours {
+			deviations[k] = math.Abs(d - median)
+		}
+		// A one-bit floor keeps perfectly stable neighbourhoods from
+		// turning any change at all into an infinite score
+		spread := math.Max(1.4826*medianOf(deviations), 1)
+		z := (float64(p.distance) - median) / spread
+		if z >= threshold {
+			anomalies = append(anomalies, Anomaly{
+				Timestamp: p.to,
+				Previous:  p.from,
+				Distance:  p.distance,
+				Median:    median,
+				ZScore:    z,
+			})
+		}
+	}
+	return anomalies
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
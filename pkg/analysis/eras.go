@@ -0,0 +1,64 @@
+package analysis
+
+import (
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// Era is a run of consecutive captures with about the same content: each
+// is within the era distance of the first capture, its representative
+type Era struct {
+	// Start is the timestamp of the representative
+	Start string `json:"start"`
+	// End is the timestamp of the last capture of the era
+	End string `json:"end"`
+	// Until is the start of the next era, empty for the current one
+	Until    string `json:"until,omitempty"`
+	Captures int    `json:"captures"`
+	// DurationSeconds runs from Start to Until, or to End for the
+	// current era
+	DurationSeconds int64 `json:"duration_seconds"`
+	// Distance is how far the representative is from the previous one
+	Distance int `json:"distance,omitempty"`
+}
+
+// Eras groups captures, in timestamp order, into eras: a capture farther
+// than distance from the representative of the current era starts a new
+// one. Captures whose hash cannot be decoded are skipped.
+func Eras(captures []storage.Capture, distance int) []Era {
+	var eras []Era
+	var representative uint64
+	for _, capture := range captures {
+		hash, err := simhash.DecodeSimHash(capture.SimHash)
+		if err != nil {
+			continue
+		}
+		if len(eras) > 0 {
+			if d := simhash.Distance(representative, hash); d > distance {
+				eras[len(eras)-1].Until = capture.Timestamp
+				eras = append(eras, Era{Start: capture.Timestamp, Distance: d})
+				representative = hash
+			}
+		} else {
+			eras = append(eras, Era{Start: capture.Timestamp})
+			representative = hash
+		}
+		era := &eras[len(eras)-1]
+		era.End = capture.Timestamp
+		era.Captures++
+	}
+
+	for i := range eras {
+		end := eras[i].Until
+		if end == "" {
+			end = eras[i].End
+		}
+		start, err1 := ts.Parse(eras[i].Start)
+		until, err2 := ts.Parse(end)
+		if err1 == nil && err2 == nil {
+			eras[i].DurationSeconds = int64(until.Sub(start).Seconds())
+		}
+	}
+	return eras
+}
@@ -0,0 +1,58 @@
+package analysis
+
+import (
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// Month is the change rate of a URL within one calendar month
+type Month struct {
+	// Month is formatted YYYY-MM
+	Month    string `json:"month"`
+	Captures int    `json:"captures"`
+	// Comparisons counts the consecutive capture pairs ending in this month
+	Comparisons int `json:"comparisons"`
+	// AvgDistance is the mean Hamming distance of those pairs
+	AvgDistance float64 `json:"avg_distance"`
+}
+
+// Trend aggregates captures, in timestamp order, into per-month capture
+// counts and average distance between consecutive captures. A pair is
+// counted in the month of its later capture; captures whose hash cannot
+// be decoded are skipped.
+func Trend(captures []storage.Capture) []Month {
+	var months []Month
+	var total []int
+	var prev uint64
+	havePrev := false
+
+	for _, capture := range captures {
+		if len(capture.Timestamp) < 6 {
+			continue
+		}
+		hash, err := simhash.DecodeSimHash(capture.SimHash)
+		if err != nil {
+			continue
+		}
+
+		month := capture.Timestamp[:4] + "-" + capture.Timestamp[4:6]
+		if len(months) == 0 || months[len(months)-1].Month != month {
+			months = append(months, Month{Month: month})
+			total = append(total, 0)
+		}
+		m := &months[len(months)-1]
+		m.Captures++
+		if havePrev {
+			m.Comparisons++
+			total[len(total)-1] += simhash.Distance(prev, hash)
+		}
+		prev, havePrev = hash, true
+	}
+
+	for i := range months {
+		if months[i].Comparisons > 0 {
+			months[i].AvgDistance = float64(total[i]) / float64(months[i].Comparisons)
+		}
+	}
+	return months
+}
@@ -0,0 +1,353 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"wayback-discover-diff/config"
+)
+
+// CDXFormat describes how a CDX server encodes its JSON output
+type CDXFormat string
+
+const (
+	// FormatRows is the Wayback Machine dialect: a JSON array of rows
+	// whose first row holds the field names.
+	FormatRows CDXFormat = "rows"
+	// FormatNDJSON is the pywb/OpenWayback dialect: one JSON object per line.
+	FormatNDJSON CDXFormat = "ndjson"
+)
+
+// Source describes a replay archive and the quirks of its CDX API
+type Source struct {
+	Name string
+	// CDXURL is the CDX search endpoint, without query string
+	CDXURL string
+	// ReplayURL is the replay prefix; snapshots are fetched from
+	// ReplayURL/<timestamp><modifier>/<url>
+	ReplayURL string
+	// Modifier is the replay flag requesting the original, unrewritten body
+	Modifier string
+	Format   CDXFormat
+	// AvailabilityURL is the Wayback Availability API endpoint, empty
+	// for archives without one
+	AvailabilityURL string
+}
+
+// presets holds the built-in sources for well-known public archives
+var presets = map[string]Source{
+	"wayback": {
+		Name:            "wayback",
+		CDXURL:          "http://web.archive.org/cdx/search/cdx",
+		ReplayURL:       "http://web.archive.org/web",
+		Modifier:        "id_",
+		Format:          FormatRows,
+		AvailabilityURL: "https://archive.org/wayback/available",
+	},
+	"arquivo": {
+		Name:      "arquivo",
+		CDXURL:    "https://arquivo.pt/wayback/cdx",
+		ReplayURL: "https://arquivo.pt/noFrame/replay",
+		Modifier:  "id_",
+		Format:    FormatNDJSON,
+	},
+	"ukwa": {
+		Name:      "ukwa",
+		CDXURL:    "https://www.webarchive.org.uk/wayback/archive/cdx",
+		ReplayURL: "https://www.webarchive.org.uk/wayback/archive",
+		Modifier:  "id_",
+		Format:    FormatNDJSON,
+	},
+	// devserver is the fixture archive of "wdd devserver"
+	"devserver": {
+		Name:      "devserver",
+		CDXURL:    "http://127.0.0.1:4100/cdx",
+		ReplayURL: "http://127.0.0.1:4100/web",
+		Modifier:  "id_",
+		Format:    FormatRows,
+	},
+	"loc": {
+		Name:      "loc",
+		CDXURL:    "https://webarchive.loc.gov/all/cdx",
+		ReplayURL: "https://webarchive.loc.gov/all",
+		Modifier:  "id_",
+		Format:    FormatNDJSON,
+	},
+}
+
+// Preset returns the built-in source with the given name
+func Preset(name string) (Source, bool) {
+	src, ok := presets[strings.ToLower(name)]
+	return src, ok
+}
+
+// PresetNames lists the names of the built-in sources in sorted order
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ErrUnknownArchive is returned for an archive name not in config.archives
+var ErrUnknownArchive = errors.New("unknown archive")
+
+// ErrNoSnapshots is returned for CDX responses listing no captures
+var ErrNoSnapshots = errors.New("no snapshots found")
+
+// FromConfig builds the source selected by config.archive, applying any
+// explicit endpoint overrides on top of the preset
+func FromConfig() (Source, error) {
+	return build(config.AppConfig.Archive)
+}
+
+// Named builds the source config.archives defines under name; the empty
+// name is the default source of FromConfig
+func Named(name string) (Source, error) {
+	if name == "" {
+		return FromConfig()
+	}
+	cfg, ok := config.AppConfig.Archives[name]
+	if !ok {
+		return Source{}, ErrUnknownArchive
+	}
+	src, err := build(cfg)
+	if err != nil {
+		return Source{}, fmt.Errorf("archive %s: %v", name, err)
+	}
+	src.Name = name
+	return src, nil
+}
+
+// Names lists the archives of config.archives in sorted order
+func Names() []string {
+	names := make([]string, 0, len(config.AppConfig.Archives))
+	for name := range config.AppConfig.Archives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func build(cfg config.ArchiveConfig) (Source, error) {
+	name := cfg.Preset
+	if name == "" {
+		name = "wayback"
+	}
+	src, ok := Preset(name)
+	if !ok {
+		return Source{}, fmt.Errorf("unknown archive preset: %s", name)
+	}
+
+	if cfg.CdxURL != "" {
+		src.CDXURL = cfg.CdxURL
+	}
+	if cfg.ReplayURL != "" {
+		src.ReplayURL = cfg.ReplayURL
+	}
+	if cfg.Modifier != "" {
+		src.Modifier = cfg.Modifier
+	}
+	if cfg.Format != "" {
+		switch f := CDXFormat(cfg.Format); f {
+		case FormatRows, FormatNDJSON:
+			src.Format = f
+		default:
+			return Source{}, fmt.Errorf("unknown archive format %q, expected %s or %s", cfg.Format, FormatRows, FormatNDJSON)
+		}
+	}
+	if cfg.AvailabilityURL != "" {
+		src.AvailabilityURL = cfg.AvailabilityURL
+	}
+	return src, nil
+}
+
+// CDXQuery builds the CDX search URL for captures of url between from and to,
+// restricted by optional CDX filter expressions
+func (s Source) CDXQuery(target string, from, to string, filters ...string) string {
+	params := url.Values{}
+	params.Set("url", target)
+	params.Set("output", "json")
+	if from != "" {
+		params.Set("from", from)
+	}
+	if to != "" {
+		params.Set("to", to)
+	}
+	for _, f := range filters {
+		params.Add("filter", f)
+	}
+	return s.CDXURL + "?" + params.Encode()
+}
+
+// SnapshotURL returns the replay URL for the original body of a capture
+func (s Source) SnapshotURL(timestamp, target string) string {
+	return fmt.Sprintf("%s/%s%s/%s", strings.TrimRight(s.ReplayURL, "/"), timestamp, s.Modifier, target)
+}
+
+// ViewURL returns the replay URL showing a capture to readers, as the
+// archive presents it rather than its original body
+func (s Source) ViewURL(timestamp, target string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.ReplayURL, "/"), timestamp, target)
+}
+
+// AvailabilityQuery builds the Availability API URL asking for the capture
+// of target closest to timestamp, or "" when the archive has no such API
+func (s Source) AvailabilityQuery(target, timestamp string) string {
+	if s.AvailabilityURL == "" {
+		return ""
+	}
+	params := url.Values{}
+	params.Set("url", target)
+	params.Set("timestamp", timestamp)
+	return s.AvailabilityURL + "?" + params.Encode()
+}
+
+// ParseAvailability decodes an Availability API response and returns the
+// timestamp of the closest available capture, "" when there is none
+func ParseAvailability(r io.Reader) (string, error) {
+	var body struct {
+		ArchivedSnapshots struct {
+			Closest *struct {
+				Available bool   `json:"available"`
+				Timestamp string `json:"timestamp"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return "", err
+	}
+	closest := body.ArchivedSnapshots.Closest
+	if closest == nil || !closest.Available {
+		return "", nil
+	}
+	return closest.Timestamp, nil
+}
+
+// Capture is one row of a CDX response
+type Capture struct {
+	Timestamp string
+	// Digest is the archive's checksum of the capture body, usually the
+	// base32 SHA-1; empty when the row has none
+	Digest string
+}
+
+// ParseTimestamps decodes a CDX response body and returns the capture timestamps
+func (s Source) ParseTimestamps(r io.Reader) ([]string, error) {
+	captures, err := s.ParseCaptures(r)
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make([]string, len(captures))
+	for i, c := range captures {
+		timestamps[i] = c.Timestamp
+	}
+	return timestamps, nil
+}
+
+// ParseCaptures decodes a CDX response body and returns its captures
+func (s Source) ParseCaptures(r io.Reader) ([]Capture, error) {
+	switch s.Format {
+	case FormatNDJSON:
+		return parseNDJSON(r)
+	default:
+		return parseRows(r)
+	}
+}
+
+func parseRows(r io.Reader) ([]Capture, error) {
+	var results [][]string
+	if err := json.NewDecoder(r).Decode(&results); err != nil {
+		return nil, err
+	}
+
+	if len(results) < 2 {
+		return nil, ErrNoSnapshots
+	}
+
+	// Locate the timestamp and digest columns from the header row
+	col, digestCol := 1, -1
+	for i, name := range results[0] {
+		switch name {
+		case "timestamp":
+			col = i
+		case "digest":
+			digestCol = i
+		}
+	}
+
+	captures := make([]Capture, 0, len(results)-1)
+	for _, row := range results[1:] {
+		if len(row) <= col {
+			continue
+		}
+		c := Capture{Timestamp: row[col]}
+		if digestCol >= 0 && len(row) > digestCol {
+			c.Digest = row[digestCol]
+		}
+		captures = append(captures, c)
+	}
+	return captures, nil
+}
+
+func parseNDJSON(r io.Reader) ([]Capture, error) {
+	var captures []Capture
+	dec := json.NewDecoder(r)
+	for {
+		var row struct {
+			Timestamp string `json:"timestamp"`
+			Digest    string `json:"digest"`
+		}
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row.Timestamp != "" {
+			captures = append(captures, Capture{Timestamp: row.Timestamp, Digest: row.Digest})
+		}
+	}
+
+	if len(captures) == 0 {
+		return nil, ErrNoSnapshots
+	}
+	return captures, nil
+}
+
+// VerifyDigest checks body against a CDX digest: a base32 or hex SHA-1,
+// optionally prefixed with "sha1:". ok is false for digests in any other
+// format, which cannot be checked.
+func VerifyDigest(digest string, body []byte) (match, ok bool) {
+	if len(digest) > 5 && strings.EqualFold(digest[:5], "sha1:") {
+		digest = digest[5:]
+	}
+	sum := sha1.Sum(body)
+	switch len(digest) {
+	case 32:
+		want, err := base32.StdEncoding.DecodeString(strings.ToUpper(digest))
+		if err != nil {
+			return false, false
+		}
+		return bytes.Equal(want, sum[:]), true
+	case 40:
+		want, err := hex.DecodeString(digest)
+		if err != nil {
+			return false, false
+		}
+		return bytes.Equal(want, sum[:]), true
+	}
+	return false, false
+}
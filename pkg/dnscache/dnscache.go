@@ -0,0 +1,119 @@
+// Package dnscache provides a caching resolver for outgoing connections,
+// with static overrides to pin hosts to chosen addresses.
+package dnscache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+type entry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// Resolver caches host lookups for ttl. Hosts listed in overrides always
+// resolve to the given addresses.
+type Resolver struct {
+	ttl       time.Duration
+	overrides map[string][]string
+	resolver  *net.Resolver
+	dialer    *net.Dialer
+
+	mu    sync.Mutex
+	cache map[string]entry
+}
+
+// New creates a resolver; a zero ttl disables caching but keeps overrides
+func New(ttl time.Duration, overrides map[string][]string) *Resolver {
+	normalized := make(map[string][]string, len(overrides))
+	for host, addrs := range overrides {
+		normalized[strings.ToLower(host)] = addrs
+	}
+	return &Resolver{
+		ttl:       ttl,
+		overrides: normalized,
+		resolver:  net.DefaultResolver,
+		dialer:    &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		cache:     make(map[string]entry),
+	}
+}
+
+// FromConfig creates the resolver described by config.dns
+func FromConfig() (*Resolver, error) {
+	cfg := config.AppConfig.DNS
+	for host, addrs := range cfg.Overrides {
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("dns override for %s: invalid IP address %s", host, addr)
+			}
+		}
+	}
+	return New(time.Duration(cfg.CacheTTL)*time.Second, cfg.Overrides), nil
+}
+
+// LookupHost returns the addresses of host, from the overrides or cache
+// when possible
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(host)
+	if addrs, ok := r.overrides[host]; ok {
+		return addrs, nil
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		e, ok := r.cache[host]
+		r.mu.Unlock()
+		if ok && time.Now().Before(e.expires) {
+			return e.addrs, nil
+		}
+	}
+
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	logging.Debugf(logging.Downloader, "resolved %s: %v", host, addrs)
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[host] = entry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// DialContext is a drop-in for http.Transport.DialContext that resolves
+// through the cache and tries each address in turn
+func (r *Resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, lastErr
+}
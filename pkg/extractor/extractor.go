@@ -0,0 +1,79 @@
+package extractor
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// Extractor turns a snapshot body into a weighted feature map
+type Extractor interface {
+	Extract(ctx context.Context, body []byte) (map[string]int, error)
+	Close(ctx context.Context) error
+}
+
+// Set maps media types to the custom extractors configured for them
+type Set struct {
+	byType map[string]Extractor
+}
+
+// Load compiles every extractor listed in config.extractors
+func Load(ctx context.Context) (*Set, error) {
+	set := &Set{byType: make(map[string]Extractor)}
+
+	for _, cfg := range config.AppConfig.Extractors {
+		mediaType := normalizeType(cfg.ContentType)
+		if mediaType == "" {
+			set.Close(ctx)
+			return nil, fmt.Errorf("extractor for %s: content_type is required", cfg.WASM)
+		}
+		if _, dup := set.byType[mediaType]; dup {
+			set.Close(ctx)
+			return nil, fmt.Errorf("duplicate extractor for content type %s", mediaType)
+		}
+
+		ext, err := NewWASM(ctx, cfg.WASM, WASMLimits{
+			MemoryPages: cfg.MemoryPages,
+			TimeoutMs:   cfg.TimeoutMs,
+		})
+		if err != nil {
+			set.Close(ctx)
+			return nil, fmt.Errorf("extractor for %s: %v", mediaType, err)
+		}
+		set.byType[mediaType] = ext
+		logging.Debugf(logging.Extractor, "loaded %s for %s", cfg.WASM, mediaType)
+	}
+
+	return set, nil
+}
+
+// For returns the extractor registered for contentType, if any
+func (s *Set) For(contentType string) (Extractor, bool) {
+	if s == nil {
+		return nil, false
+	}
+	ext, ok := s.byType[normalizeType(contentType)]
+	return ext, ok
+}
+
+// Close releases all compiled modules
+func (s *Set) Close(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	for _, ext := range s.byType {
+		ext.Close(ctx)
+	}
+}
+
+func normalizeType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
@@ -0,0 +1,149 @@
+package extractor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"wayback-discover-diff/pkg/logging"
+)
+
+const (
+	defaultMemoryPages = 256 // 16MiB
+	defaultTimeoutMs   = 5000
+)
+
+// WASMLimits bounds the resources available to a single extraction
+type WASMLimits struct {
+	// MemoryPages caps linear memory in 64KiB pages
+	MemoryPages uint32
+	// TimeoutMs aborts the guest once the extraction runs this long
+	TimeoutMs int
+}
+
+// WASMExtractor runs a feature extractor compiled to WebAssembly.
+//
+// The module must export its memory and two functions:
+//
+//	alloc(size i32) i32              reserve size bytes for the input body
+//	extract(ptr i32, len i32) i64    return (ptr << 32 | len) of a JSON
+//	                                 object mapping features to weights
+//
+// Every call runs in a fresh module instance, so guests cannot keep state
+// between captures.
+type WASMExtractor struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+}
+
+// NewWASM compiles the module at path with the given limits
+func NewWASM(ctx context.Context, path string, limits WASMLimits) (*WASMExtractor, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.MemoryPages == 0 {
+		limits.MemoryPages = defaultMemoryPages
+	}
+	if limits.TimeoutMs <= 0 {
+		limits.TimeoutMs = defaultTimeoutMs
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(limits.MemoryPages).
+		WithCloseOnContextDone(true))
+
+	// WASI is provided without filesystem, network or environment access
+	// so that extractors built with standard toolchains can link.
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("compile %s: %v", path, err)
+	}
+
+	for _, name := range []string{"alloc", "extract"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("%s does not export %s", path, name)
+		}
+	}
+
+	return &WASMExtractor{
+		runtime:  runtime,
+		compiled: compiled,
+		timeout:  time.Duration(limits.TimeoutMs) * time.Millisecond,
+	}, nil
+}
+
+// Extract passes body to the guest and decodes the returned feature map
+func (e *WASMExtractor) Extract(ctx context.Context, body []byte) (map[string]int, error) {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	mod, err := e.runtime.InstantiateModule(ctx, e.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("instantiate: %v", err)
+	}
+	defer mod.Close(ctx)
+
+	ptr, err := call(ctx, mod, "alloc", uint64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	if !mod.Memory().Write(uint32(ptr), body) {
+		return nil, fmt.Errorf("alloc returned out of range pointer")
+	}
+
+	packed, err := call(ctx, mod, "extract", ptr, uint64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	out, ok := mod.Memory().Read(uint32(packed>>32), uint32(packed))
+	if !ok {
+		return nil, fmt.Errorf("extract returned out of range result")
+	}
+
+	features := make(map[string]int)
+	if err := json.Unmarshal(out, &features); err != nil {
+		return nil, fmt.Errorf("decode features: %v", err)
+	}
+	logging.Debugf(logging.Extractor, "wasm extraction bytes=%d features=%d took=%s",
+		len(body), len(features), time.Since(started))
+	return features, nil
+}
+
+// Close releases the runtime and the compiled module
+func (e *WASMExtractor) Close(ctx context.Context) error {
+	return e.runtime.Close(ctx)
+}
+
+func call(ctx context.Context, mod api.Module, name string, params ...uint64) (uint64, error) {
+	results, err := mod.ExportedFunction(name).Call(ctx, params...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, fmt.Errorf("%s: time limit exceeded", name)
+		}
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(results) != 1 {
+		return 0, fmt.Errorf("%s: expected one result, got %d", name, len(results))
+	}
+	return results[0], nil
+}
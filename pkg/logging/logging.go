@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Level is a log severity
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+// Modules with their own verbosity settings
+const (
+	Downloader = "downloader"
+	Extractor  = "extractor"
+	Storage    = "storage"
+	Worker     = "worker"
+)
+
+// modules lists the names accepted by SetModuleLevel and Configure
+var moduleNames = []string{Downloader, Extractor, Storage, Worker}
+
+// Modules returns the names of the modules with their own levels
+func Modules() []string {
+	return append([]string(nil), moduleNames...)
+}
+
+// IsModule reports whether name is one of Modules
+func IsModule(name string) bool {
+	for _, m := range moduleNames {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name to a Level
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level: %s", s)
+}
+
+var (
+	mu      sync.RWMutex
+	global  = Info
+	modules = make(map[string]Level)
+)
+
+// SetLevel changes the default level for all modules
+func SetLevel(l Level) {
+	mu.Lock()
+	global = l
+	mu.Unlock()
+}
+
+// SetModuleLevel overrides the level of a single module
+func SetModuleLevel(module string, l Level) {
+	mu.Lock()
+	modules[module] = l
+	mu.Unlock()
+}
+
+// ClearModuleLevel makes module follow the default level again
+func ClearModuleLevel(module string) {
+	mu.Lock()
+	delete(modules, module)
+	mu.Unlock()
+}
+
+// Levels returns the default level and all module overrides
+func Levels() (Level, map[string]Level) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	overrides := make(map[string]Level, len(modules))
+	for module, l := range modules {
+		overrides[module] = l
+	}
+	return global, overrides
+}
+
+// Enabled reports whether messages of level l from module are logged
+func Enabled(module string, l Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if ml, ok := modules[module]; ok {
+		return l >= ml
+	}
+	return l >= global
+}
+
+// Configure applies level names from config, e.g. level "info" with
+// modules {"downloader": "debug"}
+func Configure(level string, moduleLevels map[string]string) error {
+	if level != "" {
+		l, err := ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		SetLevel(l)
+	}
+	for module, name := range moduleLevels {
+		if !IsModule(module) {
+			return fmt.Errorf("unknown log module: %s (known: %s)", module, strings.Join(moduleNames, ", "))
+		}
+		l, err := ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("module %s: %v", module, err)
+		}
+		SetModuleLevel(module, l)
+	}
+	return nil
+}
+
+func logf(module string, l Level, format string, args ...interface{}) {
+	if !Enabled(module, l) {
+		return
+	}
+	log.Printf("[%s] %s: %s", strings.ToUpper(l.String()), module, fmt.Sprintf(format, args...))
+}
+
+// Debugf logs a debug message for module
+func Debugf(module, format string, args ...interface{}) { logf(module, Debug, format, args...) }
+
+// Infof logs an informational message for module
+func Infof(module, format string, args ...interface{}) { logf(module, Info, format, args...) }
+
+// Warnf logs a warning for module
+func Warnf(module, format string, args ...interface{}) { logf(module, Warn, format, args...) }
+
+// Errorf logs an error for module
+func Errorf(module, format string, args ...interface{}) { logf(module, Error, format, args...) }
@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value exported at /metrics
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a family of counters told apart by the value of one label
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]*uint64
+}
+
+// Inc adds one to the counter of label value v
+func (c *CounterVec) Inc(v string) {
+	c.mu.Lock()
+	n, ok := c.values[v]
+	if !ok {
+		n = new(uint64)
+		c.values[v] = n
+	}
+	c.mu.Unlock()
+	atomic.AddUint64(n, 1)
+}
+
+// Value returns the count of label value v
+func (c *CounterVec) Value(v string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.values[v]; ok {
+		return atomic.LoadUint64(n)
+	}
+	return 0
+}
+
+func (c *CounterVec) render() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	var b strings.Builder
+	for _, v := range values {
+		fmt.Fprintf(&b, "%s{%s=%q} %d\n", c.name, c.label, v, atomic.LoadUint64(c.values[v]))
+	}
+	return b.String()
+}
+
+// Gauge is a value exported at /metrics that may go up and down
+type Gauge struct {
+	name string
+	help string
+	bits uint64
+}
+
+// Set replaces the value of the gauge
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Histogram counts observed values in cumulative buckets, exported at
+// /metrics with their sum and count
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Observe adds one value to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) render() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var b strings.Builder
+	for i, upper := range h.buckets {
+		fmt.Fprintf(&b, "%s_bucket{le=\"%v\"} %d\n", h.name, upper, h.counts[i])
+	}
+	fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(&b, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+	return b.String()
+}
+
+var (
+	mu         sync.Mutex
+	counters   = make(map[string]*Counter)
+	vecs       = make(map[string]*CounterVec)
+	gauges     = make(map[string]*Gauge)
+	histograms = make(map[string]*Histogram)
+)
+
+// NewCounter registers a counter. Registering the same name twice returns
+// the existing counter.
+func NewCounter(name, help string) *Counter {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c, ok := counters[name]; ok {
+		return c
+	}
+	c := &Counter{name: name, help: help}
+	counters[name] = c
+	return c
+}
+
+// NewCounterVec registers a counter family labelled by label.
+// Registering the same name twice returns the existing family.
+func NewCounterVec(name, help, label string) *CounterVec {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c, ok := vecs[name]; ok {
+		return c
+	}
+	c := &CounterVec{name: name, help: help, label: label, values: map[string]*uint64{}}
+	vecs[name] = c
+	return c
+}
+
+// NewGauge registers a gauge. Registering the same name twice returns the
+// existing gauge.
+func NewGauge(name, help string) *Gauge {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if g, ok := gauges[name]; ok {
+		return g
+	}
+	g := &Gauge{name: name, help: help}
+	gauges[name] = g
+	return g
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds in
+// increasing order. Registering the same name twice returns the existing
+// histogram.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if h, ok := histograms[name]; ok {
+		return h
+	}
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	histograms[name] = h
+	return h
+}
+
+// HTTPPanics counts handler panics recovered by the HTTP middleware
+var HTTPPanics = NewCounter("wdd_http_panics_total", "Panics recovered in HTTP handlers.")
+
+// Write renders all counters, gauges and histograms in the Prometheus text
+// exposition format
+func Write(w io.Writer) error {
+	type metric struct {
+		name, help, kind, samples string
+	}
+	mu.Lock()
+	all := make([]metric, 0, len(counters)+len(vecs)+len(gauges)+len(histograms))
+	for _, c := range counters {
+		all = append(all, metric{c.name, c.help, "counter", fmt.Sprintf("%s %d\n", c.name, c.Value())})
+	}
+	for _, c := range vecs {
+		all = append(all, metric{c.name, c.help, "counter", c.render()})
+	}
+	for _, g := range gauges {
+		all = append(all, metric{g.name, g.help, "gauge", fmt.Sprintf("%s %v\n", g.name, g.Value())})
+	}
+	for _, h := range histograms {
+		all = append(all, metric{h.name, h.help, "histogram", h.render()})
+	}
+	mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	for _, m := range all {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s", m.name, m.help, m.name, m.kind, m.samples)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"wayback-discover-diff/config"
+)
+
+// SignatureHeader carries the signatures of an outbound webhook request
+const SignatureHeader = "X-WDD-Signature"
+
+// signingKeys returns the keys signing requests to url by key ID, from the
+// config.webhooks.signing entry with the longest prefix of url
+func signingKeys(url string) (map[string]string, error) {
+	best := -1
+	var keyEnv map[string]string
+	for _, entry := range config.AppConfig.Webhooks.Signing {
+		if strings.HasPrefix(url, entry.Prefix) && len(entry.Prefix) > best {
+			best, keyEnv = len(entry.Prefix), entry.KeyEnv
+		}
+	}
+	keys := make(map[string]string, len(keyEnv))
+	for id, env := range keyEnv {
+		secret := os.Getenv(env)
+		if secret == "" {
+			return nil, fmt.Errorf("webhook signing key %s: %s is not set", id, env)
+		}
+		keys[id] = secret
+	}
+	return keys, nil
+}
+
+// ValidateSigning checks that every key of config.webhooks.signing is set
+// and has a usable ID
+func ValidateSigning() error {
+	for _, entry := range config.AppConfig.Webhooks.Signing {
+		for id, env := range entry.KeyEnv {
+			if id == "" || id == "t" || strings.ContainsAny(id, ",=") {
+				return fmt.Errorf("webhook signing key id %q must be non-empty, not \"t\" and without ',' or '='", id)
+			}
+			if os.Getenv(env) == "" {
+				return fmt.Errorf("webhook signing key %s: %s is not set", id, env)
+			}
+		}
+	}
+	return nil
+}
+
+// sign adds the signature header to a request to url carrying body, when
+// signing keys apply to url
+func sign(req *http.Request, url string, body []byte) error {
+	keys, err := signingKeys(url)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t := strconv.FormatInt(time.Now().Unix(), 10)
+	parts := []string{"t=" + t}
+	for _, id := range ids {
+		mac := hmac.New(sha256.New, []byte(keys[id]))
+		mac.Write([]byte(t + "."))
+		mac.Write(body)
+		parts = append(parts, id+"="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	req.Header.Set(SignatureHeader, strings.Join(parts, ","))
+	return nil
+}
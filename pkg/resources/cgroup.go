@@ -0,0 +1,84 @@
+package resources
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup hierarchies are mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// unlimitedMemory is the smallest cgroup v1 memory limit taken to mean
+// no limit; v1 reports an unset limit as a page-aligned maximum int64
+const unlimitedMemory = 1 << 62
+
+// MemoryLimit reads the memory limit in bytes of the cgroup the process
+// runs in, supporting cgroup v2 and the memory controller of v1. It is 0
+// when unlimited or unreadable. The CPU quota is left to automaxprocs.
+func MemoryLimit() int64 {
+	paths := ownCgroups()
+	if v2, ok := paths[""]; ok && exists(filepath.Join(cgroupRoot, "cgroup.controllers")) {
+		raw := readFile(lookup(cgroupRoot, v2, "memory.max"))
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		return 0
+	}
+	if path, ok := paths["memory"]; ok {
+		dir := filepath.Join(cgroupRoot, "memory")
+		n, err := strconv.ParseInt(readFile(lookup(dir, path, "memory.limit_in_bytes")), 10, 64)
+		if err == nil && n > 0 && n < unlimitedMemory {
+			return n
+		}
+	}
+	return 0
+}
+
+// ownCgroups maps the controllers of /proc/self/cgroup to the process's
+// cgroup path; the cgroup v2 hierarchy is listed under ""
+func ownCgroups() map[string]string {
+	paths := map[string]string{}
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return paths
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+	}
+	return paths
+}
+
+// lookup returns the file of the process's cgroup under dir, or the one at
+// the root of dir where a container sees its own cgroup as the root
+func lookup(dir, path, file string) string {
+	if own := filepath.Join(dir, path, file); exists(own) {
+		return own
+	}
+	return filepath.Join(dir, file)
+}
+
+func readFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,79 @@
+// Package resources sizes the process to the CPU and memory limits of its
+// container for the settings left unset: GOMAXPROCS, the Go memory limit
+// and config.threads.
+package resources
+
+import (
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"go.uber.org/automaxprocs/maxprocs"
+
+	"wayback-discover-diff/config"
+)
+
+// Defaults of config.resources
+const (
+	defaultMemoryRatio   = 0.9
+	defaultThreadsPerCPU = 2
+	defaultTaskMemoryMB  = 64
+)
+
+// Tune applies the container limits to the settings left unset. An
+// explicit GOMAXPROCS or GOMEMLIMIT environment variable wins over the
+// container limits, as do config.threads and config.resources.
+func Tune() {
+	cfg := config.AppConfig.Resources
+
+	if _, err := maxprocs.Set(maxprocs.Logger(log.Printf)); err != nil {
+		log.Printf("Reading the container CPU quota: %v", err)
+	}
+
+	// A negative limit only reads the current one
+	memory := debug.SetMemoryLimit(-1)
+	if os.Getenv("GOMEMLIMIT") == "" {
+		limit := MemoryLimit()
+		switch {
+		case cfg.MemoryLimitMB > 0:
+			memory = int64(cfg.MemoryLimitMB) << 20
+			debug.SetMemoryLimit(memory)
+		case limit > 0:
+			ratio := cfg.MemoryRatio
+			if ratio <= 0 || ratio > 1 {
+				ratio = defaultMemoryRatio
+			}
+			memory = int64(float64(limit) * ratio)
+			debug.SetMemoryLimit(memory)
+			log.Printf("Container memory limit %d MiB: Go memory limit set to %d MiB", limit>>20, memory>>20)
+		}
+	}
+
+	if config.AppConfig.Threads <= 0 {
+		config.AppConfig.Threads = threads(memory, cfg.ThreadsPerCPU, cfg.TaskMemoryMB)
+		log.Printf("Worker concurrency (threads) set to %d", config.AppConfig.Threads)
+	}
+}
+
+// threads derives the worker concurrency from GOMAXPROCS, capped so that
+// every concurrent capture gets taskMemoryMB of the memory limit
+func threads(memory int64, perCPU, taskMemoryMB int) int {
+	if perCPU <= 0 {
+		perCPU = defaultThreadsPerCPU
+	}
+	if taskMemoryMB <= 0 {
+		taskMemoryMB = defaultTaskMemoryMB
+	}
+	n := perCPU * runtime.GOMAXPROCS(0)
+	if memory > 0 && memory < math.MaxInt64 {
+		if fit := int(memory / (int64(taskMemoryMB) << 20)); fit < n {
+			n = fit
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,90 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// TypeJanitor is the periodic task enforcing retention policies
+const TypeJanitor = "retention:janitor"
+
+// RegisterSchedule validates the policies and schedules the janitor
+func RegisterSchedule(scheduler *asynq.Scheduler) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	schedule := config.AppConfig.Retention.Schedule
+	if schedule == "" {
+		schedule = "@hourly"
+	}
+	_, err := scheduler.Register(schedule, asynq.NewTask(TypeJanitor, nil), asynq.Unique(time.Hour))
+	return err
+}
+
+// Janitor deletes or shortens the lifetime of records outliving their
+// class's retention
+type Janitor struct {
+	redisClient *redis.Client
+}
+
+// NewJanitor creates a janitor working on redisClient
+func NewJanitor(redisClient *redis.Client) *Janitor {
+	return &Janitor{redisClient: redisClient}
+}
+
+// HandleJanitor enforces every class's policy
+func (j *Janitor) HandleJanitor(ctx context.Context, t *asynq.Task) error {
+	for _, c := range Classes() {
+		ttl := TTL(c.Name)
+		if ttl <= 0 {
+			continue
+		}
+		for _, prefix := range c.Prefixes {
+			removed, capped, err := j.enforce(ctx, c, prefix, ttl)
+			if err != nil {
+				return fmt.Errorf("retention %s: %v", c.Name, err)
+			}
+			if removed > 0 || capped > 0 {
+				logging.Infof(logging.Storage, "retention %s: removed %d and capped %d keys under %s", c.Name, removed, capped, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+func (j *Janitor) enforce(ctx context.Context, c Class, prefix string, ttl time.Duration) (removed, capped int, err error) {
+	iter := j.redisClient.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+
+		if c.Age != nil {
+			if at, ok := c.Age(key); ok && time.Since(at) > ttl {
+				if err := j.redisClient.Unlink(ctx, key).Err(); err != nil {
+					return removed, capped, err
+				}
+				removed++
+			}
+			continue
+		}
+
+		// A negative TTL means no expiry (or a key that vanished meanwhile)
+		current, err := j.redisClient.TTL(ctx, key).Result()
+		if err != nil {
+			return removed, capped, err
+		}
+		if current == -1 || current > ttl {
+			if err := j.redisClient.Expire(ctx, key, ttl).Err(); err != nil {
+				return removed, capped, err
+			}
+			capped++
+		}
+	}
+	return removed, capped, iter.Err()
+}
@@ -0,0 +1,120 @@
+// Package retention centralizes how long each class of stored record is
+// kept. Owners register their record classes; writers ask TTL for the
+// expiry to set and the janitor task enforces the policies on records
+// written before a policy changed.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wayback-discover-diff/config"
+)
+
+// Class is a kind of stored record with its own retention
+type Class struct {
+	Name string
+	// Prefixes are the Redis key prefixes of the class's records, free of
+	// SCAN glob metacharacters
+	Prefixes []string
+	// Default is used when config.retention.policies has no entry
+	Default func() time.Duration
+	// Age dates a record from its key. Classes without it are enforced
+	// by capping key TTLs; keys Age cannot date are left alone.
+	Age func(key string) (time.Time, bool)
+}
+
+var (
+	mu      sync.RWMutex
+	classes = make(map[string]Class)
+)
+
+// Register adds a record class; it is meant to be called from init
+func Register(c Class) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, dup := classes[c.Name]; dup {
+		panic("retention: class registered twice: " + c.Name)
+	}
+	for _, prefix := range c.Prefixes {
+		if strings.ContainsAny(prefix, "*?[]\\") {
+			panic("retention: glob metacharacter in prefix of class " + c.Name)
+		}
+	}
+	classes[c.Name] = c
+}
+
+// Classes returns the registered classes ordered by name
+func Classes() []Class {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	all := make([]Class, 0, len(classes))
+	for _, c := range classes {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// TTL is how long records of the named class are kept; zero keeps them
+// forever. Invalid policies are reported by Validate and fall back to the
+// class default here.
+func TTL(name string) time.Duration {
+	if raw, ok := config.AppConfig.Retention.Policies[name]; ok {
+		if d, err := ParseDuration(raw); err == nil {
+			return d
+		}
+	}
+
+	mu.RLock()
+	c, ok := classes[name]
+	mu.RUnlock()
+	if !ok || c.Default == nil {
+		return 0
+	}
+	return c.Default()
+}
+
+// Validate checks that every configured policy names a registered class
+// and has a valid duration
+func Validate() error {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for name, raw := range config.AppConfig.Retention.Policies {
+		if _, ok := classes[name]; !ok {
+			return fmt.Errorf("retention policy for unknown record class %s", name)
+		}
+		if _, err := ParseDuration(raw); err != nil {
+			return fmt.Errorf("retention policy %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ParseDuration reads a Go duration, a number of days such as "400d" or a
+// plain number of seconds
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return d, nil
+}
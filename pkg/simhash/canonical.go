@@ -0,0 +1,42 @@
+package simhash
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Canonical returns the href of the first <link rel="canonical"> in the
+// head of an HTML document, or "" when there is none. Tokenizing stops at
+// the body, where the link is not allowed.
+func Canonical(htmlContent []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(htmlContent))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "body":
+				return ""
+			case "link":
+				var rel, href string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "rel":
+						rel = a.Val
+					case "href":
+						href = a.Val
+					}
+				}
+				for _, r := range strings.Fields(rel) {
+					if strings.EqualFold(r, "canonical") {
+						return strings.TrimSpace(href)
+					}
+				}
+			}
+		}
+	}
+}
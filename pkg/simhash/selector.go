@@ -0,0 +1,313 @@
+package simhash
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Selectors is a list of CSS selectors matching the elements any of them
+// matches. Supported are type, universal, #id, .class and attribute
+// selectors ([attr], [attr=value], [attr~=word], [attr^=prefix],
+// [attr$=suffix], [attr*=text]) compounded and joined by descendant and
+// child (>) combinators.
+type Selectors []selector
+
+// selector is a complex selector, its subject last
+type selector []step
+
+// step is a compound selector of a complex selector
+type step struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrMatch
+	// child is set when the step before is joined by >
+	child bool
+}
+
+type attrMatch struct {
+	key   string
+	op    string
+	value string
+}
+
+// ParseSelectors compiles CSS selector lists such as "#comments, .ad-slot"
+func ParseSelectors(lists []string) (Selectors, error) {
+	var out Selectors
+	for _, list := range lists {
+		for _, s := range splitList(list) {
+			sel, err := parseSelector(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sel)
+		}
+	}
+	return out, nil
+}
+
+// splitList splits a selector list at the commas outside attribute
+// selectors
+func splitList(list string) []string {
+	var parts []string
+	var quote byte
+	start, inAttr := 0, false
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case inAttr && (c == '"' || c == '\''):
+			quote = c
+		case c == '[':
+			inAttr = true
+		case c == ']':
+			inAttr = false
+		case c == ',' && !inAttr:
+			parts = append(parts, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, list[start:])
+}
+
+// Match reports whether any of the selectors matches n
+func (s Selectors) Match(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	for _, sel := range s {
+		if sel.matchAt(len(sel)-1, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s selector) matchAt(i int, n *html.Node) bool {
+	if !s[i].matches(n) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	if s[i].child {
+		return n.Parent != nil && s.matchAt(i-1, n.Parent)
+	}
+	for p := n.Parent; p != nil; p = p.Parent {
+		if s.matchAt(i-1, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st step) matches(n *html.Node) bool {
+	if n.Type != html.ElementNode || (st.tag != "" && n.Data != st.tag) {
+		return false
+	}
+	if st.id != "" && attr(n, "id") != st.id {
+		return false
+	}
+	if len(st.classes) > 0 {
+		classes := strings.Fields(attr(n, "class"))
+		for _, class := range st.classes {
+			if !contains(classes, class) {
+				return false
+			}
+		}
+	}
+	for _, a := range st.attrs {
+		value, ok := lookupAttr(n, a.key)
+		if !ok {
+			return false
+		}
+		switch a.op {
+		case "=":
+			ok = value == a.value
+		case "~=":
+			ok = contains(strings.Fields(value), a.value)
+		case "^=":
+			ok = a.value != "" && strings.HasPrefix(value, a.value)
+		case "$=":
+			ok = a.value != "" && strings.HasSuffix(value, a.value)
+		case "*=":
+			ok = a.value != "" && strings.Contains(value, a.value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func lookupAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorParser reads one complex selector
+type selectorParser struct {
+	s string
+	i int
+}
+
+func parseSelector(s string) (selector, error) {
+	p := &selectorParser{s: s}
+	var sel selector
+	child := false
+	for {
+		p.skipSpace()
+		if p.done() {
+			break
+		}
+		if p.s[p.i] == '>' {
+			if len(sel) == 0 || child {
+				return nil, p.errorf("unexpected >")
+			}
+			child = true
+			p.i++
+			continue
+		}
+		st, err := p.step()
+		if err != nil {
+			return nil, err
+		}
+		st.child = child
+		sel = append(sel, st)
+		child = false
+	}
+	if len(sel) == 0 || child {
+		return nil, fmt.Errorf("invalid selector %q", s)
+	}
+	return sel, nil
+}
+
+func (p *selectorParser) step() (step, error) {
+	var st step
+	start := p.i
+	if p.s[p.i] == '*' {
+		p.i++
+	} else {
+		st.tag = strings.ToLower(p.ident())
+	}
+	for !p.done() {
+		switch c := p.s[p.i]; c {
+		case '#', '.':
+			p.i++
+			name := p.ident()
+			if name == "" {
+				return st, p.errorf("expected a name after %c", c)
+			}
+			if c == '#' {
+				st.id = name
+			} else {
+				st.classes = append(st.classes, name)
+			}
+		case '[':
+			a, err := p.attr()
+			if err != nil {
+				return st, err
+			}
+			st.attrs = append(st.attrs, a)
+		case ' ', '\t', '\n', '\r', '\f', '>':
+			return st, nil
+		default:
+			return st, p.errorf("unexpected %q", c)
+		}
+	}
+	if p.i == start {
+		return st, p.errorf("empty selector")
+	}
+	return st, nil
+}
+
+// attr reads an attribute selector, the opening bracket next
+func (p *selectorParser) attr() (attrMatch, error) {
+	var a attrMatch
+	p.i++
+	p.skipSpace()
+	if a.key = strings.ToLower(p.ident()); a.key == "" {
+		return a, p.errorf("expected an attribute name")
+	}
+	p.skipSpace()
+	if p.done() {
+		return a, p.errorf("unterminated attribute selector")
+	}
+	if p.s[p.i] == ']' {
+		p.i++
+		return a, nil
+	}
+	for _, op := range []string{"=", "~=", "^=", "$=", "*="} {
+		if strings.HasPrefix(p.s[p.i:], op) {
+			a.op = op
+			p.i += len(op)
+			break
+		}
+	}
+	if a.op == "" {
+		return a, p.errorf("expected ] or an attribute operator")
+	}
+	p.skipSpace()
+	if !p.done() && (p.s[p.i] == '"' || p.s[p.i] == '\'') {
+		quote := p.s[p.i]
+		end := strings.IndexByte(p.s[p.i+1:], quote)
+		if end < 0 {
+			return a, p.errorf("unterminated string")
+		}
+		a.value = p.s[p.i+1 : p.i+1+end]
+		p.i += end + 2
+	} else if a.value = p.ident(); a.value == "" {
+		return a, p.errorf("expected an attribute value")
+	}
+	p.skipSpace()
+	if p.done() || p.s[p.i] != ']' {
+		return a, p.errorf("expected ]")
+	}
+	p.i++
+	return a, nil
+}
+
+// ident reads a name of letters, digits, - and _
+func (p *selectorParser) ident() string {
+	start := p.i
+	for !p.done() {
+		c := p.s[p.i]
+		if c != '-' && c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') &&
+			!('0' <= c && c <= '9') && c < 0x80 {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *selectorParser) skipSpace() {
+	for !p.done() && strings.IndexByte(" \t\n\r\f", p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *selectorParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid selector %q at %d: %s", p.s, p.i, fmt.Sprintf(format, args...))
+}
@@ -3,6 +3,8 @@ package simhash
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"math/bits"
 	"strings"
 	"unicode"
 
@@ -16,37 +18,204 @@ type Feature struct {
 	Weight int
 }
 
+// ExtractOptions adds optional content to the features of a page. Each
+// weight is added per occurrence of a word; zero leaves the content out.
+type ExtractOptions struct {
+	// AltText weighs the alt attribute of images
+	AltText int
+	// Meta weighs meta keywords and description and og: properties
+	Meta int
+	// JSONLD weighs the string values of application/ld+json scripts
+	JSONLD int
+	// Limits bound the work spent on a single document
+	Limits Limits
+	// Ignore removes the elements it matches with their content, such as
+	// comment sections or ad slots, before anything is extracted
+	Ignore Selectors
+	// Tokens maps volatile tokens of all extracted text to placeholders
+	Tokens TokenOptions
+}
+
+// Limits guard extraction against huge or deeply nested documents. Zero
+// values are unlimited.
+type Limits struct {
+	// MaxNodes is the number of tags and text runs read, and of nodes
+	// visited, before extraction stops
+	MaxNodes int
+	// MaxDepth is the nesting depth below which nodes are skipped
+	MaxDepth int
+	// MaxTokens is the number of visible words taken from the document
+	MaxTokens int
+}
+
 // ExtractHTMLFeatures processes HTML document and extracts key features
 func ExtractHTMLFeatures(htmlContent []byte) map[string]int {
+	features, _ := ExtractFeatures(htmlContent, ExtractOptions{})
+	return features
+}
+
+// ExtractFeatures extracts the visible text of an HTML document plus the
+// optional content enabled in opts. It reports whether opts.Limits cut
+// the document short, in which case the features cover only part of it.
+func ExtractFeatures(htmlContent []byte, opts ExtractOptions) (map[string]int, bool) {
 	features := make(map[string]int)
 
+	limits := opts.Limits
+	htmlContent, truncated := bound(htmlContent, limits)
 	doc, err := html.Parse(bytes.NewReader(htmlContent))
 	if err != nil {
-		return features
+		return features, truncated
 	}
 
+	type entry struct {
+		node  *html.Node
+		depth int
+	}
 	var text strings.Builder
-	var extractText func(*html.Node)
-	extractText = func(n *html.Node) {
+	var nodes, tokens int
+
+	// Walk the tree in document order with an explicit stack so nesting
+	// cannot exhaust the goroutine stack
+	stack := []entry{{doc, 0}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := e.node
+
+		if limits.MaxNodes > 0 && nodes >= limits.MaxNodes {
+			truncated = true
+			break
+		}
+		nodes++
+
 		if n.Type == html.TextNode {
-			text.WriteString(n.Data + " ")
+			if limits.MaxTokens <= 0 {
+				text.WriteString(n.Data + " ")
+				continue
+			}
+			words := strings.Fields(n.Data)
+			if tokens+len(words) > limits.MaxTokens {
+				words = words[:limits.MaxTokens-tokens]
+				truncated = true
+			}
+			tokens += len(words)
+			text.WriteString(strings.Join(words, " ") + " ")
+			if truncated {
+				break
+			}
+			continue
 		}
 		if n.Type == html.ElementNode {
-			// Skip script and style elements
-			if n.Data == "script" || n.Data == "style" {
-				return
+			if opts.Ignore.Match(n) {
+				continue
 			}
+			// Script and style text is skipped; optional features come
+			// from attributes and JSON-LD
+			switch n.Data {
+			case "img":
+				if opts.AltText > 0 {
+					addWords(features, attr(n, "alt"), opts.AltText, opts.Tokens)
+				}
+			case "meta":
+				if opts.Meta > 0 && isContentMeta(n) {
+					addWords(features, attr(n, "content"), opts.Meta, opts.Tokens)
+				}
+			case "script":
+				if opts.JSONLD > 0 && strings.EqualFold(attr(n, "type"), "application/ld+json") && n.FirstChild != nil {
+					var data interface{}
+					if json.Unmarshal([]byte(n.FirstChild.Data), &data) == nil {
+						addJSONStrings(features, data, opts.JSONLD, opts.Tokens)
+					}
+				}
+				continue
+			case "style":
+				continue
+			}
+		}
+
+		if n.FirstChild == nil {
+			continue
+		}
+		if limits.MaxDepth > 0 && e.depth >= limits.MaxDepth {
+			truncated = true
+			continue
 		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			extractText(c)
+		// Children are pushed last to first so the first is visited next
+		for c := n.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, entry{c, e.depth + 1})
 		}
 	}
 
-	extractText(doc)
+	addWords(features, text.String(), 1, opts.Tokens)
+	return features, truncated
+}
+
+// voidElements never have children, so their start tags do not nest
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
 
-	// Process the extracted text
-	words := strings.Fields(strings.ToLower(text.String()))
+// bound drops the markup nested deeper than limits.MaxDepth and everything
+// after the first limits.MaxNodes tokens, reporting whether anything was
+// dropped. The parser slows down sharply on deeply nested input, so this
+// runs as a linear pass over the tokens before parsing.
+func bound(htmlContent []byte, limits Limits) ([]byte, bool) {
+	if limits.MaxNodes <= 0 && limits.MaxDepth <= 0 {
+		return htmlContent, false
+	}
+
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(htmlContent))
+	depth, count := 0, 0
+	truncated := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if count++; limits.MaxNodes > 0 && count > limits.MaxNodes {
+			truncated = true
+			break
+		}
+
+		keep := true
+		switch tt {
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			if !voidElements[string(name)] {
+				depth++
+				keep = limits.MaxDepth <= 0 || depth <= limits.MaxDepth
+			}
+		case html.EndTagToken:
+			keep = limits.MaxDepth <= 0 || depth <= limits.MaxDepth
+			if depth > 0 {
+				depth--
+			}
+		default:
+			keep = limits.MaxDepth <= 0 || depth <= limits.MaxDepth
+		}
+		if keep {
+			out.Write(z.Raw())
+		} else {
+			truncated = true
+		}
+	}
+	if !truncated {
+		return htmlContent, false
+	}
+	return out.Bytes(), true
+}
+
+// addWords adds weight for every word of text, or for the placeholder
+// tokens puts in its place
+func addWords(features map[string]int, text string, weight int, tokens TokenOptions) {
+	words := strings.Fields(tokens.placeholders(strings.ToLower(text)))
 	for _, word := range words {
+		if placeholder, ok := tokens.placeholder(word); ok {
+			features[placeholder] += weight
+			continue
+		}
 		// Remove punctuation and non-letter characters
 		word = strings.Map(func(r rune) rune {
 			if unicode.IsPunct(r) || !unicode.IsLetter(r) {
@@ -57,11 +226,47 @@ func ExtractHTMLFeatures(htmlContent []byte) map[string]int {
 
 		word = strings.TrimSpace(word)
 		if word != "" {
-			features[word]++
+			features[word] += weight
 		}
 	}
+}
 
-	return features
+// addJSONStrings adds the words of every string value in a decoded JSON
+// document, skipping @-keywords such as @context and @type
+func addJSONStrings(features map[string]int, v interface{}, weight int, tokens TokenOptions) {
+	switch v := v.(type) {
+	case string:
+		addWords(features, v, weight, tokens)
+	case []interface{}:
+		for _, item := range v {
+			addJSONStrings(features, item, weight, tokens)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			if strings.HasPrefix(key, "@") {
+				continue
+			}
+			addJSONStrings(features, item, weight, tokens)
+		}
+	}
+}
+
+// isContentMeta matches meta keywords/description and Open Graph tags
+func isContentMeta(n *html.Node) bool {
+	switch strings.ToLower(attr(n, "name")) {
+	case "keywords", "description":
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(attr(n, "property")), "og:")
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
 }
 
 // CalculateSimHash computes the simhash for the given features
@@ -132,3 +337,37 @@ func DecodeSimHash(encoded string) (uint64, error) {
 	}
 	return simhash, nil
 }
+
+// Distance is the number of differing bits between two simhashes
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// DistanceMatrix returns the pairwise distances of hashes. Each pair is
+// computed once with a single popcount and mirrored; the rows share one
+// backing array.
+func DistanceMatrix(hashes []uint64) [][]int {
+	n := len(hashes)
+	cells := make([]int, n*n)
+	matrix := make([][]int, n)
+	for i := range matrix {
+		matrix[i] = cells[i*n : (i+1)*n]
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			d := bits.OnesCount64(hashes[i] ^ hashes[j])
+			matrix[i][j] = d
+			matrix[j][i] = d
+		}
+	}
+	return matrix
+}
+
+// Similarity normalizes the distance of two size-bit simhashes to [0,1],
+// where 1 means identical
+func Similarity(distance, size int) float64 {
+	if size <= 0 {
+		return 0
+	}
+	return 1 - float64(distance)/float64(size)
+}
@@ -0,0 +1,79 @@
+package simhash
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Placeholder features of TokenOptions
+const (
+	NumberToken = "<number>"
+	DateToken   = "<date>"
+)
+
+// TokenOptions replace volatile tokens with placeholders, so that pages
+// differing only in a visitor counter or a "last updated" stamp hash alike
+type TokenOptions struct {
+	// Numbers maps numerals such as 1,234 or 3.5% to NumberToken; they are
+	// dropped otherwise
+	Numbers bool
+	// Dates maps dates and times such as 2019-03-01, 03/01/2019,
+	// March 1, 2019 or 12:30 pm to DateToken
+	Dates bool
+}
+
+const (
+	month   = `(?:jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sep(?:t(?:ember)?)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)\.?`
+	weekday = `(?:(?:mon|tue|wed|thu|fri|sat|sun)[a-z]*\.?,?\s+)?`
+	day     = `\d{1,2}(?:st|nd|rd|th)?`
+	clock   = `\d{1,2}:\d{2}(?::\d{2})?(?:\s*[ap]\.?m\b\.?)?`
+)
+
+// datePattern matches the date and time forms of TokenOptions.Dates in
+// lowercased text
+var datePattern = regexp.MustCompile(`\b(?:` +
+	// ISO 8601 dates, optionally with a time and zone
+	`\d{4}-\d{1,2}-\d{1,2}(?:[t ]\d{1,2}:\d{2}(?::\d{2}(?:\.\d+)?)?(?:z|[+-]\d{2}:?\d{2})?)?` +
+	`|\d{1,2}[/.-]\d{1,2}[/.-](?:\d{4}|\d{2})` +
+	`|` + weekday + month + `\s+` + day + `(?:,?\s+\d{4})?` +
+	`|` + weekday + day + `\s+(?:of\s+)?` + month + `(?:,?\s+\d{4})?` +
+	`|` + month + `,?\s+\d{4}` +
+	`|` + clock +
+	`)\b`)
+
+// placeholders replaces the dates of lowercased text by DateToken
+func (o TokenOptions) placeholders(text string) string {
+	if !o.Dates {
+		return text
+	}
+	return datePattern.ReplaceAllString(text, " "+DateToken+" ")
+}
+
+// placeholder returns the placeholder standing for word, if any
+func (o TokenOptions) placeholder(word string) (string, bool) {
+	if o.Dates && word == DateToken {
+		return DateToken, true
+	}
+	if o.Numbers && isNumeral(word) {
+		return NumberToken, true
+	}
+	return "", false
+}
+
+// isNumeral reports whether word is digits with separators, signs,
+// currency or percent signs and trailing punctuation, but no letters
+func isNumeral(word string) bool {
+	digits := false
+	for _, r := range word {
+		switch {
+		case unicode.IsDigit(r):
+			digits = true
+		case unicode.IsLetter(r):
+			return false
+		case !strings.ContainsRune(".,:;+-−%‰()'\"!?", r) && !unicode.Is(unicode.Sc, r):
+			return false
+		}
+	}
+	return digits
+}
@@ -0,0 +1,166 @@
+// Package similarity provides the metrics /diff can compare captures with.
+// Metrics register themselves by name, like pipeline hooks and retention
+// classes; Hamming distance over the simhash is the default.
+package similarity
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"wayback-discover-diff/config"
+)
+
+// Default is the metric used when a request does not name one
+const Default = "hamming"
+
+// ErrNoFeatures is returned by feature metrics when a capture has no
+// stored features
+var ErrNoFeatures = errors.New("features are not stored for this capture")
+
+// Capture is what a metric may compare: the simhash, always present, and
+// the stored features, when config.simhash.store_features was set
+type Capture struct {
+	Hash     uint64
+	Features map[string]int
+}
+
+// Metric scores two captures of a URL
+type Metric interface {
+	// Similarity is in [0,1], 1 meaning identical; size is the bit size
+	// of the simhashes
+	Similarity(a, b Capture, size int) (float64, error)
+	// NeedsFeatures reports whether the metric reads stored features
+	NeedsFeatures() bool
+}
+
+var (
+	mu      sync.RWMutex
+	metrics = make(map[string]Metric)
+)
+
+// Register makes a metric selectable as /diff?metric=name. It panics on
+// duplicate names.
+func Register(name string, m Metric) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, dup := metrics[name]; dup {
+		panic(fmt.Sprintf("similarity: metric %q registered twice", name))
+	}
+	metrics[name] = m
+}
+
+// Lookup returns the metric registered under name
+func Lookup(name string) (Metric, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	m, ok := metrics[name]
+	return m, ok
+}
+
+// Names lists the registered metrics
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("hamming", hamming{})
+	Register("weighted", weighted{})
+	Register("jaccard", jaccard{})
+	Register("containment", containment{})
+}
+
+// hamming is the share of equal simhash bits
+type hamming struct{}
+
+func (hamming) NeedsFeatures() bool { return false }
+
+func (hamming) Similarity(a, b Capture, size int) (float64, error) {
+	if size <= 0 {
+		return 0, nil
+	}
+	return 1 - float64(bits.OnesCount64(a.Hash^b.Hash))/float64(size), nil
+}
+
+// weighted is the share of bit weight, from config.diff.bit_weights, on
+// which the simhashes agree. Bits without a configured weight weigh 1.
+type weighted struct{}
+
+func (weighted) NeedsFeatures() bool { return false }
+
+func (weighted) Similarity(a, b Capture, size int) (float64, error) {
+	weights := config.AppConfig.Diff.BitWeights
+	var total, differing float64
+	diff := a.Hash ^ b.Hash
+	for i := 0; i < size; i++ {
+		w := 1.0
+		if i < len(weights) {
+			w = weights[i]
+		}
+		total += w
+		if diff&(1<<uint(i)) != 0 {
+			differing += w
+		}
+	}
+	if total <= 0 {
+		return 0, nil
+	}
+	return 1 - differing/total, nil
+}
+
+// jaccard is the size of the intersection of the feature sets over the
+// size of their union
+type jaccard struct{}
+
+func (jaccard) NeedsFeatures() bool { return true }
+
+func (jaccard) Similarity(a, b Capture, size int) (float64, error) {
+	if a.Features == nil || b.Features == nil {
+		return 0, ErrNoFeatures
+	}
+	shared := intersection(a.Features, b.Features)
+	union := len(a.Features) + len(b.Features) - shared
+	if union == 0 {
+		return 1, nil
+	}
+	return float64(shared) / float64(union), nil
+}
+
+// containment is the share of the first capture's features still present
+// in the second, e.g. how much of a baseline survives in a later version
+type containment struct{}
+
+func (containment) NeedsFeatures() bool { return true }
+
+func (containment) Similarity(a, b Capture, size int) (float64, error) {
+	if a.Features == nil || b.Features == nil {
+		return 0, ErrNoFeatures
+	}
+	if len(a.Features) == 0 {
+		return 1, nil
+	}
+	return float64(intersection(a.Features, b.Features)) / float64(len(a.Features)), nil
+}
+
+func intersection(a, b map[string]int) int {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	n := 0
+	for feature := range a {
+		if _, ok := b[feature]; ok {
+			n++
+		}
+	}
+	return n
+}
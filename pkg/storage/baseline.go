@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// BaselinesKey is the Redis hash mapping URLs to their pinned baseline
+// capture timestamp
+const BaselinesKey = "baselines"
+
+// SetBaseline pins the capture of url at timestamp as its baseline
+func (s *Store) SetBaseline(ctx context.Context, url, timestamp string) error {
+	return s.client.HSet(ctx, BaselinesKey, s.scoped(url), timestamp).Err()
+}
+
+// Baseline returns the pinned baseline timestamp of url, or ErrNotFound
+func (s *Store) Baseline(ctx context.Context, url string) (string, error) {
+	var timestamp string
+	err := retry(ctx, func() (err error) {
+		timestamp, err = s.reader().HGet(ctx, BaselinesKey, s.scoped(url)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return timestamp, err
+}
+
+// DeleteBaseline unpins the baseline of url, reporting whether one was set
+func (s *Store) DeleteBaseline(ctx context.Context, url string) (bool, error) {
+	removed, err := s.client.HDel(ctx, BaselinesKey, s.scoped(url)).Result()
+	return removed > 0, err
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"wayback-discover-diff/config"
+)
+
+// encPrefix marks values written by the cipher: enc:<key id>:<base64 nonce+ciphertext>
+const encPrefix = "enc:"
+
+// Cipher seals stored values with AES-GCM. Values are always written with
+// the active key; any configured key can open them, which allows keys to
+// be rotated without rewriting existing data.
+type Cipher struct {
+	activeID string
+	aeads    map[string]cipher.AEAD
+}
+
+// newCipherFromConfig loads the keys of config.storage.encryption from
+// its key provider
+func newCipherFromConfig() (*Cipher, error) {
+	cfg := config.AppConfig.Storage.Encryption
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	provider, err := keyProvider(cfg.Provider)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := provider.Keys(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cipher{activeID: cfg.ActiveKey, aeads: make(map[string]cipher.AEAD)}
+	for id, raw := range keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("encryption key id %q must not contain ':'", id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads[id] = aead
+	}
+
+	if _, ok := c.aeads[c.activeID]; !ok {
+		return nil, fmt.Errorf("active encryption key %q is not configured", c.activeID)
+	}
+	return c, nil
+}
+
+// Seal encrypts value, binding it to the Redis key it is stored under
+func (c *Cipher) Seal(key, value string) (string, error) {
+	aead := c.aeads[c.activeID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return encPrefix + c.activeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value written by Seal. Plaintext values are returned
+// unchanged so encryption can be enabled on an existing dataset.
+func (c *Cipher) Open(key, value string) (string, error) {
+	if !strings.HasPrefix(value, encPrefix) {
+		return value, nil
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, encPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	aead, ok := c.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %q", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
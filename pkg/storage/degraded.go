@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// ErrUnavailable is returned when Redis could not be reached within the
+// configured retries and no cached value could stand in
+var ErrUnavailable = errors.New("storage unavailable")
+
+// transient reports whether err is a connection failure worth retrying,
+// as opposed to a missing key, a Redis error reply or a cancelled request
+func transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "LOADING") || strings.Contains(msg, "connection pool timeout")
+}
+
+// retry runs op until it succeeds or fails for a reason other than a
+// connection error, at most config.storage.retry.attempts times. Running
+// out of attempts yields an error wrapping ErrUnavailable.
+func retry(ctx context.Context, op func() error) error {
+	cfg := config.AppConfig.Storage.Retry
+	backoff := time.Duration(cfg.BackoffMs) * time.Millisecond
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(); !transient(err) {
+			return err
+		}
+		if attempt >= cfg.Attempts {
+			return unavailable(err)
+		}
+		logging.Debugf(logging.Storage, "attempt %d failed, retrying in %s: %v", attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return unavailable(err)
+		}
+		backoff *= 2
+	}
+}
+
+func unavailable(err error) error {
+	return &unavailableError{err: err}
+}
+
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return ErrUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+type staleKey struct{}
+
+// TrackStale returns a context in which reads answered from the stale
+// cache are recorded, see Stale
+func TrackStale(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleKey{}, new(int32))
+}
+
+// Stale reports whether a read made with ctx was answered from the stale
+// cache because Redis was unreachable
+func Stale(ctx context.Context) bool {
+	flag, ok := ctx.Value(staleKey{}).(*int32)
+	return ok && atomic.LoadInt32(flag) == 1
+}
+
+func markStale(ctx context.Context) {
+	if flag, ok := ctx.Value(staleKey{}).(*int32); ok {
+		atomic.StoreInt32(flag, 1)
+	}
+}
+
+// staleCache keeps the most recently read values by Redis key so reads
+// can still be answered, possibly out of date, during a short outage
+type staleCache struct {
+	size   int
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type staleEntry struct {
+	key    string
+	value  interface{}
+	stored time.Time
+}
+
+// newStaleCacheFromConfig returns the cache of config.storage.stale_cache,
+// or nil when it is disabled
+func newStaleCacheFromConfig() *staleCache {
+	cfg := config.AppConfig.Storage.StaleCache
+	if cfg.Size <= 0 {
+		return nil
+	}
+	return &staleCache{
+		size:    cfg.Size,
+		maxAge:  time.Duration(cfg.MaxAge) * time.Second,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *staleCache) put(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = staleEntry{key: key, value: value, stored: time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(staleEntry{key: key, value: value, stored: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(staleEntry).key)
+	}
+}
+
+func (c *staleCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(staleEntry)
+	if c.maxAge > 0 && time.Since(entry.stored) > c.maxAge {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *staleCache) drop(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *staleCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+// cached answers a read that failed with err from the stale cache when
+// Redis is unavailable, marking ctx as stale
+func (s *Store) cached(ctx context.Context, key string, err error) (interface{}, bool) {
+	if !errors.Is(err, ErrUnavailable) {
+		return nil, false
+	}
+	value, ok := s.stale.get(key)
+	if ok {
+		logging.Warnf(logging.Storage, "serving %s from the stale cache: %v", key, err)
+		markStale(ctx)
+	}
+	return value, ok
+}
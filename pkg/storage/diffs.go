@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrExists is returned when a record to create is already stored
+var ErrExists = errors.New("already exists")
+
+// DiffLinkKey holds the diff permalink with id. Permalinks are cited from
+// reports, so they are kept with no expiry and outlive the captures.
+func DiffLinkKey(id string) string {
+	return "diff-link:" + id
+}
+
+// SaveDiffLink stores link, marshalled to JSON, under id, or returns
+// ErrExists if id is taken
+func (s *Store) SaveDiffLink(ctx context.Context, id string, link interface{}) error {
+	raw, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	key := DiffLinkKey(id)
+	sealed, err := s.seal(key, string(raw))
+	if err != nil {
+		return err
+	}
+	var created bool
+	err = retry(ctx, func() (err error) {
+		created, err = s.client.SetNX(ctx, key, sealed, 0).Result()
+		return err
+	})
+	if err == nil && !created {
+		return ErrExists
+	}
+	return err
+}
+
+// DiffLink unmarshals the diff permalink with id into link, or returns
+// ErrNotFound
+func (s *Store) DiffLink(ctx context.Context, id string, link interface{}) error {
+	key := DiffLinkKey(id)
+	var raw string
+	err := retry(ctx, func() (err error) {
+		raw, err = s.reader().Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	plain, err := s.open(key, raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(plain), link)
+}
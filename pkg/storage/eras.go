@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErasKey is the Redis hash of the eras computed for url, by hash size and
+// era distance
+func ErasKey(url string) string {
+	return "eras:" + url
+}
+
+// erasRecord is the stored form of a set of eras
+type erasRecord struct {
+	ComputedAt time.Time       `json:"computed_at"`
+	Eras       json.RawMessage `json:"eras"`
+}
+
+func (s *Store) erasField(distance int) string {
+	return fmt.Sprintf("%d/%d", s.size, distance)
+}
+
+// SaveEras stores eras, marshalled to JSON, as the eras of url for distance
+func (s *Store) SaveEras(ctx context.Context, url string, distance int, eras interface{}, ttl time.Duration) error {
+	raw, err := json.Marshal(eras)
+	if err != nil {
+		return err
+	}
+	record, err := json.Marshal(erasRecord{ComputedAt: time.Now().UTC().Truncate(time.Second), Eras: raw})
+	if err != nil {
+		return err
+	}
+	key, field := ErasKey(s.hashed(url)), s.erasField(distance)
+	sealed, err := s.seal(fieldAAD(key, field), string(record))
+	if err != nil {
+		return err
+	}
+	return retry(ctx, func() error {
+		pipe := s.client.TxPipeline()
+		pipe.HSet(ctx, key, field, sealed)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// Eras unmarshals the stored eras of url for distance into eras and
+// returns when they were computed, or ErrNotFound
+func (s *Store) Eras(ctx context.Context, url string, distance int, eras interface{}) (time.Time, error) {
+	key, field := ErasKey(s.hashed(url)), s.erasField(distance)
+	var raw string
+	err := retry(ctx, func() (err error) {
+		raw, err = s.reader().HGet(ctx, key, field).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	plain, err := s.open(fieldAAD(key, field), raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var record erasRecord
+	if err := json.Unmarshal([]byte(plain), &record); err != nil {
+		return time.Time{}, err
+	}
+	return record.ComputedAt, json.Unmarshal(record.Eras, eras)
+}
+
+// DeleteEras drops the eras stored for url under every extraction
+// profile, to be computed again from its current captures
+func (s *Store) DeleteEras(ctx context.Context, url string) error {
+	views := s.profileViews()
+	keys := make([]string, len(views))
+	for i, view := range views {
+		keys[i] = ErasKey(view.hashed(url))
+	}
+	return retry(ctx, func() error {
+		return s.client.Del(ctx, keys...).Err()
+	})
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// ExclusionsKey is the Redis hash of the excluded captures of url, by
+// timestamp
+func ExclusionsKey(url string) string {
+	return "exclusions:" + url
+}
+
+// Exclusion records why an operator took a capture out of analyses, e.g.
+// a known bad capture or a defacement under investigation
+type Exclusion struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// ExcludeCapture excludes the capture of url at timestamp for reason,
+// replacing an earlier reason. Exclusions apply to hashes of every size
+// and outlive the captures themselves, so recomputed hashes stay excluded.
+// Records are sealed like capture metadata.
+func (s *Store) ExcludeCapture(ctx context.Context, url, timestamp, reason string) (Exclusion, error) {
+	e := Exclusion{Reason: reason, At: time.Now().UTC().Truncate(time.Second)}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	key := ExclusionsKey(s.scoped(url))
+	sealed, err := s.seal(fieldAAD(key, timestamp), string(raw))
+	if err != nil {
+		return e, err
+	}
+	return e, retry(ctx, func() error {
+		return s.client.HSet(ctx, key, timestamp, sealed).Err()
+	})
+}
+
+// IncludeCapture lifts the exclusion of a capture, reporting whether it
+// was excluded
+func (s *Store) IncludeCapture(ctx context.Context, url, timestamp string) (bool, error) {
+	var removed int64
+	err := retry(ctx, func() (err error) {
+		removed, err = s.client.HDel(ctx, ExclusionsKey(s.scoped(url)), timestamp).Result()
+		return err
+	})
+	return removed > 0, err
+}
+
+// Exclusions returns the excluded captures of url by timestamp
+func (s *Store) Exclusions(ctx context.Context, url string) (map[string]Exclusion, error) {
+	key := ExclusionsKey(s.scoped(url))
+	var raw map[string]string
+	err := retry(ctx, func() (err error) {
+		raw, err = s.reader().HGetAll(ctx, key).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := make(map[string]Exclusion, len(raw))
+	for timestamp, value := range raw {
+		var e Exclusion
+		// Keep the capture excluded even if its record is unreadable
+		if plain, err := s.open(fieldAAD(key, timestamp), value); err != nil {
+			e.Reason = "undecryptable exclusion record"
+		} else if json.Unmarshal([]byte(plain), &e) != nil {
+			e.Reason = plain
+		}
+		exclusions[timestamp] = e
+	}
+	return exclusions, nil
+}
+
+// WithoutExcluded returns the captures not in exclusions, in order
+func WithoutExcluded(captures []Capture, exclusions map[string]Exclusion) []Capture {
+	if len(exclusions) == 0 {
+		return captures
+	}
+	kept := make([]Capture, 0, len(captures))
+	for _, c := range captures {
+		if _, excluded := exclusions[c.Timestamp]; !excluded {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
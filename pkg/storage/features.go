@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// deltaPrefix starts stored feature records holding a FeatureDelta;
+// full feature maps are stored as plain JSON
+const deltaPrefix = "delta:"
+
+// maxDeltaChain bounds the records read to rebuild one feature map
+const maxDeltaChain = 1000
+
+// FeatureDelta is the difference between the features of a capture and
+// those of Base, an earlier capture of the same URL. Changes holds the new
+// count minus the count of Base, for the features whose count changed; a
+// feature whose count drops to 0 is gone.
+type FeatureDelta struct {
+	Base    string         `json:"base"`
+	Depth   int            `json:"depth"`
+	Changes map[string]int `json:"changes"`
+}
+
+// Diff returns the delta turning the features from into to
+func Diff(from, to map[string]int) map[string]int {
+	changes := make(map[string]int)
+	for feature, n := range to {
+		if d := n - from[feature]; d != 0 {
+			changes[feature] = d
+		}
+	}
+	for feature, n := range from {
+		if _, ok := to[feature]; !ok {
+			changes[feature] = -n
+		}
+	}
+	return changes
+}
+
+// FeaturesKey is the Redis key holding the feature map of url at
+// timestamp, stored when config.simhash.store_features is set
+func FeaturesKey(url, timestamp string) string {
+	return fmt.Sprintf("features:%s:%s", url, timestamp)
+}
+
+// SetFeatures stores the features a capture was hashed from, expiring
+// with its simhash
+func (s *Store) SetFeatures(ctx context.Context, url, timestamp string, features map[string]int,
+	ttl time.Duration) error {
+	raw, err := json.Marshal(features)
+	if err != nil {
+		return err
+	}
+	key := FeaturesKey(s.hashed(url), timestamp)
+	sealed, err := s.seal(key, string(raw))
+	if err != nil {
+		return err
+	}
+	return retry(ctx, func() error {
+		return s.client.Set(ctx, key, sealed, ttl).Err()
+	})
+}
+
+// SetFeatureDelta stores the features of a capture as delta from the
+// capture delta.Base, whose features must be stored. It refreshes the
+// expiry of the base so that the delta does not outlive it.
+func (s *Store) SetFeatureDelta(ctx context.Context, url, timestamp string, delta FeatureDelta,
+	ttl time.Duration) error {
+	raw, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	key := FeaturesKey(s.hashed(url), timestamp)
+	sealed, err := s.seal(key, deltaPrefix+string(raw))
+	if err != nil {
+		return err
+	}
+	return retry(ctx, func() error {
+		pipe := s.client.TxPipeline()
+		pipe.Set(ctx, key, sealed, ttl)
+		if ttl > 0 {
+			pipe.Expire(ctx, FeaturesKey(s.hashed(url), delta.Base), ttl)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// GetFeatures returns the stored features of a capture, or ErrNotFound.
+// Features stored as a delta are rebuilt from their base captures; a
+// missing base is ErrNotFound too.
+func (s *Store) GetFeatures(ctx context.Context, url, timestamp string) (map[string]int, error) {
+	features, delta, err := s.featureRecord(ctx, url, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	// Collect the deltas down to a full map, then replay them oldest first
+	var deltas []map[string]int
+	for features == nil {
+		if len(deltas) >= maxDeltaChain {
+			return nil, fmt.Errorf("%s: feature delta chain too long", FeaturesKey(s.hashed(url), timestamp))
+		}
+		deltas = append(deltas, delta.Changes)
+		if features, delta, err = s.featureRecord(ctx, url, delta.Base); err != nil {
+			return nil, err
+		}
+	}
+	for i := len(deltas) - 1; i >= 0; i-- {
+		for feature, d := range deltas[i] {
+			if n := features[feature] + d; n != 0 {
+				features[feature] = n
+			} else {
+				delete(features, feature)
+			}
+		}
+	}
+	return features, nil
+}
+
+// FeatureChanges returns how the features of url changed from one capture
+// to another, as Diff does. A delta stored against from is returned as is.
+func (s *Store) FeatureChanges(ctx context.Context, url, from, to string) (map[string]int, error) {
+	_, delta, err := s.featureRecord(ctx, url, to)
+	if err != nil {
+		return nil, err
+	}
+	if delta.Base == from && delta.Changes != nil {
+		return delta.Changes, nil
+	}
+	before, err := s.GetFeatures(ctx, url, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := s.GetFeatures(ctx, url, to)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(before, after), nil
+}
+
+// featureRecord reads the stored features of a capture, either a full map
+// or a delta
+func (s *Store) featureRecord(ctx context.Context, url, timestamp string) (map[string]int, FeatureDelta, error) {
+	var delta FeatureDelta
+	key := FeaturesKey(s.hashed(url), timestamp)
+	var value string
+	err := retry(ctx, func() (err error) {
+		value, err = s.reader().Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, delta, ErrNotFound
+	}
+	if err != nil {
+		return nil, delta, err
+	}
+	plain, err := s.open(key, value)
+	if err != nil {
+		return nil, delta, err
+	}
+
+	if raw, ok := strings.CutPrefix(plain, deltaPrefix); ok {
+		if err := json.Unmarshal([]byte(raw), &delta); err != nil {
+			return nil, delta, fmt.Errorf("%s: %v", key, err)
+		}
+		return nil, delta, nil
+	}
+	var features map[string]int
+	if err := json.Unmarshal([]byte(plain), &features); err != nil {
+		return nil, delta, fmt.Errorf("%s: %v", key, err)
+	}
+	if features == nil {
+		features = map[string]int{}
+	}
+	return features, delta, nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"wayback-discover-diff/config"
+)
+
+// KeyProvider supplies the 256-bit encryption keys of
+// config.storage.encryption by key ID
+type KeyProvider interface {
+	Keys(ctx context.Context) (map[string][]byte, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]KeyProvider{
+		"env":   envKeys{},
+		"vault": vaultKeys{},
+	}
+)
+
+// RegisterKeyProvider makes a key provider available under name so it can
+// be selected with config.storage.encryption.provider, e.g. to fetch keys
+// from a cloud KMS. It is meant to be called from init functions of
+// compiled-in packages and panics on duplicate names.
+func RegisterKeyProvider(name string, p KeyProvider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if _, dup := providers[name]; dup {
+		panic(fmt.Sprintf("storage: key provider %q registered twice", name))
+	}
+	providers[name] = p
+}
+
+// keyProvider resolves config.storage.encryption.provider, env by default
+func keyProvider(name string) (KeyProvider, error) {
+	if name == "" {
+		name = "env"
+	}
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key provider: %s", name)
+	}
+	return p, nil
+}
+
+// envKeys reads each key of key_env from an environment variable holding
+// 32 base64 bytes
+type envKeys struct{}
+
+func (envKeys) Keys(ctx context.Context) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for id, env := range config.AppConfig.Storage.Encryption.KeyEnv {
+		raw, err := base64.StdEncoding.DecodeString(os.Getenv(env))
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("encryption key %s: %s must hold 32 base64-encoded bytes", id, env)
+		}
+		keys[id] = raw
+	}
+	return keys, nil
+}
+
+// vaultKeys unwraps the data keys of vault.wrapped_keys, created with the
+// datakey endpoint of a HashiCorp Vault transit key, through its decrypt
+// endpoint, so that plaintext keys are never configured
+type vaultKeys struct{}
+
+func (vaultKeys) Keys(ctx context.Context) (map[string][]byte, error) {
+	cfg := config.AppConfig.Storage.Encryption.Vault
+	token := os.Getenv(cfg.TokenEnv)
+	if cfg.Address == "" || cfg.TransitKey == "" || token == "" {
+		return nil, fmt.Errorf("vault key provider needs vault.address, vault.transit_key and a token in vault.token_env")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	endpoint := strings.TrimRight(cfg.Address, "/") + "/v1/transit/decrypt/" + cfg.TransitKey
+
+	keys := make(map[string][]byte)
+	for id, wrapped := range cfg.WrappedKeys {
+		body, err := json.Marshal(map[string]string{"ciphertext": wrapped})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Vault-Token", token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %v", id, err)
+		}
+		var decrypted struct {
+			Data struct {
+				Plaintext string `json:"plaintext"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&decrypted)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("encryption key %s: vault answered %s", id, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %v", id, err)
+		}
+		raw, err := base64.StdEncoding.DecodeString(decrypted.Data.Plaintext)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("encryption key %s: vault data key must be 32 bytes", id)
+		}
+		keys[id] = raw
+	}
+	return keys, nil
+}
@@ -0,0 +1,810 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/retention"
+)
+
+// RetentionCaptures names simhashes of every size with their capture
+// metadata, stored features and eras in retention policies
+const RetentionCaptures = "captures"
+
+func init() {
+	retention.Register(retention.Class{
+		Name:     RetentionCaptures,
+		Prefixes: []string{"simhash", "meta", "features:", "eras:"},
+		Default: func() time.Duration {
+			return time.Duration(config.AppConfig.Simhash.ExpireAfter) * time.Second
+		},
+	})
+}
+
+// ErrNotFound is returned when a requested value is not stored
+var ErrNotFound = errors.New("not found")
+
+// ErrUndecryptable is returned for stored values that fail to decrypt
+var ErrUndecryptable = errors.New("undecryptable value")
+
+// Capture is a stored simhash for one timestamp of a URL
+type Capture struct {
+	Timestamp string
+	SimHash   string
+}
+
+// Store is the persistence layer for simhash values. When encryption is
+// enabled values are sealed before they reach Redis and opened on read,
+// so callers always see plaintext.
+//
+// Writes always go to the primary client. Query reads are spread over the
+// read replicas, if any, so bulk indexing does not slow down the API.
+//
+// Hashes of a non-default bit size live in their own key namespace, see
+// WithSize, so they are never listed or compared with default-size ones.
+// Likewise captures of a named archive are kept apart, see WithArchive.
+//
+// Operations failing with connection errors are retried, and simhash reads
+// fall back to values recently read in process while Redis is unreachable;
+// see TrackStale.
+type Store struct {
+	client   *redis.Client
+	replicas []*redis.Client
+	next     *uint32
+	cipher   *Cipher
+	size     int
+	archive  string
+	profile  string
+	stale    *staleCache
+}
+
+// New wraps the primary client and optional read replicas, enabling
+// encryption according to config.storage
+func New(client *redis.Client, replicas ...*redis.Client) (*Store, error) {
+	c, err := newCipherFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &Store{client: client, replicas: replicas, next: new(uint32), cipher: c,
+		stale: newStaleCacheFromConfig()}, nil
+}
+
+// WithSize returns a view of the store reading and writing simhashes of
+// the given bit size. Size 0 is the configured default size.
+func (s *Store) WithSize(size int) *Store {
+	if size == s.size {
+		return s
+	}
+	view := *s
+	view.size = size
+	return &view
+}
+
+// WithArchive returns a view of the store reading and writing captures
+// of the named archive of config.archives. The empty name is the default
+// archive.
+func (s *Store) WithArchive(name string) *Store {
+	if name == s.archive {
+		return s
+	}
+	view := *s
+	view.archive = name
+	return &view
+}
+
+// WithProfile returns a view of the store reading and writing the hashes
+// of captures whose features were extracted with the named profile of
+// config.simhash.profiles. Each profile keeps its own hashes, metadata,
+// features, versions, eras and year listings, so they never mix with
+// those of other profiles; exclusions and baselines are shared. The empty
+// name is the default extraction.
+func (s *Store) WithProfile(name string) *Store {
+	if name == s.profile {
+		return s
+	}
+	view := *s
+	view.profile = name
+	return &view
+}
+
+// ProfileArchive is the archive part of the keys holding hashes of the
+// named archive computed with profile: the archive itself for the default
+// extraction, "archive~profile" otherwise
+func ProfileArchive(archive, profile string) string {
+	if profile == "" {
+		return archive
+	}
+	return archive + "~" + profile
+}
+
+// ArchiveURL is the form url takes in the keys of the named archive: the
+// default archive stores it as is, others prefix it with "@name|"
+func ArchiveURL(archive, url string) string {
+	if archive == "" {
+		return url
+	}
+	return "@" + archive + "|" + url
+}
+
+// SplitArchiveURL reverses ArchiveURL
+func SplitArchiveURL(key string) (archive, url string) {
+	if !strings.HasPrefix(key, "@") {
+		return "", key
+	}
+	i := strings.Index(key, "|")
+	if i < 0 {
+		return "", key
+	}
+	return key[1:i], key[i+1:]
+}
+
+// scoped is url as stored in the keys of the store's archive
+func (s *Store) scoped(url string) string {
+	return ArchiveURL(s.archive, url)
+}
+
+// hashed is url as stored in the keys of the store's archive and profile,
+// for the records derived from its hashes
+func (s *Store) hashed(url string) string {
+	return ArchiveURL(ProfileArchive(s.archive, s.profile), url)
+}
+
+// reader picks the client serving query reads, rotating over replicas
+func (s *Store) reader() *redis.Client {
+	if len(s.replicas) == 0 {
+		return s.client
+	}
+	n := atomic.AddUint32(s.next, 1)
+	return s.replicas[int(n)%len(s.replicas)]
+}
+
+// Client exposes the raw Redis client for bookkeeping keys that are not
+// part of the stored dataset (task markers, templates, usage counters)
+func (s *Store) Client() *redis.Client {
+	return s.client
+}
+
+// SimhashKey is the Redis key holding the default-size simhash of url at
+// timestamp
+func SimhashKey(url, timestamp string) string {
+	return fmt.Sprintf("simhash:%s:%s", url, timestamp)
+}
+
+// SizedSimhashKey is the Redis key holding the simhash of the given bit
+// size; size 0 is the default namespace of SimhashKey
+func SizedSimhashKey(size int, url, timestamp string) string {
+	if size == 0 {
+		return SimhashKey(url, timestamp)
+	}
+	return fmt.Sprintf("simhash%d:%s:%s", size, url, timestamp)
+}
+
+func (s *Store) simhashKey(url, timestamp string) string {
+	return SizedSimhashKey(s.size, s.hashed(url), timestamp)
+}
+
+func (s *Store) seal(key, value string) (string, error) {
+	if s.cipher == nil {
+		return value, nil
+	}
+	return s.cipher.Seal(key, value)
+}
+
+// fieldAAD is what a value sealed into the field of a Redis hash is bound
+// to
+func fieldAAD(key, field string) string {
+	return key + "/" + field
+}
+
+// openMeta opens a capture metadata field, also accepting the key:name
+// binding metadata was sealed with before fieldAAD
+func (s *Store) openMeta(key, name, value string) (string, error) {
+	plain, err := s.open(fieldAAD(key, name), value)
+	if errors.Is(err, ErrUndecryptable) {
+		if legacy, lerr := s.open(key+":"+name, value); lerr == nil {
+			return legacy, nil
+		}
+	}
+	return plain, err
+}
+
+func (s *Store) open(key, value string) (string, error) {
+	if s.cipher == nil {
+		return value, nil
+	}
+	plain, err := s.cipher.Open(key, value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUndecryptable, err)
+	}
+	return plain, nil
+}
+
+// HasSimHash reports whether a simhash is stored for url at timestamp.
+// It reads from the primary since workers use it to skip finished captures.
+func (s *Store) HasSimHash(ctx context.Context, url, timestamp string) (bool, error) {
+	var n int64
+	err := retry(ctx, func() (err error) {
+		n, err = s.client.Exists(ctx, s.simhashKey(url, timestamp)).Result()
+		return err
+	})
+	return n == 1, err
+}
+
+// GetSimHash returns the encoded simhash of url at timestamp
+func (s *Store) GetSimHash(ctx context.Context, url, timestamp string) (string, error) {
+	key := s.simhashKey(url, timestamp)
+	var value string
+	err := retry(ctx, func() (err error) {
+		value, err = s.reader().Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	if cached, ok := s.cached(ctx, key, err); ok {
+		return cached.(string), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if value, err = s.open(key, value); err == nil {
+		s.stale.put(key, value)
+	}
+	return value, err
+}
+
+// CaptureRef identifies one capture of a URL
+type CaptureRef struct {
+	URL       string
+	Timestamp string
+}
+
+// GetSimHashes returns the encoded simhashes of refs, in order, reading
+// them in a single pipelined round trip. Captures that are not stored
+// yield an empty string.
+func (s *Store) GetSimHashes(ctx context.Context, refs []CaptureRef) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	cmds := make([]*redis.StringCmd, len(refs))
+	err := retry(ctx, func() error {
+		_, err := s.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, ref := range refs {
+				cmds[i] = pipe.Get(ctx, s.simhashKey(ref.URL, ref.Timestamp))
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if errors.Is(err, ErrUnavailable) {
+		return s.cachedSimHashes(ctx, refs, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]string, len(refs))
+	for i, cmd := range cmds {
+		raw, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := s.simhashKey(refs[i].URL, refs[i].Timestamp)
+		if values[i], err = s.open(key, raw); err != nil {
+			return nil, err
+		}
+		s.stale.put(key, values[i])
+	}
+	return values, nil
+}
+
+// cachedSimHashes answers GetSimHashes from the stale cache, provided it
+// holds every requested capture
+func (s *Store) cachedSimHashes(ctx context.Context, refs []CaptureRef, err error) ([]string, error) {
+	values := make([]string, len(refs))
+	for i, ref := range refs {
+		cached, ok := s.cached(ctx, s.simhashKey(ref.URL, ref.Timestamp), err)
+		if !ok {
+			return nil, err
+		}
+		values[i] = cached.(string)
+	}
+	return values, nil
+}
+
+// SetSimHash stores the encoded simhash of url at timestamp
+func (s *Store) SetSimHash(ctx context.Context, url, timestamp, encoded string, ttl time.Duration) error {
+	key := s.simhashKey(url, timestamp)
+	value, err := s.seal(key, encoded)
+	if err != nil {
+		return err
+	}
+	logging.Debugf(logging.Storage, "SET %s (ttl %s)", key, ttl)
+	err = retry(ctx, func() error {
+		return s.client.Set(ctx, key, value, ttl).Err()
+	})
+	if err == nil {
+		s.stale.drop(key, listKey(s.simhashKey(url, "")))
+	}
+	return err
+}
+
+// listKey names the stale cache entry of ListSimHashes for a key prefix
+func listKey(prefix string) string {
+	return "list " + prefix
+}
+
+// ListSimHashes returns every stored capture of url in timestamp order
+func (s *Store) ListSimHashes(ctx context.Context, url string) ([]Capture, error) {
+	prefix := s.simhashKey(url, "")
+	var keys []string
+	var values []interface{}
+	err := retry(ctx, func() (err error) {
+		reader := s.reader()
+		keys, err = scan(ctx, reader, EscapePattern(prefix)+"*")
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		logging.Debugf(logging.Storage, "list %s: %d keys from %s", url, len(keys), reader.Options().Addr)
+		values, err = reader.MGet(ctx, keys...).Result()
+		return err
+	})
+	if cached, ok := s.cached(ctx, listKey(prefix), err); ok {
+		return append([]Capture(nil), cached.([]Capture)...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	captures := make([]Capture, 0, len(keys))
+	for i, key := range keys {
+		raw, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		// The prefix also matches longer URLs such as url:8080/page
+		timestamp := strings.TrimPrefix(key, prefix)
+		if strings.Contains(timestamp, ":") {
+			continue
+		}
+		value, err := s.open(key, raw)
+		if err != nil {
+			continue
+		}
+		captures = append(captures, Capture{Timestamp: timestamp, SimHash: value})
+	}
+
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].Timestamp < captures[j].Timestamp
+	})
+	s.stale.put(listKey(prefix), captures)
+	return captures, nil
+}
+
+// LatestBefore returns the most recent capture of url taken strictly
+// before timestamp, whatever its year
+func (s *Store) LatestBefore(ctx context.Context, url, timestamp string) (Capture, error) {
+	captures, err := s.ListSimHashes(ctx, url)
+	if err != nil {
+		return Capture{}, err
+	}
+	i := sort.Search(len(captures), func(i int) bool {
+		return captures[i].Timestamp >= timestamp
+	})
+	if i == 0 {
+		return Capture{}, ErrNotFound
+	}
+	return captures[i-1], nil
+}
+
+// scan collects all keys matching pattern without blocking Redis
+func scan(ctx context.Context, client *redis.Client, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// EscapePattern quotes glob metacharacters so a URL can be used as a
+// literal prefix in SCAN/KEYS patterns
+func EscapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Metadata field names stored alongside each capture
+const (
+	// MetaPrecision is the number of significant digits in the timestamp
+	// returned by the archive before normalization
+	MetaPrecision = "precision"
+	// MetaTruncated is "1" when the capture was hashed from only part of
+	// the page because of simhash.limits
+	MetaTruncated = "truncated"
+	// MetaCanonical is the rel=canonical URL of the page, when recorded
+	MetaCanonical = "canonical"
+	// MetaAliasOf is the URL a hash was copied from to its canonical URL
+	MetaAliasOf = "alias_of"
+	// MetaExpiresAt is when the capture expires by the writer's clock,
+	// in RFC 3339; see ExpiresAt
+	MetaExpiresAt = "expires_at"
+)
+
+// MetaKey is the Redis hash holding metadata for url at timestamp
+func MetaKey(url, timestamp string) string {
+	return fmt.Sprintf("meta:%s:%s", url, timestamp)
+}
+
+// SizedMetaKey is the Redis hash holding the metadata of the simhash of
+// the given bit size; size 0 is the default namespace of MetaKey
+func SizedMetaKey(size int, url, timestamp string) string {
+	if size == 0 {
+		return MetaKey(url, timestamp)
+	}
+	return fmt.Sprintf("meta%d:%s:%s", size, url, timestamp)
+}
+
+func (s *Store) metaKey(url, timestamp string) string {
+	return SizedMetaKey(s.size, s.hashed(url), timestamp)
+}
+
+// SetCaptureMeta records metadata fields for a capture, expiring with it
+func (s *Store) SetCaptureMeta(ctx context.Context, url, timestamp string, fields map[string]string,
+	ttl time.Duration) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	key := s.metaKey(url, timestamp)
+
+	values := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		sealed, err := s.seal(fieldAAD(key, name), value)
+		if err != nil {
+			return err
+		}
+		values[name] = sealed
+	}
+
+	return retry(ctx, func() error {
+		pipe := s.client.TxPipeline()
+		pipe.HSet(ctx, key, values)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// GetCaptureMeta returns all metadata fields recorded for a capture
+func (s *Store) GetCaptureMeta(ctx context.Context, url, timestamp string) (map[string]string, error) {
+	key := s.metaKey(url, timestamp)
+	var values map[string]string
+	err := retry(ctx, func() (err error) {
+		values, err = s.reader().HGetAll(ctx, key).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(values))
+	for name, value := range values {
+		plain, err := s.openMeta(key, name, value)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = plain
+	}
+	return fields, nil
+}
+
+// ExpiresAt returns when the simhash of url at timestamp expires, or the
+// zero time when it does not. Of the expiry recorded by the writer and the
+// one given by the key's remaining TTL on this clock, the earlier is
+// taken: the writer's clock may be skewed and the retention janitor may
+// have shortened the TTL since.
+func (s *Store) ExpiresAt(ctx context.Context, url, timestamp string) (time.Time, error) {
+	key := s.metaKey(url, timestamp)
+	var ttl *redis.DurationCmd
+	var recorded *redis.StringCmd
+	err := retry(ctx, func() error {
+		pipe := s.reader().Pipeline()
+		ttl = pipe.PTTL(ctx, s.simhashKey(url, timestamp))
+		recorded = pipe.HGet(ctx, key, MetaExpiresAt)
+		_, err := pipe.Exec(ctx)
+		if err == redis.Nil {
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var at time.Time
+	if d := ttl.Val(); d > 0 {
+		at = time.Now().Add(d)
+	}
+	if value, err := recorded.Result(); err == nil {
+		plain, err := s.openMeta(key, MetaExpiresAt, value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t, err := time.Parse(time.RFC3339, plain); err == nil && (at.IsZero() || t.Before(at)) {
+			at = t
+		}
+	}
+	return at.UTC().Truncate(time.Second), nil
+}
+
+// PurgeURL deletes every stored simhash of any size and extraction
+// profile, metadata record, feature map and year version of url,
+// restricted to captures from year when it is not empty, along with a
+// baseline pinned to a purged capture, and drops url from the year
+// listings. It returns the number of keys removed.
+func (s *Store) PurgeURL(ctx context.Context, url, year string) (int, error) {
+	// Purged captures must not resurface during an outage
+	defer s.stale.reset()
+
+	removed := 0
+	for _, view := range s.profileViews() {
+		n, err := view.purgeHashes(ctx, url, year)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	if err := s.DeleteEras(ctx, url); err != nil {
+		return removed, err
+	}
+	if baseline, err := s.Baseline(ctx, url); err == nil && strings.HasPrefix(baseline, year) {
+		if _, err := s.DeleteBaseline(ctx, url); err != nil {
+			return removed, err
+		}
+	} else if err != nil && err != ErrNotFound {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// purgeHashes deletes the records of url derived from its hashes in the
+// store's profile for PurgeURL
+func (s *Store) purgeHashes(ctx context.Context, url, year string) (int, error) {
+	removed := 0
+	hashed := s.hashed(url)
+	for _, prefix := range []string{SimhashKey(hashed, ""), MetaKey(hashed, ""), FeaturesKey(hashed, ""),
+		VersionsKey(hashed, ""), versionPrefix(hashed)} {
+		n, err := s.PurgePrefix(ctx, prefix, year)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	// Non-default sizes: the wildcard may match other URLs, so check each key
+	for _, name := range []string{"simhash", "meta"} {
+		keys, err := scan(ctx, s.client, name+"[0-9]*:"+EscapePattern(hashed+":"+year)+"*")
+		if err != nil {
+			return removed, err
+		}
+		var doomed []string
+		for _, key := range keys {
+			size, keyURL, timestamp, ok := parseSizedKey(name, key)
+			if ok && size > 0 && keyURL == hashed && strings.HasPrefix(timestamp, year) {
+				doomed = append(doomed, key)
+			}
+		}
+		if err := s.unlink(ctx, doomed); err != nil {
+			return removed, err
+		}
+		removed += len(doomed)
+	}
+	return removed, s.unindexURL(ctx, url, year)
+}
+
+// profileViews are the views of the store's archive for the default
+// extraction and every profile of config.simhash.profiles
+func (s *Store) profileViews() []*Store {
+	views := []*Store{s.WithProfile("")}
+	for name := range config.AppConfig.Simhash.Profiles {
+		views = append(views, s.WithProfile(name))
+	}
+	return views
+}
+
+// PurgePrefix deletes the keys made of prefix followed by a final key
+// segment starting with match. Keys with further ':' separated segments
+// belong to longer URLs sharing the prefix (url:8080/page) and are kept.
+func (s *Store) PurgePrefix(ctx context.Context, prefix, match string) (int, error) {
+	keys, err := scan(ctx, s.client, EscapePattern(prefix+match)+"*")
+	if err != nil {
+		return 0, err
+	}
+
+	var doomed []string
+	for _, key := range keys {
+		if !strings.Contains(strings.TrimPrefix(key, prefix), ":") {
+			doomed = append(doomed, key)
+		}
+	}
+	return len(doomed), s.unlink(ctx, doomed)
+}
+
+// unlink removes keys in batches without blocking Redis
+func (s *Store) unlink(ctx context.Context, keys []string) error {
+	const batch = 500
+	for start := 0; start < len(keys); start += batch {
+		end := start + batch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := s.client.Unlink(ctx, keys[start:end]...).Err(); err != nil {
+			return err
+		}
+		logging.Debugf(logging.Storage, "unlinked %d keys", end-start)
+	}
+	return nil
+}
+
+// ParseSimhashKey splits a default-size simhash key into its URL and
+// timestamp
+func ParseSimhashKey(key string) (url, timestamp string, ok bool) {
+	return splitKey("simhash:", key)
+}
+
+// ParseSizedSimhashKey splits a simhash key of any size namespace into its
+// bit size (0 for the default namespace), URL and timestamp
+func ParseSizedSimhashKey(key string) (size int, url, timestamp string, ok bool) {
+	return parseSizedKey("simhash", key)
+}
+
+// ParseSizedMetaKey splits a capture metadata key of any size namespace
+// into its bit size (0 for the default namespace), URL and timestamp
+func ParseSizedMetaKey(key string) (size int, url, timestamp string, ok bool) {
+	return parseSizedKey("meta", key)
+}
+
+// parseSizedKey splits a key of the name<size>: namespaces
+func parseSizedKey(name, key string) (size int, url, timestamp string, ok bool) {
+	i := strings.Index(key, ":")
+	if i < 0 || !strings.HasPrefix(key, name) {
+		return 0, "", "", false
+	}
+	if digits := key[len(name):i]; digits != "" {
+		n, err := strconv.Atoi(digits)
+		if err != nil || n <= 0 || strconv.Itoa(n) != digits {
+			return 0, "", "", false
+		}
+		size = n
+	}
+	if url, timestamp, ok = splitKey(key[:i+1], key); !ok {
+		return 0, "", "", false
+	}
+	return size, url, timestamp, true
+}
+
+func splitKey(prefix, key string) (url, timestamp string, ok bool) {
+	rest := strings.TrimPrefix(key, prefix)
+	if rest == key {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// ScanPrefix calls fn with batches of keys starting with prefix
+func (s *Store) ScanPrefix(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, EscapePattern(prefix)+"*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ReadKey returns the decrypted value stored under a raw key
+func (s *Store) ReadKey(ctx context.Context, key string) (string, error) {
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.open(key, value)
+}
+
+// WriteKey seals value and stores it under a raw key, as ReadKey reads it
+func (s *Store) WriteKey(ctx context.Context, key, value string, ttl time.Duration) error {
+	sealed, err := s.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return retry(ctx, func() error {
+		return s.client.Set(ctx, key, sealed, ttl).Err()
+	})
+}
+
+// ReadHash returns the decrypted fields of a raw hash key whose fields are
+// sealed under key/field, like exclusions and eras
+func (s *Store) ReadHash(ctx context.Context, key string) (map[string]string, error) {
+	raw, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(raw))
+	for field, value := range raw {
+		plain, err := s.open(fieldAAD(key, field), value)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = plain
+	}
+	return fields, nil
+}
+
+// WriteHashField seals value under key/field and stores it in a raw hash
+// key, as ReadHash reads it
+func (s *Store) WriteHashField(ctx context.Context, key, field, value string, ttl time.Duration) error {
+	sealed, err := s.seal(fieldAAD(key, field), value)
+	if err != nil {
+		return err
+	}
+	return retry(ctx, func() error {
+		pipe := s.client.TxPipeline()
+		pipe.HSet(ctx, key, field, sealed)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// Delete removes raw keys from the store
+func (s *Store) Delete(ctx context.Context, keys ...string) error {
+	return s.unlink(ctx, keys)
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testCipher is a Cipher sealing with key k2 and also holding retired key k1
+func testCipher(t *testing.T) *Cipher {
+	t.Helper()
+	c := &Cipher{activeID: "k2", aeads: make(map[string]cipher.AEAD)}
+	for id, fill := range map[string]byte{"k1": 1, "k2": 2} {
+		block, err := aes.NewCipher([]byte(strings.Repeat(string(fill), 32)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.aeads[id] = aead
+	}
+	return c
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	s := &Store{cipher: testCipher(t)}
+	key := "@arquivo|example.com"
+	tests := []struct {
+		name      string
+		sealAAD   string
+		openAAD   string
+		value     string
+		wantError bool
+	}{
+		{"key", key, key, "ANPEUQxkLYw=", false},
+		{"empty value", key, key, "", false},
+		{"hash field", fieldAAD(key, "20190101000000"), fieldAAD(key, "20190101000000"), "ANPEUQxkLYw=", false},
+		{"value of another key", key, "example.com", "ANPEUQxkLYw=", true},
+		{"value of another field", fieldAAD(key, "20190101000000"), fieldAAD(key, "20190301000000"), "ANPEUQxkLYw=", true},
+		{"field value opened with the key", fieldAAD(key, "20190101000000"), key, "ANPEUQxkLYw=", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := s.seal(tt.sealAAD, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(sealed, encPrefix+"k2:") {
+				t.Errorf("sealed %q, want it sealed with the active key", sealed)
+			}
+			got, err := s.open(tt.openAAD, sealed)
+			if tt.wantError {
+				if !errors.Is(err, ErrUndecryptable) {
+					t.Errorf("open = %q, %v, want ErrUndecryptable", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.value {
+				t.Errorf("open = %q, %v, want %q", got, err, tt.value)
+			}
+		})
+	}
+}
+
+func TestOpenRetiredKeyAndPlaintext(t *testing.T) {
+	c := testCipher(t)
+	retired := &Cipher{activeID: "k1", aeads: c.aeads}
+	sealed, err := retired.Seal("simhash:example.com:20190101000000", "ANPEUQxkLYw=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, value, want string
+		wantError         bool
+	}{
+		{"retired key", sealed, "ANPEUQxkLYw=", false},
+		{"plaintext", "ANPEUQxkLYw=", "ANPEUQxkLYw=", false},
+		{"unknown key", strings.Replace(sealed, "enc:k1:", "enc:k9:", 1), "", true},
+		{"missing key id", "enc:ANPEUQxkLYw=", "", true},
+		{"bad base64", "enc:k1:!!!", "", true},
+		{"short ciphertext", "enc:k1:AAAA", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Open("simhash:example.com:20190101000000", tt.value)
+			if (err != nil) != tt.wantError || got != tt.want {
+				t.Errorf("Open = %q, %v, want %q, error %v", got, err, tt.want, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestOpenMeta(t *testing.T) {
+	s := &Store{cipher: testCipher(t)}
+	key := MetaKey("example.com", "20190101000000")
+	current, err := s.seal(fieldAAD(key, "status"), "200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := s.seal(key+":status", "200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.seal(fieldAAD(key, "mimetype"), "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, value, want string
+		wantError         bool
+	}{
+		{"field binding", current, "200", false},
+		{"legacy key:name binding", legacy, "200", false},
+		{"plaintext", "200", "200", false},
+		{"value of another field", other, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.openMeta(key, "status", tt.value)
+			if tt.wantError {
+				if !errors.Is(err, ErrUndecryptable) {
+					t.Errorf("openMeta = %q, %v, want ErrUndecryptable", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("openMeta = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSizedKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		parse     func(string) (int, string, string, bool)
+		key       string
+		size      int
+		url, ts   string
+		wantMatch bool
+	}{
+		{"default simhash", ParseSizedSimhashKey, SimhashKey("example.com/a:b", "20190101000000"), 0, "example.com/a:b", "20190101000000", true},
+		{"sized simhash", ParseSizedSimhashKey, SizedSimhashKey(32, "example.com", "20190101000000"), 32, "example.com", "20190101000000", true},
+		{"archive simhash", ParseSizedSimhashKey, SizedSimhashKey(128, ArchiveURL("arquivo", "example.com"), "20190101000000"), 128, "@arquivo|example.com", "20190101000000", true},
+		{"default meta", ParseSizedMetaKey, MetaKey("example.com", "20190101000000"), 0, "example.com", "20190101000000", true},
+		{"sized meta", ParseSizedMetaKey, SizedMetaKey(32, "example.com", "20190101000000"), 32, "example.com", "20190101000000", true},
+		{"meta is not simhash", ParseSizedSimhashKey, MetaKey("example.com", "20190101000000"), 0, "", "", false},
+		{"simhash is not meta", ParseSizedMetaKey, SimhashKey("example.com", "20190101000000"), 0, "", "", false},
+		{"zero padded size", ParseSizedSimhashKey, "simhash032:example.com:20190101000000", 0, "", "", false},
+		{"zero size", ParseSizedSimhashKey, "simhash0:example.com:20190101000000", 0, "", "", false},
+		{"non numeric size", ParseSizedSimhashKey, "simhashx:example.com:20190101000000", 0, "", "", false},
+		{"missing timestamp", ParseSizedSimhashKey, "simhash:example.com", 0, "", "", false},
+		{"missing URL", ParseSizedSimhashKey, "simhash32::20190101000000", 0, "", "", false},
+		{"no namespace", ParseSizedSimhashKey, "simhash", 0, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, url, ts, ok := tt.parse(tt.key)
+			if ok != tt.wantMatch || size != tt.size || url != tt.url || ts != tt.ts {
+				t.Errorf("parse(%q) = %d, %q, %q, %v, want %d, %q, %q, %v",
+					tt.key, size, url, ts, ok, tt.size, tt.url, tt.ts, tt.wantMatch)
+			}
+		})
+	}
+}
+
+func TestParseURLsKey(t *testing.T) {
+	tests := []struct {
+		key           string
+		size          int
+		archive, year string
+		wantMatch     bool
+	}{
+		{"urls:2019", 0, "", "2019", true},
+		{"urls32:2019", 32, "", "2019", true},
+		{URLsKey(0, "arquivo~rich", "2019"), 0, "arquivo~rich", "2019", true},
+		{URLsKey(64, "arquivo", "2019"), 64, "arquivo", "2019", true},
+		{"urlsx:2019", 0, "", "", false},
+		{"urls0:2019", 0, "", "", false},
+		{"urls", 0, "", "", false},
+		{"simhash:2019", 0, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			size, archive, year, ok := ParseURLsKey(tt.key)
+			if ok != tt.wantMatch || size != tt.size || archive != tt.archive || year != tt.year {
+				t.Errorf("ParseURLsKey(%q) = %d, %q, %q, %v, want %d, %q, %q, %v",
+					tt.key, size, archive, year, ok, tt.size, tt.archive, tt.year, tt.wantMatch)
+			}
+		})
+	}
+}
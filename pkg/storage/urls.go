@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// URLsKey is the sorted set of the URLs with hashes of the given size for
+// year, all scored 0 so they list in byte order. Each archive has its own
+// set, see ArchiveURL.
+func URLsKey(size int, archive, year string) string {
+	if size == 0 {
+		return "urls:" + ArchiveURL(archive, year)
+	}
+	return fmt.Sprintf("urls%d:%s", size, ArchiveURL(archive, year))
+}
+
+// IndexURL records that url has hashes for year. The index lives as long
+// as the captures written last, so it expires once none of its URLs can
+// have data left.
+func (s *Store) IndexURL(ctx context.Context, url, year string, ttl time.Duration) error {
+	key := URLsKey(s.size, ProfileArchive(s.archive, s.profile), year)
+	return retry(ctx, func() error {
+		pipe := s.client.TxPipeline()
+		pipe.ZAdd(ctx, key, &redis.Z{Member: url})
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// URLs returns up to count URLs with hashes for year from offset on, in
+// byte order, and how many there are in all
+func (s *Store) URLs(ctx context.Context, year string, offset, count int) ([]string, int, error) {
+	key := URLsKey(s.size, ProfileArchive(s.archive, s.profile), year)
+	var (
+		urls  *redis.StringSliceCmd
+		total *redis.IntCmd
+	)
+	err := retry(ctx, func() error {
+		pipe := s.reader().Pipeline()
+		urls = pipe.ZRange(ctx, key, int64(offset), int64(offset+count-1))
+		total = pipe.ZCard(ctx, key)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return urls.Val(), int(total.Val()), nil
+}
+
+// unindexURL drops url from the indexes of year, or of every year when
+// year is empty, for hashes of every size
+func (s *Store) unindexURL(ctx context.Context, url, year string) error {
+	keys, err := scan(ctx, s.client, "urls*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, archive, keyYear, ok := ParseURLsKey(key)
+		if !ok || archive != ProfileArchive(s.archive, s.profile) || (year != "" && keyYear != year) {
+			continue
+		}
+		if err := s.client.ZRem(ctx, key, url).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseURLsKey returns the bit size (0 for the default namespace), archive
+// and year of a URLsKey of any size
+func ParseURLsKey(key string) (size int, archive, year string, ok bool) {
+	rest := strings.TrimPrefix(key, "urls")
+	i := strings.Index(rest, ":")
+	if rest == key || i < 0 {
+		return 0, "", "", false
+	}
+	if i > 0 {
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n <= 0 {
+			return 0, "", "", false
+		}
+		size = n
+	}
+	archive, year = SplitArchiveURL(rest[i+1:])
+	return size, archive, year, true
+}
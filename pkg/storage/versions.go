@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/pkg/retention"
+)
+
+// RetentionVersions names the year snapshots kept for as_of queries
+const RetentionVersions = "versions"
+
+func init() {
+	retention.Register(retention.Class{
+		Name:     RetentionVersions,
+		Prefixes: []string{"versions:", "version:"},
+		Default:  func() time.Duration { return 365 * 24 * time.Hour },
+	})
+}
+
+// Version is a snapshot of the simhashes of one year of a URL, taken when
+// a calculation job for that year completed
+type Version struct {
+	JobID string
+	At    time.Time
+}
+
+// versionRecord is the stored form of a version
+type versionRecord struct {
+	Size     int         `json:"size"`
+	Captures [][2]string `json:"captures"`
+}
+
+// VersionsKey is the sorted set of the versions of url's year, scored by
+// the time they were taken
+func VersionsKey(url, year string) string {
+	return fmt.Sprintf("versions:%s:%s", url, year)
+}
+
+// VersionKey holds the captures of the version taken by job
+func VersionKey(url, year, job string) string {
+	return versionPrefix(url) + year + "/" + job
+}
+
+func versionPrefix(url string) string {
+	return fmt.Sprintf("version:%s:", url)
+}
+
+// SaveYearVersion records captures as the state of url's year after job
+func (s *Store) SaveYearVersion(ctx context.Context, url, year, job string, captures []Capture, ttl time.Duration) error {
+	record := versionRecord{Size: s.size, Captures: make([][2]string, len(captures))}
+	for i, c := range captures {
+		record.Captures[i] = [2]string{c.Timestamp, c.SimHash}
+	}
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := VersionKey(s.hashed(url), year, job)
+	sealed, err := s.seal(key, string(raw))
+	if err != nil {
+		return err
+	}
+
+	index := VersionsKey(s.hashed(url), year)
+	return retry(ctx, func() error {
+		pipe := s.client.TxPipeline()
+		pipe.Set(ctx, key, sealed, ttl)
+		pipe.ZAdd(ctx, index, &redis.Z{Score: float64(time.Now().Unix()), Member: job})
+		if ttl > 0 {
+			pipe.Expire(ctx, index, ttl)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// YearVersions lists the versions of url's year, oldest first
+func (s *Store) YearVersions(ctx context.Context, url, year string) ([]Version, error) {
+	var entries []redis.Z
+	err := retry(ctx, func() (err error) {
+		entries, err = s.reader().ZRangeWithScores(ctx, VersionsKey(s.hashed(url), year), 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(entries))
+	for _, e := range entries {
+		job, _ := e.Member.(string)
+		versions = append(versions, Version{JobID: job, At: time.Unix(int64(e.Score), 0).UTC()})
+	}
+	return versions, nil
+}
+
+// YearVersionByJob returns the captures of url's year as job left them,
+// or ErrNotFound
+func (s *Store) YearVersionByJob(ctx context.Context, url, year, job string) (Version, []Capture, error) {
+	var score float64
+	err := retry(ctx, func() (err error) {
+		score, err = s.reader().ZScore(ctx, VersionsKey(s.hashed(url), year), job).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return Version{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return Version{}, nil, err
+	}
+	version := Version{JobID: job, At: time.Unix(int64(score), 0).UTC()}
+	captures, err := s.versionCaptures(ctx, url, year, job)
+	return version, captures, err
+}
+
+// YearVersionAsOf returns the latest version of url's year taken at or
+// before at, or ErrNotFound
+func (s *Store) YearVersionAsOf(ctx context.Context, url, year string, at time.Time) (Version, []Capture, error) {
+	var entries []redis.Z
+	err := retry(ctx, func() (err error) {
+		entries, err = s.reader().ZRevRangeByScoreWithScores(ctx, VersionsKey(s.hashed(url), year), &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(at.Unix(), 10),
+		}).Result()
+		return err
+	})
+	if err != nil {
+		return Version{}, nil, err
+	}
+
+	// Versions of other bit sizes share the index; take the newest of ours
+	for _, e := range entries {
+		job, _ := e.Member.(string)
+		captures, err := s.versionCaptures(ctx, url, year, job)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return Version{}, nil, err
+		}
+		return Version{JobID: job, At: time.Unix(int64(e.Score), 0).UTC()}, captures, nil
+	}
+	return Version{}, nil, ErrNotFound
+}
+
+// versionCaptures reads the captures of a version of the store's bit size
+func (s *Store) versionCaptures(ctx context.Context, url, year, job string) ([]Capture, error) {
+	key := VersionKey(s.hashed(url), year, job)
+	var raw string
+	err := retry(ctx, func() (err error) {
+		raw, err = s.reader().Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := s.open(key, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var record versionRecord
+	if err := json.Unmarshal([]byte(plain), &record); err != nil {
+		return nil, err
+	}
+	if record.Size != s.size {
+		return nil, ErrNotFound
+	}
+	captures := make([]Capture, len(record.Captures))
+	for i, c := range record.Captures {
+		captures[i] = Capture{Timestamp: c[0], SimHash: c[1]}
+	}
+	return captures, nil
+}
@@ -0,0 +1,76 @@
+// Package surt converts URLs to the SURT form used as the urlkey of CDX
+// indexes, e.g. http://www.example.com/a?b=1&a=2 becomes
+// com,example)/a?a=2&b=1
+package surt
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Key returns the SURT key of rawURL. URLs without a scheme are read as
+// http. A URL that cannot be parsed is returned lowercased.
+func Key(rawURL string) string {
+	s := strings.TrimSpace(rawURL)
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(rawURL)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if (port == "80" && u.Scheme == "http") || (port == "443" && u.Scheme == "https") {
+		port = ""
+	}
+
+	var key strings.Builder
+	if net.ParseIP(host) != nil {
+		key.WriteString(host)
+	} else {
+		labels := strings.Split(host, ".")
+		if len(labels) > 2 && isWWW(labels[0]) {
+			labels = labels[1:]
+		}
+		for i := len(labels) - 1; i >= 0; i-- {
+			key.WriteString(labels[i])
+			if i > 0 {
+				key.WriteByte(',')
+			}
+		}
+	}
+	if port != "" {
+		key.WriteString(":" + port)
+	}
+	key.WriteByte(')')
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key.WriteString(strings.ToLower(path))
+
+	if u.RawQuery != "" {
+		args := strings.Split(strings.ToLower(u.RawQuery), "&")
+		sort.Strings(args)
+		key.WriteString("?" + strings.Join(args, "&"))
+	}
+	return key.String()
+}
+
+// isWWW matches the www, www1, www2... labels CDX servers drop
+func isWWW(label string) bool {
+	if !strings.HasPrefix(label, "www") {
+		return false
+	}
+	for _, r := range label[3:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
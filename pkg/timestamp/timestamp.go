@@ -0,0 +1,89 @@
+package timestamp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Layout is the canonical 14-digit Wayback timestamp layout (UTC)
+const Layout = "20060102150405"
+
+// Digits is the length of a canonical timestamp
+const Digits = 14
+
+// padding completes truncated timestamps to the first second of the
+// period they denote, e.g. "2019" becomes 2019-01-01 00:00:00
+const padding = "00000101000000"
+
+// Normalize converts a timestamp from any supported archive dialect into
+// the canonical 14-digit UTC form. It returns the number of significant
+// digits the input carried so callers can retain the original precision.
+//
+// Accepted inputs are digit strings of 4 to 17 digits (longer forms with
+// milliseconds are truncated to seconds) and RFC 3339 dates with a zone
+// offset, which are converted to UTC.
+func Normalize(raw string) (string, int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", 0, fmt.Errorf("empty timestamp")
+	}
+
+	if !isDigits(raw) {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid timestamp: %s", raw)
+		}
+		return t.UTC().Format(Layout), Digits, nil
+	}
+
+	precision := len(raw)
+	switch {
+	case precision < 4 || precision > 17:
+		return "", 0, fmt.Errorf("invalid timestamp length: %s", raw)
+	case precision > Digits:
+		raw = raw[:Digits]
+		precision = Digits
+	case precision%2 == 1:
+		// Only the tens digit of the last field is given: its earliest
+		// value ends in 0, or in 1 for a month or day of 0x
+		units := padding[precision]
+		if raw[precision-1] != '0' {
+			units = '0'
+		}
+		raw += string(units) + padding[precision+1:]
+	case precision < Digits:
+		raw += padding[precision:]
+	}
+
+	if _, err := time.Parse(Layout, raw); err != nil {
+		return "", 0, fmt.Errorf("invalid timestamp: %s", raw)
+	}
+	return raw, precision, nil
+}
+
+// Parse returns the time denoted by a timestamp in any accepted form
+func Parse(raw string) (time.Time, error) {
+	ts, _, err := Normalize(raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(Layout, ts)
+}
+
+// Year returns the year of a canonical timestamp
+func Year(ts string) string {
+	if len(ts) < 4 {
+		return ""
+	}
+	return ts[:4]
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+// Package transport builds the worker's HTTP transports, tuned per archive
+// host, bounded per operation and instrumented to verify connection reuse.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+)
+
+// Protocols accepted by transport.hosts[].protocol
+const (
+	ProtocolAuto  = ""
+	ProtocolHTTP2 = "h2"
+	ProtocolHTTP1 = "http1"
+)
+
+var (
+	connections = metrics.NewCounter("wdd_archive_connections_total",
+		"Connections used for archive requests.")
+	reusedConnections = metrics.NewCounter("wdd_archive_connections_reused_total",
+		"Archive requests sent on a reused connection.")
+	http2Responses = metrics.NewCounter("wdd_archive_http2_responses_total",
+		"Archive responses received over HTTP/2.")
+)
+
+// DialFunc dials outgoing connections, e.g. dnscache.Resolver.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Transport routes requests to a transport tuned for their host
+type Transport struct {
+	fallback *http.Transport
+	hosts    map[string]*hostTransport
+}
+
+type hostTransport struct {
+	transport *http.Transport
+	// slots limits in-flight requests when max_streams is set
+	slots chan struct{}
+}
+
+// Defaults of the phases of a config.RequestBudget
+const (
+	defaultConnect = 30 * time.Second
+	defaultTLS     = 10 * time.Second
+	defaultTotal   = 20 * time.Second
+)
+
+// NewClient creates an HTTP client on the transport of config.transport,
+// bounded by budget
+func NewClient(dial DialFunc, budget config.RequestBudget) (*http.Client, error) {
+	rt, err := FromConfig(dial, budget)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt, Timeout: orDefault(budget.TotalMs, defaultTotal)}, nil
+}
+
+// FromConfig creates the transport described by config.transport, its
+// connections bounded by the connect, TLS and header phases of budget
+func FromConfig(dial DialFunc, budget config.RequestBudget) (*Transport, error) {
+	dial = withConnectTimeout(dial, orDefault(budget.ConnectMs, defaultConnect))
+	t := &Transport{
+		fallback: base(dial, budget),
+		hosts:    make(map[string]*hostTransport),
+	}
+	for host, cfg := range config.AppConfig.Transport.Hosts {
+		tr := base(dial, budget)
+		switch cfg.Protocol {
+		case ProtocolAuto:
+		case ProtocolHTTP2:
+			tr.ForceAttemptHTTP2 = true
+		case ProtocolHTTP1:
+			// A non-nil empty map disables HTTP/2 negotiation
+			tr.ForceAttemptHTTP2 = false
+			tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			tr.TLSClientConfig = &tls.Config{NextProtos: []string{"http/1.1"}}
+		default:
+			return nil, fmt.Errorf("transport for %s: unknown protocol %q", host, cfg.Protocol)
+		}
+		if cfg.MaxStreams < 0 || cfg.TLSSessionCache < 0 {
+			return nil, fmt.Errorf("transport for %s: limits must not be negative", host)
+		}
+		if cfg.TLSSessionCache > 0 {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(cfg.TLSSessionCache)
+		}
+
+		ht := &hostTransport{transport: tr}
+		if cfg.MaxStreams > 0 {
+			tr.MaxIdleConnsPerHost = cfg.MaxStreams
+			ht.slots = make(chan struct{}, cfg.MaxStreams)
+		}
+		t.hosts[strings.ToLower(host)] = ht
+	}
+	return t, nil
+}
+
+func base(dial DialFunc, budget config.RequestBudget) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if dial != nil {
+		tr.DialContext = dial
+	}
+	tr.TLSHandshakeTimeout = orDefault(budget.TLSMs, defaultTLS)
+	tr.ResponseHeaderTimeout = time.Duration(budget.HeaderMs) * time.Millisecond
+	return tr
+}
+
+// withConnectTimeout bounds each dial of dial, the default dialer's when
+// nil, by timeout
+func withConnectTimeout(dial DialFunc, timeout time.Duration) DialFunc {
+	if dial == nil {
+		return (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
+
+// orDefault converts ms milliseconds to a duration, def when unset
+func orDefault(ms int, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connections.Inc()
+			if info.Reused {
+				reusedConnections.Inc()
+			}
+			logging.Debugf(logging.Downloader, "%s: connection reused=%v idle=%s", req.URL.Host, info.Reused, info.IdleTime)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	ht, ok := t.hosts[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		return t.observe(t.fallback.RoundTrip(req))
+	}
+	if ht.slots != nil {
+		select {
+		case ht.slots <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		resp, err := t.observe(ht.transport.RoundTrip(req))
+		if err != nil {
+			<-ht.slots
+			return nil, err
+		}
+		// The slot is held until the body has been read and closed
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { <-ht.slots }}
+		return resp, nil
+	}
+	return t.observe(ht.transport.RoundTrip(req))
+}
+
+func (t *Transport) observe(resp *http.Response, err error) (*http.Response, error) {
+	if err == nil && resp.ProtoMajor == 2 {
+		http2Responses.Inc()
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes idle connections of every host transport
+func (t *Transport) CloseIdleConnections() {
+	t.fallback.CloseIdleConnections()
+	for _, ht := range t.hosts {
+		ht.transport.CloseIdleConnections()
+	}
+}
+
+// releaseBody runs release once when the response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
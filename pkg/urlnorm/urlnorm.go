@@ -0,0 +1,125 @@
+// Package urlnorm applies the url_normalization rules of the config to
+// submitted URLs, e.g. with drop_params [utm_*] and sort_params
+// http://example.com/a?utm_source=x&b=2&a=1#top becomes
+// http://example.com/a?a=1&b=2
+package urlnorm
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"wayback-discover-diff/config"
+)
+
+// Normalize rewrites rawURL with the rules of its host. The rest of the
+// URL is kept byte for byte, and a URL without a scheme stays without
+// one; canonicalizing it is left to the CDX server.
+func Normalize(rawURL string) string {
+	rules := rulesFor(host(rawURL))
+	s := rawURL
+	if rules.StripFragment {
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+	}
+	if len(rules.DropParams) == 0 && !rules.SortParams {
+		return s
+	}
+
+	rest, fragment := s, ""
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		rest, fragment = s[:i], s[i:]
+	}
+	i := strings.IndexByte(rest, '?')
+	if i < 0 {
+		return s
+	}
+	base, query := rest[:i], rest[i+1:]
+
+	var params []string
+	for _, param := range strings.Split(query, "&") {
+		if param != "" && !dropped(paramName(param), rules.DropParams) {
+			params = append(params, param)
+		}
+	}
+	if rules.SortParams {
+		sort.SliceStable(params, func(i, j int) bool {
+			return paramName(params[i]) < paramName(params[j])
+		})
+	}
+	if len(params) > 0 {
+		base += "?" + strings.Join(params, "&")
+	}
+	return base + fragment
+}
+
+// Validate reports malformed patterns in the rules
+func Validate() error {
+	cfg := config.AppConfig.URLNormalization
+	check := func(where string, rules config.URLRules) error {
+		for _, pattern := range rules.DropParams {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s.drop_params: bad pattern %q", where, pattern)
+			}
+		}
+		return nil
+	}
+	if err := check("url_normalization", cfg.URLRules); err != nil {
+		return err
+	}
+	for name, rules := range cfg.Hosts {
+		if err := check("url_normalization.hosts."+name, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rulesFor returns the rules of the longest configured host matching h,
+// or the default rules
+func rulesFor(h string) config.URLRules {
+	cfg := config.AppConfig.URLNormalization
+	rules, best := cfg.URLRules, -1
+	for name, hostRules := range cfg.Hosts {
+		name = strings.ToLower(name)
+		if (h == name || strings.HasSuffix(h, "."+name)) && len(name) > best {
+			rules, best = hostRules, len(name)
+		}
+	}
+	return rules
+}
+
+// host returns the lowercased host of rawURL, read as http without a
+// scheme
+func host(rawURL string) string {
+	s := strings.TrimSpace(rawURL)
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// paramName returns the decoded name of a key=value query parameter
+func paramName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if decoded, err := url.QueryUnescape(name); err == nil {
+		return decoded
+	}
+	return name
+}
+
+func dropped(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
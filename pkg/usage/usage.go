@@ -0,0 +1,168 @@
+package usage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/pkg/retention"
+)
+
+const (
+	// Anonymous is the tenant used when no API keys are configured
+	Anonymous = "anonymous"
+
+	tenantsKey = "usage:tenants"
+	dayLayout  = "20060102"
+
+	// RetentionClass names the daily counters in retention policies
+	RetentionClass = "usage"
+)
+
+func init() {
+	retention.Register(retention.Class{
+		Name:     RetentionClass,
+		Prefixes: []string{"usage:"},
+		// A little over a year of daily counters
+		Default: func() time.Duration { return 400 * 24 * time.Hour },
+		Age: func(key string) (time.Time, bool) {
+			i := strings.LastIndex(key, ":")
+			if key == tenantsKey || i < 0 {
+				return time.Time{}, false
+			}
+			day, err := time.Parse(dayLayout, key[i+1:])
+			return day, err == nil
+		},
+	})
+}
+
+// Counter names stored in each daily usage hash
+const (
+	Requests  = "requests"
+	Snapshots = "snapshots"
+	Bytes     = "bytes"
+	CPUMillis = "cpu_ms"
+)
+
+// Counters is a set of usage increments or totals
+type Counters map[string]int64
+
+// Day is the usage of one tenant on one UTC day
+type Day struct {
+	Date     string   `json:"date"`
+	Counters Counters `json:"counters"`
+}
+
+func dayKey(tenant string, day time.Time) string {
+	return fmt.Sprintf("usage:%s:%s", tenant, day.UTC().Format(dayLayout))
+}
+
+// Record adds counters to tenant's usage for today
+func Record(ctx context.Context, redisClient *redis.Client, tenant string, counters Counters) error {
+	_, err := record(ctx, redisClient, tenant, counters, false)
+	return err
+}
+
+// RecordToday adds counters as Record does and returns tenant's usage so
+// far today, including them, in the same round trip
+func RecordToday(ctx context.Context, redisClient *redis.Client, tenant string, counters Counters) (Counters, error) {
+	return record(ctx, redisClient, tenant, counters, true)
+}
+
+func record(ctx context.Context, redisClient *redis.Client, tenant string, counters Counters, read bool) (Counters, error) {
+	if tenant == "" {
+		tenant = Anonymous
+	}
+	key := dayKey(tenant, time.Now())
+
+	pipe := redisClient.TxPipeline()
+	for name, n := range counters {
+		pipe.HIncrBy(ctx, key, name, n)
+	}
+	if ttl := retention.TTL(RetentionClass); ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+	pipe.SAdd(ctx, tenantsKey, tenant)
+	var today *redis.StringStringMapCmd
+	if read {
+		today = pipe.HGetAll(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	if today == nil {
+		return nil, nil
+	}
+	return parseCounters(today.Val()), nil
+}
+
+// Range returns tenant's daily usage between from and to, inclusive
+func Range(ctx context.Context, redisClient *redis.Client, tenant string, from, to time.Time) ([]Day, error) {
+	pipe := redisClient.Pipeline()
+	var dates []string
+	var cmds []*redis.StringStringMapCmd
+	for day := from.UTC(); !day.After(to.UTC()); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(dayLayout))
+		cmds = append(cmds, pipe.HGetAll(ctx, dayKey(tenant, day)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	days := make([]Day, 0, len(dates))
+	for i, cmd := range cmds {
+		values, err := cmd.Result()
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		days = append(days, Day{Date: dates[i], Counters: parseCounters(values)})
+	}
+	return days, nil
+}
+
+// Tenants lists every tenant that has recorded usage
+func Tenants(ctx context.Context, redisClient *redis.Client) ([]string, error) {
+	return redisClient.SMembers(ctx, tenantsKey).Result()
+}
+
+// ParseDay parses a YYYYMMDD date
+func ParseDay(s string) (time.Time, error) {
+	return time.Parse(dayLayout, s)
+}
+
+// Sum adds up the counters of several days
+func Sum(days []Day) Counters {
+	total := Counters{}
+	for _, day := range days {
+		for name, n := range day.Counters {
+			total[name] += n
+		}
+	}
+	return total
+}
+
+func parseCounters(values map[string]string) Counters {
+	counters := make(Counters, len(values))
+	for name, raw := range values {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			continue
+		}
+		counters[name] = n
+	}
+	return counters
+}
+
+// KeyPrefix is the common prefix of tenant's daily usage keys
+func KeyPrefix(tenant string) string {
+	return "usage:" + tenant + ":"
+}
+
+// Forget drops tenant from the tenants listed by Tenants
+func Forget(ctx context.Context, redisClient *redis.Client, tenant string) error {
+	return redisClient.SRem(ctx, tenantsKey, tenant).Err()
+}
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/urlnorm"
+)
+
+// canonicalURL returns the absolute rel=canonical URL of an HTML capture,
+// normalized like submitted URLs, or "" when it has none
+func canonicalURL(capture *Capture) string {
+	if capture.ContentType != "" && !IsHTMLType(capture.ContentType) {
+		return ""
+	}
+	href := simhash.Canonical(capture.Body)
+	if href == "" {
+		return ""
+	}
+	base := capture.URL
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	u := b.ResolveReference(ref)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return urlnorm.Normalize(u.String())
+}
+
+// aliasCanonical also stores the hash of capture under its canonical URL
+// so the captures of that URL include every URL serving the page. A hash
+// the canonical URL already has at the timestamp is kept.
+func aliasCanonical(ctx context.Context, store *storage.Store, capture *Capture, ttl time.Duration) {
+	canonical := capture.Canonical
+	if canonical == "" || canonical == capture.URL || !config.AppConfig.Canonical.Alias {
+		return
+	}
+	if _, err := store.GetSimHash(ctx, canonical, capture.Timestamp); err != storage.ErrNotFound {
+		return
+	}
+	err := store.SetSimHash(ctx, canonical, capture.Timestamp, capture.Encoded, ttl)
+	if err == nil {
+		meta := map[string]string{storage.MetaAliasOf: capture.URL}
+		if ttl > 0 {
+			meta[storage.MetaExpiresAt] = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+		}
+		err = store.SetCaptureMeta(ctx, canonical, capture.Timestamp, meta, ttl)
+	}
+	if err == nil {
+		err = store.IndexURL(ctx, canonical, ts.Year(capture.Timestamp), ttl)
+	}
+	if err != nil {
+		logging.Warnf(logging.Worker, "aliasing %s %s to %s: %v", capture.URL, capture.Timestamp, canonical, err)
+	}
+}
@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/pkg/logging"
+)
+
+// ErrInterrupted stops a job when the worker shuts down. The job's
+// progress is kept in a checkpoint and its task is retried without
+// counting as a failure, see IsFailure.
+var ErrInterrupted = errors.New("worker shutting down")
+
+// IsFailure tells asynq which task errors count as failures
+func IsFailure(err error) bool {
+	return !errors.Is(err, ErrInterrupted)
+}
+
+// Checkpoint is the progress of a job stopped by a shutdown or its
+// deadline, from which the next attempt resumes
+type Checkpoint struct {
+	Summary JobSummary `json:"summary"`
+	// Year is the year in progress and Last the archive timestamp of
+	// its last capture done; Current counts the captures of Year so far
+	Year    int         `json:"year"`
+	Last    string      `json:"last,omitempty"`
+	Current YearSummary `json:"current"`
+}
+
+func checkpointKey(id string) string {
+	return "job:checkpoint:" + id
+}
+
+type progressKey struct{}
+
+// jobProgress follows the captures a task has done, and those a previous
+// attempt did according to its checkpoint
+type jobProgress struct {
+	year int
+	last string
+	// resumeYear and resume are the year and last capture of the
+	// checkpoint; captures up to resume are passed over
+	resumeYear int
+	resume     string
+	current    YearSummary
+}
+
+// Drain makes running jobs stop after their current capture, saving a
+// checkpoint. It is called once the server begins shutting down.
+func (w *Worker) Drain() {
+	w.drainOnce.Do(func() { close(w.draining) })
+}
+
+func (w *Worker) stopping() bool {
+	select {
+	case <-w.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// resume loads the checkpoint of job id into summary and returns a context
+// following the progress of the task
+func (w *Worker) resume(ctx context.Context, id string, summary *JobSummary) context.Context {
+	pr := &jobProgress{}
+	ctx = context.WithValue(ctx, progressKey{}, pr)
+	if id == "" {
+		return ctx
+	}
+	raw, err := w.redisClient.Get(ctx, checkpointKey(id)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			logging.Warnf(logging.Worker, "job %s: reading checkpoint: %v", id, err)
+		}
+		return ctx
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(raw, &cp); err != nil {
+		return ctx
+	}
+	*summary = cp.Summary
+	pr.resumeYear, pr.resume, pr.current = cp.Year, cp.Last, cp.Current
+	pr.year, pr.last = cp.Year, cp.Last
+	logging.Debugf(logging.Worker, "job %s: resuming %d after %s", id, cp.Year, cp.Last)
+	return ctx
+}
+
+// saveCheckpoint records the progress of an interrupted job. It runs
+// without the task context, which may be past its deadline.
+func (w *Worker) saveCheckpoint(ctx context.Context, summary JobSummary) {
+	pr, ok := ctx.Value(progressKey{}).(*jobProgress)
+	if !ok || summary.JobID == "" {
+		return
+	}
+	raw, err := json.Marshal(Checkpoint{Summary: summary, Year: pr.year, Last: pr.last, Current: pr.current})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.redisClient.Set(ctx, checkpointKey(summary.JobID), raw, historyTTL).Err(); err != nil {
+		logging.Warnf(logging.Worker, "job %s: saving checkpoint: %v", summary.JobID, err)
+	}
+}
+
+// done reports whether a previous attempt of the task already did the
+// capture of p's year at the archive timestamp
+func done(ctx context.Context, p SimHashPayload, timestamp string) bool {
+	pr, ok := ctx.Value(progressKey{}).(*jobProgress)
+	return ok && p.Year == pr.resumeYear && timestamp <= pr.resume
+}
+
+// advance records the capture at timestamp as the last one done
+func advance(ctx context.Context, p SimHashPayload, timestamp string, skipped bool) {
+	pr, ok := ctx.Value(progressKey{}).(*jobProgress)
+	if !ok {
+		return
+	}
+	if pr.year != p.Year {
+		pr.current = YearSummary{Year: p.Year}
+	}
+	pr.year, pr.last = p.Year, timestamp
+	if skipped {
+		pr.current.Skipped++
+	} else {
+		pr.current.Processed++
+	}
+}
+
+// resumedYear returns the captures of year counted by the checkpoint the
+// task resumed from and whether the checkpoint reached year at all
+func resumedYear(ctx context.Context, year int) (YearSummary, bool) {
+	pr, ok := ctx.Value(progressKey{}).(*jobProgress)
+	if !ok || pr.resumeYear == 0 {
+		return YearSummary{}, true
+	}
+	if year == pr.resumeYear {
+		return pr.current, true
+	}
+	return YearSummary{}, year > pr.resumeYear
+}
@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/pkg/archive"
+)
+
+// TypeDiscoverYears fans an all-years request out into per-year tasks
+const TypeDiscoverYears = "simhash:discover"
+
+// HandleDiscoverYears queries the CDX server for the years in which p.URL
+// was captured and enqueues a calculation for each of them. With the
+// Sitemap option the pages of its archived sitemap get a discovery each.
+func (w *Worker) HandleDiscoverYears(ctx context.Context, t *asynq.Task) error {
+	var p SimHashPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+
+	src, err := w.sourceFor(p)
+	var years []int
+	if err == nil {
+		years, err = w.getYears(ctx, src, p.URL, p.Options.Filters)
+	}
+	if err == nil {
+		for _, year := range years {
+			yp := p
+			yp.Year = year
+			if _, _, err = EnqueueCalculation(ctx, w.redisClient, w.taskClient, yp); err != nil {
+				break
+			}
+		}
+	}
+	var pages []string
+	if err == nil && p.Options.Sitemap {
+		pages, err = w.sitemapURLs(ctx, src, p)
+		for _, page := range pages {
+			pp := p
+			pp.URL, pp.Options.Sitemap = page, false
+			if _, _, err = EnqueueDiscovery(ctx, w.redisClient, w.taskClient, pp); err != nil {
+				break
+			}
+		}
+	}
+
+	if err == nil || isFinalAttempt(ctx) {
+		jobID, _ := asynq.GetTaskID(ctx)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		w.redisClient.Del(ctx, p.discoveryKey())
+
+		status := "completed"
+		if err != nil {
+			status = "failed"
+		}
+		publishJobDone(ctx, w.redisClient, jobID, status)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Discovered %d capture years for %s", len(years), p.URL)
+	if p.Options.Sitemap {
+		log.Printf("Discovered %d sitemap pages for %s", len(pages), p.URL)
+	}
+	return nil
+}
+
+// getYears returns the distinct years with captures of url, oldest first
+func (w *Worker) getYears(ctx context.Context, src archive.Source, url string, filters []string) ([]int, error) {
+	// Collapsing on the first four timestamp digits yields one row per year
+	cdxURL := src.CDXQuery(url, "", "", filters...) + "&fl=timestamp&collapse=timestamp:4"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cdxURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.cdxClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	timestamps, err := src.ParseTimestamps(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var years []int
+	seen := make(map[int]bool)
+	for _, raw := range timestamps {
+		if len(raw) < 4 {
+			continue
+		}
+		year, err := strconv.Atoi(raw[:4])
+		if err != nil || seen[year] {
+			continue
+		}
+		seen[year] = true
+		years = append(years, year)
+	}
+	return years, nil
+}
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"context"
+	"strconv"
+
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// consecutiveDistances is the distribution of Hamming distances between
+// consecutive captures of completed jobs. A sudden shift after deploying
+// extractor or config changes hints at a regression.
+var consecutiveDistances = metrics.NewHistogram("wdd_capture_distance_bits",
+	"Hamming distance between consecutive captures of each completed job.",
+	[]float64{0, 1, 2, 4, 6, 8, 12, 16, 24, 32, 48, 64})
+
+// observeDistances adds the distances between consecutive captures to
+// consecutiveDistances
+func observeDistances(captures []storage.Capture) {
+	var prev uint64
+	seen := false
+	for _, c := range captures {
+		hash, err := simhash.DecodeSimHash(c.SimHash)
+		if err != nil {
+			continue
+		}
+		if seen {
+			consecutiveDistances.Observe(float64(simhash.Distance(prev, hash)))
+		}
+		prev, seen = hash, true
+	}
+}
+
+// recordYear observes the distances of the year a job completed, refreshes
+// the URL's eras, lists the URL under the year for /urls and keeps its
+// hashes as the version left by the job, for /simhash?as_of=
+func (w *Worker) recordYear(ctx context.Context, p SimHashPayload, jobID string) {
+	store := w.storeFor(p)
+	stored, err := store.ListSimHashes(ctx, p.URL)
+	if err != nil {
+		logging.Warnf(logging.Worker, "job %s: listing year %d: %v", jobID, p.Year, err)
+		return
+	}
+
+	year := strconv.Itoa(p.Year)
+	var captures []storage.Capture
+	for _, c := range stored {
+		if ts.Year(c.Timestamp) == year {
+			captures = append(captures, c)
+		}
+	}
+	// Excluded captures stay in the version but not in the distribution
+	exclusions, err := store.Exclusions(ctx, p.URL)
+	if err != nil {
+		logging.Warnf(logging.Worker, "job %s: reading exclusions: %v", jobID, err)
+	}
+	observeDistances(storage.WithoutExcluded(captures, exclusions))
+	if err == nil {
+		if _, err := saveEras(ctx, store, p.URL, EraDistance(), stored, exclusions); err != nil {
+			logging.Warnf(logging.Worker, "job %s: saving eras: %v", jobID, err)
+		}
+	}
+
+	if len(captures) == 0 {
+		return
+	}
+	if err := store.IndexURL(ctx, p.URL, year, retention.TTL(storage.RetentionCaptures)); err != nil {
+		logging.Warnf(logging.Worker, "job %s: indexing year %d: %v", jobID, p.Year, err)
+	}
+	if jobID == "" {
+		return
+	}
+	ttl := retention.TTL(storage.RetentionVersions)
+	if err := store.SaveYearVersion(ctx, p.URL, year, jobID, captures, ttl); err != nil {
+		logging.Warnf(logging.Worker, "job %s: saving year version: %v", jobID, err)
+	}
+}
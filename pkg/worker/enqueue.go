@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// TaskKey is the Redis key marking a running calculation for url and year
+func TaskKey(url string, year int) string {
+	return fmt.Sprintf("task:%s:%d", url, year)
+}
+
+// SizedTaskKey marks a running calculation of simhashes of the given bit
+// size; size 0 is the default size of TaskKey
+func SizedTaskKey(url string, year, size int) string {
+	if size == 0 {
+		return TaskKey(url, year)
+	}
+	return fmt.Sprintf("task:%s:%d-%d", url, year, size)
+}
+
+// RangeTaskKey marks a running calculation of the years from to to
+func RangeTaskKey(url string, from, to, size int) string {
+	if size == 0 {
+		return fmt.Sprintf("task:%s:%d..%d", url, from, to)
+	}
+	return fmt.Sprintf("task:%s:%d..%d-%d", url, from, to, size)
+}
+
+// TaskKeyPrefix is the common prefix of every task marker of url
+func TaskKeyPrefix(url string) string {
+	return fmt.Sprintf("task:%s:", url)
+}
+
+// TaskKeyPrefixes are the prefixes of the task markers of url and of the
+// task IDs remembered for them, see recentKey
+func TaskKeyPrefixes(url string) []string {
+	return []string{TaskKeyPrefix(url), recentKey(TaskKeyPrefix(url))}
+}
+
+// DiscoveryTaskKey is the Redis key marking a running all-years discovery
+// of hashes of the given bit size (0 for the default)
+func DiscoveryTaskKey(url string, size int) string {
+	if size == 0 {
+		return fmt.Sprintf("task:%s:all", url)
+	}
+	return fmt.Sprintf("task:%s:all-%d", url, size)
+}
+
+func (p SimHashPayload) discoveryKey() string {
+	return DiscoveryTaskKey(storage.ArchiveURL(storage.ProfileArchive(p.Options.Archive, p.Options.Profile), p.URL), p.Options.Size)
+}
+
+// EnqueueCalculation submits a calculation job unless one is already
+// running for the same URL and year, in which case the existing job ID
+// is returned with existing set to true.
+func EnqueueCalculation(ctx context.Context, redisClient *redis.Client, taskClient *asynq.Client,
+	p SimHashPayload) (taskID string, existing bool, err error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return "", false, err
+	}
+	return enqueueUnique(ctx, redisClient, taskClient, p.taskKey(),
+		asynq.NewTask(TypeCalculateSimHash, payload), taskOptions(p)...)
+}
+
+// EnqueueDiscovery submits a task that finds every year with captures of
+// p.URL and enqueues one calculation per year
+func EnqueueDiscovery(ctx context.Context, redisClient *redis.Client, taskClient *asynq.Client,
+	p SimHashPayload) (taskID string, existing bool, err error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return "", false, err
+	}
+	return enqueueUnique(ctx, redisClient, taskClient, p.discoveryKey(),
+		asynq.NewTask(TypeDiscoverYears, payload), taskOptions(p)...)
+}
+
+// ErrRecentDuplicate is returned when an identical task was enqueued
+// within config.queues.collapse_window, has since finished and its ID is
+// no longer known
+var ErrRecentDuplicate = errors.New("identical task enqueued recently")
+
+// taskOptions are the queue and time limits of the task of job p
+func taskOptions(p SimHashPayload) []asynq.Option {
+	var opts []asynq.Option
+	if p.Options.Priority != "" {
+		opts = append(opts, asynq.Queue(p.Options.Priority))
+	}
+	if timeout := jobTimeout(p); timeout > 0 {
+		opts = append(opts, asynq.Timeout(timeout))
+	}
+	if deadline := jobDeadline(); deadline > 0 {
+		opts = append(opts, asynq.Deadline(time.Now().Add(deadline)))
+	}
+	return opts
+}
+
+// jobTimeout is config.queues.job_timeout, per year for multi-year jobs
+func jobTimeout(p SimHashPayload) time.Duration {
+	timeout := time.Duration(config.AppConfig.Queues.JobTimeout) * time.Second
+	if p.ranged() {
+		timeout *= time.Duration(p.YearTo - p.Year + 1)
+	}
+	return timeout
+}
+
+// jobDeadline is config.queues.job_deadline
+func jobDeadline() time.Duration {
+	return time.Duration(config.AppConfig.Queues.JobDeadline) * time.Second
+}
+
+// enqueueUnique enqueues task with opts unless taskKey already names a
+// running task. The marker is claimed before enqueueing so concurrent
+// callers agree on a single task ID.
+func enqueueUnique(ctx context.Context, redisClient *redis.Client, taskClient *asynq.Client,
+	taskKey string, task *asynq.Task, opts ...asynq.Option) (taskID string, existing bool, err error) {
+	taskID = uuid.New().String()
+	for attempt := 0; ; attempt++ {
+		claimed, err := redisClient.SetNX(ctx, taskKey, taskID, 24*time.Hour).Result()
+		if err != nil {
+			return "", false, fmt.Errorf("failed to store task information: %v", err)
+		}
+		if claimed {
+			break
+		}
+		// Check if there's already a task running for this key
+		running, err := redisClient.Get(ctx, taskKey).Result()
+		if err == nil {
+			return running, true, nil
+		}
+		// The running task finished in between; claim again once
+		if err != redis.Nil || attempt > 0 {
+			return "", false, err
+		}
+	}
+
+	// Create new task
+	opts = append([]asynq.Option{asynq.TaskID(taskID)}, opts...)
+	if window := time.Duration(config.AppConfig.Queues.CollapseWindow) * time.Second; window > 0 {
+		opts = append(opts, asynq.Unique(window))
+	}
+	if keep := JobRetention(); keep > 0 {
+		opts = append(opts, asynq.Retention(keep))
+	}
+	if _, err := taskClient.EnqueueContext(ctx, task, opts...); err != nil {
+		redisClient.Del(ctx, taskKey)
+		if errors.Is(err, asynq.ErrDuplicateTask) {
+			// The identical task has finished; answer with its ID
+			if recent, err := redisClient.Get(ctx, recentKey(taskKey)).Result(); err == nil {
+				return recent, true, nil
+			}
+			return "", false, ErrRecentDuplicate
+		}
+		return "", false, fmt.Errorf("failed to create task: %v", err)
+	}
+	if window := time.Duration(config.AppConfig.Queues.CollapseWindow) * time.Second; window > 0 {
+		redisClient.Set(ctx, recentKey(taskKey), taskID, window)
+	}
+	recordHistory(ctx, redisClient, taskID, HistoryQueued, "")
+	return taskID, false, nil
+}
+
+// recentKey remembers the ID of the task last enqueued under taskKey for
+// config.queues.collapse_window, as long as asynq rejects it as a duplicate
+func recentKey(taskKey string) string {
+	return "recent:" + taskKey
+}
+
+// TemplatesKey is the Redis hash holding job templates by name
+const TemplatesKey = "job_templates"
+
+// LoadTemplate returns the job options stored under name
+func LoadTemplate(ctx context.Context, redisClient *redis.Client, name string) (JobOptions, bool, error) {
+	var opts JobOptions
+
+	raw, err := redisClient.HGet(ctx, TemplatesKey, name).Result()
+	if err == redis.Nil {
+		return opts, false, nil
+	}
+	if err != nil {
+		return opts, false, err
+	}
+
+	if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+		return opts, false, err
+	}
+	return opts, true, nil
+}
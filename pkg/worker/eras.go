@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"context"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/analysis"
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// defaultEraDistance is the era distance when config.analysis.eras.distance
+// is unset
+const defaultEraDistance = 3
+
+// EraSet is the stored result of grouping a URL's captures into eras
+type EraSet struct {
+	Distance int            `json:"distance"`
+	Captures int            `json:"captures"`
+	Excluded int            `json:"excluded,omitempty"`
+	Eras     []analysis.Era `json:"eras"`
+}
+
+// EraDistance is the default era distance
+func EraDistance() int {
+	if d := config.AppConfig.Analysis.Eras.Distance; d > 0 {
+		return d
+	}
+	return defaultEraDistance
+}
+
+// RefreshEras groups the captures of url not excluded into eras of
+// distance and stores them
+func RefreshEras(ctx context.Context, store *storage.Store, url string, distance int) (EraSet, error) {
+	stored, err := store.ListSimHashes(ctx, url)
+	if err != nil {
+		return EraSet{}, err
+	}
+	exclusions, err := store.Exclusions(ctx, url)
+	if err != nil {
+		return EraSet{}, err
+	}
+	return saveEras(ctx, store, url, distance, stored, exclusions)
+}
+
+func saveEras(ctx context.Context, store *storage.Store, url string, distance int,
+	stored []storage.Capture, exclusions map[string]storage.Exclusion) (EraSet, error) {
+	captures := storage.WithoutExcluded(stored, exclusions)
+	set := EraSet{
+		Distance: distance,
+		Captures: len(captures),
+		Excluded: len(stored) - len(captures),
+		Eras:     analysis.Eras(captures, distance),
+	}
+	if len(set.Eras) == 0 {
+		return set, nil
+	}
+	return set, store.SaveEras(ctx, url, distance, set, retention.TTL(storage.RetentionCaptures))
+}
@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"wayback-discover-diff/config"
+)
+
+// Error classes weighted by config.error_policy.weights
+const (
+	ErrorTimeout = "timeout"
+	ErrorNetwork = "network"
+	ErrorHTTP4xx = "http_4xx"
+	ErrorHTTP5xx = "http_5xx"
+	ErrorContent = "content"
+	ErrorDigest  = "digest"
+	ErrorOther   = "other"
+)
+
+// IsErrorClass reports whether name is one of the error classes
+func IsErrorClass(name string) bool {
+	switch name {
+	case ErrorTimeout, ErrorNetwork, ErrorHTTP4xx, ErrorHTTP5xx, ErrorContent, ErrorDigest, ErrorOther:
+		return true
+	}
+	return false
+}
+
+// statusError is returned for a replay response other than 200 OK
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status: %d", e.code)
+}
+
+// contentError is returned for captures that cannot be hashed: bodies of
+// unsupported types or without any features
+type contentError struct {
+	msg string
+}
+
+func (e *contentError) Error() string {
+	return e.msg
+}
+
+// digestError is returned for a body whose SHA-1 differs from the digest
+// of its CDX row
+type digestError struct {
+	digest string
+	size   int
+}
+
+func (e *digestError) Error() string {
+	return fmt.Sprintf("digest mismatch: %d bytes do not match %s", e.size, e.digest)
+}
+
+// classifyError returns the class of a capture error
+func classifyError(err error) string {
+	var status *statusError
+	var content *contentError
+	var digest *digestError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.As(err, &netErr):
+		return ErrorNetwork
+	case errors.As(err, &status) && status.code >= 500:
+		return ErrorHTTP5xx
+	case errors.As(err, &status):
+		return ErrorHTTP4xx
+	case errors.As(err, &content):
+		return ErrorContent
+	case errors.As(err, &digest):
+		return ErrorDigest
+	}
+	return ErrorOther
+}
+
+// errorWeight is how much a capture error counts toward the job's error
+// thresholds; classes missing from config.error_policy.weights weigh 1
+func errorWeight(err error) float64 {
+	if weight, ok := config.AppConfig.ErrorPolicy.Weights[classifyError(err)]; ok {
+		return weight
+	}
+	return 1
+}
+
+// errorBudget decides when a job has failed too many captures to go on:
+// once the weighted errors reach max_errors, or once more than
+// error_policy.max_ratio of the last error_policy.window captures failed.
+type errorBudget struct {
+	// counts are the capture errors by class
+	counts map[string]int
+	total  float64
+	// window holds the weights of the most recent outcomes, 0 for success
+	window    []float64
+	next      int
+	filled    int
+	windowSum float64
+}
+
+func newErrorBudget() *errorBudget {
+	b := &errorBudget{counts: map[string]int{}}
+	if n := config.AppConfig.ErrorPolicy.Window; n > 0 {
+		b.window = make([]float64, n)
+	}
+	return b
+}
+
+// record accounts for the outcome of one capture, err being nil on
+// success, and returns a non-nil error once the job should abort
+func (b *errorBudget) record(err error) error {
+	weight := 0.0
+	if err != nil {
+		b.counts[classifyError(err)]++
+		weight = errorWeight(err)
+	}
+	b.total += weight
+
+	if len(b.window) > 0 {
+		b.windowSum += weight - b.window[b.next]
+		b.window[b.next] = weight
+		b.next = (b.next + 1) % len(b.window)
+		if b.filled < len(b.window) {
+			b.filled++
+		}
+	}
+	return errorsExceeded(b.total, b.windowSum, b.filled)
+}
+
+type budgetKey struct{}
+
+// withErrorBudget returns a context carrying a new error budget for the
+// captures of one task
+func withErrorBudget(ctx context.Context) (context.Context, *errorBudget) {
+	b := newErrorBudget()
+	return context.WithValue(ctx, budgetKey{}, b), b
+}
+
+// budgetFrom returns the error budget of the task processing ctx, or a
+// fresh one outside of a task
+func budgetFrom(ctx context.Context) *errorBudget {
+	if b, ok := ctx.Value(budgetKey{}).(*errorBudget); ok {
+		return b
+	}
+	return newErrorBudget()
+}
+
+// errorsExceeded applies the error policy to weighted errors in total and
+// within a window of samples captures
+func errorsExceeded(total, windowErrors float64, samples int) error {
+	if max := config.AppConfig.MaxErrors; max > 0 && total >= float64(max) {
+		return fmt.Errorf("max errors reached: %d", max)
+	}
+
+	cfg := config.AppConfig.ErrorPolicy
+	if cfg.MaxRatio <= 0 || samples == 0 || samples < cfg.MinSamples {
+		return nil
+	}
+	if ratio := windowErrors / float64(samples); ratio > cfg.MaxRatio {
+		return fmt.Errorf("error rate %.0f%% of the last %d captures exceeds %.0f%%",
+			ratio*100, samples, cfg.MaxRatio*100)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package worker
+
+import (
+	"context"
+	"log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// JobDoneChannel is the pub/sub channel on which the terminal status of
+// job id is published, for clients long-polling /job
+func JobDoneChannel(id string) string {
+	return "job:done:" + id
+}
+
+// publishJobDone announces that a job reached a terminal status
+func publishJobDone(ctx context.Context, rdb *redis.Client, id, status string) {
+	if id == "" {
+		return
+	}
+	state := HistoryCompleted
+	if status != "completed" {
+		state = HistoryFailed
+	}
+	recordHistory(ctx, rdb, id, state, "")
+	if err := rdb.Publish(ctx, JobDoneChannel(id), status).Err(); err != nil {
+		log.Printf("Job %s: failed to publish completion: %v", id, err)
+	}
+}
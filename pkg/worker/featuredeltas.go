@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// defaultFullEvery is the length of a delta chain when
+// config.simhash.feature_deltas.full_every is unset
+const defaultFullEvery = 20
+
+type chainKey struct{}
+
+// featureChain is the capture whose features a job stored last, the base
+// of the delta stored for the next one
+type featureChain struct {
+	timestamp string
+	features  map[string]int
+	depth     int
+}
+
+// withFeatureChain returns a context carrying a new feature chain for the
+// captures of one task
+func withFeatureChain(ctx context.Context) context.Context {
+	return context.WithValue(ctx, chainKey{}, &featureChain{})
+}
+
+// storeFeatures stores the features of capture. With
+// config.simhash.feature_deltas, captures hashed in timestamp order by one
+// task are stored as the delta from the capture before, with a full map
+// every full_every captures and for the first capture of each year, so
+// that purging a year leaves no delta without its base.
+func (w *Worker) storeFeatures(ctx context.Context, store *storage.Store, capture *Capture, ttl time.Duration) error {
+	cfg := config.AppConfig.Simhash.FeatureDeltas
+	chain, ok := ctx.Value(chainKey{}).(*featureChain)
+	if !cfg.Enabled || !ok {
+		return store.SetFeatures(ctx, capture.URL, capture.Timestamp, capture.Features, ttl)
+	}
+	fullEvery := cfg.FullEvery
+	if fullEvery <= 0 {
+		fullEvery = defaultFullEvery
+	}
+
+	var err error
+	depth := 0
+	if chain.features != nil && chain.timestamp < capture.Timestamp &&
+		ts.Year(chain.timestamp) == ts.Year(capture.Timestamp) && chain.depth+1 < fullEvery {
+		depth = chain.depth + 1
+		err = store.SetFeatureDelta(ctx, capture.URL, capture.Timestamp, storage.FeatureDelta{
+			Base:    chain.timestamp,
+			Depth:   depth,
+			Changes: storage.Diff(chain.features, capture.Features),
+		}, ttl)
+	} else {
+		err = store.SetFeatures(ctx, capture.URL, capture.Timestamp, capture.Features, ttl)
+	}
+	if err == nil {
+		*chain = featureChain{timestamp: capture.Timestamp, features: capture.Features, depth: depth}
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+)
+
+// ForgetJobs removes what the job records keep of url in archive for a
+// takedown, restricted to jobs covering year when it is not empty: the
+// tasks asynq still holds (waiting, scheduled, retrying, failed or
+// retained as completed) and, for those and for the finished jobs whose
+// report names url in archive, the history, report, checkpoint and
+// staged capture bodies. Running tasks are left to finish. It returns the
+// number of tasks and keys removed.
+func ForgetJobs(ctx context.Context, rdb *redis.Client, inspector *asynq.Inspector,
+	archive, url, year string) (int, error) {
+	removed := 0
+	ids := map[string]bool{}
+
+	queues, err := inspector.Queues()
+	if err != nil {
+		return 0, err
+	}
+	listers := []func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error){
+		inspector.ListPendingTasks, inspector.ListScheduledTasks, inspector.ListRetryTasks,
+		inspector.ListArchivedTasks, inspector.ListCompletedTasks,
+	}
+	for _, q := range queues {
+		for _, list := range listers {
+			var doomed []string
+			for page := 1; ; page++ {
+				tasks, err := list(q, asynq.Page(page), asynq.PageSize(100))
+				if errors.Is(err, asynq.ErrQueueNotFound) {
+					break
+				}
+				if err != nil {
+					return removed, err
+				}
+				for _, t := range tasks {
+					if id, ok := taskJob(t, archive, url, year); ok {
+						doomed = append(doomed, t.ID)
+						ids[id] = true
+					}
+				}
+				if len(tasks) < 100 {
+					break
+				}
+			}
+			// Deleted after listing so that pages do not shift
+			for _, id := range doomed {
+				err := inspector.DeleteTask(q, id)
+				if err == nil {
+					removed++
+				} else if !errors.Is(err, asynq.ErrTaskNotFound) {
+					return removed, err
+				}
+			}
+		}
+	}
+
+	iter := rdb.Scan(ctx, 0, reportKey("*"), 1000).Iterator()
+	for iter.Next(ctx) {
+		raw, err := rdb.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var report JobReport
+		if json.Unmarshal(raw, &report) == nil && report.URL == url && report.Archive == archive &&
+			(year == "" || report.Year == 0 || strconv.Itoa(report.Year) == year) {
+			ids[report.JobID] = true
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return removed, err
+	}
+
+	for id := range ids {
+		if id == "" {
+			continue
+		}
+		keys := []string{historyKey(id), reportKey(id), checkpointKey(id), stageKey(id)}
+		cached := rdb.Scan(ctx, 0, stageCacheKey(id, "*"), 1000).Iterator()
+		for cached.Next(ctx) {
+			keys = append(keys, cached.Val())
+		}
+		if err := cached.Err(); err != nil {
+			return removed, err
+		}
+		n, err := rdb.Unlink(ctx, keys...).Result()
+		removed += int(n)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// taskJob returns the job ID of a calculation, discovery or stage task of
+// url in archive covering year
+func taskJob(t *asynq.TaskInfo, archive, url, year string) (string, bool) {
+	var p SimHashPayload
+	id := t.ID
+	switch t.Type {
+	case TypeCalculateSimHash, TypeDiscoverYears:
+		if json.Unmarshal(t.Payload, &p) != nil {
+			return "", false
+		}
+	case TypeFetchCapture, TypeHashCapture:
+		var stage StagePayload
+		if json.Unmarshal(t.Payload, &stage) != nil {
+			return "", false
+		}
+		p, id = stage.Job, stage.JobID
+	default:
+		return "", false
+	}
+	if p.URL != url || p.Options.Archive != archive {
+		return "", false
+	}
+	if year == "" || p.Year == 0 {
+		return id, true
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return "", false
+	}
+	to := p.YearTo
+	if to < p.Year {
+		to = p.Year
+	}
+	return id, p.Year <= y && y <= to
+}
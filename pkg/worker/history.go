@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/pkg/logging"
+)
+
+// Job history states
+const (
+	HistoryQueued    = "queued"
+	HistoryActive    = "active"
+	HistoryRetrying  = "retrying"
+	HistoryCompleted = "completed"
+	HistoryFailed    = "failed"
+)
+
+// historyTTL is how long the state transitions of a job are kept
+const historyTTL = 7 * 24 * time.Hour
+
+// HistoryEvent is one state transition of a job
+type HistoryEvent struct {
+	State  string    `json:"state"`
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func historyKey(id string) string {
+	return "job:history:" + id
+}
+
+// recordHistory appends a state transition to the history of job id
+func recordHistory(ctx context.Context, rdb *redis.Client, id, state, detail string) {
+	if id == "" {
+		return
+	}
+	raw, _ := json.Marshal(HistoryEvent{State: state, At: time.Now().UTC(), Detail: detail})
+	pipe := rdb.Pipeline()
+	pipe.RPush(ctx, historyKey(id), raw)
+	pipe.Expire(ctx, historyKey(id), historyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logging.Warnf(logging.Worker, "job %s: failed to record %s transition: %v", id, state, err)
+	}
+}
+
+// JobHistory returns the state transitions of job id, oldest first
+func JobHistory(ctx context.Context, rdb *redis.Client, id string) ([]HistoryEvent, error) {
+	entries, err := rdb.LRange(ctx, historyKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistory(entries), nil
+}
+
+// decodeHistory decodes the entries of a history list, skipping malformed
+// ones
+func decodeHistory(entries []string) []HistoryEvent {
+	events := make([]HistoryEvent, 0, len(entries))
+	for _, raw := range entries {
+		var e HistoryEvent
+		if json.Unmarshal([]byte(raw), &e) == nil {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// TrackHistory is asynq middleware recording when job tasks start and
+// when they fail with retries left. Terminal states are recorded when the
+// job finishes, which for staged jobs is after the task itself.
+func (w *Worker) TrackHistory(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		switch t.Type() {
+		case TypeCalculateSimHash, TypeDiscoverYears:
+		default:
+			return next.ProcessTask(ctx, t)
+		}
+
+		id, _ := asynq.GetTaskID(ctx)
+		recordHistory(ctx, w.redisClient, id, HistoryActive, "")
+		err := next.ProcessTask(ctx, t)
+		if err != nil && !isFinalAttempt(ctx) {
+			recordHistory(ctx, w.redisClient, id, HistoryRetrying, err.Error())
+		}
+		return err
+	})
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrSkipCapture can be returned by a hook to drop the current capture
+// without counting it as a download error
+var ErrSkipCapture = errors.New("capture skipped by hook")
+
+// Capture carries the state of a single snapshot through the pipeline.
+// Hooks may inspect and modify it in place.
+type Capture struct {
+	URL         string
+	Timestamp   string
+	ContentType string
+	Body        []byte
+	Features    map[string]int
+	Hash        uint64
+	Encoded     string
+	// Truncated is set when extraction limits cut the page short
+	Truncated bool
+	// Canonical is the rel=canonical URL of the page when
+	// config.canonical.record is set
+	Canonical string
+
+	timings phaseTimings
+}
+
+// Hook lets deployers run custom code at fixed points of the per-capture
+// pipeline. Embed BaseHook to implement only the stages you need.
+type Hook interface {
+	// PreDownload runs before the snapshot body is fetched
+	PreDownload(ctx context.Context, c *Capture) error
+	// PostDownload runs once Body is populated, e.g. to strip banners
+	PostDownload(ctx context.Context, c *Capture) error
+	// PreHash runs once Features are extracted, before hashing
+	PreHash(ctx context.Context, c *Capture) error
+	// PostStore runs after the simhash has been written
+	PostStore(ctx context.Context, c *Capture) error
+}
+
+// BaseHook provides no-op implementations of every Hook stage
+type BaseHook struct{}
+
+func (BaseHook) PreDownload(ctx context.Context, c *Capture) error  { return nil }
+func (BaseHook) PostDownload(ctx context.Context, c *Capture) error { return nil }
+func (BaseHook) PreHash(ctx context.Context, c *Capture) error      { return nil }
+func (BaseHook) PostStore(ctx context.Context, c *Capture) error    { return nil }
+
+var (
+	hooksMu  sync.RWMutex
+	registry = make(map[string]Hook)
+)
+
+// RegisterHook makes a hook available under name so it can be enabled
+// from config.worker.hooks. It is meant to be called from init functions
+// of compiled-in packages and panics on duplicate names.
+func RegisterHook(name string, h Hook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("worker: hook %q registered twice", name))
+	}
+	registry[name] = h
+}
+
+// lookupHooks resolves the configured hook names in order
+func lookupHooks(names []string) ([]Hook, error) {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+
+	hooks := make([]Hook, 0, len(names))
+	for _, name := range names {
+		h, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown hook: %s", name)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+type hookStage func(Hook, context.Context, *Capture) error
+
+// runHooks invokes stage on every enabled hook, stopping at the first error
+func (w *Worker) runHooks(ctx context.Context, stage hookStage, c *Capture) error {
+	for _, h := range w.hooks {
+		if err := stage(h, ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
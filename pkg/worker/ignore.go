@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/simhash"
+)
+
+// compileIgnore parses the selectors of config.simhash.ignore by host,
+// which like template profiles treats www.host as host
+func compileIgnore() (map[string]simhash.Selectors, error) {
+	compiled := make(map[string]simhash.Selectors, len(config.AppConfig.Simhash.Ignore))
+	for host, selectors := range config.AppConfig.Simhash.Ignore {
+		sel, err := simhash.ParseSelectors(selectors)
+		if err != nil {
+			return nil, fmt.Errorf("simhash.ignore.%s: %v", host, err)
+		}
+		compiled[strings.TrimPrefix(strings.ToLower(host), "www.")] = sel
+	}
+	return compiled, nil
+}
+
+// ValidateIgnore reports malformed selectors in config.simhash.ignore
+func ValidateIgnore() error {
+	_, err := compileIgnore()
+	return err
+}
+
+// ignoredRegions returns the selectors of the longest configured host
+// matching the host of url or one of its parent domains
+func (w *Worker) ignoredRegions(url string) simhash.Selectors {
+	if len(w.ignore) == 0 {
+		return nil
+	}
+	h := ProfileHost(url)
+	var regions simhash.Selectors
+	best := -1
+	for host, sel := range w.ignore {
+		if (h == host || strings.HasSuffix(h, "."+host)) && len(host) > best {
+			regions, best = sel, len(host)
+		}
+	}
+	return regions
+}
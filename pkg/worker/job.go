@@ -0,0 +1,325 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/notify"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+)
+
+// JobOptions tunes how a calculation job selects and processes captures.
+// They can be supplied per request or centralized in a job template.
+type JobOptions struct {
+	// Snapshots caps the number of captures sampled per year;
+	// zero falls back to config.snapshots.number_per_year
+	Snapshots int `json:"snapshots,omitempty"`
+	// Filters are passed to the CDX server as filter= expressions,
+	// e.g. "statuscode:200" or "!mimetype:warc/revisit"
+	Filters []string `json:"filters,omitempty"`
+	// Callback receives a JobSummary when the job finishes
+	Callback string `json:"callback,omitempty"`
+	// NotifyEmail receives a summary email when the job finishes
+	NotifyEmail string `json:"notify_email,omitempty"`
+	// Size is the simhash bit size; zero is config.simhash.size
+	Size int `json:"size,omitempty"`
+	// Archive names the source of config.archives captures are read from
+	// and stored for; empty is the default archive
+	Archive string `json:"archive,omitempty"`
+	// Priority is the queue of config.queues.priorities the job runs in;
+	// empty is DefaultQueue
+	Priority string `json:"priority,omitempty"`
+	// Profile names the config.simhash.profiles entry features are
+	// extracted with; empty is the settings of config.simhash. Each
+	// profile stores its hashes apart, see storage.Store.WithProfile.
+	Profile string `json:"profile,omitempty"`
+	// Sitemap has an all-years job also discover the pages listed by the
+	// archived sitemap.xml of its host, each in an all-years job of its
+	// own, to catch pages the CDX listing of the URL does not lead to
+	Sitemap bool `json:"sitemap,omitempty"`
+}
+
+// JobSummary describes the outcome of a calculation job
+type JobSummary struct {
+	JobID     string  `json:"job_id"`
+	URL       string  `json:"url"`
+	Year      int     `json:"year"`
+	Status    string  `json:"status"`
+	Processed int     `json:"processed"`
+	Skipped   int     `json:"skipped"`
+	Duration  float64 `json:"duration_seconds"`
+	Error     string  `json:"error,omitempty"`
+	// Errors counts the captures that failed, by error class
+	Errors map[string]int `json:"errors,omitempty"`
+	// YearTo is the last year of a multi-year job, whose years are
+	// summed up in Years
+	YearTo int           `json:"year_to,omitempty"`
+	Years  []YearSummary `json:"years,omitempty"`
+}
+
+// sampleSnapshots evenly picks at most limit items from snapshots
+func sampleSnapshots[T any](snapshots []T, limit int) []T {
+	if limit <= 0 || len(snapshots) <= limit {
+		return snapshots
+	}
+
+	sampled := make([]T, 0, limit)
+	step := float64(len(snapshots)) / float64(limit)
+	for i := 0; i < limit; i++ {
+		sampled = append(sampled, snapshots[int(float64(i)*step)])
+	}
+	return sampled
+}
+
+func snapshotLimit(opts JobOptions) int {
+	if opts.Snapshots > 0 {
+		return opts.Snapshots
+	}
+	return config.AppConfig.Snapshots.NumberPerYear
+}
+
+// HashSize checks a requested simhash size against the config.simhash
+// bounds. The default size is returned as 0 so its hashes keep the default
+// storage namespace.
+func HashSize(requested int) (int, error) {
+	if requested == 0 || requested == config.AppConfig.Simhash.Size {
+		return 0, nil
+	}
+
+	min, max := SizeRange()
+	if requested < min || requested > max {
+		return 0, fmt.Errorf("simhash size must be between %d and %d bits", min, max)
+	}
+	return requested, nil
+}
+
+// SizeRange returns the smallest and largest simhash sizes clients may
+// request
+func SizeRange() (min, max int) {
+	cfg := config.AppConfig.Simhash
+	min, max = cfg.MinSize, cfg.MaxSize
+	if min == 0 {
+		min = cfg.Size
+	}
+	if max == 0 {
+		max = cfg.Size
+	}
+	if max > 64 {
+		max = 64 // hashes are stored as 64-bit values
+	}
+	return min, max
+}
+
+// BitSize is the number of bits in hashes of a size returned by HashSize
+func BitSize(size int) int {
+	if size == 0 {
+		size = config.AppConfig.Simhash.Size
+	}
+	if size > 64 {
+		size = 64
+	}
+	return size
+}
+
+// featureOptions are the HTML extraction options of the profile named
+// name in config.simhash.profiles, or those of config.simhash when name is
+// empty or unknown
+func featureOptions(name string) simhash.ExtractOptions {
+	if profile, ok := config.AppConfig.Simhash.Profiles[name]; ok && name != "" {
+		return extractOptions(profile)
+	}
+	return extractOptions(config.AppConfig.Simhash.ExtractProfile)
+}
+
+// IsProfile reports whether name is a profile of config.simhash.profiles
+func IsProfile(name string) bool {
+	_, ok := config.AppConfig.Simhash.Profiles[name]
+	return ok
+}
+
+// ProfileNames lists config.simhash.profiles in byte order
+func ProfileNames() []string {
+	names := make([]string, 0, len(config.AppConfig.Simhash.Profiles))
+	for name := range config.AppConfig.Simhash.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// extractOptions are the HTML extraction options of profile
+func extractOptions(profile config.ExtractProfile) simhash.ExtractOptions {
+	cfg, limits := profile.Features, profile.Limits
+	return simhash.ExtractOptions{
+		AltText: cfg.AltText,
+		Meta:    cfg.Meta,
+		JSONLD:  cfg.JSONLD,
+		Limits:  simhash.Limits{MaxNodes: limits.MaxNodes, MaxDepth: limits.MaxDepth, MaxTokens: limits.MaxTokens},
+		Tokens:  simhash.TokenOptions{Numbers: profile.Tokens.Numbers, Dates: profile.Tokens.Dates},
+	}
+}
+
+// taskKey is the running-task marker of a calculation job
+func (p SimHashPayload) taskKey() string {
+	url := storage.ArchiveURL(storage.ProfileArchive(p.Options.Archive, p.Options.Profile), p.URL)
+	if p.ranged() {
+		return RangeTaskKey(url, p.Year, p.YearTo, p.Options.Size)
+	}
+	return SizedTaskKey(url, p.Year, p.Options.Size)
+}
+
+// store is the view of the store holding the job's simhashes
+func (w *Worker) storeFor(p SimHashPayload) *storage.Store {
+	return w.store.WithArchive(p.Options.Archive).WithProfile(p.Options.Profile).WithSize(p.Options.Size)
+}
+
+// sourceFor returns the archive source of a job, failing without retries
+// for archives missing from config.archives
+func (w *Worker) sourceFor(p SimHashPayload) (archive.Source, error) {
+	src, ok := w.sources[p.Options.Archive]
+	if !ok {
+		return archive.Source{}, fmt.Errorf("%v: %s: %w", archive.ErrUnknownArchive, p.Options.Archive, asynq.SkipRetry)
+	}
+	return src, nil
+}
+
+// isFinalAttempt reports whether asynq will not retry the task again
+func isFinalAttempt(ctx context.Context) bool {
+	retried, ok1 := asynq.GetRetryCount(ctx)
+	maxRetry, ok2 := asynq.GetMaxRetry(ctx)
+	return !ok1 || !ok2 || retried >= maxRetry
+}
+
+// retryRedis runs op up to three times, backing off from 100ms, for the
+// bookkeeping writes a job cannot finish without
+func retryRedis(ctx context.Context, op func() error) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == 3 {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// deadlineGrace is how long before the deadline asynq gives a task its
+// handler stops, at most, so that asynq takes the handler's result
+const deadlineGrace = 5 * time.Second
+
+// withGrace ends ctx a tenth of the time left, at most deadlineGrace,
+// before its deadline. Past the deadline asynq fails the task with a
+// retry whatever its handler returns.
+func withGrace(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	grace := time.Until(deadline) / 10
+	if grace > deadlineGrace {
+		grace = deadlineGrace
+	}
+	return context.WithDeadline(ctx, deadline.Add(-grace))
+}
+
+// pastDeadline reports whether the deadline asynq gave the attempt of job
+// p started at attempt is config.queues.job_deadline rather than the
+// attempt's timeout. asynq takes the earlier of both, in whole seconds.
+func pastDeadline(p SimHashPayload, attempt, deadline time.Time) bool {
+	if jobDeadline() <= 0 || deadline.IsZero() {
+		return false
+	}
+	timeout := jobTimeout(p)
+	return timeout <= 0 || deadline.Before(attempt.Add(timeout-2*time.Second))
+}
+
+// finishJob clears the running-task marker, stores the job report and
+// delivers the job summary to the configured callback
+func (w *Worker) finishJob(ctx context.Context, p SimHashPayload, summary JobSummary) {
+	// Cancelled or timed out jobs are finished too
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 15*time.Second)
+	defer cancel()
+
+	// A marker left behind would block the job's resubmission for a day
+	err := retryRedis(ctx, func() error {
+		return w.redisClient.Del(ctx, p.taskKey(), checkpointKey(summary.JobID)).Err()
+	})
+	if err != nil {
+		log.Printf("Job %s: failed to clear task marker: %v", summary.JobID, err)
+	}
+	if summary.Status == "completed" {
+		recordJobDuration(ctx, w.redisClient, summary.Duration)
+		// processYears records the years of multi-year jobs as it goes
+		if !p.ranged() {
+			w.recordYear(ctx, p, summary.JobID)
+		}
+	}
+	// Waiters of /job read the result from the report
+	w.saveReport(ctx, p, summary)
+	publishJobDone(ctx, w.redisClient, summary.JobID, summary.Status)
+
+	if p.Options.Callback != "" {
+		if err := notify.PostJSON(ctx, p.Options.Callback, summary); err != nil {
+			log.Printf("Job %s: callback failed: %v", summary.JobID, err)
+		}
+	}
+
+	if p.Options.NotifyEmail != "" && notify.MailEnabled() {
+		subject, body := summaryMail(summary)
+		if err := notify.SendMail(p.Options.NotifyEmail, subject, body); err != nil {
+			log.Printf("Job %s: notification email failed: %v", summary.JobID, err)
+		}
+	}
+}
+
+// summaryMail renders the notification email for a finished job
+func summaryMail(s JobSummary) (string, string) {
+	years := strconv.Itoa(s.Year)
+	if s.YearTo > s.Year {
+		years += "-" + strconv.Itoa(s.YearTo)
+	}
+	subject := fmt.Sprintf("[wayback-discover-diff] Job %s %s: %s %s", s.JobID, s.Status, s.URL, years)
+
+	results := url.Values{}
+	results.Set("url", s.URL)
+	results.Set("year", strconv.Itoa(s.Year))
+	link := config.PublicLink("/simhash?") + results.Encode()
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Job:       %s\n", s.JobID)
+	fmt.Fprintf(&body, "URL:       %s\n", s.URL)
+	fmt.Fprintf(&body, "Year:      %s\n", years)
+	fmt.Fprintf(&body, "Status:    %s\n", s.Status)
+	fmt.Fprintf(&body, "Processed: %d captures\n", s.Processed)
+	fmt.Fprintf(&body, "Skipped:   %d captures\n", s.Skipped)
+	fmt.Fprintf(&body, "Duration:  %s\n", time.Duration(s.Duration*float64(time.Second)).Round(time.Second))
+	if len(s.Errors) > 0 {
+		classes := make([]string, 0, len(s.Errors))
+		for class, n := range s.Errors {
+			classes = append(classes, fmt.Sprintf("%s %d", class, n))
+		}
+		sort.Strings(classes)
+		fmt.Fprintf(&body, "Errors:    %s\n", strings.Join(classes, ", "))
+	}
+	if s.Error != "" {
+		fmt.Fprintf(&body, "Error:     %s\n", s.Error)
+	}
+	fmt.Fprintf(&body, "\nResults:   %s\n", link)
+	return subject, body.String()
+}
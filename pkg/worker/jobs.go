@@ -0,0 +1,227 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// Job states listed by ListJobs, in the order they are listed
+const (
+	JobPending   = "pending"
+	JobActive    = "active"
+	JobRetrying  = "retrying"
+	JobCompleted = "completed"
+)
+
+// JobStates are the states ListJobs knows
+var JobStates = []string{JobPending, JobActive, JobRetrying, JobCompleted}
+
+// JobInfo describes a calculation or discovery task for GET /jobs
+type JobInfo struct {
+	ID     string `json:"job_id"`
+	Type   string `json:"type"`
+	Queue  string `json:"queue"`
+	State  string `json:"state"`
+	URL    string `json:"url"`
+	Year   int    `json:"year,omitempty"`
+	YearTo int    `json:"year_to,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	// EnqueuedAt is when the job was first queued, from its history
+	EnqueuedAt  *time.Time `json:"enqueued_at,omitempty"`
+	Retried     int        `json:"retried,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// JobRetention is how long asynq keeps completed jobs for ListJobs, see
+// config.queues.retention
+func JobRetention() time.Duration {
+	return time.Duration(config.AppConfig.Queues.Retention) * time.Second
+}
+
+// ListJobs lists up to limit jobs in the given states, every state when
+// none is given, across queue or every configured queue. Completed jobs
+// are kept for JobRetention only.
+func ListJobs(ctx context.Context, rdb *redis.Client, inspector *asynq.Inspector,
+	states []string, queue string, limit int) ([]JobInfo, error) {
+	if len(states) == 0 {
+		states = JobStates
+	}
+	queues := QueueNames()
+	if queue != "" {
+		queues = []string{queue}
+	}
+
+	jobs := []JobInfo{}
+	for _, state := range states {
+		list, err := jobLister(inspector, state)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range queues {
+			for page := 1; len(jobs) < limit; page++ {
+				tasks, err := list(q, asynq.Page(page), asynq.PageSize(100))
+				if errors.Is(err, asynq.ErrQueueNotFound) {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				for _, t := range tasks {
+					if job, ok := jobInfo(ctx, rdb, t, state); ok && len(jobs) < limit {
+						jobs = append(jobs, job)
+					}
+				}
+				if len(tasks) < 100 {
+					break
+				}
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// jobLister is the inspector call listing the tasks of state
+func jobLister(inspector *asynq.Inspector, state string) (func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error), error) {
+	switch state {
+	case JobPending:
+		return inspector.ListPendingTasks, nil
+	case JobActive:
+		return inspector.ListActiveTasks, nil
+	case JobRetrying:
+		return inspector.ListRetryTasks, nil
+	case JobCompleted:
+		return inspector.ListCompletedTasks, nil
+	}
+	return nil, fmt.Errorf("unknown job state %s", state)
+}
+
+// jobInfo describes t when it is a calculation or discovery job
+func jobInfo(ctx context.Context, rdb *redis.Client, t *asynq.TaskInfo, state string) (JobInfo, bool) {
+	switch t.Type {
+	case TypeCalculateSimHash, TypeDiscoverYears:
+	default:
+		return JobInfo{}, false
+	}
+	var p SimHashPayload
+	if err := json.Unmarshal(t.Payload, &p); err != nil {
+		return JobInfo{}, false
+	}
+	job := JobInfo{ID: t.ID, Type: t.Type, Queue: t.Queue, State: state, URL: p.URL,
+		Year: p.Year, YearTo: p.YearTo, Tenant: p.Tenant, Retried: t.Retried, LastError: t.LastErr}
+	if !t.CompletedAt.IsZero() {
+		completed := t.CompletedAt.UTC()
+		job.CompletedAt = &completed
+	}
+	if raw, err := rdb.LIndex(ctx, historyKey(t.ID), 0).Bytes(); err == nil {
+		var first HistoryEvent
+		if json.Unmarshal(raw, &first) == nil && first.State == HistoryQueued {
+			job.EnqueuedAt = &first.At
+		}
+	}
+	return job, true
+}
+
+// JobLookup is what the status of a job is told from. Task is nil once
+// asynq no longer holds the task; Result is set for finished jobs whose
+// report is kept.
+type JobLookup struct {
+	Task    *asynq.TaskInfo
+	Staging bool
+	Result  *JobSummary
+	History []HistoryEvent
+}
+
+// LookupJobs gathers the task, staging state, result and history of each
+// of ids, in order. A single pipeline locates the tasks across the queues
+// and reads the job keys, so the inspector is only asked for tasks that
+// exist, once each, plus once to check the key layout when none does.
+// Without fullHistory History holds the latest transition only.
+func LookupJobs(ctx context.Context, rdb *redis.Client, inspector *asynq.Inspector,
+	ids []string, fullHistory bool) ([]JobLookup, error) {
+	queues := QueueNames()
+	pipe := rdb.Pipeline()
+	exists := make([][]*redis.IntCmd, len(ids))
+	pending := make([]*redis.StringCmd, len(ids))
+	reports := make([]*redis.StringCmd, len(ids))
+	histories := make([]*redis.StringSliceCmd, len(ids))
+	for i, id := range ids {
+		for _, q := range queues {
+			exists[i] = append(exists[i], pipe.Exists(ctx, taskKey(q, id)))
+		}
+		pending[i] = pipe.HGet(ctx, stageKey(id), stagePending)
+		reports[i] = pipe.Get(ctx, reportKey(id))
+		if fullHistory {
+			histories[i] = pipe.LRange(ctx, historyKey(id), 0, -1)
+		} else {
+			histories[i] = pipe.LRange(ctx, historyKey(id), -1, -1)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// taskKey follows asynq's internal layout. When no task was located,
+	// one inspector lookup tells whether that layout still holds; only if
+	// it does not are the tasks looked up through the inspector instead.
+	located := false
+	for i := range ids {
+		for j := range queues {
+			located = located || exists[i][j].Val() == 1
+		}
+	}
+	probed, fallback := false, false
+
+	lookups := make([]JobLookup, len(ids))
+	for i, id := range ids {
+		job := &lookups[i]
+		for j, q := range queues {
+			if exists[i][j].Val() == 0 {
+				continue
+			}
+			info, err := inspector.GetTaskInfo(q, id)
+			if errors.Is(err, asynq.ErrTaskNotFound) {
+				// Deleted since it was located
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			job.Task = info
+			break
+		}
+		if job.Task == nil && !located && (!probed || fallback) {
+			info, err := FindTask(inspector, id)
+			if err != nil && !errors.Is(err, ErrTaskNotFound) {
+				return nil, err
+			}
+			if !probed && info != nil {
+				logging.Warnf(logging.Worker, "task keys not where asynq v0.24.1 keeps them, "+
+					"looking jobs up through the inspector")
+				fallback = true
+			}
+			probed = true
+			job.Task = info
+		}
+		if n, err := pending[i].Int(); err == nil {
+			job.Staging = n > 0
+		}
+		if raw, err := reports[i].Bytes(); err == nil {
+			var report JobReport
+			if json.Unmarshal(raw, &report) == nil {
+				job.Result = &report.JobSummary
+			}
+		}
+		job.History = decodeHistory(histories[i].Val())
+	}
+	return lookups, nil
+}
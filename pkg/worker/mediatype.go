@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// defaultHTMLTypes are hashed when config.snapshots.content_types is empty
+var defaultHTMLTypes = []string{"text/html", "application/xhtml+xml"}
+
+// HTMLContentTypes are the media types hashed with the HTML extractor,
+// config.snapshots.content_types or text/html and application/xhtml+xml
+func HTMLContentTypes() []string {
+	if types := config.AppConfig.Snapshots.ContentTypes; len(types) > 0 {
+		return types
+	}
+	return defaultHTMLTypes
+}
+
+// parseContentType returns the lowercased media type of a Content-Type
+// header and its charset parameter, if any. A header with malformed
+// parameters still yields its media type.
+func parseContentType(contentType string) (mediaType, charsetLabel string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+		return strings.ToLower(strings.TrimSpace(mediaType)), ""
+	}
+	return mediaType, params["charset"]
+}
+
+// IsHTMLType reports whether captures served with contentType are hashed
+// with the HTML extractor. Entries of the allowlist are path.Match
+// patterns, so application/*+xml admits every XML variant.
+func IsHTMLType(contentType string) bool {
+	mediaType, _ := parseContentType(contentType)
+	if mediaType == "" {
+		return false
+	}
+	for _, pattern := range HTMLContentTypes() {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// toUTF8 transcodes an HTML body from the charset of its Content-Type to
+// UTF-8, which the extractor expects. Bodies without a charset, in UTF-8
+// or in an unknown charset are returned unchanged.
+func toUTF8(body []byte, contentType string) []byte {
+	_, label := parseContentType(contentType)
+	if label == "" {
+		return body
+	}
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		logging.Debugf(logging.Downloader, "unknown charset %q, hashing bytes as they are", label)
+		return body
+	}
+	if name == "utf-8" {
+		return body
+	}
+	decoded, err := io.ReadAll(enc.NewDecoder().Reader(bytes.NewReader(body)))
+	if err != nil {
+		logging.Debugf(logging.Downloader, "transcoding from %s: %v", name, err)
+		return body
+	}
+	return decoded
+}
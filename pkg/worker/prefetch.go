@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// prefetched is a capture downloaded ahead of hashing. A nil capture
+// without error is already stored.
+type prefetched struct {
+	snap      archive.Capture
+	capture   *Capture
+	precision int
+	err       error
+}
+
+// processPrefetched processes a year job as a pipeline: listMonths lists
+// the captures a month at a time, prefetch downloads them up to
+// config.worker.prefetch.depth ahead, and the captures are hashed in
+// timestamp order as they arrive
+func (w *Worker) processPrefetched(ctx context.Context, p SimHashPayload, src archive.Source, summary *JobSummary) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	depth := config.AppConfig.Worker.Prefetch.Depth
+	if depth < 1 {
+		depth = 1
+	}
+	snapshots, listed := w.listMonths(ctx, src, p, depth)
+	fetched := w.prefetch(ctx, p, snapshots, depth)
+
+	budget := budgetFrom(ctx)
+	for f := range fetched {
+		err := f.err
+		if err == nil && f.capture != nil {
+			err = w.hashCapture(ctx, p, f.capture, f.precision)
+		}
+		if abort := w.account(ctx, p, summary, budget, f.snap, err); abort != nil {
+			return abort
+		}
+		if w.stopping() {
+			return ErrInterrupted
+		}
+	}
+	if err := <-listed; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// listMonths sends the captures of p's year on the returned channel, one
+// CDX query per month, and then the listing error, if any: like a single
+// query for the year, it fails when no month has captures. The snapshot
+// limit is spread over the months left, so the share of sparse months
+// goes to later ones.
+func (w *Worker) listMonths(ctx context.Context, src archive.Source, p SimHashPayload,
+	depth int) (<-chan archive.Capture, <-chan error) {
+	out := make(chan archive.Capture, depth)
+	listed := make(chan error, 1)
+	go func() {
+		defer close(out)
+		limit := snapshotLimit(p.Options)
+		seen := make(map[string]bool)
+		for month := 1; month <= 12 && (limit <= 0 || len(seen) < limit); month++ {
+			snapshots, err := w.getMonthSnapshots(ctx, src, p, month)
+			if err != nil && err != archive.ErrNoSnapshots {
+				listed <- err
+				return
+			}
+			if limit > 0 {
+				left := limit - len(seen)
+				snapshots = sampleSnapshots(snapshots, (left+12-month)/(13-month))
+			}
+			for _, snap := range snapshots {
+				if seen[snap.Timestamp] {
+					continue
+				}
+				seen[snap.Timestamp] = true
+				if done(ctx, p, snap.Timestamp) {
+					continue
+				}
+				select {
+				case out <- snap:
+				case <-ctx.Done():
+					listed <- nil
+					return
+				}
+			}
+		}
+		if len(seen) == 0 {
+			listed <- archive.ErrNoSnapshots
+			return
+		}
+		listed <- nil
+	}()
+	return out, listed
+}
+
+// getMonthSnapshots lists the captures of one month of p's year
+func (w *Worker) getMonthSnapshots(ctx context.Context, src archive.Source, p SimHashPayload,
+	month int) ([]archive.Capture, error) {
+	period := fmt.Sprintf("%04d%02d", p.Year, month)
+	cdxURL := src.CDXQuery(p.URL, period, period, p.Options.Filters...)
+
+	logging.Debugf(logging.Downloader, "CDX query %s", cdxURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cdxURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.cdxClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return src.ParseCaptures(resp.Body)
+}
+
+// prefetch downloads the captures received on snapshots, keeping up to
+// depth downloaded captures waiting for hashing
+func (w *Worker) prefetch(ctx context.Context, p SimHashPayload, snapshots <-chan archive.Capture,
+	depth int) <-chan prefetched {
+	out := make(chan prefetched, depth)
+	go func() {
+		defer close(out)
+		for snap := range snapshots {
+			capture, precision, err := w.fetchCapture(ctx, p, snap)
+			select {
+			case out <- prefetched{snap: snap, capture: capture, precision: precision, err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,203 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/storage"
+)
+
+const (
+	// TypeBuildProfile samples the stored pages of a host into a template profile
+	TypeBuildProfile = "profile:build"
+	// ProfilesKey is the Redis hash holding template profiles by host
+	ProfilesKey = "template_profiles"
+)
+
+// TemplateProfile lists the features shared by nearly all pages of a host
+type TemplateProfile struct {
+	Host     string    `json:"host"`
+	Features []string  `json:"features"`
+	Pages    int       `json:"pages"`
+	BuiltAt  time.Time `json:"built_at"`
+}
+
+// ProfilePayload requests a template profile of Host from up to Sample pages
+type ProfilePayload struct {
+	Host   string `json:"host"`
+	Sample int    `json:"sample,omitempty"`
+}
+
+// ProfileHost is the host a URL's template profile is stored under:
+// lowercased and without a leading www.
+func ProfileHost(rawURL string) string {
+	s := rawURL
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// LoadProfile returns the template profile stored for host
+func LoadProfile(ctx context.Context, redisClient *redis.Client, host string) (TemplateProfile, bool, error) {
+	var profile TemplateProfile
+
+	raw, err := redisClient.HGet(ctx, ProfilesKey, host).Result()
+	if err == redis.Nil {
+		return profile, false, nil
+	}
+	if err != nil {
+		return profile, false, err
+	}
+
+	if err := json.Unmarshal([]byte(raw), &profile); err != nil {
+		return profile, false, err
+	}
+	return profile, true, nil
+}
+
+// EnqueueProfileBuild submits a task building the template profile of host
+func EnqueueProfileBuild(ctx context.Context, taskClient *asynq.Client, p ProfilePayload) (string, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	info, err := taskClient.EnqueueContext(ctx, asynq.NewTask(TypeBuildProfile, payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create task: %v", err)
+	}
+	return info.ID, nil
+}
+
+// HandleBuildProfile fetches the latest capture of a sample of the host's
+// stored pages and records the features found on nearly all of them
+func (w *Worker) HandleBuildProfile(ctx context.Context, t *asynq.Task) error {
+	var p ProfilePayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+	cfg := config.AppConfig.TemplateProfiles
+	sample := p.Sample
+	if sample <= 0 {
+		sample = cfg.SampleSize
+	}
+	if sample <= 0 {
+		sample = 20
+	}
+	minPages := cfg.MinPages
+	if minPages <= 0 {
+		minPages = 5
+	}
+	threshold := cfg.Threshold
+	if threshold <= 0 || threshold > 1 {
+		threshold = 0.9
+	}
+
+	pages, err := w.hostPages(ctx, p.Host)
+	if err != nil {
+		return err
+	}
+	urls := make([]string, 0, len(pages))
+	for u := range pages {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	urls = sampleSnapshots(urls, sample)
+
+	// Document frequency of every feature over the sampled pages
+	frequency := make(map[string]int)
+	sampled := 0
+	for _, u := range urls {
+		body, contentType, err := w.downloadSnapshot(ctx, w.source, u, pages[u], "")
+		if err != nil {
+			logging.Debugf(logging.Worker, "profile %s: skipping %s: %v", p.Host, u, err)
+			continue
+		}
+		capture := &Capture{URL: u, Timestamp: pages[u], Body: body, ContentType: contentType}
+		if err := w.extractFeatures(ctx, capture, ""); err != nil || len(capture.Features) == 0 {
+			continue
+		}
+		for feature := range capture.Features {
+			frequency[feature]++
+		}
+		sampled++
+	}
+	if sampled < minPages {
+		return fmt.Errorf("profile %s: only %d of %d pages could be sampled, need %d: %w",
+			p.Host, sampled, len(urls), minPages, asynq.SkipRetry)
+	}
+
+	profile := TemplateProfile{Host: p.Host, Pages: sampled, BuiltAt: time.Now().UTC(), Features: []string{}}
+	for feature, n := range frequency {
+		if float64(n) >= threshold*float64(sampled) {
+			profile.Features = append(profile.Features, feature)
+		}
+	}
+	sort.Strings(profile.Features)
+
+	raw, _ := json.Marshal(profile)
+	if err := w.redisClient.HSet(ctx, ProfilesKey, p.Host, raw).Err(); err != nil {
+		return err
+	}
+	log.Printf("Built template profile of %s: %d features from %d pages", p.Host, len(profile.Features), sampled)
+	return nil
+}
+
+// hostPages maps the stored URLs of host to their latest capture. Every
+// default-size simhash key of the default archive is scanned, so this is
+// meant for background use.
+func (w *Worker) hostPages(ctx context.Context, host string) (map[string]string, error) {
+	pages := make(map[string]string)
+	err := w.store.ScanPrefix(ctx, "simhash:", func(keys []string) error {
+		for _, key := range keys {
+			u, timestamp, ok := storage.ParseSimhashKey(key)
+			if name, _ := storage.SplitArchiveURL(u); name != "" || !ok || ProfileHost(u) != host {
+				continue
+			}
+			if timestamp > pages[u] {
+				pages[u] = timestamp
+			}
+		}
+		return nil
+	})
+	return pages, err
+}
+
+// suppressTemplate drops the template features of the capture's host. The
+// features are kept when nothing but template would remain.
+func (w *Worker) suppressTemplate(ctx context.Context, capture *Capture) {
+	profile, found, err := LoadProfile(ctx, w.redisClient, ProfileHost(capture.URL))
+	if err != nil {
+		logging.Warnf(logging.Worker, "failed to load template profile for %s: %v", capture.URL, err)
+		return
+	}
+	if !found || len(profile.Features) == 0 {
+		return
+	}
+
+	remaining := make(map[string]int, len(capture.Features))
+	for feature, weight := range capture.Features {
+		remaining[feature] = weight
+	}
+	for _, feature := range profile.Features {
+		delete(remaining, feature)
+	}
+	if len(remaining) > 0 {
+		capture.Features = remaining
+	}
+}
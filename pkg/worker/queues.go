@@ -0,0 +1,399 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+)
+
+// DefaultQueue receives every newly submitted job
+const DefaultQueue = "default"
+
+var (
+	// ErrTaskNotFound is returned when no queue holds the task
+	ErrTaskNotFound = errors.New("task not found")
+	// ErrTaskNotWaiting is returned when a task can no longer be moved
+	// because it is running or finished
+	ErrTaskNotWaiting = errors.New("task is not waiting")
+	// ErrTaskNotFailed is returned when a task to retry has not failed
+	ErrTaskNotFailed = errors.New("task has not failed")
+	// ErrJobRunning is returned when another job of the same URL and year
+	// is running
+	ErrJobRunning = errors.New("another job is running")
+)
+
+// Queues returns the weight of each configured queue, always including
+// DefaultQueue
+func Queues() map[string]int {
+	queues := map[string]int{DefaultQueue: 1}
+	for name, weight := range config.AppConfig.Queues.Weights {
+		if weight > 0 {
+			queues[name] = weight
+		}
+	}
+	if config.AppConfig.Worker.Stages.Enabled {
+		// Stage queues default to the weight of new jobs
+		for _, name := range []string{fetchQueue(), hashQueue()} {
+			if _, ok := queues[name]; !ok {
+				queues[name] = queues[DefaultQueue]
+			}
+		}
+	}
+	if config.AppConfig.Verify.Enabled {
+		// The verifier yields to jobs unless given a weight
+		if _, ok := queues[VerifyQueue()]; !ok {
+			queues[VerifyQueue()] = 1
+		}
+	}
+	return queues
+}
+
+// IsPriority reports whether clients may submit jobs to queue, one of
+// config.queues.priorities
+func IsPriority(queue string) bool {
+	for _, name := range config.AppConfig.Queues.Priorities {
+		if name == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyQueue is the queue of the storage verifier, see config.verify.queue
+func VerifyQueue() string {
+	if q := config.AppConfig.Verify.Queue; q != "" {
+		return q
+	}
+	return "verify"
+}
+
+// QueueNames lists the configured queues by decreasing weight
+func QueueNames() []string {
+	queues := Queues()
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if queues[names[i]] != queues[names[j]] {
+			return queues[names[i]] > queues[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// FindTask looks the task up in every configured queue
+func FindTask(inspector *asynq.Inspector, id string) (*asynq.TaskInfo, error) {
+	for _, queue := range QueueNames() {
+		info, err := inspector.GetTaskInfo(queue, id)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound) {
+			return nil, err
+		}
+	}
+	return nil, ErrTaskNotFound
+}
+
+// durationsKey is the Redis list of recent job durations in seconds
+const durationsKey = "stats:job_durations"
+
+// durationSamples is the number of recent jobs throughput is estimated from
+const durationSamples = 100
+
+// QueueEstimate predicts when a waiting task will start
+type QueueEstimate struct {
+	// Position is 1 for the task that runs next in its queue
+	Position int
+	// ETA is the expected wait; zero when no job has finished recently
+	ETA time.Duration
+}
+
+// recordJobDuration keeps the duration of a finished job for estimates
+func recordJobDuration(ctx context.Context, rdb *redis.Client, seconds float64) {
+	pipe := rdb.Pipeline()
+	pipe.LPush(ctx, durationsKey, strconv.FormatFloat(seconds, 'f', 3, 64))
+	pipe.LTrim(ctx, durationsKey, 0, durationSamples-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logging.Warnf(logging.Worker, "failed to record job duration: %v", err)
+	}
+}
+
+// EstimateQueue returns the position of a pending task in its queue and
+// the time until it starts, from the mean duration of recent jobs and the
+// concurrency of the running workers. ok is false when the task is not
+// pending.
+func EstimateQueue(ctx context.Context, rdb *redis.Client, inspector *asynq.Inspector, id string) (QueueEstimate, bool, error) {
+	var est QueueEstimate
+	info, err := FindTask(inspector, id)
+	if err != nil || info.State != asynq.TaskStatePending {
+		return est, false, nil
+	}
+
+	key := pendingKey(info.Queue)
+	index, err := rdb.LPos(ctx, key, id, redis.LPosArgs{}).Result()
+	if err == redis.Nil {
+		// Dequeued in the meantime
+		return est, false, nil
+	}
+	if err != nil {
+		return est, false, err
+	}
+	length, err := rdb.LLen(ctx, key).Result()
+	if err != nil {
+		return est, false, err
+	}
+	// The rightmost task is dequeued first
+	est.Position = int(length - index)
+
+	samples, err := rdb.LRange(ctx, durationsKey, 0, -1).Result()
+	if err != nil {
+		return est, false, err
+	}
+	var sum float64
+	var n int
+	for _, s := range samples {
+		if d, err := strconv.ParseFloat(s, 64); err == nil {
+			sum += d
+			n++
+		}
+	}
+	if n == 0 {
+		return est, true, nil
+	}
+
+	concurrency := 0
+	if servers, err := inspector.Servers(); err == nil {
+		for _, srv := range servers {
+			concurrency += srv.Concurrency
+		}
+	}
+	if concurrency == 0 {
+		concurrency = config.AppConfig.Threads
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	mean := sum / float64(n)
+	est.ETA = time.Duration(mean * float64(est.Position) / float64(concurrency) * float64(time.Second))
+	return est, true, nil
+}
+
+// Backlog counts the tasks pending across the configured queues
+func Backlog(ctx context.Context, rdb *redis.Client) (int, error) {
+	pipe := rdb.Pipeline()
+	var lengths []*redis.IntCmd
+	for name := range Queues() {
+		lengths = append(lengths, pipe.LLen(ctx, pendingKey(name)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, l := range lengths {
+		total += int(l.Val())
+	}
+	return total, nil
+}
+
+// pendingKey, taskKey and bumpScript rely on the Redis layout of asynq
+// v0.24.1 (internal/base: QueueKeyPrefix, PendingKey, TaskKey), which is
+// not part of its API. Check them against internal/base when upgrading.
+
+// pendingKey is the list asynq dequeues a queue's pending tasks from; it
+// pops from the right, so the rightmost task runs next
+func pendingKey(queue string) string {
+	return fmt.Sprintf("asynq:{%s}:pending", queue)
+}
+
+// taskKey is the hash asynq keeps a task of queue in
+func taskKey(queue, id string) string {
+	return fmt.Sprintf("asynq:{%s}:t:%s", queue, id)
+}
+
+// bumpScript moves a pending task ID to the dequeue end of its list
+var bumpScript = redis.NewScript(`
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("RPUSH", KEYS[1], ARGV[1])
+return 1
+`)
+
+// Reprioritize moves a waiting task to queue, keeping its ID, and with
+// front set places it next in line there. An empty queue keeps the task
+// in its current queue.
+func Reprioritize(ctx context.Context, redisClient *redis.Client, inspector *asynq.Inspector,
+	taskClient *asynq.Client, id, queue string, front bool) (*asynq.TaskInfo, error) {
+	info, err := FindTask(inspector, id)
+	if err != nil {
+		return nil, err
+	}
+	if queue == "" {
+		queue = info.Queue
+	}
+	if _, ok := Queues()[queue]; !ok {
+		return nil, fmt.Errorf("unknown queue %s", queue)
+	}
+	switch info.State {
+	case asynq.TaskStatePending, asynq.TaskStateScheduled, asynq.TaskStateRetry:
+	default:
+		return nil, ErrTaskNotWaiting
+	}
+
+	if queue != info.Queue || (front && info.State != asynq.TaskStatePending) {
+		// asynq cannot move tasks, so the task is deleted and enqueued again
+		// under the same ID
+		if err := inspector.DeleteTask(info.Queue, id); err != nil {
+			// Picked up by a worker since it was looked up
+			return nil, fmt.Errorf("%w: %v", ErrTaskNotWaiting, err)
+		}
+		opts := []asynq.Option{asynq.TaskID(id), asynq.MaxRetry(info.MaxRetry)}
+		if info.Timeout > 0 {
+			opts = append(opts, asynq.Timeout(info.Timeout))
+		}
+		if !info.Deadline.IsZero() {
+			opts = append(opts, asynq.Deadline(info.Deadline))
+		}
+		if info.Retention > 0 {
+			opts = append(opts, asynq.Retention(info.Retention))
+		}
+		if info.State != asynq.TaskStatePending && !front {
+			opts = append(opts, asynq.ProcessAt(info.NextProcessAt))
+		}
+		task := asynq.NewTask(info.Type, info.Payload)
+		moved, err := taskClient.EnqueueContext(ctx, task, append(opts, asynq.Queue(queue))...)
+		if err != nil {
+			// Put the task back where it was rather than losing it
+			if _, restoreErr := taskClient.EnqueueContext(ctx, task, append(opts, asynq.Queue(info.Queue))...); restoreErr != nil {
+				return nil, fmt.Errorf("failed to re-enqueue task: %v (restore failed: %v)", err, restoreErr)
+			}
+			return nil, fmt.Errorf("failed to re-enqueue task: %v", err)
+		}
+		info = moved
+		recordHistory(ctx, redisClient, id, HistoryQueued, "moved to "+queue)
+	}
+
+	if front && info.State == asynq.TaskStatePending {
+		moved, err := bumpScript.Run(ctx, redisClient, []string{pendingKey(queue)}, id).Int()
+		if err != nil {
+			return nil, err
+		}
+		if moved == 0 {
+			// Dequeued by a worker in the meantime
+			return nil, ErrTaskNotWaiting
+		}
+	}
+	return info, nil
+}
+
+// RetryFailed runs a failed task again under the same ID: one archived
+// after its last attempt, or one waiting for its next attempt. The task
+// keeps its retry count, so an archived task gets a single attempt, unless
+// reset starts the count over. A task past its deadline, which would stop
+// at once, is given a new config.queues.job_deadline and its count
+// started over. The running-task marker of the job is claimed again so
+// that new submissions join it.
+func RetryFailed(ctx context.Context, redisClient *redis.Client, inspector *asynq.Inspector,
+	taskClient *asynq.Client, id string, reset bool) (*asynq.TaskInfo, error) {
+	info, err := FindTask(inspector, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.State != asynq.TaskStateArchived && info.State != asynq.TaskStateRetry {
+		return nil, ErrTaskNotFailed
+	}
+
+	release, err := claimMarker(ctx, redisClient, info)
+	if err != nil {
+		return nil, err
+	}
+	expired := !info.Deadline.IsZero() && !info.Deadline.After(time.Now())
+	if !reset && !expired {
+		if err := inspector.RunTask(info.Queue, id); err != nil {
+			release()
+			return nil, fmt.Errorf("%w: %v", ErrTaskNotFailed, err)
+		}
+		recordHistory(ctx, redisClient, id, HistoryQueued, "retried")
+		return inspector.GetTaskInfo(info.Queue, id)
+	}
+
+	// asynq cannot reset the retry count, so the task is deleted and
+	// enqueued again under the same ID
+	if err := inspector.DeleteTask(info.Queue, id); err != nil {
+		release()
+		return nil, fmt.Errorf("%w: %v", ErrTaskNotFailed, err)
+	}
+	opts := []asynq.Option{asynq.TaskID(id), asynq.Queue(info.Queue), asynq.MaxRetry(info.MaxRetry)}
+	if info.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(info.Timeout))
+	}
+	if !expired && !info.Deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(info.Deadline))
+	} else if expired && jobDeadline() > 0 {
+		opts = append(opts, asynq.Deadline(time.Now().Add(jobDeadline())))
+	}
+	if info.Retention > 0 {
+		opts = append(opts, asynq.Retention(info.Retention))
+	}
+	retried, err := taskClient.EnqueueContext(ctx, asynq.NewTask(info.Type, info.Payload), opts...)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to re-enqueue task: %v", err)
+	}
+	recordHistory(ctx, redisClient, id, HistoryQueued, "retried, retry count reset")
+	return retried, nil
+}
+
+// claimMarker sets the running-task marker of a calculation or discovery
+// task to its ID, failing with ErrJobRunning when another task holds it.
+// The returned function clears a marker claimed here.
+func claimMarker(ctx context.Context, redisClient *redis.Client, info *asynq.TaskInfo) (func(), error) {
+	var p SimHashPayload
+	var key string
+	switch info.Type {
+	case TypeCalculateSimHash, TypeDiscoverYears:
+		if err := json.Unmarshal(info.Payload, &p); err != nil {
+			return nil, err
+		}
+		size, err := HashSize(p.Options.Size)
+		if err != nil {
+			return nil, err
+		}
+		p.Options.Size = size
+		key = p.taskKey()
+		if info.Type == TypeDiscoverYears {
+			key = p.discoveryKey()
+		}
+	default:
+		return func() {}, nil
+	}
+
+	claimed, err := redisClient.SetNX(ctx, key, info.ID, 24*time.Hour).Result()
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return func() { redisClient.Del(ctx, key) }, nil
+	}
+	running, err := redisClient.Get(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if running != info.ID {
+		return nil, fmt.Errorf("%w: %s", ErrJobRunning, running)
+	}
+	return func() {}, nil
+}
@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wayback-discover-diff/pkg/analysis"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// largestChanges is the number of largest distances listed in a report
+const largestChanges = 10
+
+// ErrReportNotFound is returned for jobs without a stored report
+var ErrReportNotFound = errors.New("report not found")
+
+// JobReport summarizes a finished job for /job/report: its summary, the
+// captures of its years and how they changed
+type JobReport struct {
+	JobSummary
+	// Archive is the archive of the job, empty for the default one
+	Archive  string    `json:"archive,omitempty"`
+	Finished time.Time `json:"finished"`
+	// Captures counts the stored captures of the years, Excluded those
+	// left out of the change analysis
+	Captures int `json:"captures"`
+	Excluded int `json:"excluded,omitempty"`
+	// ChangePoints are the captures starting a new era of the year, see
+	// analysis.Eras
+	ChangePoints []Change `json:"change_points"`
+	// Largest are the largest distances between consecutive captures,
+	// largest first
+	Largest []Change `json:"largest"`
+}
+
+// Change is the distance from one capture to the next one compared
+type Change struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Distance int    `json:"distance"`
+}
+
+func reportKey(id string) string {
+	return "job:report:" + id
+}
+
+// saveReport stores the report of a finished job as long as its history.
+// A report whose change analysis failed still carries the job summary,
+// which /job returns as the job's result.
+func (w *Worker) saveReport(ctx context.Context, p SimHashPayload, summary JobSummary) {
+	if summary.JobID == "" {
+		return
+	}
+	report, err := w.buildReport(ctx, p, summary)
+	if err != nil {
+		logging.Warnf(logging.Worker, "job %s: building report: %v", summary.JobID, err)
+		report = JobReport{JobSummary: summary, Finished: time.Now().UTC().Truncate(time.Second),
+			ChangePoints: []Change{}, Largest: []Change{}}
+	}
+	report.Archive = p.Options.Archive
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	if err := w.redisClient.Set(ctx, reportKey(summary.JobID), raw, historyTTL).Err(); err != nil {
+		logging.Warnf(logging.Worker, "job %s: saving report: %v", summary.JobID, err)
+	}
+}
+
+func (w *Worker) buildReport(ctx context.Context, p SimHashPayload, summary JobSummary) (JobReport, error) {
+	report := JobReport{JobSummary: summary, Finished: time.Now().UTC().Truncate(time.Second),
+		ChangePoints: []Change{}, Largest: []Change{}}
+	store := w.storeFor(p)
+	stored, err := store.ListSimHashes(ctx, p.URL)
+	if err != nil {
+		return report, err
+	}
+	exclusions, err := store.Exclusions(ctx, p.URL)
+	if err != nil {
+		return report, err
+	}
+
+	var captures []storage.Capture
+	for _, c := range stored {
+		if year, _ := strconv.Atoi(ts.Year(c.Timestamp)); year >= p.Year && year <= p.lastYear() {
+			captures = append(captures, c)
+		}
+	}
+	report.Captures = len(captures)
+	captures = storage.WithoutExcluded(captures, exclusions)
+	report.Excluded = report.Captures - len(captures)
+
+	eras := analysis.Eras(captures, EraDistance())
+	for i := 1; i < len(eras); i++ {
+		report.ChangePoints = append(report.ChangePoints,
+			Change{From: eras[i-1].Start, To: eras[i].Start, Distance: eras[i].Distance})
+	}
+
+	var prev storage.Capture
+	var prevHash uint64
+	for _, c := range captures {
+		hash, err := simhash.DecodeSimHash(c.SimHash)
+		if err != nil {
+			continue
+		}
+		if prev.Timestamp != "" {
+			report.Largest = append(report.Largest,
+				Change{From: prev.Timestamp, To: c.Timestamp, Distance: simhash.Distance(prevHash, hash)})
+		}
+		prev, prevHash = c, hash
+	}
+	sort.SliceStable(report.Largest, func(i, j int) bool {
+		return report.Largest[i].Distance > report.Largest[j].Distance
+	})
+	if len(report.Largest) > largestChanges {
+		report.Largest = report.Largest[:largestChanges]
+	}
+	return report, nil
+}
+
+// Report returns the report of job id
+func Report(ctx context.Context, rdb *redis.Client, id string) (JobReport, error) {
+	var report JobReport
+	raw, err := rdb.Get(ctx, reportKey(id)).Bytes()
+	if err == redis.Nil {
+		return report, ErrReportNotFound
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, json.Unmarshal(raw, &report)
+}
+
+// JobResult returns the summary of finished job id, kept with its report.
+// found is false for jobs still running or whose report has expired.
+func JobResult(ctx context.Context, rdb *redis.Client, id string) (summary JobSummary, found bool, err error) {
+	report, err := Report(ctx, rdb, id)
+	if err == ErrReportNotFound {
+		return summary, false, nil
+	}
+	if err != nil {
+		return summary, false, err
+	}
+	return report.JobSummary, true, nil
+}
@@ -0,0 +1,392 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/retention"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// TypeRetryCaptures periodically retries captures that failed with a
+// transient error
+const TypeRetryCaptures = "captures:retry"
+
+// Redis keys of the capture error records
+const (
+	// captureErrorsKey is the hash of error records by capture ID
+	captureErrorsKey = "capture-errors"
+	// captureErrorsDueKey is the sorted set of capture IDs scored by the
+	// time of their next retry
+	captureErrorsDueKey = "capture-errors:due"
+)
+
+var (
+	captureRetries = metrics.NewCounter("wdd_capture_retries_total",
+		"Failed captures retried by the capture retry task.")
+	captureRetriesRecovered = metrics.NewCounter("wdd_capture_retries_recovered_total",
+		"Retried captures that were hashed.")
+	captureRetriesAbandoned = metrics.NewCounter("wdd_capture_retries_abandoned_total",
+		"Failed captures given up after config.capture_retry.max_attempts retries.")
+	inlineRetries = metrics.NewCounter("wdd_capture_retries_inline_total",
+		"Captures retried at once through POST /captures/retry.")
+)
+
+// ErrNotArchived is returned by RetryCaptureNow for a capture the archive
+// does not list
+var ErrNotArchived = errors.New("capture not archived")
+
+// captureError records a capture that failed with a retryable error
+type captureError struct {
+	// Job carries the URL, year and tenant of the capture and the size,
+	// archive, profile and CDX filters of its job
+	Job SimHashPayload `json:"job"`
+	// Timestamp is the archive's own timestamp of the capture
+	Timestamp string `json:"timestamp"`
+	Digest    string `json:"digest,omitempty"`
+	Class     string `json:"class"`
+	Error     string `json:"error"`
+	// Attempts is the number of retries failed so far
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// RegisterRetrySchedule validates config.capture_retry and schedules the
+// retry task when enabled
+func RegisterRetrySchedule(scheduler *asynq.Scheduler) error {
+	cfg := config.AppConfig.CaptureRetry
+	if !cfg.Enabled {
+		return nil
+	}
+	if err := ValidateCaptureRetry(); err != nil {
+		return err
+	}
+	schedule := cfg.Schedule
+	if schedule == "" {
+		schedule = "@hourly"
+	}
+	_, err := scheduler.Register(schedule, asynq.NewTask(TypeRetryCaptures, nil), asynq.Unique(time.Hour))
+	return err
+}
+
+// ValidateCaptureRetry checks the settings of config.capture_retry
+func ValidateCaptureRetry() error {
+	cfg := config.AppConfig.CaptureRetry
+	if _, err := retryCooldown(); err != nil {
+		return err
+	}
+	if cfg.Backoff < 1 {
+		return fmt.Errorf("capture_retry.backoff must be at least 1")
+	}
+	if cfg.MaxAttempts <= 0 {
+		return fmt.Errorf("capture_retry.max_attempts must be positive")
+	}
+	for _, class := range cfg.Classes {
+		if !IsErrorClass(class) {
+			return fmt.Errorf("capture_retry.classes: unknown error class %q", class)
+		}
+	}
+	return nil
+}
+
+// retryCooldown is the wait before the first retry of a capture
+func retryCooldown() (time.Duration, error) {
+	cooldown, err := retention.ParseDuration(config.AppConfig.CaptureRetry.Cooldown)
+	if err != nil || cooldown <= 0 {
+		return 0, fmt.Errorf("capture_retry.cooldown must be a positive duration, e.g. \"7d\"")
+	}
+	return cooldown, nil
+}
+
+// retryDelay is the wait before the next retry of a capture whose retries
+// failed attempts times
+func retryDelay(attempts int) time.Duration {
+	cooldown, err := retryCooldown()
+	if err != nil {
+		cooldown = 7 * 24 * time.Hour
+	}
+	backoff := config.AppConfig.CaptureRetry.Backoff
+	if backoff < 1 {
+		backoff = 1
+	}
+	return time.Duration(float64(cooldown) * math.Pow(backoff, float64(attempts)))
+}
+
+// retryable reports whether captures failing with err are kept for retry
+func retryable(err error) bool {
+	if !config.AppConfig.CaptureRetry.Enabled || err == nil || errors.Is(err, ErrSkipCapture) {
+		return false
+	}
+	class := classifyError(err)
+	for _, c := range config.AppConfig.CaptureRetry.Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// captureErrorID identifies a capture across archives, extraction
+// profiles and hash sizes
+func captureErrorID(p SimHashPayload, timestamp string) string {
+	return fmt.Sprintf("%s|%d|%s|%s", storage.ProfileArchive(p.Options.Archive, p.Options.Profile),
+		p.Options.Size, p.URL, timestamp)
+}
+
+// newCaptureError is the record kept for a capture of p that failed with
+// err, carrying the options the capture is selected and hashed with
+func newCaptureError(p SimHashPayload, snap archive.Capture, err error) captureError {
+	return captureError{
+		Job: SimHashPayload{URL: p.URL, Year: p.Year, Tenant: p.Tenant,
+			Options: JobOptions{Size: p.Options.Size, Archive: p.Options.Archive,
+				Profile: p.Options.Profile, Filters: p.Options.Filters}},
+		Timestamp: snap.Timestamp,
+		Digest:    snap.Digest,
+		Class:     classifyError(err),
+		Error:     err.Error(),
+		FailedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// recordCaptureError keeps a capture that failed with a retryable error
+// for the retry task. A capture already kept keeps its retry schedule.
+func (w *Worker) recordCaptureError(ctx context.Context, p SimHashPayload, snap archive.Capture, err error) {
+	if !retryable(err) {
+		return
+	}
+	timestamp, _, tsErr := ts.Normalize(snap.Timestamp)
+	if tsErr != nil {
+		return
+	}
+	rec := newCaptureError(p, snap, err)
+	raw, jsonErr := json.Marshal(rec)
+	if jsonErr != nil {
+		return
+	}
+
+	id := captureErrorID(p, timestamp)
+	due := float64(rec.FailedAt.Add(retryDelay(0)).Unix())
+	pipe := w.redisClient.TxPipeline()
+	pipe.HSetNX(ctx, captureErrorsKey, id, raw)
+	pipe.ZAddNX(ctx, captureErrorsDueKey, &redis.Z{Score: due, Member: id})
+	if _, err := pipe.Exec(ctx); err != nil {
+		logging.Warnf(logging.Worker, "failed to keep capture %s of %s for retry: %v", timestamp, p.URL, err)
+	}
+}
+
+// HandleRetryCaptures retries the kept captures whose cool-down is over.
+// Hashed captures are forgotten; the others wait longer each time until
+// config.capture_retry.max_attempts retries have failed.
+func (w *Worker) HandleRetryCaptures(ctx context.Context, t *asynq.Task) error {
+	cfg := config.AppConfig.CaptureRetry
+	if !cfg.Enabled {
+		return nil
+	}
+	batch := cfg.Batch
+	if batch <= 0 {
+		batch = 100
+	}
+	ids, err := w.redisClient.ZRangeByScore(ctx, captureErrorsDueKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: int64(batch),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := w.retryCapture(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryCapture retries one kept capture, failing only when its record
+// cannot be read or updated
+func (w *Worker) retryCapture(ctx context.Context, id string) error {
+	raw, err := w.redisClient.HGet(ctx, captureErrorsKey, id).Result()
+	if err == redis.Nil {
+		return w.forgetCaptureError(ctx, id)
+	}
+	if err != nil {
+		return err
+	}
+	var rec captureError
+	if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+		logging.Warnf(logging.Worker, "dropping unreadable capture error record %s: %v", id, err)
+		return w.forgetCaptureError(ctx, id)
+	}
+
+	captureRetries.Inc()
+	err = w.processSnapshot(ctx, rec.Job, archive.Capture{Timestamp: rec.Timestamp, Digest: rec.Digest})
+	if err == nil || errors.Is(err, ErrSkipCapture) {
+		captureRetriesRecovered.Inc()
+		logging.Debugf(logging.Worker, "retried capture %s of %s", rec.Timestamp, rec.Job.URL)
+		return w.forgetCaptureError(ctx, id)
+	}
+
+	rec.Attempts++
+	if rec.Attempts >= config.AppConfig.CaptureRetry.MaxAttempts || !retryable(err) {
+		captureRetriesAbandoned.Inc()
+		logging.Warnf(logging.Worker, "giving up capture %s of %s after %d retries: %v",
+			rec.Timestamp, rec.Job.URL, rec.Attempts, err)
+		return w.forgetCaptureError(ctx, id)
+	}
+	rec.Class, rec.Error = classifyError(err), err.Error()
+	rec.FailedAt = time.Now().UTC().Truncate(time.Second)
+	updated, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	due := float64(rec.FailedAt.Add(retryDelay(rec.Attempts)).Unix())
+	pipe := w.redisClient.TxPipeline()
+	pipe.HSet(ctx, captureErrorsKey, id, updated)
+	pipe.ZAdd(ctx, captureErrorsDueKey, &redis.Z{Score: due, Member: id})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// RetryCaptureNow downloads and hashes the capture of p.URL at the
+// canonical timestamp right away, in the calling goroutine rather than a
+// task. The archive's timestamp and digest come from the kept error record
+// of the capture, else from the CDX server. It reports whether the capture
+// was hashed, false when its hash was stored already; a capture dropped by
+// a hook fails with ErrSkipCapture. A recovered capture is forgotten by the
+// retry task; one failing with a retryable error is kept for it.
+func (w *Worker) RetryCaptureNow(ctx context.Context, p SimHashPayload, timestamp string) (bool, error) {
+	if year, err := strconv.Atoi(ts.Year(timestamp)); err == nil {
+		p.Year = year
+	}
+	stored, err := w.storeFor(p).HasSimHash(ctx, p.URL, timestamp)
+	if err != nil {
+		return false, err
+	}
+	id := captureErrorID(p, timestamp)
+	if stored {
+		return false, w.forgetCaptureError(ctx, id)
+	}
+
+	raw, err := w.redisClient.HGet(ctx, captureErrorsKey, id).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	var rec captureError
+	var snap archive.Capture
+	if err == redis.Nil || json.Unmarshal([]byte(raw), &rec) != nil {
+		if snap, err = w.findCapture(ctx, p, timestamp); err != nil {
+			return false, err
+		}
+	} else {
+		snap = archive.Capture{Timestamp: rec.Timestamp, Digest: rec.Digest}
+	}
+
+	inlineRetries.Inc()
+	err = w.processSnapshot(ctx, p, snap)
+	if errors.Is(err, ErrSkipCapture) {
+		w.forgetCaptureError(ctx, id)
+		return false, err
+	}
+	if err == nil {
+		logging.Debugf(logging.Worker, "retried capture %s of %s inline", snap.Timestamp, p.URL)
+		return true, w.forgetCaptureError(ctx, id)
+	}
+	w.recordCaptureError(ctx, p, snap, err)
+	return false, err
+}
+
+// findCapture looks up the CDX row of the capture of p.URL at the
+// canonical timestamp
+func (w *Worker) findCapture(ctx context.Context, p SimHashPayload, timestamp string) (archive.Capture, error) {
+	src, err := w.sourceFor(p)
+	if err != nil {
+		return archive.Capture{}, err
+	}
+	cdxURL := src.CDXQuery(p.URL, timestamp, timestamp, p.Options.Filters...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cdxURL, nil)
+	if err != nil {
+		return archive.Capture{}, err
+	}
+	logging.Debugf(logging.Downloader, "CDX query %s", cdxURL)
+	resp, err := w.cdxClient.Do(req)
+	if err != nil {
+		return archive.Capture{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return archive.Capture{}, &statusError{code: resp.StatusCode}
+	}
+
+	captures, err := src.ParseCaptures(resp.Body)
+	if err != nil && err != archive.ErrNoSnapshots {
+		return archive.Capture{}, err
+	}
+	for _, c := range captures {
+		if normalized, _, err := ts.Normalize(c.Timestamp); err == nil && normalized == timestamp {
+			return c, nil
+		}
+	}
+	return archive.Capture{}, ErrNotArchived
+}
+
+func (w *Worker) forgetCaptureError(ctx context.Context, id string) error {
+	pipe := w.redisClient.TxPipeline()
+	pipe.HDel(ctx, captureErrorsKey, id)
+	pipe.ZRem(ctx, captureErrorsDueKey, id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DropCaptureErrors forgets the kept captures of the URLs matching drop,
+// in any archive and hash size, so the retry task does not hash them
+// again after a purge. It returns the number of captures forgotten.
+func DropCaptureErrors(ctx context.Context, rdb *redis.Client, drop func(url string) bool) (int, error) {
+	dropped := 0
+	var cursor uint64
+	for {
+		fields, next, err := rdb.HScan(ctx, captureErrorsKey, cursor, "*", 500).Result()
+		if err != nil {
+			return dropped, err
+		}
+		var ids []string
+		var members []interface{}
+		for i := 0; i+1 < len(fields); i += 2 {
+			var rec captureError
+			if json.Unmarshal([]byte(fields[i+1]), &rec) == nil && drop(rec.Job.URL) {
+				ids = append(ids, fields[i])
+				members = append(members, fields[i])
+			}
+		}
+		if len(ids) > 0 {
+			pipe := rdb.TxPipeline()
+			pipe.HDel(ctx, captureErrorsKey, ids...)
+			pipe.ZRem(ctx, captureErrorsDueKey, members...)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return dropped, err
+			}
+			dropped += len(ids)
+		}
+		if next == 0 {
+			return dropped, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"wayback-discover-diff/pkg/archive"
+)
+
+func TestCaptureErrorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		opts JobOptions
+	}{
+		{"default", JobOptions{}},
+		{"sized archive", JobOptions{Size: 32, Archive: "arquivo"}},
+		{"profile and filters", JobOptions{Profile: "rich", Filters: []string{"statuscode:200", "!mimetype:warc/revisit"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			// Options that do not affect the capture are not kept
+			opts.Callback, opts.Priority, opts.Snapshots = "http://hook.example/", "urgent", 5
+			p := SimHashPayload{URL: "example.com/page", Year: 2019, Tenant: "t1", Options: opts}
+			snap := archive.Capture{Timestamp: "20190101123456", Digest: "SHA1"}
+
+			rec := newCaptureError(p, snap, &statusError{code: 503})
+			raw, err := json.Marshal(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded captureError
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(decoded.Job.Options, tt.opts) {
+				t.Errorf("options = %+v, want %+v", decoded.Job.Options, tt.opts)
+			}
+			if decoded.Job.URL != p.URL || decoded.Job.Year != p.Year || decoded.Job.Tenant != p.Tenant {
+				t.Errorf("job = %+v, want URL, year and tenant of %+v", decoded.Job, p)
+			}
+			if decoded.Timestamp != snap.Timestamp || decoded.Digest != snap.Digest {
+				t.Errorf("capture = %s %s, want %s %s", decoded.Timestamp, decoded.Digest, snap.Timestamp, snap.Digest)
+			}
+			if decoded.Class != ErrorHTTP5xx || !decoded.FailedAt.Equal(rec.FailedAt) {
+				t.Errorf("class %s at %v, want %s at %v", decoded.Class, decoded.FailedAt, ErrorHTTP5xx, rec.FailedAt)
+			}
+			// The retry task finds the record under the ID of the job it rebuilds
+			if got, want := captureErrorID(decoded.Job, "20190101123456"), captureErrorID(p, "20190101123456"); got != want {
+				t.Errorf("id of decoded job = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestCaptureErrorIDSeparatesProfiles(t *testing.T) {
+	ids := map[string]bool{}
+	for _, opts := range []JobOptions{{}, {Profile: "rich"}, {Size: 32}, {Archive: "arquivo"}, {Archive: "arquivo", Profile: "rich"}} {
+		id := captureErrorID(SimHashPayload{URL: "example.com", Options: opts}, "20190101000000")
+		if ids[id] {
+			t.Errorf("options %+v share capture error ID %s", opts, id)
+		}
+		ids[id] = true
+	}
+	if got, want := captureErrorID(SimHashPayload{URL: "example.com"}, "20190101000000"), "|0|example.com|20190101000000"; got != want {
+		t.Errorf("default ID = %s, want %s, as kept before profiles", got, want)
+	}
+}
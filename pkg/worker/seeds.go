@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/urlnorm"
+)
+
+// TypeImportSeeds periodically enqueues calculations for new seed URLs
+const TypeImportSeeds = "seeds:import"
+
+// SeedPayload names the config.seeds entry to import
+type SeedPayload struct {
+	Name string `json:"name"`
+}
+
+// RegisterSeedSchedules registers one periodic import task per seed list
+func RegisterSeedSchedules(scheduler *asynq.Scheduler) error {
+	for _, seed := range config.AppConfig.Seeds {
+		if seed.Name == "" || seed.Source == "" {
+			return fmt.Errorf("seed lists require a name and a source")
+		}
+		schedule := seed.Schedule
+		if schedule == "" {
+			schedule = "@daily"
+		}
+
+		payload, err := json.Marshal(SeedPayload{Name: seed.Name})
+		if err != nil {
+			return err
+		}
+		task := asynq.NewTask(TypeImportSeeds, payload)
+		if _, err := scheduler.Register(schedule, task, asynq.Unique(time.Hour)); err != nil {
+			return fmt.Errorf("seed list %s: %v", seed.Name, err)
+		}
+	}
+	return nil
+}
+
+// HandleImportSeeds reads a seed list, diffs it against the URLs already
+// imported from it and enqueues current-year calculations for new entries
+func (w *Worker) HandleImportSeeds(ctx context.Context, t *asynq.Task) error {
+	var p SeedPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+
+	var source, template string
+	for _, seed := range config.AppConfig.Seeds {
+		if seed.Name == p.Name {
+			source, template = seed.Source, seed.Template
+		}
+	}
+	if source == "" {
+		return fmt.Errorf("unknown seed list: %s: %w", p.Name, asynq.SkipRetry)
+	}
+
+	var opts JobOptions
+	if template != "" {
+		var found bool
+		var err error
+		opts, found, err = LoadTemplate(ctx, w.redisClient, template)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("seed list %s: unknown template %s: %w", p.Name, template, asynq.SkipRetry)
+		}
+	}
+
+	urls, err := w.readSeeds(ctx, source)
+	if err != nil {
+		return fmt.Errorf("seed list %s: %v", p.Name, err)
+	}
+
+	knownKey := fmt.Sprintf("seeds:known:%s", p.Name)
+	year := time.Now().UTC().Year()
+	enqueued := 0
+	for _, url := range urls {
+		url = urlnorm.Normalize(url)
+		added, err := w.redisClient.SAdd(ctx, knownKey, url).Result()
+		if err != nil {
+			return err
+		}
+		if added == 0 {
+			continue
+		}
+
+		_, _, err = EnqueueCalculation(ctx, w.redisClient, w.taskClient,
+			SimHashPayload{URL: url, Year: year, Options: opts})
+		if err != nil {
+			// Forget the URL so the next run picks it up again
+			w.redisClient.SRem(ctx, knownKey, url)
+			return err
+		}
+		enqueued++
+	}
+
+	log.Printf("Seed list %s: %d URLs, %d new jobs", p.Name, len(urls), enqueued)
+	return nil
+}
+
+// readSeeds loads URLs from a local file, a public s3:// object or an
+// HTTP endpoint. Sources may be plain text with one URL per line (blank
+// lines and # comments ignored) or a JSON array of strings.
+func (w *Worker) readSeeds(ctx context.Context, source string) ([]string, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case strings.HasPrefix(source, "s3://"):
+		// Requests are not signed, so only public objects can be read,
+		// through the virtual-hosted HTTPS endpoint
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "s3://"), "/")
+		data, err = w.fetchSeeds(ctx, fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket, key))
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		data, err = w.fetchSeeds(ctx, source)
+	default:
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var urls []string
+		if err := json.Unmarshal(trimmed, &urls); err != nil {
+			return nil, err
+		}
+		return urls, nil
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// fetchSeeds downloads a seed list with the CDX client, bounded by
+// config.transport.cdx
+func (w *Worker) fetchSeeds(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "wayback-discover-diff")
+
+	resp, err := w.cdxClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+	"wayback-discover-diff/pkg/simhash"
+)
+
+var (
+	shadowCaptures = metrics.NewCounter("wdd_shadow_captures_total",
+		"Captures also hashed with the candidate profile of simhash.shadow.")
+	shadowTruncated = metrics.NewCounter("wdd_shadow_truncated_total",
+		"Shadowed captures the candidate limits cut short.")
+	// shadowDistances compares with wdd_capture_distance_bits: a candidate
+	// whose distances to the stored hashes are small next to the changes
+	// between captures is safe to switch to
+	shadowDistances = metrics.NewHistogram("wdd_shadow_distance_bits",
+		"Hamming distance between the stored and the candidate hash of each shadowed capture.",
+		[]float64{0, 1, 2, 4, 6, 8, 12, 16, 24, 32, 48, 64})
+)
+
+// shadowed reports whether capture is in the share of captures hashed
+// with the candidate profile. The choice is a hash of the URL and
+// timestamp, so that a capture processed again is picked again.
+func shadowed(capture *Capture) bool {
+	fraction := config.AppConfig.Simhash.Shadow.Fraction
+	if fraction <= 0 {
+		return false
+	}
+	if fraction >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(capture.URL))
+	h.Write([]byte{0})
+	h.Write([]byte(capture.Timestamp))
+	return float64(h.Sum64())/math.MaxUint64 < fraction
+}
+
+// shadowHash hashes a capture of the shadowed share again with the
+// candidate profile and observes the distance to its stored hash. The
+// candidate features go through template suppression like the stored
+// ones but not through hooks; it is never stored. Captures of custom
+// extractors, which profiles do not apply to, are passed over.
+func (w *Worker) shadowHash(ctx context.Context, capture *Capture, size int) {
+	if !shadowed(capture) {
+		return
+	}
+	if _, ok := w.extractors.For(capture.ContentType); ok {
+		return
+	}
+	candidate := &Capture{URL: capture.URL, Timestamp: capture.Timestamp}
+	opts := extractOptions(config.AppConfig.Simhash.Shadow.Candidate)
+	opts.Ignore = w.ignoredRegions(capture.URL)
+	candidate.Features, candidate.Truncated = simhash.ExtractFeatures(capture.Body, opts)
+	if config.AppConfig.TemplateProfiles.Enabled {
+		w.suppressTemplate(ctx, candidate)
+	}
+	if len(candidate.Features) == 0 {
+		logging.Debugf(logging.Worker, "shadow url=%q timestamp=%s: no candidate features", capture.URL, capture.Timestamp)
+		return
+	}
+
+	distance := simhash.Distance(capture.Hash, simhash.CalculateSimHash(candidate.Features, size))
+	shadowCaptures.Inc()
+	if candidate.Truncated {
+		shadowTruncated.Inc()
+	}
+	shadowDistances.Observe(float64(distance))
+	logging.Debugf(logging.Worker, "shadow url=%q timestamp=%s: distance %d, %d features, candidate %d",
+		capture.URL, capture.Timestamp, distance, len(capture.Features), len(candidate.Features))
+}
@@ -0,0 +1,166 @@
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/urlnorm"
+)
+
+// maxSitemapSize is the largest sitemap the sitemap protocol allows
+const maxSitemapSize = 50 << 20
+
+// sitemap is a sitemap.xml urlset or sitemapindex document
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// sitemapMaxURLs is config.worker.sitemap.max_urls, default 1000
+func sitemapMaxURLs() int {
+	if n := config.AppConfig.Worker.Sitemap.MaxURLs; n > 0 {
+		return n
+	}
+	return 1000
+}
+
+// sitemapURLs returns the pages of the host of p.URL listed by a recent
+// archived capture of its /sitemap.xml, following a sitemap index one
+// level down, in the form of p.URL and at most sitemapMaxURLs of them.
+// A host without an archived sitemap has no pages listed.
+func (w *Worker) sitemapURLs(ctx context.Context, src archive.Source, p SimHashPayload) ([]string, error) {
+	host := ProfileHost(p.URL)
+	if host == "" {
+		return nil, nil
+	}
+	root, err := w.fetchSitemap(ctx, src, sitemapHost(p.URL)+"/sitemap.xml")
+	if err != nil || root == nil {
+		return nil, err
+	}
+
+	docs := []*sitemap{root}
+	for _, child := range root.Sitemaps {
+		if ProfileHost(child.Loc) != host {
+			continue
+		}
+		doc, err := w.fetchSitemap(ctx, src, strings.TrimSpace(child.Loc))
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+
+	limit := sitemapMaxURLs()
+	seen := map[string]bool{p.URL: true}
+	var urls []string
+	for _, doc := range docs {
+		for _, entry := range doc.URLs {
+			loc := strings.TrimSpace(entry.Loc)
+			if ProfileHost(loc) != host {
+				continue
+			}
+			if _, rest, ok := strings.Cut(loc, "://"); ok && !strings.Contains(p.URL, "://") {
+				loc = rest
+			}
+			loc = urlnorm.Normalize(loc)
+			if seen[loc] {
+				continue
+			}
+			seen[loc] = true
+			if len(urls) == limit {
+				logging.Warnf(logging.Worker, "sitemap of %s lists more than %d pages, ignoring the rest", host, limit)
+				return urls, nil
+			}
+			urls = append(urls, loc)
+		}
+	}
+	return urls, nil
+}
+
+// sitemapHost is the scheme, when given, and host of url
+func sitemapHost(url string) string {
+	scheme := ""
+	if i := strings.Index(url, "://"); i >= 0 {
+		scheme, url = url[:i+len("://")], url[i+len("://"):]
+	}
+	if i := strings.IndexAny(url, "/?#"); i >= 0 {
+		url = url[:i]
+	}
+	return scheme + url
+}
+
+// fetchSitemap downloads and parses a capture of target answered with 200
+// in the latest month it was captured, or returns nil when there is none
+// or it does not parse. Gzipped sitemaps are accepted.
+func (w *Worker) fetchSitemap(ctx context.Context, src archive.Source, target string) (*sitemap, error) {
+	cdxURL := src.CDXQuery(target, "", "", "statuscode:200") + "&fl=timestamp&collapse=timestamp:6"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cdxURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.cdxClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	timestamps, err := src.ParseTimestamps(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(timestamps) == 0 {
+		return nil, nil
+	}
+
+	snapshotURL := src.SnapshotURL(timestamps[len(timestamps)-1], target)
+	logging.Debugf(logging.Downloader, "GET %s", snapshotURL)
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, snapshotURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "wayback-discover-diff")
+	if config.AppConfig.CdxAuthToken != "" {
+		req.Header.Set("Cookie", fmt.Sprintf("cdx_auth_token=%s", config.AppConfig.CdxAuthToken))
+	}
+	resp, err = w.snapshotClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSitemapSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil
+		}
+		r = io.LimitReader(gz, maxSitemapSize)
+	}
+	var doc sitemap
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		logging.Warnf(logging.Worker, "sitemap %s at %s: %v", target, timestamps[len(timestamps)-1], err)
+		return nil, nil
+	}
+	return &doc, nil
+}
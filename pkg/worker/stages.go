@@ -0,0 +1,333 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/logging"
+	ts "wayback-discover-diff/pkg/timestamp"
+)
+
+// Stage task types of a split year job
+const (
+	TypeFetchCapture = "simhash:fetch"
+	TypeHashCapture  = "simhash:hash"
+)
+
+// StagePayload names one capture of a staged year job
+type StagePayload struct {
+	JobID string         `json:"job_id"`
+	Job   SimHashPayload `json:"job"`
+	// Timestamp is the archive's own timestamp of the capture
+	Timestamp string `json:"timestamp"`
+	// Digest is the CDX checksum of the capture body, if any
+	Digest string `json:"digest,omitempty"`
+}
+
+// Fields of the job progress hash
+const (
+	stagePending   = "pending"
+	stageProcessed = "processed"
+	stageSkipped   = "skipped"
+	stageErrors    = "errors"
+	stageStarted   = "started"
+	stageFailed    = "failed"
+	// stageErrorClass prefixes the per-class error counts
+	stageErrorClass = "errors:"
+	// stageDone prefixes the timestamps of the captures counted
+	stageDone = "done:"
+)
+
+// stageKey is the Redis hash tracking the captures of a staged job
+func stageKey(jobID string) string {
+	return "stage:" + jobID
+}
+
+// stageCacheKey holds a fetched body until its hash task runs
+func stageCacheKey(jobID, timestamp string) string {
+	return fmt.Sprintf("stage:%s:%s", jobID, timestamp)
+}
+
+func fetchQueue() string {
+	if q := config.AppConfig.Worker.Stages.FetchQueue; q != "" {
+		return q
+	}
+	return "fetch"
+}
+
+func hashQueue() string {
+	if q := config.AppConfig.Worker.Stages.HashQueue; q != "" {
+		return q
+	}
+	return "hash"
+}
+
+func stageCacheTTL() time.Duration {
+	if s := config.AppConfig.Worker.Stages.CacheTTL; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return time.Hour
+}
+
+// StagesRunning reports whether captures of a staged job are still being
+// fetched or hashed after its year task completed
+func StagesRunning(ctx context.Context, rdb *redis.Client, jobID string) (bool, error) {
+	pending, err := rdb.HGet(ctx, stageKey(jobID), stagePending).Int()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return pending > 0, err
+}
+
+// startStages lists the captures of a year job and enqueues a fetch task
+// for each. The job finishes when the last capture has been hashed.
+func (w *Worker) startStages(ctx context.Context, jobID string, p SimHashPayload) error {
+	fail := func(err error) error {
+		if isFinalAttempt(ctx) {
+			w.finishJob(ctx, p, JobSummary{JobID: jobID, URL: p.URL, Year: p.Year, Status: "failed", Error: err.Error()})
+		}
+		return err
+	}
+
+	src, err := w.sourceFor(p)
+	if err != nil {
+		return fail(err)
+	}
+	snapshots, err := w.getSnapshots(ctx, src, p.URL, p.Year, p.Options.Filters)
+	if err != nil {
+		return fail(err)
+	}
+	snapshots = sampleSnapshots(snapshots, snapshotLimit(p.Options))
+	if len(snapshots) == 0 {
+		w.finishJob(ctx, p, JobSummary{JobID: jobID, URL: p.URL, Year: p.Year, Status: "completed"})
+		return nil
+	}
+
+	// A retried year task keeps the progress of its first attempt; stage
+	// task IDs are derived from the capture, so none is enqueued twice
+	key := stageKey(jobID)
+	created, err := w.redisClient.HSetNX(ctx, key, stagePending, len(snapshots)).Result()
+	if err != nil {
+		return fail(err)
+	}
+	if created {
+		w.redisClient.HSet(ctx, key, stageStarted, time.Now().Unix())
+	}
+	w.redisClient.Expire(ctx, key, 24*time.Hour)
+
+	for _, snap := range snapshots {
+		err := w.enqueueStage(ctx, TypeFetchCapture, fetchQueue(), StagePayload{JobID: jobID, Job: p, Timestamp: snap.Timestamp, Digest: snap.Digest})
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) enqueueStage(ctx context.Context, typ, queue string, sp StagePayload) error {
+	payload, err := json.Marshal(sp)
+	if err != nil {
+		return err
+	}
+	// Completed stage tasks are retained so their IDs stay taken
+	_, err = w.taskClient.EnqueueContext(ctx, asynq.NewTask(typ, payload),
+		asynq.Queue(queue),
+		asynq.TaskID(fmt.Sprintf("%s:%s:%s", sp.JobID, typ, sp.Timestamp)),
+		asynq.MaxRetry(config.AppConfig.Worker.Stages.MaxRetry),
+		asynq.Retention(stageCacheTTL()))
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		return nil
+	}
+	return err
+}
+
+// HandleFetchCapture downloads one capture into the stage cache and hands
+// it to a hash task
+func (w *Worker) HandleFetchCapture(ctx context.Context, t *asynq.Task) error {
+	var sp StagePayload
+	if err := json.Unmarshal(t.Payload(), &sp); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+
+	if failed, _ := w.redisClient.HExists(ctx, stageKey(sp.JobID), stageFailed).Result(); failed {
+		// The job already gave up; only account for the capture
+		w.completeStage(ctx, sp, stageSkipped)
+		return nil
+	}
+
+	capture, precision, err := w.fetchCapture(ctx, sp.Job, archive.Capture{Timestamp: sp.Timestamp, Digest: sp.Digest})
+	if err != nil {
+		return w.stageError(ctx, sp, err)
+	}
+	if capture == nil {
+		w.completeStage(ctx, sp, stageProcessed)
+		return nil
+	}
+
+	cacheKey := stageCacheKey(sp.JobID, sp.Timestamp)
+	pipe := w.redisClient.TxPipeline()
+	pipe.HSet(ctx, cacheKey, "body", capture.Body, "content_type", capture.ContentType, "precision", precision,
+		"download_ms", capture.timings.download.Milliseconds())
+	pipe.Expire(ctx, cacheKey, stageCacheTTL())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return w.stageError(ctx, sp, err)
+	}
+	if err := w.enqueueStage(ctx, TypeHashCapture, hashQueue(), sp); err != nil {
+		return w.stageError(ctx, sp, err)
+	}
+	return nil
+}
+
+// HandleHashCapture hashes a cached capture and stores its simhash
+func (w *Worker) HandleHashCapture(ctx context.Context, t *asynq.Task) error {
+	var sp StagePayload
+	if err := json.Unmarshal(t.Payload(), &sp); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+	size, err := HashSize(sp.Job.Options.Size)
+	if err != nil {
+		return w.stageError(ctx, sp, fmt.Errorf("%v: %w", err, asynq.SkipRetry))
+	}
+	sp.Job.Options.Size = size
+
+	cacheKey := stageCacheKey(sp.JobID, sp.Timestamp)
+	cached, err := w.redisClient.HGetAll(ctx, cacheKey).Result()
+	if err != nil {
+		return w.stageError(ctx, sp, err)
+	}
+	if len(cached) == 0 {
+		return w.stageError(ctx, sp, fmt.Errorf("fetched body of %s expired: %w", sp.Timestamp, asynq.SkipRetry))
+	}
+
+	timestamp, _, err := ts.Normalize(sp.Timestamp)
+	if err != nil {
+		return w.stageError(ctx, sp, fmt.Errorf("%v: %w", err, asynq.SkipRetry))
+	}
+	precision, _ := strconv.Atoi(cached["precision"])
+	downloadMs, _ := strconv.ParseInt(cached["download_ms"], 10, 64)
+	capture := &Capture{
+		URL:         sp.Job.URL,
+		Timestamp:   timestamp,
+		ContentType: cached["content_type"],
+		Body:        []byte(cached["body"]),
+		timings:     phaseTimings{download: time.Duration(downloadMs) * time.Millisecond},
+	}
+	if err := w.hashCapture(ctx, sp.Job, capture, precision); err != nil {
+		return w.stageError(ctx, sp, err)
+	}
+
+	w.redisClient.Del(ctx, cacheKey)
+	w.completeStage(ctx, sp, stageProcessed)
+	return nil
+}
+
+// stageError accounts for a failed stage once asynq will not retry it,
+// counting it toward the job's error policy. Stages finish out of order,
+// so the error ratio is taken over every capture finished so far.
+func (w *Worker) stageError(ctx context.Context, sp StagePayload, err error) error {
+	skip := errors.Is(err, ErrSkipCapture)
+	if !skip && !errors.Is(err, asynq.SkipRetry) && !isFinalAttempt(ctx) {
+		return err
+	}
+
+	w.redisClient.Del(ctx, stageCacheKey(sp.JobID, sp.Timestamp))
+	if !skip {
+		key := stageKey(sp.JobID)
+		w.redisClient.HIncrBy(ctx, key, stageErrorClass+classifyError(err), 1)
+		errs, incrErr := w.redisClient.HIncrByFloat(ctx, key, stageErrors, errorWeight(err)).Result()
+		if incrErr == nil {
+			progress, _ := w.redisClient.HMGet(ctx, key, stageProcessed, stageSkipped).Result()
+			samples := 1 // this capture, not yet counted as skipped
+			for _, v := range progress {
+				if s, ok := v.(string); ok {
+					n, _ := strconv.Atoi(s)
+					samples += n
+				}
+			}
+			if abort := errorsExceeded(errs, errs, samples); abort != nil {
+				w.redisClient.HSetNX(ctx, key, stageFailed, abort.Error())
+			}
+		}
+	}
+	if !skip {
+		w.recordCaptureError(ctx, sp.Job, archive.Capture{Timestamp: sp.Timestamp, Digest: sp.Digest}, err)
+	}
+	w.completeStage(ctx, sp, stageSkipped)
+	if skip {
+		return nil
+	}
+	return err
+}
+
+// completeScript counts the outcome ARGV[2] of the capture ARGV[1] of a
+// staged job once, however often it is recorded, and returns the captures
+// still pending, or -1 when it was counted before or the job is over
+var completeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 or redis.call("HSETNX", KEYS[1], ARGV[1], 1) == 0 then
+	return -1
+end
+redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
+return redis.call("HINCRBY", KEYS[1], ARGV[3], -1)
+`)
+
+// completeStage records the outcome of one capture and finishes the job
+// after its last capture. An outcome that cannot be recorded fails the
+// job rather than leaving it pending.
+func (w *Worker) completeStage(ctx context.Context, sp StagePayload, outcome string) {
+	// The outcome is recorded even when the task was cancelled meanwhile
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 15*time.Second)
+	defer cancel()
+
+	key := stageKey(sp.JobID)
+	var pending int64
+	err := retryRedis(ctx, func() (err error) {
+		pending, err = completeScript.Run(ctx, w.redisClient, []string{key},
+			stageDone+sp.Timestamp, outcome, stagePending).Int64()
+		return err
+	})
+	if err != nil {
+		logging.Errorf(logging.Worker, "job %s: failed to record stage outcome: %v", sp.JobID, err)
+		w.redisClient.Del(ctx, key)
+		w.finishJob(ctx, sp.Job, JobSummary{JobID: sp.JobID, URL: sp.Job.URL, Year: sp.Job.Year,
+			Status: "failed", Error: "recording stage outcome: " + err.Error()})
+		return
+	}
+	if pending != 0 {
+		return
+	}
+
+	progress, err := w.redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		logging.Errorf(logging.Worker, "job %s: failed to read stage progress: %v", sp.JobID, err)
+	}
+	summary := JobSummary{JobID: sp.JobID, URL: sp.Job.URL, Year: sp.Job.Year, Status: "completed"}
+	summary.Processed, _ = strconv.Atoi(progress[stageProcessed])
+	summary.Skipped, _ = strconv.Atoi(progress[stageSkipped])
+	if started, err := strconv.ParseInt(progress[stageStarted], 10, 64); err == nil {
+		summary.Duration = time.Since(time.Unix(started, 0)).Seconds()
+	}
+	if reason := progress[stageFailed]; reason != "" {
+		summary.Status = "failed"
+		summary.Error = reason
+	}
+	for field, value := range progress {
+		if class := strings.TrimPrefix(field, stageErrorClass); class != field {
+			if summary.Errors == nil {
+				summary.Errors = map[string]int{}
+			}
+			summary.Errors[class], _ = strconv.Atoi(value)
+		}
+	}
+	w.redisClient.Del(ctx, key)
+	w.finishJob(ctx, sp.Job, summary)
+}
@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"time"
+
+	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/metrics"
+)
+
+var (
+	capturesProcessed = metrics.NewCounter("wdd_captures_processed_total",
+		"Captures downloaded, hashed and stored.")
+	captureMillis = metrics.NewCounter("wdd_capture_processing_milliseconds_total",
+		"Time spent processing captures, summed over all phases.")
+	slowCaptures = metrics.NewCounter("wdd_slow_captures_total",
+		"Captures whose processing exceeded worker.slow_capture_ms.")
+	truncatedCaptures = metrics.NewCounter("wdd_truncated_captures_total",
+		"Captures cut short by simhash.limits during feature extraction.")
+)
+
+// phaseTimings is the time a capture spent in each pipeline phase
+type phaseTimings struct {
+	download time.Duration
+	parse    time.Duration
+	hash     time.Duration
+	store    time.Duration
+}
+
+func (t phaseTimings) total() time.Duration {
+	return t.download + t.parse + t.hash + t.store
+}
+
+// observeCapture records the processing time of a capture and logs it
+// when it exceeds the slow-capture threshold
+func observeCapture(c *Capture) {
+	total := c.timings.total()
+	capturesProcessed.Inc()
+	captureMillis.Add(uint64(total.Milliseconds()))
+
+	threshold := time.Duration(config.AppConfig.Worker.SlowCaptureMs) * time.Millisecond
+	if threshold <= 0 || total < threshold {
+		return
+	}
+	slowCaptures.Inc()
+	logging.Warnf(logging.Worker, "slow capture url=%q timestamp=%s bytes=%d features=%d total_ms=%d download_ms=%d parse_ms=%d hash_ms=%d store_ms=%d",
+		c.URL, c.Timestamp, len(c.Body), len(c.Features), total.Milliseconds(),
+		c.timings.download.Milliseconds(), c.timings.parse.Milliseconds(),
+		c.timings.hash.Milliseconds(), c.timings.store.Milliseconds())
+}
@@ -3,10 +3,11 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,7 +15,16 @@ import (
 	"github.com/hibiken/asynq"
 
 	"wayback-discover-diff/config"
+	"wayback-discover-diff/pkg/archive"
+	"wayback-discover-diff/pkg/dnscache"
+	"wayback-discover-diff/pkg/extractor"
+	"wayback-discover-diff/pkg/logging"
+	"wayback-discover-diff/pkg/retention"
 	"wayback-discover-diff/pkg/simhash"
+	"wayback-discover-diff/pkg/storage"
+	ts "wayback-discover-diff/pkg/timestamp"
+	"wayback-discover-diff/pkg/transport"
+	"wayback-discover-diff/pkg/usage"
 )
 
 const (
@@ -23,60 +33,170 @@ const (
 )
 
 type Worker struct {
-	redisClient  *redis.Client
-	httpClient   *http.Client
-	downloadErrs int
-	mutex        sync.Mutex
+	store       *storage.Store
+	redisClient *redis.Client
+	taskClient  *asynq.Client
+	// cdxClient lists captures and snapshotClient downloads them, each
+	// within the budget of config.transport
+	cdxClient      *http.Client
+	snapshotClient *http.Client
+	source         archive.Source
+	sources        map[string]archive.Source
+	hooks          []Hook
+	extractors     *extractor.Set
+	// ignore holds the selectors of config.simhash.ignore by host
+	ignore map[string]simhash.Selectors
+	// draining is closed by Drain
+	draining  chan struct{}
+	drainOnce sync.Once
 }
 
 type SimHashPayload struct {
 	URL  string `json:"url"`
 	Year int    `json:"year"`
+	// YearTo extends the job to the years up to it, see processYears
+	YearTo  int        `json:"year_to,omitempty"`
+	Tenant  string     `json:"tenant,omitempty"`
+	Options JobOptions `json:"options"`
 }
 
-func NewWorker(redisClient *redis.Client) *Worker {
-	return &Worker{
-		redisClient: redisClient,
-		httpClient: &http.Client{
-			Timeout: time.Second * 20,
-		},
+func NewWorker(store *storage.Store, taskClient *asynq.Client, source archive.Source,
+	extractors *extractor.Set) (*Worker, error) {
+	hooks, err := lookupHooks(config.AppConfig.Worker.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	ignore, err := compileIgnore()
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := dnscache.FromConfig()
+	if err != nil {
+		return nil, err
 	}
+	cdxClient, err := transport.NewClient(resolver.DialContext, config.AppConfig.Transport.CDX)
+	if err != nil {
+		return nil, err
+	}
+	snapshotClient, err := transport.NewClient(resolver.DialContext, config.AppConfig.Transport.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]archive.Source{"": source}
+	for _, name := range archive.Names() {
+		if sources[name], err = archive.Named(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Worker{
+		store:          store,
+		redisClient:    store.Client(),
+		taskClient:     taskClient,
+		cdxClient:      cdxClient,
+		snapshotClient: snapshotClient,
+		source:         source,
+		sources:        sources,
+		hooks:          hooks,
+		extractors:     extractors,
+		ignore:         ignore,
+		draining:       make(chan struct{}),
+	}, nil
 }
 
 func (w *Worker) HandleCalculateSimHash(ctx context.Context, t *asynq.Task) error {
+	attempt := time.Now()
+	taskDeadline, _ := ctx.Deadline()
+	ctx, cancel := withGrace(ctx)
+	defer cancel()
 	var p SimHashPayload
 	if err := json.Unmarshal(t.Payload(), &p); err != nil {
 		return fmt.Errorf("json.Unmarshal failed: %v", err)
 	}
+	size, err := HashSize(p.Options.Size)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+	p.Options.Size = size
 
-	// Reset error counter for new task
-	w.mutex.Lock()
-	w.downloadErrs = 0
-	w.mutex.Unlock()
+	jobID, _ := asynq.GetTaskID(ctx)
+	// Multi-year jobs are processed within their task even when staged
+	if config.AppConfig.Worker.Stages.Enabled && !p.ranged() {
+		return w.startStages(ctx, jobID, p)
+	}
+	summary := JobSummary{JobID: jobID, URL: p.URL, Year: p.Year, YearTo: p.YearTo, Status: "completed"}
+	start := time.Now()
+
+	// Process URL for the given years, accounting for errors of this task only
+	ctx, budget := withErrorBudget(ctx)
+	ctx = withFeatureChain(ctx)
+	ctx = w.resume(ctx, jobID, &summary)
+	if p.ranged() {
+		err = w.processYears(ctx, p, &summary)
+	} else {
+		err = w.processURLForYear(ctx, p, &summary)
+	}
 
-	// Process URL for the given year
-	return w.processURLForYear(ctx, p.URL, p.Year)
+	summary.Duration += time.Since(start).Seconds()
+	for class, n := range budget.counts {
+		if summary.Errors == nil {
+			summary.Errors = make(map[string]int)
+		}
+		summary.Errors[class] += n
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && pastDeadline(p, attempt, taskDeadline) {
+		// Later attempts would stop at once
+		summary.Status, summary.Error = "failed", "job deadline exceeded"
+		w.finishJob(ctx, p, summary)
+		return fmt.Errorf("job deadline exceeded: %w", asynq.SkipRetry)
+	}
+	if errors.Is(err, ErrInterrupted) || (err != nil && ctx.Err() != nil && !isFinalAttempt(ctx)) {
+		// The next attempt resumes where this one stopped
+		w.saveCheckpoint(ctx, summary)
+		return err
+	}
+	if err != nil {
+		summary.Status = "failed"
+		summary.Error = err.Error()
+	}
+	if err == nil || isFinalAttempt(ctx) {
+		w.finishJob(ctx, p, summary)
+	}
+	return err
 }
 
-func (w *Worker) processURLForYear(ctx context.Context, url string, year int) error {
+func (w *Worker) processURLForYear(ctx context.Context, p SimHashPayload, summary *JobSummary) error {
+	src, err := w.sourceFor(p)
+	if err != nil {
+		return err
+	}
+	if config.AppConfig.Worker.Prefetch.Enabled {
+		return w.processPrefetched(ctx, p, src, summary)
+	}
+
 	// Get snapshots for the year
-	snapshots, err := w.getSnapshots(url, year)
+	snapshots, err := w.getSnapshots(ctx, src, p.URL, p.Year, p.Options.Filters)
 	if err != nil {
 		return err
 	}
+	snapshots = sampleSnapshots(snapshots, snapshotLimit(p.Options))
 
 	// Process each snapshot
+	budget := budgetFrom(ctx)
 	for _, snap := range snapshots {
+		if w.stopping() {
+			return ErrInterrupted
+		}
+		if done(ctx, p, snap.Timestamp) {
+			continue
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			if err := w.processSnapshot(ctx, url, snap); err != nil {
-				w.incrementErrors()
-				if w.getErrorCount() >= config.AppConfig.MaxErrors {
-					return fmt.Errorf("max errors reached: %d", config.AppConfig.MaxErrors)
-				}
-				continue
+			err := w.processSnapshot(ctx, p, snap)
+			if abort := w.account(ctx, p, summary, budget, snap, err); abort != nil {
+				return abort
 			}
 		}
 	}
@@ -84,43 +204,175 @@ func (w *Worker) processURLForYear(ctx context.Context, url string, year int) er
 	return nil
 }
 
-func (w *Worker) processSnapshot(ctx context.Context, url string, timestamp string) error {
-	// Check if we already have this snapshot processed
-	key := fmt.Sprintf("simhash:%s:%s", url, timestamp)
-	exists, err := w.redisClient.Exists(ctx, key).Result()
+// account records the outcome of one snapshot in the job summary and the
+// error budget, returning the error stopping the job once it is spent
+func (w *Worker) account(ctx context.Context, p SimHashPayload, summary *JobSummary, budget *errorBudget,
+	snap archive.Capture, err error) error {
+	advance(ctx, p, snap.Timestamp, err != nil)
+	if err == ErrSkipCapture {
+		summary.Skipped++
+		return nil
+	}
 	if err != nil {
+		summary.Skipped++
+		w.recordCaptureError(ctx, p, snap, err)
+	} else {
+		summary.Processed++
+	}
+	return budget.record(err)
+}
+
+func (w *Worker) processSnapshot(ctx context.Context, p SimHashPayload, snap archive.Capture) error {
+	capture, precision, err := w.fetchCapture(ctx, p, snap)
+	if err != nil || capture == nil {
 		return err
 	}
-	if exists == 1 {
-		return nil
+	return w.hashCapture(ctx, p, capture, precision)
+}
+
+// fetchCapture downloads a snapshot through the download hooks. A nil
+// capture means its simhash is already stored.
+func (w *Worker) fetchCapture(ctx context.Context, p SimHashPayload, snap archive.Capture) (*Capture, int, error) {
+	url := p.URL
+	rawTimestamp := snap.Timestamp
+
+	// Store under the canonical form, but fetch with the archive's own
+	// timestamp, which its replay URLs expect
+	timestamp, precision, err := ts.Normalize(rawTimestamp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Check if we already have this snapshot processed
+	exists, err := w.storeFor(p).HasSimHash(ctx, url, timestamp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if exists {
+		return nil, 0, nil
+	}
+
+	capture := &Capture{URL: url, Timestamp: timestamp}
+	if err := w.runHooks(ctx, Hook.PreDownload, capture); err != nil {
+		return nil, 0, err
+	}
+
+	src, err := w.sourceFor(p)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Download snapshot
-	content, err := w.downloadSnapshot(url, timestamp)
+	downloadStarted := time.Now()
+	capture.Body, capture.ContentType, err = w.downloadSnapshot(ctx, src, url, rawTimestamp, snap.Digest)
+	capture.timings.download = time.Since(downloadStarted)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	if err := w.runHooks(ctx, Hook.PostDownload, capture); err != nil {
+		// Usage is charged by hashCapture, which this capture never reaches
+		w.recordUsage(ctx, p.Tenant, len(capture.Body), 0)
+		return nil, 0, err
 	}
+	return capture, precision, nil
+}
+
+// hashCapture extracts the features of a downloaded capture, then computes
+// and stores its simhash
+func (w *Worker) hashCapture(ctx context.Context, p SimHashPayload, capture *Capture, precision int) error {
+	var cpu time.Duration
+	defer func() { w.recordUsage(ctx, p.Tenant, len(capture.Body), cpu) }()
 
 	// Extract features and calculate simhash
-	features := simhash.ExtractHTMLFeatures(content)
-	if len(features) == 0 {
-		return fmt.Errorf("no features extracted")
+	started := time.Now()
+	if err := w.extractFeatures(ctx, capture, p.Options.Profile); err != nil {
+		return err
+	}
+	if config.AppConfig.TemplateProfiles.Enabled {
+		w.suppressTemplate(ctx, capture)
+	}
+	if config.AppConfig.Canonical.Record {
+		capture.Canonical = canonicalURL(capture)
+	}
+	capture.timings.parse = time.Since(started)
+	if err := w.runHooks(ctx, Hook.PreHash, capture); err != nil {
+		return err
+	}
+	if len(capture.Features) == 0 {
+		return &contentError{msg: "no features extracted"}
 	}
 
-	hash := simhash.CalculateSimHash(features, config.AppConfig.Simhash.Size)
-	encoded := simhash.EncodeSimHash(hash)
+	hashStarted := time.Now()
+	capture.Hash = simhash.CalculateSimHash(capture.Features, BitSize(p.Options.Size))
+	capture.Encoded = simhash.EncodeSimHash(capture.Hash)
+	capture.timings.hash = time.Since(hashStarted)
+	cpu = time.Since(started)
+	w.shadowHash(ctx, capture, BitSize(p.Options.Size))
 
 	// Store in Redis
-	return w.redisClient.Set(ctx, key, encoded,
-		time.Duration(config.AppConfig.Simhash.ExpireAfter)*time.Second).Err()
+	storeStarted := time.Now()
+	ttl := retention.TTL(storage.RetentionCaptures)
+	store := w.storeFor(p)
+	if err := store.SetSimHash(ctx, capture.URL, capture.Timestamp, capture.Encoded, ttl); err != nil {
+		return err
+	}
+	meta := map[string]string{storage.MetaPrecision: strconv.Itoa(precision)}
+	if capture.Truncated {
+		meta[storage.MetaTruncated] = "1"
+	}
+	if capture.Canonical != "" {
+		meta[storage.MetaCanonical] = capture.Canonical
+	}
+	if ttl > 0 {
+		meta[storage.MetaExpiresAt] = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+	err := store.SetCaptureMeta(ctx, capture.URL, capture.Timestamp, meta, ttl)
+	if err != nil {
+		return err
+	}
+	aliasCanonical(ctx, store, capture, ttl)
+	if config.AppConfig.Simhash.StoreFeatures {
+		if err := w.storeFeatures(ctx, store, capture, ttl); err != nil {
+			return err
+		}
+	}
+	capture.timings.store = time.Since(storeStarted)
+	observeCapture(capture)
+	return w.runHooks(ctx, Hook.PostStore, capture)
+}
+
+// extractFeatures fills capture.Features with the custom extractor of its
+// content type, or the HTML extractor with the options of profile
+func (w *Worker) extractFeatures(ctx context.Context, capture *Capture, profile string) error {
+	if ext, ok := w.extractors.For(capture.ContentType); ok {
+		features, err := ext.Extract(ctx, capture.Body)
+		if err != nil {
+			return fmt.Errorf("custom extractor: %v", err)
+		}
+		capture.Features = features
+		return nil
+	}
+	opts := featureOptions(profile)
+	opts.Ignore = w.ignoredRegions(capture.URL)
+	capture.Features, capture.Truncated = simhash.ExtractFeatures(capture.Body, opts)
+	logging.Debugf(logging.Extractor, "html extraction url=%q timestamp=%s profile=%q bytes=%d features=%d",
+		capture.URL, capture.Timestamp, profile, len(capture.Body), len(capture.Features))
+	if capture.Truncated {
+		truncatedCaptures.Inc()
+		logging.Warnf(logging.Worker, "extraction limits reached url=%q timestamp=%s bytes=%d features=%d",
+			capture.URL, capture.Timestamp, len(capture.Body), len(capture.Features))
+	}
+	return nil
 }
 
-func (w *Worker) downloadSnapshot(url, timestamp string) ([]byte, error) {
-	waybackURL := fmt.Sprintf("http://web.archive.org/web/%sid_/%s", timestamp, url)
+// downloadSnapshot fetches the original body of a capture, checking it
+// against digest when the CDX row carried one
+func (w *Worker) downloadSnapshot(ctx context.Context, src archive.Source, url, timestamp, digest string) ([]byte, string, error) {
+	snapshotURL := src.SnapshotURL(timestamp, url)
 
-	req, err := http.NewRequest("GET", waybackURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, snapshotURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	req.Header.Set("User-Agent", "wayback-discover-diff")
@@ -128,67 +380,66 @@ func (w *Worker) downloadSnapshot(url, timestamp string) ([]byte, error) {
 		req.Header.Set("Cookie", fmt.Sprintf("cdx_auth_token=%s", config.AppConfig.CdxAuthToken))
 	}
 
-	resp, err := w.httpClient.Do(req)
+	logging.Debugf(logging.Downloader, "GET %s", snapshotURL)
+	resp, err := w.snapshotClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
+	logging.Debugf(logging.Downloader, "GET %s: %d %s", snapshotURL, resp.StatusCode, resp.Header.Get("Content-Type"))
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		return nil, "", &statusError{code: resp.StatusCode}
 	}
 
 	contentType := resp.Header.Get("Content-Type")
-	if !isHTMLContent(contentType) {
-		return nil, fmt.Errorf("not HTML content: %s", contentType)
+	_, custom := w.extractors.For(contentType)
+	if !custom && !IsHTMLType(contentType) {
+		return nil, "", &contentError{msg: "not HTML content: " + contentType}
 	}
 
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	// A body the transport decompressed no longer matches the digest of
+	// the archived bytes
+	if digest != "" && config.AppConfig.Snapshots.VerifyDigest && !resp.Uncompressed {
+		if match, ok := archive.VerifyDigest(digest, body); ok && !match {
+			return nil, "", &digestError{digest: digest, size: len(body)}
+		}
+	}
+	if !custom {
+		body = toUTF8(body, contentType)
+	}
+	return body, contentType, nil
 }
 
-func (w *Worker) getSnapshots(url string, year int) ([]string, error) {
-	cdxURL := fmt.Sprintf("http://web.archive.org/cdx/search/cdx?url=%s&from=%d&to=%d&output=json",
-		url, year, year)
+func (w *Worker) getSnapshots(ctx context.Context, src archive.Source, url string, year int, filters []string) ([]archive.Capture, error) {
+	cdxURL := src.CDXQuery(url, strconv.Itoa(year), strconv.Itoa(year), filters...)
 
-	resp, err := w.httpClient.Get(cdxURL)
+	logging.Debugf(logging.Downloader, "CDX query %s", cdxURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cdxURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	var results [][]string
-	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+	resp, err := w.cdxClient.Do(req)
+	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if len(results) < 2 {
-		return nil, fmt.Errorf("no snapshots found")
-	}
-
-	// Extract timestamps (skip header row)
-	timestamps := make([]string, 0, len(results)-1)
-	for _, row := range results[1:] {
-		if len(row) > 1 {
-			timestamps = append(timestamps, row[1])
-		}
-	}
-
-	return timestamps, nil
-}
-
-func (w *Worker) incrementErrors() {
-	w.mutex.Lock()
-	w.downloadErrs++
-	w.mutex.Unlock()
-}
-
-func (w *Worker) getErrorCount() int {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
-	return w.downloadErrs
+	return src.ParseCaptures(resp.Body)
 }
 
-func isHTMLContent(contentType string) bool {
-	return strings.Contains(strings.ToLower(contentType), "text/html") ||
-		strings.Contains(strings.ToLower(contentType), "application/xhtml")
+// recordUsage charges one downloaded snapshot to the job's tenant
+func (w *Worker) recordUsage(ctx context.Context, tenant string, size int, cpu time.Duration) {
+	err := usage.Record(ctx, w.redisClient, tenant, usage.Counters{
+		usage.Snapshots: 1,
+		usage.Bytes:     int64(size),
+		usage.CPUMillis: cpu.Milliseconds(),
+	})
+	if err != nil {
+		logging.Errorf(logging.Worker, "failed to record usage for %s: %v", tenant, err)
+	}
 }
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"wayback-discover-diff/pkg/archive"
+)
+
+// HistoryProgress is the history event recorded as each year of a
+// multi-year job is done; its detail sums up the year
+const HistoryProgress = "progress"
+
+// YearSummary is the outcome of one year of a multi-year job
+type YearSummary struct {
+	Year      int    `json:"year"`
+	Processed int    `json:"processed"`
+	Skipped   int    `json:"skipped"`
+	Empty     bool   `json:"empty,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ranged reports whether p covers several years, Year to YearTo
+func (p SimHashPayload) ranged() bool {
+	return p.YearTo > p.Year
+}
+
+// lastYear is the last year covered by p
+func (p SimHashPayload) lastYear() int {
+	if p.ranged() {
+		return p.YearTo
+	}
+	return p.Year
+}
+
+// yearJob is the single-year part of a multi-year job
+func (p SimHashPayload) yearJob(year int) SimHashPayload {
+	p.Year, p.YearTo = year, 0
+	return p
+}
+
+// processYears processes the years of a multi-year job one after the
+// other within its task, recording each year in the job history as it is
+// done. Years without captures are passed over; other errors stop the job,
+// and a retry skips the captures already stored.
+func (w *Worker) processYears(ctx context.Context, p SimHashPayload, summary *JobSummary) error {
+	for year := p.Year; year <= p.YearTo; year++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if w.stopping() {
+			return ErrInterrupted
+		}
+		// Years finished before a checkpoint are in summary.Years already
+		carried, reached := resumedYear(ctx, year)
+		if !reached {
+			continue
+		}
+		yp := p.yearJob(year)
+		release := w.claimYear(ctx, yp, summary.JobID)
+		ys := JobSummary{Processed: carried.Processed, Skipped: carried.Skipped}
+		err := w.processURLForYear(ctx, yp, &ys)
+		release()
+
+		summary.Processed += ys.Processed - carried.Processed
+		summary.Skipped += ys.Skipped - carried.Skipped
+		if errors.Is(err, ErrInterrupted) || (err != nil && ctx.Err() != nil) {
+			// The checkpoint carries the year so far
+			return err
+		}
+		result := YearSummary{Year: year, Processed: ys.Processed, Skipped: ys.Skipped, Empty: err == archive.ErrNoSnapshots}
+		if err != nil && !result.Empty {
+			result.Error = err.Error()
+			summary.Years = append(summary.Years, result)
+			return err
+		}
+		summary.Years = append(summary.Years, result)
+		recordHistory(ctx, w.redisClient, summary.JobID, HistoryProgress,
+			fmt.Sprintf("%d: %d processed, %d skipped", year, ys.Processed, ys.Skipped))
+		if !result.Empty {
+			w.recordYear(ctx, yp, summary.JobID)
+		}
+	}
+	return nil
+}
+
+// claimYear marks a year of a multi-year job as running, like a job of
+// that year, unless one is already running. The returned function clears
+// the mark.
+func (w *Worker) claimYear(ctx context.Context, yp SimHashPayload, jobID string) func() {
+	key := yp.taskKey()
+	claimed, err := w.redisClient.SetNX(ctx, key, jobID, 24*time.Hour).Result()
+	if err != nil || !claimed {
+		return func() {}
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		w.redisClient.Del(ctx, key)
+	}
+}